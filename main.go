@@ -1,321 +1,123 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"image"
-	_ "image/gif"
-	_ "image/jpeg"
-	_ "image/png"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
-	"strconv"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
-)
-
-// Store represents a store from the Store Master
-type Store struct {
-	StoreID   string `json:"store_id"`
-	StoreName string `json:"store_name"`
-	AreaCode  string `json:"area_code"`
-}
-
-// Visit represents a store visit with images
-type Visit struct {
-	StoreID   string   `json:"store_id"`
-	ImageURLs []string `json:"image_url"`
-	VisitTime string   `json:"visit_time"`
-}
-
-// SubmitJobRequest represents the request payload for job submission
-type SubmitJobRequest struct {
-	Count  int     `json:"count"`
-	Visits []Visit `json:"visits"`
-}
-
-// JobResponse represents the response for job submission
-type JobResponse struct {
-	JobID int `json:"job_id"`
-}
 
-// JobStatusResponse represents the response for job status
-type JobStatusResponse struct {
-	Status string       `json:"status"`
-	JobID  string       `json:"job_id"`
-	Errors []StoreError `json:"error,omitempty"`
-}
-
-// StoreError represents an error for a specific store
-type StoreError struct {
-	StoreID string `json:"store_id"`
-	Error   string `json:"error"`
-}
-
-// ImageResult represents the result of processing an image
-type ImageResult struct {
-	StoreID   string  `json:"store_id"`
-	StoreName string  `json:"store_name"`
-	AreaCode  string  `json:"area_code"`
-	ImageURL  string  `json:"image_url"`
-	Width     int     `json:"width"`
-	Height    int     `json:"height"`
-	Perimeter float64 `json:"perimeter"`
-}
-
-type JobData struct {
-	ID          int
-	Status      string
-	Results     []ImageResult
-	Errors      []StoreError
-	CreatedAt   time.Time
-	CompletedAt time.Time
-	mu          sync.Mutex
-}
-
-var (
-	jobs        = make(map[int]*JobData)
-	jobsMutex   sync.Mutex
-	nextJobID   = 1
-	storeMaster = map[string]Store{
-		"S00339218": {StoreID: "S00339218", StoreName: "Store A", AreaCode: "NYC"},
-		"S01408764": {StoreID: "S01408764", StoreName: "Store B", AreaCode: "LA"},
-	}
+	"my-app/server"
 )
 
-// getStore retrieves a store from the Store Master by ID
-func getStore(storeID string) (Store, bool) {
-	store, ok := storeMaster[storeID]
-	return store, ok
-}
-
-func downloadAndGetDimensions(url string) (width, height int, err error) {
-
-	// Create a temporary directory for downloads if it doesn't exist
-	tempDir := "temp_images"
-	if _, err := os.Stat(tempDir); os.IsNotExist(err) {
-		os.Mkdir(tempDir, 0755)
-	}
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return 0, 0, fmt.Errorf("error creating request: %v", err)
-	}
-
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return 0, 0, fmt.Errorf("error downloading image: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return 0, 0, fmt.Errorf("error downloading image: status code %d", resp.StatusCode)
+func main() {
+	cfg, err := server.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-
-	img, _, err := image.Decode(resp.Body)
 	if err != nil {
-		return 0, 0, fmt.Errorf("error decoding image: %v", err)
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
-	bounds := img.Bounds()
-	width = bounds.Max.X - bounds.Min.X
-	height = bounds.Max.Y - bounds.Min.Y
-
-	return width, height, nil
-}
-
-func calculateImagePerimeter(storeID, imageURL string) (ImageResult, error) {
+	logger := server.NewLogger(cfg, os.Stderr)
+	slog.SetDefault(logger)
+	cfg.Logger = logger
 
-	store, exists := getStore(storeID)
-	if !exists {
-		return ImageResult{}, fmt.Errorf("store ID %s does not exist", storeID)
+	stores := server.SampleStoreMaster()
+	if cfg.StoreMasterPath != "" {
+		stores, err = server.LoadStoreMaster(cfg.StoreMasterPath)
+		if err != nil {
+			fatal("error loading the store master", err)
+		}
+		logger.Info("loaded stores", "stores", len(stores), "path", cfg.StoreMasterPath)
 	}
-
-	width, height, err := downloadAndGetDimensions(imageURL)
-	if err != nil {
-		return ImageResult{}, err
+	if cfg.StoreMasterURL != "" {
+		// Fetched once the server is created, so it can revalidate it later
+		stores = nil
 	}
 
-	perimeter := 2.0 * float64(width+height)
-
-	sleepTime := 100 + rand.Intn(300) // 0.1 to 0.4 seconds in milliseconds
-	time.Sleep(time.Duration(sleepTime) * time.Millisecond)
-
-	return ImageResult{
-		StoreID:   store.StoreID,
-		StoreName: store.StoreName,
-		AreaCode:  store.AreaCode,
-		ImageURL:  imageURL,
-		Width:     width,
-		Height:    height,
-		Perimeter: perimeter,
-	}, nil
-}
-
-// processJob processes a job
-func processJob(job *JobData, req SubmitJobRequest) {
-	var wg sync.WaitGroup
-
-	// Process each visit
-	for _, visit := range req.Visits {
-		storeID := visit.StoreID
-
-		// Check if the store exists
-		if _, exists := getStore(storeID); !exists {
-			job.mu.Lock()
-			job.Status = "failed"
-			job.Errors = append(job.Errors, StoreError{
-				StoreID: storeID,
-				Error:   "Store ID does not exist",
-			})
-			job.mu.Unlock()
-			job.CompletedAt = time.Now()
-			return
+	if cfg.APIKeysPath != "" {
+		keys, err := server.LoadAPIKeys(cfg.APIKeysPath)
+		if err != nil {
+			fatal("error loading API keys", err)
 		}
-
-		// Process each image for this visit
-		for _, imageURL := range visit.ImageURLs {
-			wg.Add(1)
-			go func(storeID, imageURL string) {
-				defer wg.Done()
-
-				result, err := calculateImagePerimeter(storeID, imageURL)
-				job.mu.Lock()
-				defer job.mu.Unlock()
-
-				if err != nil {
-					job.Status = "failed"
-					job.Errors = append(job.Errors, StoreError{
-						StoreID: storeID,
-						Error:   err.Error(),
-					})
-					return
-				}
-
-				job.Results = append(job.Results, result)
-			}(storeID, imageURL)
+		cfg.APIKeys = append(cfg.APIKeys, keys...)
+		if err := cfg.Validate(); err != nil {
+			fatal("invalid configuration", err)
 		}
+		logger.Info("loaded API keys", "keys", len(keys), "path", cfg.APIKeysPath)
 	}
 
-	// Wait for all image processing to complete
-	wg.Wait()
-
-	job.mu.Lock()
-	if job.Status != "failed" {
-		job.Status = "completed"
-	}
-	job.CompletedAt = time.Now()
-	job.mu.Unlock()
-}
-
-func responseError(w http.ResponseWriter, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusBadRequest)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
-}
-
-// handleSubmitJob handles the job submission endpoint
-func handleSubmitJob(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		responseError(w, "Invalid Method")
-		return
-	}
-	var req SubmitJobRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields()
-	err := decoder.Decode(&req)
-	if err != nil || (req.Count == 0 && len(req.Visits) > 0) {
-		responseError(w, "Invalid request payload")
-		return
-	}
-
-	if req.Count != len(req.Visits) {
-		responseError(w, "Count does not match number of visits")
-		return
-	}
-
-	// Create a new job
-	jobsMutex.Lock()
-	jobID := nextJobID
-	nextJobID++
-	job := &JobData{
-		ID:        jobID,
-		Status:    "ongoing",
-		CreatedAt: time.Now(),
+	if cfg.JobStorePath != "" {
+		jobStore, err := server.OpenFileJobStore(cfg.JobStorePath)
+		if err != nil {
+			fatal("error opening the job store", err)
+		}
+		cfg.JobStore = jobStore
 	}
-	jobs[jobID] = job
-	jobsMutex.Unlock()
-
-	// Process the job asynchronously
-	go processJob(job, req)
-
-	// Return the job ID
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(JobResponse{JobID: jobID})
-}
 
-// handleJobStatus handles the job status endpoint
-func handleJobStatus(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+	// Initialize the random seed
+	rand.Seed(time.Now().UnixNano())
 
-	// Get the job ID from the query parameters
-	jobIDStr := r.URL.Query().Get("jobid")
-	if jobIDStr == "" {
-		http.Error(w, "Missing job ID", http.StatusBadRequest)
-		return
+	srv := server.New(cfg, stores)
+	if cfg.StoreMasterURL != "" {
+		if _, err := srv.ReloadStores(); err != nil {
+			fatal("error fetching the store master", err)
+		}
 	}
-
-	jobID, err := strconv.Atoi(jobIDStr)
-	if err != nil {
-		http.Error(w, "Invalid job ID", http.StatusBadRequest)
-		return
+	if err := srv.RestoreJobs(); err != nil {
+		fatal("error restoring jobs", err)
 	}
 
-	// Get the job
-	jobsMutex.Lock()
-	job, exists := jobs[jobID]
-	jobsMutex.Unlock()
+	// Start the server
+	httpServer := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: srv}
+	go func() {
+		logger.Info("server starting", "port", cfg.Port)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("server error", err)
+		}
+	}()
+
+	// Reload the store master on SIGHUP
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			if _, err := srv.ReloadStores(); err != nil {
+				logger.Error("error reloading the store master", "error", err)
+			}
+		}
+	}()
 
-	if !exists {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(struct{}{})
-		return
-	}
+	// Wait for a shutdown signal
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	logger.Info("shutting down", "signal", sig.String())
 
-	// Return the job status
-	w.Header().Set("Content-Type", "application/json")
-	response := JobStatusResponse{
-		Status: job.Status,
-		JobID:  strconv.Itoa(job.ID),
-	}
+	// Fail readiness checks and refuse new jobs while the running ones finish.
+	// The server keeps answering status requests in the meantime.
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancelDrain()
+	srv.Drain(drainCtx)
 
-	if job.Status == "failed" {
-		response.Errors = job.Errors
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		logger.Error("error shutting down server", "error", err)
 	}
-
-	json.NewEncoder(w).Encode(response)
+	logger.Info("server stopped")
 }
 
-func main() {
-	// Initialize the random seed
-	rand.Seed(time.Now().UnixNano())
-
-	// Define the API routes
-	http.HandleFunc("/submit/", handleSubmitJob)
-	http.HandleFunc("/status", handleJobStatus)
-
-	// Start the server
-	port := 8080
-	log.Printf("Server starting on port %d...", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
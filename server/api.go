@@ -0,0 +1,368 @@
+package server
+
+import (
+	"time"
+)
+
+// Store represents a store from the Store Master
+type Store struct {
+	StoreID   string `json:"store_id"`
+	StoreName string `json:"store_name"`
+	AreaCode  string `json:"area_code"`
+
+	// MinWidth, MinHeight and ExpectedAspectRatio are the constraints the
+	// store's images are expected to meet, such as 1280x720 for kiosks.
+	// Images that don't are still processed, but their results list the
+	// violations. Zero means no constraint.
+	MinWidth            int     `json:"min_width,omitempty"`
+	MinHeight           int     `json:"min_height,omitempty"`
+	ExpectedAspectRatio float64 `json:"expected_aspect_ratio,omitempty"`
+}
+
+// Visit represents a store visit with images
+type Visit struct {
+	StoreID   string   `json:"store_id"`
+	ImageURLs []string `json:"image_url"`
+	VisitTime string   `json:"visit_time"`
+
+	// Archive treats each of the visit's image URLs as a ZIP archive of
+	// images, as URLs ending in .zip always are
+	Archive bool `json:"archive,omitempty"`
+
+	// DownloadHeaders are sent with the downloads of the visit's images, on
+	// top of and overriding the job's
+	DownloadHeaders DownloadHeaders `json:"download_headers,omitempty"`
+
+	// ExpectedSHA256 holds the hex SHA-256 each image is expected to have,
+	// by its index in ImageURLs. Images past its end, or whose entry is
+	// empty, aren't checked.
+	ExpectedSHA256 []string `json:"expected_sha256,omitempty"`
+}
+
+// SubmitJobRequest represents the request payload for job submission
+type SubmitJobRequest struct {
+	Count  int     `json:"count"`
+	Visits []Visit `json:"visits"`
+
+	// Dedupe downloads each distinct image URL in the job once, reusing its
+	// dimensions for every visit that references it. Each reference is still
+	// reported as its own result or error, so Count (the number of visits)
+	// and the progress totals are unaffected.
+	Dedupe bool `json:"dedupe,omitempty"`
+
+	// Strict rejects the whole submission if any visit references an unknown
+	// store, has no images or has an invalid image URL, instead of reporting
+	// those problems as job errors
+	Strict bool `json:"strict,omitempty"`
+
+	// TimeoutSeconds is how long the job may run before its unfinished
+	// images are abandoned and it ends as timed_out. The server's default
+	// job timeout applies if it is 0.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+
+	// ImageTimeoutMS limits each of the job's image download attempts, up
+	// to the server's maximum. The server's download timeout applies if it
+	// is 0.
+	ImageTimeoutMS int `json:"image_timeout_ms,omitempty"`
+
+	// Priority is "high", "normal" or "low", deciding which queued jobs are
+	// started first. Jobs are normal priority if it is empty.
+	Priority string `json:"priority,omitempty"`
+
+	// OnError is "continue" to process every image and report all the
+	// errors, or "fail_fast" to stop the job and mark it failed at its first
+	// error. Jobs continue if it is empty.
+	OnError string `json:"on_error,omitempty"`
+
+	// FailureThresholdPercent is the percentage of the job's images that
+	// may fail before the job ends as failed rather than
+	// completed_with_errors, from 0, failing on any error, to 100. The
+	// server's default applies if it is nil.
+	FailureThresholdPercent *int `json:"failure_threshold_percent,omitempty"`
+
+	// Force creates a new job even if an identical payload was submitted
+	// recently
+	Force bool `json:"force,omitempty"`
+
+	// CallbackURL is POSTed the job's outcome once it finishes, including
+	// its results if IncludeResults is set
+	CallbackURL    string `json:"callback_url,omitempty"`
+	IncludeResults bool   `json:"include_results,omitempty"`
+
+	// DownloadHeaders are sent with the download of each of the job's
+	// images, such as an Authorization header for a host that requires one
+	DownloadHeaders DownloadHeaders `json:"download_headers,omitempty"`
+
+	// IncludeEXIF adds the camera metadata of JPEG and TIFF images to their
+	// results
+	IncludeEXIF bool `json:"include_exif,omitempty"`
+
+	// DetectDuplicates computes the perceptual hash of each image, so the
+	// job summary can list images that are likely the same photo
+	DetectDuplicates bool `json:"detect_duplicates,omitempty"`
+
+	// QualityChecks flags images that look blank, such as accidental
+	// pocket shots, for review
+	QualityChecks bool `json:"quality_checks,omitempty"`
+}
+
+// JobResponse represents the response for job submission
+type JobResponse struct {
+	JobID string `json:"job_id"`
+
+	// Deduplicated is set when an identical payload was submitted recently,
+	// so that job is returned instead of a new one
+	Deduplicated bool `json:"deduplicated,omitempty"`
+
+	// TraceID is the ID of the job's trace, when tracing is enabled
+	TraceID string `json:"trace_id,omitempty"`
+
+	// RetryOf and RerunOf are set on the responses of the retry and rerun
+	// endpoints, to the ID of the job being retried or rerun
+	RetryOf string `json:"retry_of,omitempty"`
+	RerunOf string `json:"rerun_of,omitempty"`
+}
+
+// JobStatusResponse represents the response for job status
+type JobStatusResponse struct {
+	Status             string           `json:"status"`
+	JobID              string           `json:"job_id"`
+	Priority           string           `json:"priority"`
+	SuccessfulCount    int              `json:"successful_count"`
+	FailedCount        int              `json:"failed_count"`
+	Progress           JobProgress      `json:"progress"`
+	FailureRatePercent float64          `json:"failure_rate_percent"`
+	CreatedAt          time.Time        `json:"created_at"`
+	CompletedAt        *time.Time       `json:"completed_at,omitempty"`
+	Deadline           *time.Time       `json:"deadline,omitempty"`
+	QueuePosition      int              `json:"queue_position,omitempty"`
+	Webhook            *WebhookDelivery `json:"webhook,omitempty"`
+	RetryOf            string           `json:"retry_of,omitempty"`
+	Retries            []string         `json:"retries,omitempty"`
+	TotalBytes         int64            `json:"total_bytes"`
+	Timings            *JobTimings      `json:"timings,omitempty"`
+	Warnings           []JobWarning     `json:"warnings,omitempty"`
+	Errors             []StoreError     `json:"error,omitempty"`
+}
+
+// BatchStatusResponse represents the response for the batch status
+// endpoint. Each requested job ID maps to the job's JobStatusResponse, or to
+// a JobNotFound if there is no such job.
+type BatchStatusResponse struct {
+	Jobs map[string]any `json:"jobs"`
+}
+
+// JobNotFound is the batch status entry for a job that does not exist
+type JobNotFound struct {
+	Status string `json:"status"`
+	JobID  string `json:"job_id"`
+}
+
+// JobProgress reports how many of a job's images have been processed.
+// Completed counts images processed successfully and Failed counts images
+// that could not be processed, so the job is done once their sum reaches
+// Total.
+type JobProgress struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// StoreError represents an error for a specific store, and for a specific
+// image when ImageURL is set
+type StoreError struct {
+	StoreID  string `json:"store_id"`
+	ImageURL string `json:"image_url,omitempty"`
+	Code     string `json:"code,omitempty"`
+	Error    string `json:"error"`
+
+	// Visit is the index of the visit the error belongs to, counting from 0
+	// in the order the visits were submitted. Image is the index of the
+	// image in the visit's image_url, and is nil for errors about the whole
+	// visit, such as an unknown store.
+	Visit int  `json:"visit"`
+	Image *int `json:"image,omitempty"`
+}
+
+// JobWarning describes something a job skipped without it being an error,
+// such as a file in a ZIP archive that isn't an image. Visit and Image are
+// the indexes of the image URL it was found under.
+type JobWarning struct {
+	StoreID  string `json:"store_id"`
+	ImageURL string `json:"image_url"`
+	Code     string `json:"code"`
+	Warning  string `json:"warning"`
+	Visit    int    `json:"visit"`
+	Image    int    `json:"image"`
+}
+
+// ResultsResponse represents the response for job results
+type ResultsResponse struct {
+	JobID    string        `json:"job_id"`
+	Status   string        `json:"status"`
+	Partial  bool          `json:"partial,omitempty"`
+	Progress JobProgress   `json:"progress"`
+	Count    int           `json:"count"`
+	Results  []ImageResult `json:"results"`
+}
+
+// ImageResult represents the result of processing an image
+type ImageResult struct {
+	StoreID   string  `json:"store_id"`
+	StoreName string  `json:"store_name"`
+	AreaCode  string  `json:"area_code"`
+	ImageURL  string  `json:"image_url"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	Perimeter float64 `json:"perimeter"`
+
+	Area        int     `json:"area"`
+	AspectRatio float64 `json:"aspect_ratio"`
+	Megapixels  float64 `json:"megapixels"`
+
+	// Orientation is the image's EXIF orientation tag, and RawWidth and
+	// RawHeight its dimensions as stored, when it has one. Width, Height and
+	// the figures derived from them are as the image is displayed, so are
+	// swapped from the raw ones when Orientation rotates it by 90° or 270°.
+	Orientation int `json:"orientation,omitempty"`
+	RawWidth    int `json:"raw_width,omitempty"`
+	RawHeight   int `json:"raw_height,omitempty"`
+
+	// DPIX and DPIY are the resolution the image's metadata declares, in
+	// dots per inch, and the physical fields its printed size at that
+	// resolution. They are omitted when it declares no resolution, or only
+	// an aspect ratio, rather than assuming one.
+	DPIX                float64 `json:"dpi_x,omitempty"`
+	DPIY                float64 `json:"dpi_y,omitempty"`
+	PhysicalWidthCM     float64 `json:"physical_width_cm,omitempty"`
+	PhysicalHeightCM    float64 `json:"physical_height_cm,omitempty"`
+	PhysicalPerimeterCM float64 `json:"physical_perimeter_cm,omitempty"`
+
+	// Format is the format the image decoded as, e.g. "jpeg" or "png"
+	Format string `json:"format"`
+
+	// Pages is the number of pages in a multi-page TIFF. Width and Height
+	// are those of the first page.
+	Pages int `json:"pages,omitempty"`
+
+	// EXIF is the camera metadata of a JPEG or TIFF image, when the job set
+	// include_exif and the image has any
+	EXIF *EXIF `json:"exif,omitempty"`
+
+	// SHA256 is the hex SHA-256 of the image's bytes as they were received,
+	// or of the image file within a ZIP archive
+	SHA256 string `json:"sha256,omitempty"`
+
+	// PHash is the perceptual hash of a JPEG, PNG or GIF image, when the
+	// job set detect_duplicates: 16 hex digits that differ in only a few
+	// bits between copies of the same photo
+	PHash string `json:"phash,omitempty"`
+
+	// BlankSuspect flags a JPEG, PNG or GIF image that looks blank or nearly
+	// a solid colour, when the job set quality_checks. It doesn't fail the
+	// image.
+	BlankSuspect bool `json:"blank_suspect,omitempty"`
+
+	// ContentType is the Content-Type the image was served with.
+	// ContentTypeMismatch is set when it contradicts Format.
+	ContentType         string `json:"content_type,omitempty"`
+	ContentTypeMismatch bool   `json:"content_type_mismatch,omitempty"`
+
+	// Warnings flags results that are valid but need care, such as a zero
+	// aspect_ratio reported for an image with no height
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Violations lists the store's image constraints the image doesn't
+	// meet, such as below_min_resolution
+	Violations []string `json:"violations,omitempty"`
+
+	// DownloadMS is how long the image's request took up to the response
+	// headers, DecodeMS how long reading and decoding its body took, and
+	// Bytes how much of the body was read, which is all of it, as it is
+	// hashed. They are 0 when the image was served from
+	// the cache or shared a download with an identical URL. Attempts is the
+	// number of download attempts made. Simulated processing delays are not
+	// included.
+	DownloadMS float64 `json:"download_ms"`
+	DecodeMS   float64 `json:"decode_ms"`
+	Attempts   int     `json:"attempts"`
+	Bytes      int64   `json:"bytes"`
+
+	// ContentLength is the body size declared by the response the image
+	// was downloaded from, and is omitted if it declared none. Truncated
+	// flags a body that ended before it.
+	ContentLength int64 `json:"content_length,omitempty"`
+	Truncated     bool  `json:"truncated,omitempty"`
+
+	// FinalURL is the URL the image's bytes were actually served from when
+	// the image URL redirected, and Redirects the number of redirects
+	// followed to get there. Both are omitted when there were none.
+	FinalURL  string `json:"final_url,omitempty"`
+	Redirects int    `json:"redirects,omitempty"`
+
+	// Visit is the index of the image's visit, counting from 0 in the order
+	// the visits were submitted, and Image the index of the image in the
+	// visit's image_url. VisitTime is the visit's visit_time, in UTC, and is
+	// omitted if the visit had none. Together they let results be joined
+	// back to visits.
+	Visit     int       `json:"visit"`
+	Image     int       `json:"image"`
+	VisitTime time.Time `json:"visit_time,omitzero"`
+}
+
+// Warnings reported on ImageResult
+const (
+	warningZeroHeight        = "zero_height"
+	warningPixelsUnsupported = "pixels_unsupported"
+	warningPixelsTooLarge    = "pixels_too_large"
+)
+
+// Warnings reported on JobWarning
+const (
+	warningNonImageEntry = "non_image_entry"
+)
+
+// JobSummary represents a job in the list-jobs response
+type JobSummary struct {
+	JobID       string     `json:"job_id"`
+	Status      string     `json:"status"`
+	Priority    string     `json:"priority"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ResultCount int        `json:"result_count"`
+	ErrorCount  int        `json:"error_count"`
+}
+
+// JobListResponse represents the response for the list-jobs endpoint
+type JobListResponse struct {
+	Jobs   []JobSummary `json:"jobs"`
+	Total  int          `json:"total"`
+	Limit  int          `json:"limit"`
+	Offset int          `json:"offset"`
+}
+
+// ErrorResponse represents the error envelope shared by all endpoints
+type ErrorResponse struct {
+	Error string `json:"error"`
+
+	// Code identifies the kind of error, so clients needn't match Error.
+	// It is derived from the status code unless a more specific code is set.
+	Code string `json:"code"`
+
+	JobID string `json:"job_id,omitempty"`
+
+	// RequestID is set on internal errors, so they can be found in the logs
+	RequestID string `json:"request_id,omitempty"`
+
+	// Limits is set when a submission exceeds them
+	Limits *LimitsResponse `json:"limits,omitempty"`
+
+	// Quota is set when a submission exceeds the caller's monthly quota
+	Quota *QuotaResponse `json:"quota,omitempty"`
+
+	// Rows is set when a store import has no valid rows
+	Rows []StoreImportError `json:"rows,omitempty"`
+
+	// Fields lists the invalid fields of a rejected submission
+	Fields []FieldError `json:"fields,omitempty"`
+}
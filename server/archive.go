@@ -0,0 +1,148 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultJobArchiveRetention is how long job archives are kept when neither
+// the -job-archive-retention flag nor IMGPROC_JOB_ARCHIVE_RETENTION is set
+const defaultJobArchiveRetention = 30 * 24 * time.Hour
+
+// jobArchiveExt is the extension of job archives, which are gzip compressed
+// JobRecords named by job ID
+const jobArchiveExt = ".json.gz"
+
+// archivePath returns the path of the archive of the job with the given ID
+func (s *Server) archivePath(jobID string) string {
+	return filepath.Join(s.cfg.JobArchiveDir, jobID+jobArchiveExt)
+}
+
+// archiveJob writes a job, with its submission, results, errors and
+// timestamps, to the archive directory. The archive is written to a
+// temporary file that is renamed into place, so a crash never leaves a
+// partial archive behind. It does nothing if there is no archive directory.
+func (s *Server) archiveJob(job *JobData) error {
+	if s.cfg.JobArchiveDir == "" {
+		return nil
+	}
+	job.mu.Lock()
+	rec := job.record()
+	rec.Results = append([]ImageResult(nil), job.Results...)
+	rec.Errors = append([]StoreError(nil), job.Errors...)
+	job.mu.Unlock()
+
+	if err := os.MkdirAll(s.cfg.JobArchiveDir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(s.cfg.JobArchiveDir, job.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	zw := gzip.NewWriter(file)
+	err = errors.Join(json.NewEncoder(zw).Encode(rec), zw.Close())
+	if err = errors.Join(err, file.Close()); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), s.archivePath(job.ID))
+}
+
+// LoadJobArchive reads a job archive written when the job expired, such as
+// for offline analysis of its results
+func LoadJobArchive(path string) (JobRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return JobRecord{}, err
+	}
+	defer file.Close()
+	return readJobArchive(file)
+}
+
+func readJobArchive(r io.Reader) (JobRecord, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return JobRecord{}, fmt.Errorf("error reading job archive: %v", err)
+	}
+	var rec JobRecord
+	if err := json.NewDecoder(zr).Decode(&rec); err != nil {
+		return JobRecord{}, fmt.Errorf("error reading job archive: %v", err)
+	}
+	return rec, nil
+}
+
+// removeOldArchives removes the archives, and any temporary files left by
+// a crash, last written more than the archive retention period before now.
+// Archives are kept forever if it is 0.
+func (s *Server) removeOldArchives(now time.Time) {
+	if s.cfg.JobArchiveDir == "" || s.cfg.JobArchiveRetention <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(s.cfg.JobArchiveDir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			s.log.Error("error listing job archives", "error", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, jobArchiveExt) && !strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < s.cfg.JobArchiveRetention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.cfg.JobArchiveDir, name)); err != nil {
+			s.log.Error("error removing job archive", "file", name, "error", err)
+		}
+	}
+}
+
+// handleJobArchive handles the job archive endpoint, which returns the
+// archive of an expired job as written, gzip compressed
+func (s *Server) handleJobArchive(w http.ResponseWriter, r *http.Request) {
+	jobID := r.PathValue("jobid")
+	if !isJobID(jobID) {
+		responseJobError(w, http.StatusBadRequest, "invalid jobid: must be a UUID or legacy numeric ID", jobID)
+		return
+	}
+	if s.cfg.JobArchiveDir == "" {
+		responseJobError(w, http.StatusNotFound, "job archive not found", jobID)
+		return
+	}
+	file, err := os.Open(s.archivePath(jobID))
+	if err != nil {
+		responseJobError(w, http.StatusNotFound, "job archive not found", jobID)
+		return
+	}
+	defer file.Close()
+
+	// Other clients' archives are reported as not found, like their jobs
+	if apiKey := callerKey(r.Context()); apiKey != nil && !apiKey.IsAdmin() {
+		rec, err := readJobArchive(file)
+		if err != nil || rec.Owner != apiKey.ID {
+			responseJobError(w, http.StatusNotFound, "job archive not found", jobID)
+			return
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			responseError(w, http.StatusInternalServerError, "error reading job archive")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="job_%s%s"`, jobID, jobArchiveExt))
+	io.Copy(w, file)
+}
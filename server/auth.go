@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// API key roles. Admin keys can see and manage every job, while other keys
+// only see the jobs they submitted.
+const (
+	roleClient = "client"
+	roleAdmin  = "admin"
+)
+
+// APIKeyHeader is the header clients send their API key in. A bearer token in
+// the Authorization header is accepted too.
+const APIKeyHeader = "X-API-Key"
+
+// APIKey is a key clients authenticate with. ID identifies the key in job
+// records and logs, so the key itself never has to be. Quota overrides the
+// monthly image quota for the key if it is positive.
+type APIKey struct {
+	ID    string
+	Key   string
+	Role  string
+	Quota int
+}
+
+// String returns the key's ID, so a key that ends up in a log message doesn't
+// reveal the key itself
+func (k APIKey) String() string {
+	return k.ID
+}
+
+// IsAdmin reports whether the key has the admin role
+func (k APIKey) IsAdmin() bool {
+	return k.Role == roleAdmin
+}
+
+// parseAPIKey parses an API key given as id:key, id:key:role or
+// id:key:role:quota
+func parseAPIKey(value string) (APIKey, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 4 {
+		return APIKey{}, errors.New("must be id:key, id:key:role or id:key:role:quota")
+	}
+	apiKey := APIKey{ID: strings.TrimSpace(parts[0]), Key: strings.TrimSpace(parts[1]), Role: roleClient}
+	if len(parts) >= 3 {
+		apiKey.Role = strings.TrimSpace(parts[2])
+	}
+	if len(parts) == 4 {
+		quota, err := strconv.Atoi(strings.TrimSpace(parts[3]))
+		if err != nil || quota < 0 {
+			return APIKey{}, fmt.Errorf("key %s has invalid quota %q: must be a non-negative integer", strings.TrimSpace(parts[0]), parts[3])
+		}
+		apiKey.Quota = quota
+	}
+	if apiKey.ID == "" || apiKey.Key == "" {
+		return APIKey{}, errors.New("id and key must not be empty")
+	}
+	if apiKey.Role != roleClient && apiKey.Role != roleAdmin {
+		return APIKey{}, fmt.Errorf("key %s has invalid role %q: must be client or admin", apiKey.ID, apiKey.Role)
+	}
+	return apiKey, nil
+}
+
+// apiKeyList is a flag.Value holding a comma-separated list of API keys
+type apiKeyList []APIKey
+
+func (l *apiKeyList) String() string {
+	ids := make([]string, len(*l))
+	for i, apiKey := range *l {
+		ids[i] = apiKey.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func (l *apiKeyList) Set(value string) error {
+	var keys []APIKey
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		apiKey, err := parseAPIKey(field)
+		if err != nil {
+			// The entry holds a key, so it isn't repeated in the error
+			return fmt.Errorf("invalid API key %d: %v", len(keys)+1, err)
+		}
+		keys = append(keys, apiKey)
+	}
+	*l = keys
+	return nil
+}
+
+// LoadAPIKeys reads API keys from a file with one id:key, id:key:role or
+// id:key:role:quota entry per line. Blank lines and lines starting with # are ignored.
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening API keys: %v", err)
+	}
+	defer file.Close()
+
+	keys, err := parseAPIKeys(file)
+	if err != nil {
+		return nil, fmt.Errorf("error loading API keys %s: %v", path, err)
+	}
+	return keys, nil
+}
+
+func parseAPIKeys(r io.Reader) ([]APIKey, error) {
+	var keys []APIKey
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		apiKey, err := parseAPIKey(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		keys = append(keys, apiKey)
+	}
+	return keys, scanner.Err()
+}
+
+// validateAPIKeys checks that no two API keys share an ID or a key
+func validateAPIKeys(keys []APIKey) error {
+	ids := make(map[string]bool, len(keys))
+	secrets := make(map[string]string, len(keys))
+	for _, apiKey := range keys {
+		if ids[apiKey.ID] {
+			return fmt.Errorf("duplicate API key ID %s", apiKey.ID)
+		}
+		ids[apiKey.ID] = true
+		if other, ok := secrets[apiKey.Key]; ok {
+			return fmt.Errorf("API keys %s and %s are the same key", other, apiKey.ID)
+		}
+		secrets[apiKey.Key] = apiKey.ID
+	}
+	return nil
+}
+
+// apiKeys authenticates requests against the configured API keys. Keys are
+// held as SHA-256 digests, so every comparison is between values of the same
+// length and takes the same time.
+type apiKeys struct {
+	keys    []APIKey
+	digests [][sha256.Size]byte
+}
+
+func newAPIKeys(keys []APIKey) *apiKeys {
+	a := &apiKeys{keys: keys, digests: make([][sha256.Size]byte, len(keys))}
+	for i, apiKey := range keys {
+		a.digests[i] = sha256.Sum256([]byte(apiKey.Key))
+	}
+	return a
+}
+
+// Enabled reports whether any API keys are configured. Without any,
+// authentication is off.
+func (a *apiKeys) Enabled() bool {
+	return len(a.keys) > 0
+}
+
+// ByID returns the API key with the given ID
+func (a *apiKeys) ByID(id string) (*APIKey, bool) {
+	for i := range a.keys {
+		if a.keys[i].ID == id {
+			return &a.keys[i], true
+		}
+	}
+	return nil, false
+}
+
+// Find returns the API key matching presented. Every key is compared, so the
+// time taken doesn't reveal which key matched or how closely.
+func (a *apiKeys) Find(presented string) (*APIKey, bool) {
+	digest := sha256.Sum256([]byte(presented))
+	match := -1
+	for i := range a.digests {
+		if subtle.ConstantTimeCompare(digest[:], a.digests[i][:]) == 1 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil, false
+	}
+	return &a.keys[match], true
+}
+
+// requestAPIKey returns the API key presented with r, from the X-API-Key
+// header or an Authorization: Bearer header
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// apiKeyContextKey is the context key of the API key a request was made with
+type apiKeyContextKey struct{}
+
+// callerKey returns the API key a request was made with, or nil if
+// authentication is off
+func callerKey(ctx context.Context) *APIKey {
+	apiKey, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return apiKey
+}
+
+// publicPaths can be requested without an API key, so health checks don't
+// need one
+var publicPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// isAdminPath reports whether path is an admin endpoint, on the API or its
+// legacy routes
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/api/admin/") || strings.HasPrefix(path, "/admin/")
+}
+
+// withAuth wraps next so that, when API keys are configured, every request
+// other than the health checks must present one. Admin endpoints also
+// require the admin role.
+func (s *Server) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.apiKeys.Enabled() || publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		presented := requestAPIKey(r)
+		if presented == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			responseError(w, http.StatusUnauthorized, "missing API key")
+			return
+		}
+		apiKey, ok := s.apiKeys.Find(presented)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			responseError(w, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+		if isAdminPath(r.URL.Path) && !apiKey.IsAdmin() {
+			responseError(w, http.StatusForbidden, "admin API key required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, apiKey)))
+	})
+}
+
+// canAccess reports whether the caller with apiKey may see job. Without
+// authentication every job is visible, and admins can see every job.
+// Otherwise a key only sees the jobs it submitted.
+func canAccess(apiKey *APIKey, job *JobData) bool {
+	return canAccessOwner(apiKey, job.Owner)
+}
+
+// canAccessOwner is canAccess for a job owned by owner
+func canAccessOwner(apiKey *APIKey, owner string) bool {
+	return apiKey == nil || apiKey.IsAdmin() || owner == apiKey.ID
+}
+
+// ownerID returns the ID of the key a request was made with, or "" if
+// authentication is off
+func ownerID(ctx context.Context) string {
+	if apiKey := callerKey(ctx); apiKey != nil {
+		return apiKey.ID
+	}
+	return ""
+}
+
+// ownerScoped scopes a lookup key, such as an Idempotency-Key or a payload
+// hash, to the key that owns it, so clients can't see each other's jobs
+// through it
+func ownerScoped(owner, key string) string {
+	if owner == "" {
+		return key
+	}
+	return owner + "\x00" + key
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+)
+
+// BMP files start with a 14 byte file header, followed by a DIB header whose
+// first field is its own size. The original OS/2 header stores the size as
+// 16 bit values, every later version as signed 32 bit values, where a
+// negative height marks a top-down bitmap. Only the "BM" signature is
+// matched, since writers don't all leave the reserved fields after the file
+// size zeroed.
+const bmpHeader = "BM"
+
+// bmpCoreHeaderSize is the size of the OS/2 BITMAPCOREHEADER
+const bmpCoreHeaderSize = 12
+
+var errInvalidBMP = errors.New("bmp: invalid format")
+
+func init() {
+	image.RegisterFormat("bmp", bmpHeader, decodeBMP, decodeBMPConfig)
+}
+
+// decodeBMPConfig reads the dimensions of a BMP image from its headers
+func decodeBMPConfig(r io.Reader) (image.Config, error) {
+	var hdr [26]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return image.Config{}, unexpectedEOF(err)
+	}
+	if string(hdr[0:2]) != "BM" {
+		return image.Config{}, errInvalidBMP
+	}
+
+	var width, height int
+	switch dibSize := binary.LittleEndian.Uint32(hdr[14:18]); {
+	case dibSize == bmpCoreHeaderSize:
+		width = int(binary.LittleEndian.Uint16(hdr[18:20]))
+		height = int(binary.LittleEndian.Uint16(hdr[20:22]))
+	case dibSize >= 40:
+		width = int(int32(binary.LittleEndian.Uint32(hdr[18:22])))
+		height = int(int32(binary.LittleEndian.Uint32(hdr[22:26])))
+		if height < 0 {
+			height = -height
+		}
+	default:
+		return image.Config{}, errInvalidBMP
+	}
+	if width <= 0 {
+		return image.Config{}, errInvalidBMP
+	}
+
+	return image.Config{Width: width, Height: height}, nil
+}
+
+// decodeBMP is registered so the format is recognised, but full decodes are
+// never attempted since decodeBMPConfig always has the dimensions
+func decodeBMP(r io.Reader) (image.Image, error) {
+	if _, err := decodeBMPConfig(r); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("bmp: pixel decoding not supported")
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// bmpFile returns the headers of a BMP file whose file header has the given
+// reserved fields, followed by dib
+func bmpFile(reserved uint32, dib []byte) []byte {
+	hdr := []byte("BM")
+	hdr = binary.LittleEndian.AppendUint32(hdr, uint32(14+len(dib)))
+	hdr = binary.LittleEndian.AppendUint32(hdr, reserved)
+	hdr = binary.LittleEndian.AppendUint32(hdr, uint32(14+len(dib)))
+	return slices.Concat(hdr, dib)
+}
+
+// bmpInfoHeader returns a BITMAPINFOHEADER for a width by height bitmap
+func bmpInfoHeader(width, height int32) []byte {
+	dib := binary.LittleEndian.AppendUint32(nil, 40)
+	dib = binary.LittleEndian.AppendUint32(dib, uint32(width))
+	dib = binary.LittleEndian.AppendUint32(dib, uint32(height))
+	return append(dib, make([]byte, 40-12)...)
+}
+
+func TestDecodeBMP(t *testing.T) {
+	core := binary.LittleEndian.AppendUint32(nil, bmpCoreHeaderSize)
+	core = binary.LittleEndian.AppendUint16(core, 320)
+	core = binary.LittleEndian.AppendUint16(core, 240)
+	core = append(core, 1, 0, 24, 0)
+
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+	}{
+		{"info header", bmpFile(0, bmpInfoHeader(640, 480)), 640, 480},
+		{"top-down", bmpFile(0, bmpInfoHeader(640, -480)), 640, 480},
+		{"core header", bmpFile(0, core), 320, 240},
+		{"non-zero reserved fields", bmpFile(0xdeadbeef, bmpInfoHeader(16, 9)), 16, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := decodeBytes(context.Background(), tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Width != tt.width || info.Height != tt.height || info.Format != "bmp" {
+				t.Errorf("decoded %dx%d %s, want %dx%d bmp", info.Width, info.Height, info.Format, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestDecodeBMPInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"unknown header size", bmpFile(0, append(binary.LittleEndian.AppendUint32(nil, 20), make([]byte, 16)...))},
+		{"zero width", bmpFile(0, bmpInfoHeader(0, 480))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if info, err := decodeBytes(context.Background(), tt.data); err == nil {
+				t.Errorf("decoded %dx%d, want an error", info.Width, info.Height)
+			}
+		})
+	}
+}
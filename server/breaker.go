@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults used when the breaker flags and environment variables are not set
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// circuitOpenError is returned without attempting a download when the
+// breaker for the image's host is open
+type circuitOpenError struct {
+	Host    string
+	RetryAt time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for host %s until %s", e.Host, e.RetryAt.Format(time.RFC3339))
+}
+
+// hostBreakers is a circuit breaker per image host. After threshold
+// consecutive transient failures a host's circuit opens and its downloads
+// fail immediately. Once cooldown has passed, one download is let through
+// (half-open): its success closes the circuit, and its failure opens it
+// again. A threshold of 0 disables the breakers.
+type hostBreakers struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	hosts     map[string]*hostBreaker
+}
+
+type hostBreaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+
+	// probing is set while the half-open trial download is in flight
+	probing bool
+}
+
+// BreakerState represents a host in the circuit breakers response
+type BreakerState struct {
+	Host                string     `json:"host"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"`
+}
+
+// BreakersResponse represents the response for the circuit breakers endpoint
+type BreakersResponse struct {
+	Threshold       int            `json:"threshold"`
+	CooldownSeconds float64        `json:"cooldown_seconds"`
+	Hosts           []BreakerState `json:"hosts"`
+}
+
+func newHostBreakers(threshold int, cooldown time.Duration) *hostBreakers {
+	return &hostBreakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		hosts:     make(map[string]*hostBreaker),
+	}
+}
+
+// Allow returns a circuitOpenError if downloads from host must not be
+// attempted right now
+func (b *hostBreakers) Allow(host string) error {
+	if b.threshold == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker, ok := b.hosts[host]
+	if !ok {
+		return nil
+	}
+	switch breaker.state {
+	case breakerOpen:
+		retryAt := breaker.openedAt.Add(b.cooldown)
+		if time.Now().Before(retryAt) {
+			return &circuitOpenError{Host: host, RetryAt: retryAt}
+		}
+		breaker.state = breakerHalfOpen
+		breaker.probing = true
+	case breakerHalfOpen:
+		if breaker.probing {
+			return &circuitOpenError{Host: host, RetryAt: breaker.openedAt.Add(b.cooldown)}
+		}
+		breaker.probing = true
+	}
+	return nil
+}
+
+// Record updates host's breaker with the outcome of a download. Only
+// transient failures count against the host: a 404 or an undecodable image
+// still shows the host is up, and a 429 is handled by honouring Retry-After.
+func (b *hostBreakers) Record(host string, err error) {
+	if b.threshold == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker, ok := b.hosts[host]
+	var statusErr *statusError
+	if isContextError(err) || (errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests) {
+		// The download was abandoned or throttled, which says nothing about
+		// whether the host is up
+		if ok {
+			breaker.probing = false
+		}
+		return
+	}
+
+	if err == nil || !isRetryable(err) {
+		// Forget healthy hosts so the map doesn't grow with every host seen
+		delete(b.hosts, host)
+		return
+	}
+
+	if !ok {
+		breaker = &hostBreaker{state: breakerClosed}
+		b.hosts[host] = breaker
+	}
+	breaker.failures++
+	breaker.probing = false
+	if breaker.state == breakerHalfOpen || breaker.failures >= b.threshold {
+		breaker.state = breakerOpen
+		breaker.openedAt = time.Now()
+	}
+}
+
+// States returns the breakers of every host that has recently failed
+func (b *hostBreakers) States() []BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	states := make([]BreakerState, 0, len(b.hosts))
+	for host, breaker := range b.hosts {
+		state := BreakerState{
+			Host:                host,
+			State:               breaker.state,
+			ConsecutiveFailures: breaker.failures,
+		}
+		if breaker.state != breakerClosed {
+			openedAt := breaker.openedAt
+			retryAt := openedAt.Add(b.cooldown)
+			state.OpenedAt, state.RetryAt = &openedAt, &retryAt
+			if breaker.state == breakerOpen && !time.Now().Before(retryAt) {
+				// The next download will be let through as a trial
+				state.State = breakerHalfOpen
+			}
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Host < states[j].Host })
+	return states
+}
+
+// fetchFromHost downloads an image once its host has a free download slot,
+// unless the host's circuit is open, and records the outcome against the
+// host. The download itself is limited to the image timeout.
+func (s *Server) fetchFromHost(ctx context.Context, imageURL string) (imageInfo, error) {
+	var host, hostname string
+	if u, err := url.Parse(imageURL); err == nil {
+		host, hostname = u.Host, u.Hostname()
+	}
+
+	release, err := s.limiter.Acquire(ctx, hostname)
+	if err != nil {
+		return imageInfo{}, err
+	}
+	defer release()
+
+	// Checked after waiting for a slot, in case the circuit opened meanwhile
+	if err := s.breakers.Allow(host); err != nil {
+		return imageInfo{}, err
+	}
+
+	timeout := s.imageTimeout(ctx)
+	fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	s.metrics.downloadsInFlight.Add(1)
+	start := time.Now()
+	info, err := s.fetchDimensions(fetchCtx, imageURL)
+	elapsed := time.Since(start)
+	s.metrics.imageDuration.Observe(elapsed.Seconds())
+	s.metrics.downloadsInFlight.Add(-1)
+	if err != nil && errors.Is(fetchCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		// Only this download's own timeout expired, not the caller's context
+		err = &downloadTimeoutError{Timeout: timeout}
+	}
+	s.breakers.Record(host, err)
+	s.metrics.imageDownloaded(info.Bytes)
+	countBytes(ctx, info.Bytes)
+	logger := s.logger(ctx).With("host", host, "image_url", imageURL, "duration_ms", elapsed.Milliseconds())
+	if err != nil {
+		logger.Debug("image download failed", "error", err)
+	} else {
+		logger.Debug("image downloaded")
+	}
+	return info, err
+}
+
+// handleBreakers handles the circuit breakers endpoint, which lists the
+// hosts that have recently failed and the state of their circuits
+func (s *Server) handleBreakers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BreakersResponse{
+		Threshold:       s.breakers.threshold,
+		CooldownSeconds: s.breakers.cooldown.Seconds(),
+		Hosts:           s.breakers.States(),
+	})
+}
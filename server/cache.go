@@ -0,0 +1,220 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults used when the cache flags and environment variables are not set
+const (
+	defaultCacheSize     = 10000
+	defaultCacheTTL      = time.Hour
+	defaultCacheStaleTTL = 30 * 24 * time.Hour
+)
+
+// dimensionCache caches image dimensions by URL, shared by every job. It
+// keeps at most maxEntries entries, evicting the least recently used, and
+// entries expire after ttl. Expired entries whose image was served with an
+// ETag or Last-Modified are kept for staleTTL longer, and revalidated with a
+// conditional request rather than downloaded again. Concurrent lookups of
+// the same uncached URL are coalesced into a single download.
+type dimensionCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	staleTTL   time.Duration
+	entries    map[string]*list.Element
+	lru        *list.List
+	inflight   map[string]*cacheFlight
+
+	hits        atomic.Int64
+	misses      atomic.Int64
+	coalesced   atomic.Int64
+	revalidated atomic.Int64
+}
+
+// cacheEntry is a cached download outcome. Only permanent errors are cached,
+// since transient ones may succeed when retried.
+type cacheEntry struct {
+	url     string
+	info    imageInfo
+	err     error
+	expires time.Time
+}
+
+// cacheFlight is a download in progress that other lookups can wait on
+type cacheFlight struct {
+	done chan struct{}
+	info imageInfo
+	err  error
+}
+
+// CacheStats represents the response for the cache stats endpoint.
+// Revalidated counts the expired entries refreshed by a 304 Not Modified,
+// which are neither hits nor misses.
+type CacheStats struct {
+	Entries         int     `json:"entries"`
+	MaxEntries      int     `json:"max_entries"`
+	TTLSeconds      float64 `json:"ttl_seconds"`
+	StaleTTLSeconds float64 `json:"stale_ttl_seconds"`
+	Hits            int64   `json:"hits"`
+	Misses          int64   `json:"misses"`
+	Coalesced       int64   `json:"coalesced"`
+	Revalidated     int64   `json:"revalidated"`
+}
+
+// newDimensionCache creates a cache holding up to maxEntries entries for ttl,
+// and revalidatable ones for staleTTL after that. A maxEntries of 0 disables
+// caching and coalescing, and a staleTTL of 0 revalidation.
+func newDimensionCache(maxEntries int, ttl, staleTTL time.Duration) *dimensionCache {
+	return &dimensionCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		staleTTL:   staleTTL,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		inflight:   make(map[string]*cacheFlight),
+	}
+}
+
+// Get returns the dimensions of the image at url, calling fetch to download
+// it unless the cache already holds it or another lookup is downloading it
+func (c *dimensionCache) Get(ctx context.Context, url string, fetch downloadFunc) (imageInfo, error) {
+	if c.maxEntries == 0 {
+		return fetch(ctx, url)
+	}
+
+	for {
+		c.mu.Lock()
+		// stale is an expired entry that can be revalidated
+		var stale *cacheEntry
+		if elem, ok := c.entries[url]; ok {
+			entry := elem.Value.(*cacheEntry)
+			now := time.Now()
+			switch {
+			case now.Before(entry.expires):
+				c.lru.MoveToFront(elem)
+				c.mu.Unlock()
+				c.hits.Add(1)
+				return entry.info.withoutTransfer(), entry.err
+			case c.revalidatable(entry, now):
+				stale = entry
+			default:
+				c.removeLocked(elem)
+			}
+		}
+
+		if flight, ok := c.inflight[url]; ok {
+			c.mu.Unlock()
+			c.coalesced.Add(1)
+			select {
+			case <-flight.done:
+			case <-ctx.Done():
+				return imageInfo{}, ctx.Err()
+			}
+			// If the download was abandoned because its own caller was
+			// cancelled, try again on behalf of this caller
+			if isContextError(flight.err) && ctx.Err() == nil {
+				continue
+			}
+			return flight.info.withoutTransfer(), flight.err
+		}
+
+		flight := &cacheFlight{done: make(chan struct{})}
+		c.inflight[url] = flight
+		c.mu.Unlock()
+
+		fetchCtx := ctx
+		if stale != nil {
+			fetchCtx = withValidators(ctx, stale.info.ETag, stale.info.LastModified)
+		}
+		flight.info, flight.err = fetch(fetchCtx, url)
+		if stale != nil && flight.err == nil && flight.info.NotModified {
+			// The image hasn't changed, so the stale entry is as good as new
+			c.revalidated.Add(1)
+			refreshed := stale.info.withoutTransfer()
+			refreshed.DownloadTime = flight.info.DownloadTime
+			flight.info = refreshed
+		} else {
+			c.misses.Add(1)
+		}
+
+		c.mu.Lock()
+		delete(c.inflight, url)
+		if flight.err == nil || (!isRetryable(flight.err) && !isContextError(flight.err) && !isCircuitOpen(flight.err)) {
+			c.addLocked(&cacheEntry{
+				url:     url,
+				info:    flight.info,
+				err:     flight.err,
+				expires: time.Now().Add(c.ttl),
+			})
+		}
+		c.mu.Unlock()
+		close(flight.done)
+
+		return flight.info, flight.err
+	}
+}
+
+// revalidatable reports whether an expired entry may still be refreshed with
+// a conditional request at now: only successful downloads whose image had an
+// ETag or Last-Modified can be
+func (c *dimensionCache) revalidatable(entry *cacheEntry, now time.Time) bool {
+	if entry.err != nil || (entry.info.ETag == "" && entry.info.LastModified == "") {
+		return false
+	}
+	return now.Before(entry.expires.Add(c.staleTTL))
+}
+
+func (c *dimensionCache) addLocked(entry *cacheEntry) {
+	if elem, ok := c.entries[entry.url]; ok {
+		c.removeLocked(elem)
+	}
+	c.entries[entry.url] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+func (c *dimensionCache) removeLocked(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).url)
+}
+
+// Stats returns the cache's size and hit counters
+func (c *dimensionCache) Stats() CacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+	return CacheStats{
+		Entries:         entries,
+		MaxEntries:      c.maxEntries,
+		TTLSeconds:      c.ttl.Seconds(),
+		StaleTTLSeconds: c.staleTTL.Seconds(),
+		Hits:            c.hits.Load(),
+		Misses:          c.misses.Load(),
+		Coalesced:       c.coalesced.Load(),
+		Revalidated:     c.revalidated.Load(),
+	}
+}
+
+func isCircuitOpen(err error) bool {
+	var circuitErr *circuitOpenError
+	return errors.As(err, &circuitErr)
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// handleCacheStats handles the cache stats endpoint
+func (s *Server) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cache.Stats())
+}
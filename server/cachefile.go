@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheSaveInterval is how often the image cache is saved to -cache-file, on
+// top of when the server shuts down
+const cacheSaveInterval = 5 * time.Minute
+
+// savedCacheEntry is a cache entry as saved to the cache file, one per line
+type savedCacheEntry struct {
+	Key     string    `json:"key"`
+	Info    imageInfo `json:"info"`
+	Expires time.Time `json:"expires"`
+}
+
+// save writes the cache's entries to path, replacing the file atomically.
+// Only the dimensions of downloaded images are saved: errors, which can't be
+// restored as the same error types, and ZIP archives, whose entries carry
+// errors too, are downloaded again after a restart.
+func (c *dimensionCache) save(path string) (int, error) {
+	c.mu.Lock()
+	entries := make([]savedCacheEntry, 0, c.lru.Len())
+	// Least recently used first, so loading the file in order restores it
+	for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*cacheEntry)
+		if entry.err == nil && entry.info.Entries == nil {
+			entries = append(entries, savedCacheEntry{Key: entry.url, Info: entry.info.withoutTransfer(), Expires: entry.expires})
+		}
+	}
+	c.mu.Unlock()
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+
+	w := bufio.NewWriter(file)
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			return 0, err
+		}
+	}
+	if err := errors.Join(w.Flush(), file.Close()); err != nil {
+		return 0, err
+	}
+	return len(entries), os.Rename(file.Name(), path)
+}
+
+// load adds the entries saved to path that are still fresh or revalidatable
+// to the cache. A missing file is an empty cache.
+func (c *dimensionCache) load(path string) (int, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	loaded := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var saved savedCacheEntry
+		if err := json.Unmarshal(scanner.Bytes(), &saved); err != nil {
+			return loaded, fmt.Errorf("line %d: %v", line, err)
+		}
+		entry := &cacheEntry{url: saved.Key, info: saved.Info, expires: saved.Expires}
+		if now.Before(entry.expires) || c.revalidatable(entry, now) {
+			c.addLocked(entry)
+			loaded++
+		}
+	}
+	return loaded, scanner.Err()
+}
+
+// startCacheSaver loads the image cache from -cache-file, if it is set, and
+// starts saving it there every cacheSaveInterval. A cache file that can't be
+// read only costs the downloads it would have saved, so it is logged rather
+// than stopping the server.
+func (s *Server) startCacheSaver() {
+	if s.cfg.CacheFile == "" || s.cfg.CacheSize == 0 {
+		return
+	}
+	loaded, err := s.cache.load(s.cfg.CacheFile)
+	if err != nil {
+		s.log.Warn("error loading the image cache", "path", s.cfg.CacheFile, "entries", loaded, "error", err)
+	} else if loaded > 0 {
+		s.log.Info("loaded the image cache", "path", s.cfg.CacheFile, "entries", loaded)
+	}
+
+	go func() {
+		ticker := time.NewTicker(cacheSaveInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.saveCache()
+		}
+	}()
+}
+
+// saveCache saves the image cache to -cache-file, if it is set
+func (s *Server) saveCache() {
+	if s.cfg.CacheFile == "" || s.cfg.CacheSize == 0 {
+		return
+	}
+	saved, err := s.cache.save(s.cfg.CacheFile)
+	if err != nil {
+		s.log.Error("error saving the image cache", "path", s.cfg.CacheFile, "error", err)
+		return
+	}
+	s.log.Debug("saved the image cache", "path", s.cfg.CacheFile, "entries", saved)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// hashBody hashes the whole of body from here on, reading the rest of it once
+// decoding, which usually stops after the header, is done. The returned
+// function finishes the read and returns the hex SHA-256 of every byte of
+// the body received. A body cut short by the connection is still hashed, as
+// far as it got, since the image decoded; a body over its limit, or whose
+// read otherwise fails, fails the image.
+func hashBody(body *sizeLimitedReader) func() (string, error) {
+	hash := sha256.New()
+	body.Hash = hash
+	return func() (string, error) {
+		_, err := io.Copy(io.Discard, body)
+		if body.Exceeded {
+			return "", &imageTooLargeError{Limit: body.Limit}
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+}
+
+// expectedChecksum returns the checksum expected of the image at index i of
+// a visit's image URLs, or "" if none is
+func expectedChecksum(checksums []string, i int) string {
+	if i < len(checksums) {
+		return strings.ToLower(checksums[i])
+	}
+	return ""
+}
+
+// checkChecksum fails a result whose image doesn't have the expected SHA-256,
+// if one is expected
+func checkChecksum(result ImageResult, expected string) error {
+	if expected == "" || result.SHA256 == expected {
+		return nil
+	}
+	return &codedError{
+		Code: codeChecksumMismatch,
+		Err:  fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", expected, result.SHA256),
+	}
+}
+
+// validChecksum reports whether s is a hex SHA-256 digest
+func validChecksum(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == sha256.Size*2
+}
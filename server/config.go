@@ -0,0 +1,734 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Defaults for settings without a more specific home
+const (
+	defaultPort            = 8080
+	defaultDownloadTimeout = 10 * time.Second
+	defaultMaxImageTimeout = time.Minute
+
+	defaultProcessingDelayMin = 100 * time.Millisecond
+	defaultProcessingDelayMax = 400 * time.Millisecond
+)
+
+// Config holds the server's runtime settings
+type Config struct {
+	Port             int
+	Workers          int
+	DownloadTimeout  time.Duration
+	MaxImageTimeout  time.Duration
+	DownloadAttempts int
+	MaxRetryAfter    time.Duration
+	MaxImageBytes    int64
+	MaxRedirects     int
+	CacheSize        int
+	CacheTTL         time.Duration
+	CacheStaleTTL    time.Duration
+	CacheFile        string
+	DrainTimeout     time.Duration
+	JobTimeout       time.Duration
+	JobRunners       int
+	MaxQueueDepth    int
+	PriorityAging    time.Duration
+	IdempotencyTTL   time.Duration
+	DuplicateWindow  time.Duration
+	WebhookAttempts  int
+	WebhookTimeout   time.Duration
+	MaxStatusWait    time.Duration
+	MaxBodyBytes     int64
+	MaxUploadBytes   int64
+	MaxVisits        int
+	MaxImages        int
+	SubmitRate       int
+	SubmitBurst      int
+
+	// PreflightSyncLimit is the most images a preflight checks before
+	// responding; larger preflights run in the background
+	PreflightSyncLimit int
+
+	// MaxArchiveEntries is the most files a ZIP archive of images may hold,
+	// and MaxArchiveBytes the most bytes it may take to download or hold
+	// uncompressed
+	MaxArchiveEntries int
+	MaxArchiveBytes   int64
+
+	// PHashDistance is the most bits the perceptual hashes of two images
+	// may differ by for the job summary to report them as duplicates
+	PHashDistance int
+
+	// BlankMaxStddev and BlankMaxColorRatio are the luminance standard
+	// deviation and ratio of distinct colours to pixels at or below which
+	// quality checks suspect an image of being blank
+	BlankMaxStddev     float64
+	BlankMaxColorRatio float64
+
+	// FailureThresholdPercent is the percentage of a job's images that may
+	// fail before the job is marked failed rather than completed_with_errors,
+	// unless the job sets its own. 100 only fails jobs with no results.
+	FailureThresholdPercent int
+
+	// MonthlyImageQuota is the number of images each API key may submit a
+	// month, unless the key sets its own. 0 means no quota.
+	MonthlyImageQuota int
+
+	// MaxStoredRequestBytes is the largest submission kept with its job so
+	// it can be rerun. 0 means submissions aren't kept.
+	MaxStoredRequestBytes int64
+
+	// APIKeys are the keys clients must authenticate with. Authentication is
+	// off if there are none. Keys are never logged or shown in the flag
+	// defaults. APIKeysPath is a file more keys are loaded from.
+	APIKeys     []APIKey
+	APIKeysPath string
+
+	// LogLevel is the least severe level logged: debug, info, warn or error
+	LogLevel string
+
+	// WebhookSecret signs job callbacks when set. It is never logged or
+	// shown in the flag defaults.
+	WebhookSecret string
+
+	// SimulateProcessingDelay sleeps between ProcessingDelayMin and
+	// ProcessingDelayMax after each image is downloaded, to mimic GPU
+	// processing in demo environments
+	SimulateProcessingDelay bool
+	ProcessingDelayMin      time.Duration
+	ProcessingDelayMax      time.Duration
+
+	MaxPerHost       int
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	StoreMasterPath  string
+	JobStorePath     string
+
+	// StoreMasterURL is an http or https URL to fetch the store master CSV
+	// from, instead of StoreMasterPath. It is fetched again every
+	// StoreMasterRefresh, unless that is 0.
+	StoreMasterURL     string
+	StoreMasterRefresh time.Duration
+
+	// JobRetention is how long finished jobs are kept before the janitor
+	// removes them, archiving them to JobArchiveDir first if it is set. 0
+	// keeps jobs forever. Archives are kept for JobArchiveRetention, or
+	// forever if it is 0.
+	JobRetention        time.Duration
+	JobArchiveDir       string
+	JobArchiveRetention time.Duration
+
+	// StallTimeout is how long a running job may go without processing an
+	// image before the watchdog, which checks every WatchdogInterval, stops
+	// it as stalled. 0 turns the watchdog off.
+	StallTimeout     time.Duration
+	WatchdogInterval time.Duration
+
+	// AllowedSchemes are the URL schemes images may be downloaded with.
+	// AllowedHosts, if set, restricts the hosts they may be downloaded from,
+	// and DeniedHosts excludes hosts. Host patterns may start with "*." to
+	// match every subdomain.
+	AllowedSchemes []string
+	AllowedHosts   []string
+	DeniedHosts    []string
+
+	// S3Region is the AWS region s3:// image URLs are fetched from, and
+	// S3Endpoint, if set, an S3-compatible service such as MinIO to fetch
+	// them from instead of AWS
+	S3Region   string
+	S3Endpoint string
+
+	// DownloadProxy sends image downloads through the proxy named by the
+	// HTTPS_PROXY and HTTP_PROXY environment variables, except to the hosts
+	// in NO_PROXY. DownloadCAFile is a PEM bundle of CAs trusted for
+	// downloads on top of the system's, and DownloadInsecureSkipVerify turns
+	// certificate verification off altogether, for lab environments only.
+	// Job callbacks only use them if WebhookUseDownloadTransport is set.
+	DownloadProxy               bool
+	DownloadCAFile              string
+	DownloadInsecureSkipVerify  bool
+	WebhookUseDownloadTransport bool
+
+	// UserAgent replaces the User-Agent sent with image downloads.
+	// UserAgentContact is a URL added to the default one, so image hosts
+	// can find out who is downloading from them.
+	UserAgent        string
+	UserAgentContact string
+
+	// AllowFileURLs lets images be read from local files with file: URLs,
+	// as long as they are inside one of the FileRoots directories
+	AllowFileURLs bool
+	FileRoots     []string
+
+	// VisitTimeLayouts are the formats a visit's visit_time may be given in:
+	// rfc3339, rfc1123, rfc1123z, datetime, date, unix, unix_ms or a Go time
+	// layout. The first that parses a value is used.
+	VisitTimeLayouts []string
+
+	// AllowedDestinations are address ranges images may be downloaded from
+	// even though they are internal, such as 127.0.0.0/8 in development
+	AllowedDestinations []netip.Prefix
+
+	// JobStore is where jobs are persisted. Jobs are kept in memory only if
+	// it is nil.
+	JobStore JobStore
+
+	// TraceEndpoint is the OTLP/HTTP endpoint spans are exported to, such as
+	// http://localhost:4318/v1/traces. Tracing is off if it is empty.
+	TraceEndpoint string
+
+	// Logger is where the server logs to. A JSON logger writing to stderr at
+	// LogLevel is created if it is nil.
+	Logger *slog.Logger
+
+	// HTTPClient downloads the images. A client that refuses to connect to
+	// internal addresses is created if it is nil. Downloads are limited to
+	// DownloadTimeout, or their job's image timeout, either way.
+	HTTPClient *http.Client
+}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		Port:             defaultPort,
+		Workers:          defaultWorkers,
+		DownloadTimeout:  defaultDownloadTimeout,
+		MaxImageTimeout:  defaultMaxImageTimeout,
+		DownloadAttempts: defaultDownloadAttempts,
+		MaxRetryAfter:    defaultMaxRetryAfter,
+		MaxImageBytes:    defaultMaxImageBytes,
+		MaxRedirects:     defaultMaxRedirects,
+		CacheSize:        defaultCacheSize,
+		CacheTTL:         defaultCacheTTL,
+		CacheStaleTTL:    defaultCacheStaleTTL,
+		DrainTimeout:     defaultDrainTimeout,
+		JobRunners:       defaultJobRunners,
+		MaxQueueDepth:    defaultMaxQueueDepth,
+		PriorityAging:    defaultPriorityAging,
+		IdempotencyTTL:   defaultIdempotencyTTL,
+		DuplicateWindow:  defaultDuplicateWindow,
+		WebhookAttempts:  defaultWebhookAttempts,
+		WebhookTimeout:   defaultWebhookTimeout,
+		MaxStatusWait:    defaultMaxStatusWait,
+		MaxBodyBytes:     defaultMaxBodyBytes,
+		MaxUploadBytes:   defaultMaxUploadBytes,
+		MaxVisits:        defaultMaxVisits,
+		MaxImages:        defaultMaxImages,
+		SubmitRate:       defaultSubmitRate,
+		SubmitBurst:      defaultSubmitBurst,
+
+		PreflightSyncLimit: defaultPreflightSyncLimit,
+
+		FailureThresholdPercent: defaultFailureThresholdPercent,
+
+		MaxArchiveEntries: defaultMaxArchiveEntries,
+		MaxArchiveBytes:   defaultMaxArchiveBytes,
+
+		PHashDistance: defaultPHashDistance,
+
+		BlankMaxStddev:     defaultBlankMaxStddev,
+		BlankMaxColorRatio: defaultBlankMaxColorRatio,
+
+		MonthlyImageQuota: defaultMonthlyImageQuota,
+		MaxPerHost:        defaultMaxPerHost,
+		BreakerThreshold:  defaultBreakerThreshold,
+		BreakerCooldown:   defaultBreakerCooldown,
+		AllowedSchemes:    defaultAllowedSchemes,
+		S3Region:          defaultS3Region,
+		LogLevel:          defaultLogLevel,
+		VisitTimeLayouts:  defaultVisitTimeLayouts,
+
+		MaxStoredRequestBytes: defaultMaxStoredRequestBytes,
+		JobRetention:          defaultJobRetention,
+		JobArchiveRetention:   defaultJobArchiveRetention,
+		StallTimeout:          defaultStallTimeout,
+		WatchdogInterval:      defaultWatchdogInterval,
+		StoreMasterRefresh:    defaultStoreMasterRefresh,
+
+		ProcessingDelayMin: defaultProcessingDelayMin,
+		ProcessingDelayMax: defaultProcessingDelayMax,
+	}
+}
+
+// LoadConfig resolves the configuration from the defaults, then IMGPROC_*
+// environment variables, then command-line flags, each overriding the last.
+// Invalid values are reported as errors so the server can refuse to start.
+func LoadConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	env := envReader{}
+	env.Int(&cfg.Port, "IMGPROC_PORT")
+	env.Int(&cfg.Workers, "IMGPROC_WORKERS")
+	env.Duration(&cfg.DownloadTimeout, "IMGPROC_DOWNLOAD_TIMEOUT")
+	env.Duration(&cfg.MaxImageTimeout, "IMGPROC_MAX_IMAGE_TIMEOUT")
+	env.Int(&cfg.DownloadAttempts, "IMGPROC_DOWNLOAD_ATTEMPTS")
+	env.Duration(&cfg.MaxRetryAfter, "IMGPROC_MAX_RETRY_AFTER")
+	env.Int64(&cfg.MaxImageBytes, "IMGPROC_MAX_IMAGE_BYTES")
+	env.Int(&cfg.MaxRedirects, "IMGPROC_MAX_REDIRECTS")
+	env.Int(&cfg.MaxArchiveEntries, "IMGPROC_MAX_ARCHIVE_ENTRIES")
+	env.Int64(&cfg.MaxArchiveBytes, "IMGPROC_MAX_ARCHIVE_BYTES")
+	env.Int(&cfg.PHashDistance, "IMGPROC_PHASH_DISTANCE")
+	env.Float64(&cfg.BlankMaxStddev, "IMGPROC_BLANK_MAX_STDDEV")
+	env.Float64(&cfg.BlankMaxColorRatio, "IMGPROC_BLANK_MAX_COLOR_RATIO")
+	env.Int(&cfg.CacheSize, "IMGPROC_CACHE_SIZE")
+	env.Duration(&cfg.CacheTTL, "IMGPROC_CACHE_TTL")
+	env.Duration(&cfg.CacheStaleTTL, "IMGPROC_CACHE_STALE_TTL")
+	env.String(&cfg.CacheFile, "IMGPROC_CACHE_FILE")
+	env.Duration(&cfg.DrainTimeout, "IMGPROC_DRAIN_TIMEOUT")
+	env.Duration(&cfg.JobTimeout, "IMGPROC_JOB_TIMEOUT")
+	env.Int(&cfg.JobRunners, "IMGPROC_JOB_RUNNERS")
+	env.Int(&cfg.MaxQueueDepth, "IMGPROC_MAX_QUEUE_DEPTH")
+	env.Duration(&cfg.PriorityAging, "IMGPROC_PRIORITY_AGING")
+	env.Int(&cfg.FailureThresholdPercent, "IMGPROC_FAILURE_THRESHOLD_PERCENT")
+	env.Duration(&cfg.IdempotencyTTL, "IMGPROC_IDEMPOTENCY_TTL")
+	env.Duration(&cfg.DuplicateWindow, "IMGPROC_DUPLICATE_WINDOW")
+	env.Int(&cfg.WebhookAttempts, "IMGPROC_WEBHOOK_ATTEMPTS")
+	env.Duration(&cfg.WebhookTimeout, "IMGPROC_WEBHOOK_TIMEOUT")
+	env.Duration(&cfg.MaxStatusWait, "IMGPROC_MAX_STATUS_WAIT")
+	env.Int64(&cfg.MaxBodyBytes, "IMGPROC_MAX_BODY_BYTES")
+	env.Int64(&cfg.MaxUploadBytes, "IMGPROC_MAX_UPLOAD_BYTES")
+	env.Int64(&cfg.MaxStoredRequestBytes, "IMGPROC_MAX_STORED_REQUEST_BYTES")
+	env.Int(&cfg.MaxVisits, "IMGPROC_MAX_VISITS")
+	env.Int(&cfg.MaxImages, "IMGPROC_MAX_IMAGES")
+	env.Int(&cfg.PreflightSyncLimit, "IMGPROC_PREFLIGHT_SYNC_LIMIT")
+	env.Int(&cfg.SubmitRate, "IMGPROC_SUBMIT_RATE")
+	env.Int(&cfg.SubmitBurst, "IMGPROC_SUBMIT_BURST")
+	env.Int(&cfg.MonthlyImageQuota, "IMGPROC_MONTHLY_IMAGE_QUOTA")
+	env.String(&cfg.WebhookSecret, "IMGPROC_WEBHOOK_SECRET")
+	env.String(&cfg.LogLevel, "IMGPROC_LOG_LEVEL")
+	env.String(&cfg.TraceEndpoint, "IMGPROC_TRACE_ENDPOINT")
+	env.Secret((*apiKeyList)(&cfg.APIKeys), "IMGPROC_API_KEYS")
+	env.String(&cfg.APIKeysPath, "IMGPROC_API_KEYS_FILE")
+	env.Bool(&cfg.SimulateProcessingDelay, "IMGPROC_SIMULATE_PROCESSING_DELAY")
+	env.Duration(&cfg.ProcessingDelayMin, "IMGPROC_PROCESSING_DELAY_MIN")
+	env.Duration(&cfg.ProcessingDelayMax, "IMGPROC_PROCESSING_DELAY_MAX")
+	env.Int(&cfg.MaxPerHost, "IMGPROC_MAX_PER_HOST")
+	env.Int(&cfg.BreakerThreshold, "IMGPROC_BREAKER_THRESHOLD")
+	env.Duration(&cfg.BreakerCooldown, "IMGPROC_BREAKER_COOLDOWN")
+	env.String(&cfg.StoreMasterPath, "IMGPROC_STORE_MASTER")
+	env.String(&cfg.StoreMasterURL, "IMGPROC_STORE_MASTER_URL")
+	env.Duration(&cfg.StoreMasterRefresh, "IMGPROC_STORE_MASTER_REFRESH")
+	env.String(&cfg.JobStorePath, "IMGPROC_JOB_STORE")
+	env.Duration(&cfg.JobRetention, "IMGPROC_JOB_RETENTION")
+	env.String(&cfg.JobArchiveDir, "IMGPROC_JOB_ARCHIVE_DIR")
+	env.Duration(&cfg.JobArchiveRetention, "IMGPROC_JOB_ARCHIVE_RETENTION")
+	env.Duration(&cfg.StallTimeout, "IMGPROC_STALL_TIMEOUT")
+	env.Duration(&cfg.WatchdogInterval, "IMGPROC_WATCHDOG_INTERVAL")
+	env.Value((*stringList)(&cfg.AllowedSchemes), "IMGPROC_ALLOWED_SCHEMES")
+	env.Value((*stringList)(&cfg.VisitTimeLayouts), "IMGPROC_VISIT_TIME_LAYOUTS")
+	env.Value((*stringList)(&cfg.AllowedHosts), "IMGPROC_ALLOWED_HOSTS")
+	env.Value((*stringList)(&cfg.DeniedHosts), "IMGPROC_DENIED_HOSTS")
+	// The AWS variable is the fallback, so the server can share it with
+	// other AWS tools
+	env.String(&cfg.S3Region, "AWS_REGION")
+	env.String(&cfg.S3Region, "IMGPROC_S3_REGION")
+	env.String(&cfg.S3Endpoint, "IMGPROC_S3_ENDPOINT")
+	env.Bool(&cfg.DownloadProxy, "IMGPROC_DOWNLOAD_PROXY")
+	env.String(&cfg.DownloadCAFile, "IMGPROC_DOWNLOAD_CA_FILE")
+	env.Bool(&cfg.DownloadInsecureSkipVerify, "IMGPROC_DOWNLOAD_INSECURE_SKIP_VERIFY")
+	env.Bool(&cfg.WebhookUseDownloadTransport, "IMGPROC_WEBHOOK_USE_DOWNLOAD_TRANSPORT")
+	env.String(&cfg.UserAgent, "IMGPROC_USER_AGENT")
+	env.String(&cfg.UserAgentContact, "IMGPROC_USER_AGENT_CONTACT")
+	env.Bool(&cfg.AllowFileURLs, "IMGPROC_ALLOW_FILE_URLS")
+	env.Value((*stringList)(&cfg.FileRoots), "IMGPROC_FILE_ROOTS")
+	env.Value((*prefixList)(&cfg.AllowedDestinations), "IMGPROC_ALLOW_DESTINATIONS")
+	if err := errors.Join(env.errs...); err != nil {
+		return Config{}, err
+	}
+
+	fs := flag.NewFlagSet("image-processing", flag.ContinueOnError)
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "port to listen on (env IMGPROC_PORT)")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "number of concurrent image workers shared by all jobs (env IMGPROC_WORKERS)")
+	fs.DurationVar(&cfg.DownloadTimeout, "download-timeout", cfg.DownloadTimeout, "timeout for each image download attempt (env IMGPROC_DOWNLOAD_TIMEOUT)")
+	fs.DurationVar(&cfg.MaxImageTimeout, "max-image-timeout", cfg.MaxImageTimeout, "largest per-image download timeout a job may request with image_timeout_ms (env IMGPROC_MAX_IMAGE_TIMEOUT)")
+	fs.IntVar(&cfg.DownloadAttempts, "download-attempts", cfg.DownloadAttempts, "maximum attempts per image for transient download failures (env IMGPROC_DOWNLOAD_ATTEMPTS)")
+	fs.DurationVar(&cfg.MaxRetryAfter, "max-retry-after", cfg.MaxRetryAfter, "longest Retry-After from a rate limiting image host that is waited for before retrying; longer waits fail the image as rate_limited (env IMGPROC_MAX_RETRY_AFTER)")
+	fs.Int64Var(&cfg.MaxImageBytes, "max-image-bytes", cfg.MaxImageBytes, "largest image in bytes that will be downloaded (env IMGPROC_MAX_IMAGE_BYTES)")
+	fs.IntVar(&cfg.MaxRedirects, "max-redirects", cfg.MaxRedirects, "most redirects an image download follows; more fail the image as too_many_redirects, and 0 follows none (env IMGPROC_MAX_REDIRECTS)")
+	fs.IntVar(&cfg.MaxArchiveEntries, "max-archive-entries", cfg.MaxArchiveEntries, "most files a ZIP archive of images may hold; larger archives fail as invalid_archive (env IMGPROC_MAX_ARCHIVE_ENTRIES)")
+	fs.Int64Var(&cfg.MaxArchiveBytes, "max-archive-bytes", cfg.MaxArchiveBytes, "largest ZIP archive of images in bytes, both downloaded and uncompressed (env IMGPROC_MAX_ARCHIVE_BYTES)")
+	fs.IntVar(&cfg.PHashDistance, "phash-distance", cfg.PHashDistance, "most bits the perceptual hashes of two of a job's images may differ by for its summary to report them as duplicates, when the job sets detect_duplicates; 0 only reports identical hashes (env IMGPROC_PHASH_DISTANCE)")
+	fs.Float64Var(&cfg.BlankMaxStddev, "blank-max-stddev", cfg.BlankMaxStddev, "standard deviation of luminance, out of 255, at or below which a job's quality checks flag an image as blank_suspect (env IMGPROC_BLANK_MAX_STDDEV)")
+	fs.Float64Var(&cfg.BlankMaxColorRatio, "blank-max-color-ratio", cfg.BlankMaxColorRatio, "ratio of distinct colours to pixels sampled, from 0 to 1, at or below which a job's quality checks flag an image as blank_suspect (env IMGPROC_BLANK_MAX_COLOR_RATIO)")
+	fs.IntVar(&cfg.CacheSize, "cache-size", cfg.CacheSize, "maximum number of image URLs whose dimensions are cached; 0 disables the cache (env IMGPROC_CACHE_SIZE)")
+	fs.DurationVar(&cfg.CacheTTL, "cache-ttl", cfg.CacheTTL, "how long cached image dimensions are reused (env IMGPROC_CACHE_TTL)")
+	fs.DurationVar(&cfg.CacheStaleTTL, "cache-stale-ttl", cfg.CacheStaleTTL, "how long past -cache-ttl cached dimensions of images served with an ETag or Last-Modified are kept and revalidated with a conditional request instead of downloading the image again; 0 disables revalidation (env IMGPROC_CACHE_STALE_TTL)")
+	fs.StringVar(&cfg.CacheFile, "cache-file", cfg.CacheFile, "file the image cache is saved to periodically and on shutdown, and loaded from on startup; the cache is only kept in memory when unset (env IMGPROC_CACHE_FILE)")
+	fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", cfg.DrainTimeout, "how long shutdown waits for running jobs before marking them interrupted (env IMGPROC_DRAIN_TIMEOUT)")
+	fs.DurationVar(&cfg.JobTimeout, "job-timeout", cfg.JobTimeout, "how long a job may run before its unfinished images are abandoned and it ends as timed_out, unless the job sets timeout_seconds; 0 means no limit (env IMGPROC_JOB_TIMEOUT)")
+	fs.IntVar(&cfg.JobRunners, "job-runners", cfg.JobRunners, "number of jobs processed at once; later jobs wait in the queue (env IMGPROC_JOB_RUNNERS)")
+	fs.IntVar(&cfg.MaxQueueDepth, "max-queue-depth", cfg.MaxQueueDepth, "maximum number of jobs waiting in the queue, beyond which submissions are rejected with 429; 0 means no limit (env IMGPROC_MAX_QUEUE_DEPTH)")
+	fs.DurationVar(&cfg.PriorityAging, "priority-aging", cfg.PriorityAging, "how long a queued job waits before its priority is raised a level, so low priority jobs are not starved; 0 disables aging (env IMGPROC_PRIORITY_AGING)")
+	fs.IntVar(&cfg.FailureThresholdPercent, "failure-threshold-percent", cfg.FailureThresholdPercent, "percentage of a job's images that may fail before the job is marked failed instead of completed_with_errors, unless the job sets failure_threshold_percent; 0 fails a job on any error (env IMGPROC_FAILURE_THRESHOLD_PERCENT)")
+	fs.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", cfg.IdempotencyTTL, "how long a submission's Idempotency-Key is remembered, during which resubmitting it returns the original job (env IMGPROC_IDEMPOTENCY_TTL)")
+	fs.DurationVar(&cfg.DuplicateWindow, "duplicate-window", cfg.DuplicateWindow, "how long an identical payload returns the existing job instead of creating a new one, unless the submission sets force; 0 disables duplicate detection (env IMGPROC_DUPLICATE_WINDOW)")
+	fs.IntVar(&cfg.WebhookAttempts, "webhook-attempts", cfg.WebhookAttempts, "maximum attempts to deliver a job's callback; network errors, 429 and 5xx responses are retried with exponential backoff (env IMGPROC_WEBHOOK_ATTEMPTS)")
+	fs.DurationVar(&cfg.WebhookTimeout, "webhook-timeout", cfg.WebhookTimeout, "timeout for each callback delivery attempt (env IMGPROC_WEBHOOK_TIMEOUT)")
+	fs.DurationVar(&cfg.MaxStatusWait, "max-status-wait", cfg.MaxStatusWait, "longest a status request may wait for the job to change with wait; longer waits are shortened to it (env IMGPROC_MAX_STATUS_WAIT)")
+	fs.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", cfg.MaxBodyBytes, "largest job submission in bytes, after decompression; larger submissions are rejected with 413 (env IMGPROC_MAX_BODY_BYTES)")
+	fs.Int64Var(&cfg.MaxUploadBytes, "max-upload-bytes", cfg.MaxUploadBytes, "largest upload submission in bytes, including its images; larger uploads are rejected with 413 (env IMGPROC_MAX_UPLOAD_BYTES)")
+	fs.Int64Var(&cfg.MaxStoredRequestBytes, "max-stored-request-bytes", cfg.MaxStoredRequestBytes, "largest submission in bytes kept with its job so it can be rerun; 0 keeps none (env IMGPROC_MAX_STORED_REQUEST_BYTES)")
+	fs.IntVar(&cfg.MaxVisits, "max-visits", cfg.MaxVisits, "maximum number of visits in a job; larger submissions are rejected with 422 (env IMGPROC_MAX_VISITS)")
+	fs.IntVar(&cfg.MaxImages, "max-images", cfg.MaxImages, "maximum number of image URLs in a job across all of its visits; larger submissions are rejected with 422 (env IMGPROC_MAX_IMAGES)")
+	fs.IntVar(&cfg.PreflightSyncLimit, "preflight-sync-limit", cfg.PreflightSyncLimit, "most images a preflight checks before responding; larger preflights run in the background and are polled (env IMGPROC_PREFLIGHT_SYNC_LIMIT)")
+	fs.IntVar(&cfg.SubmitRate, "submit-rate", cfg.SubmitRate, "jobs each client may submit per minute, identified by API key or by IP address when authentication is off; 0 means no limit (env IMGPROC_SUBMIT_RATE)")
+	fs.IntVar(&cfg.SubmitBurst, "submit-burst", cfg.SubmitBurst, "jobs each client may submit at once before -submit-rate applies (env IMGPROC_SUBMIT_BURST)")
+	fs.IntVar(&cfg.MonthlyImageQuota, "monthly-image-quota", cfg.MonthlyImageQuota, "images each API key may submit per calendar month (UTC), unless its entry in the API keys sets its own; 0 means no quota (env IMGPROC_MONTHLY_IMAGE_QUOTA)")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "least severe level logged: debug, info, warn or error; per-image logs are only written at debug (env IMGPROC_LOG_LEVEL)")
+	fs.StringVar(&cfg.TraceEndpoint, "trace-endpoint", cfg.TraceEndpoint, "OTLP/HTTP endpoint spans are exported to, e.g. http://localhost:4318/v1/traces; tracing is off when unset (env IMGPROC_TRACE_ENDPOINT)")
+	fs.Var((*secretValue)(&cfg.WebhookSecret), "webhook-secret", "secret job callbacks are signed with using HMAC-SHA256; prefer the environment variable, since flags are visible to other processes (env IMGPROC_WEBHOOK_SECRET)")
+	fs.StringVar(&cfg.APIKeysPath, "api-keys-file", cfg.APIKeysPath, "file of API keys clients must authenticate with, one id:key or id:key:role entry per line; authentication is off if no keys are configured (env IMGPROC_API_KEYS_FILE)")
+	fs.BoolVar(&cfg.SimulateProcessingDelay, "simulate-processing-delay", cfg.SimulateProcessingDelay, "sleep for a random time after each image is downloaded, to mimic GPU processing in demo environments (env IMGPROC_SIMULATE_PROCESSING_DELAY)")
+	fs.DurationVar(&cfg.ProcessingDelayMin, "processing-delay-min", cfg.ProcessingDelayMin, "shortest simulated processing delay (env IMGPROC_PROCESSING_DELAY_MIN)")
+	fs.DurationVar(&cfg.ProcessingDelayMax, "processing-delay-max", cfg.ProcessingDelayMax, "longest simulated processing delay (env IMGPROC_PROCESSING_DELAY_MAX)")
+	fs.IntVar(&cfg.MaxPerHost, "max-per-host", cfg.MaxPerHost, "maximum concurrent downloads from each host, beyond which downloads wait; 0 means no limit (env IMGPROC_MAX_PER_HOST)")
+	fs.IntVar(&cfg.BreakerThreshold, "breaker-threshold", cfg.BreakerThreshold, "consecutive transient download failures from a host before its downloads fail immediately; 0 disables the circuit breakers (env IMGPROC_BREAKER_THRESHOLD)")
+	fs.DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", cfg.BreakerCooldown, "how long a host's downloads fail immediately before one is tried again (env IMGPROC_BREAKER_COOLDOWN)")
+	fs.StringVar(&cfg.StoreMasterPath, "store-master", cfg.StoreMasterPath, "CSV file with AreaCode,StoreName,StoreID rows to load the store master from; a small sample store master is used if empty (env IMGPROC_STORE_MASTER)")
+	fs.StringVar(&cfg.StoreMasterURL, "store-master-url", cfg.StoreMasterURL, "http or https URL to fetch the store master CSV from, instead of a file (env IMGPROC_STORE_MASTER_URL)")
+	fs.DurationVar(&cfg.StoreMasterRefresh, "store-master-refresh", cfg.StoreMasterRefresh, "how often to fetch the store master URL again; 0 fetches it only at startup (env IMGPROC_STORE_MASTER_REFRESH)")
+	fs.StringVar(&cfg.JobStorePath, "job-store", cfg.JobStorePath, "file to persist jobs to so they survive restarts; jobs are kept in memory only if empty (env IMGPROC_JOB_STORE)")
+	fs.DurationVar(&cfg.JobRetention, "job-retention", cfg.JobRetention, "how long finished jobs are kept before they are removed; 0 keeps them forever (env IMGPROC_JOB_RETENTION)")
+	fs.StringVar(&cfg.JobArchiveDir, "job-archive-dir", cfg.JobArchiveDir, "directory expired jobs are archived to as gzip compressed JSON before they are removed; they aren't archived if empty (env IMGPROC_JOB_ARCHIVE_DIR)")
+	fs.DurationVar(&cfg.JobArchiveRetention, "job-archive-retention", cfg.JobArchiveRetention, "how long job archives are kept before they are removed; 0 keeps them forever (env IMGPROC_JOB_ARCHIVE_RETENTION)")
+	fs.DurationVar(&cfg.StallTimeout, "stall-timeout", cfg.StallTimeout, "how long a running job may go without processing an image before it is stopped as stalled; 0 turns the watchdog off (env IMGPROC_STALL_TIMEOUT)")
+	fs.DurationVar(&cfg.WatchdogInterval, "watchdog-interval", cfg.WatchdogInterval, "how often running jobs are checked for stalls (env IMGPROC_WATCHDOG_INTERVAL)")
+	fs.Var((*stringList)(&cfg.AllowedSchemes), "allowed-schemes", "comma-separated URL schemes images may be downloaded with (env IMGPROC_ALLOWED_SCHEMES)")
+	fs.Var((*stringList)(&cfg.VisitTimeLayouts), "visit-time-layouts", "comma-separated formats visit_time may be given in: rfc3339, rfc1123, rfc1123z, datetime, date, unix, unix_ms or Go time layouts (env IMGPROC_VISIT_TIME_LAYOUTS)")
+	fs.Var((*stringList)(&cfg.AllowedHosts), "allowed-hosts", "comma-separated hosts images may be downloaded from, where *.example.com matches every subdomain; any host is allowed if empty (env IMGPROC_ALLOWED_HOSTS)")
+	fs.Var((*stringList)(&cfg.DeniedHosts), "denied-hosts", "comma-separated hosts images may not be downloaded from, where *.example.com matches every subdomain (env IMGPROC_DENIED_HOSTS)")
+	fs.StringVar(&cfg.S3Region, "s3-region", cfg.S3Region, "AWS region s3:// image URLs are fetched from (env IMGPROC_S3_REGION or AWS_REGION)")
+	fs.StringVar(&cfg.S3Endpoint, "s3-endpoint", cfg.S3Endpoint, "http or https URL of an S3-compatible service such as MinIO to fetch s3:// image URLs from instead of AWS (env IMGPROC_S3_ENDPOINT)")
+	fs.BoolVar(&cfg.DownloadProxy, "download-proxy", cfg.DownloadProxy, "send image downloads through the proxy in HTTPS_PROXY or HTTP_PROXY, except to hosts in NO_PROXY (env IMGPROC_DOWNLOAD_PROXY)")
+	fs.StringVar(&cfg.DownloadCAFile, "download-ca-file", cfg.DownloadCAFile, "PEM file of CA certificates to trust for image downloads, on top of the system's (env IMGPROC_DOWNLOAD_CA_FILE)")
+	fs.BoolVar(&cfg.DownloadInsecureSkipVerify, "download-insecure-skip-verify", cfg.DownloadInsecureSkipVerify, "don't verify image hosts' TLS certificates; for lab environments only (env IMGPROC_DOWNLOAD_INSECURE_SKIP_VERIFY)")
+	fs.BoolVar(&cfg.WebhookUseDownloadTransport, "webhook-use-download-transport", cfg.WebhookUseDownloadTransport, "deliver job callbacks with the download proxy and TLS settings too (env IMGPROC_WEBHOOK_USE_DOWNLOAD_TRANSPORT)")
+	fs.StringVar(&cfg.UserAgent, "user-agent", cfg.UserAgent, "User-Agent sent with image downloads, replacing the default image-processing-service/<version> (env IMGPROC_USER_AGENT)")
+	fs.StringVar(&cfg.UserAgentContact, "user-agent-contact", cfg.UserAgentContact, "URL added to the default User-Agent so image hosts can contact the service's operators, e.g. https://example.com/bots (env IMGPROC_USER_AGENT_CONTACT)")
+	fs.BoolVar(&cfg.AllowFileURLs, "allow-file-urls", cfg.AllowFileURLs, "read images from local files given as file: URLs inside the file roots (env IMGPROC_ALLOW_FILE_URLS)")
+	fs.Var((*stringList)(&cfg.FileRoots), "file-roots", "comma-separated directories file: URLs may read images from (env IMGPROC_FILE_ROOTS)")
+	fs.Var((*prefixList)(&cfg.AllowedDestinations), "allow-destinations", "comma-separated IP ranges images may be downloaded from even though they are loopback, private or link-local, e.g. 127.0.0.0/8 for development (env IMGPROC_ALLOW_DESTINATIONS)")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks that every setting is within its allowed range
+func (cfg Config) Validate() error {
+	var errs []error
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		errs = append(errs, fmt.Errorf("invalid port %d: must be between 1 and 65535", cfg.Port))
+	}
+	if cfg.Workers < 1 {
+		errs = append(errs, fmt.Errorf("invalid worker count %d: must be at least 1", cfg.Workers))
+	}
+	if cfg.DownloadTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("invalid download timeout %v: must be positive", cfg.DownloadTimeout))
+	}
+	if cfg.MaxImageTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("invalid max image timeout %v: must be positive", cfg.MaxImageTimeout))
+	}
+	if cfg.DownloadAttempts < 1 {
+		errs = append(errs, fmt.Errorf("invalid download attempts %d: must be at least 1", cfg.DownloadAttempts))
+	}
+	if cfg.MaxRetryAfter < 0 {
+		errs = append(errs, fmt.Errorf("invalid max retry after %v: must not be negative", cfg.MaxRetryAfter))
+	}
+	if cfg.MaxImageBytes < 1 {
+		errs = append(errs, fmt.Errorf("invalid max image bytes %d: must be at least 1", cfg.MaxImageBytes))
+	}
+	if cfg.MaxRedirects < 0 {
+		errs = append(errs, fmt.Errorf("invalid max redirects %d: must not be negative", cfg.MaxRedirects))
+	}
+	if cfg.MaxArchiveEntries < 1 {
+		errs = append(errs, fmt.Errorf("invalid max archive entries %d: must be at least 1", cfg.MaxArchiveEntries))
+	}
+	if cfg.MaxArchiveBytes < 1 {
+		errs = append(errs, fmt.Errorf("invalid max archive bytes %d: must be at least 1", cfg.MaxArchiveBytes))
+	}
+	if cfg.PHashDistance < 0 || cfg.PHashDistance > 64 {
+		errs = append(errs, fmt.Errorf("invalid phash distance %d: must be between 0 and 64", cfg.PHashDistance))
+	}
+	if cfg.BlankMaxStddev < 0 {
+		errs = append(errs, fmt.Errorf("invalid blank max stddev %v: must not be negative", cfg.BlankMaxStddev))
+	}
+	if cfg.BlankMaxColorRatio < 0 || cfg.BlankMaxColorRatio > 1 {
+		errs = append(errs, fmt.Errorf("invalid blank max color ratio %v: must be between 0 and 1", cfg.BlankMaxColorRatio))
+	}
+	if cfg.CacheSize < 0 {
+		errs = append(errs, fmt.Errorf("invalid cache size %d: must not be negative", cfg.CacheSize))
+	}
+	if cfg.CacheStaleTTL < 0 {
+		errs = append(errs, fmt.Errorf("invalid cache stale TTL %v: must not be negative", cfg.CacheStaleTTL))
+	}
+	if cfg.CacheTTL <= 0 {
+		errs = append(errs, fmt.Errorf("invalid cache TTL %v: must be positive", cfg.CacheTTL))
+	}
+	if cfg.JobTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid job timeout %v: must not be negative", cfg.JobTimeout))
+	}
+	if cfg.JobRunners < 1 {
+		errs = append(errs, fmt.Errorf("invalid job runner count %d: must be at least 1", cfg.JobRunners))
+	}
+	if cfg.MaxQueueDepth < 0 {
+		errs = append(errs, fmt.Errorf("invalid max queue depth %d: must not be negative", cfg.MaxQueueDepth))
+	}
+	if cfg.PriorityAging < 0 {
+		errs = append(errs, fmt.Errorf("invalid priority aging %v: must not be negative", cfg.PriorityAging))
+	}
+	if cfg.FailureThresholdPercent < 0 || cfg.FailureThresholdPercent > 100 {
+		errs = append(errs, fmt.Errorf("invalid failure threshold percent %d: must be between 0 and 100", cfg.FailureThresholdPercent))
+	}
+	if cfg.IdempotencyTTL <= 0 {
+		errs = append(errs, fmt.Errorf("invalid idempotency TTL %v: must be positive", cfg.IdempotencyTTL))
+	}
+	if cfg.DuplicateWindow < 0 {
+		errs = append(errs, fmt.Errorf("invalid duplicate window %v: must not be negative", cfg.DuplicateWindow))
+	}
+	if cfg.WebhookAttempts < 1 {
+		errs = append(errs, fmt.Errorf("invalid webhook attempts %d: must be at least 1", cfg.WebhookAttempts))
+	}
+	if cfg.WebhookTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("invalid webhook timeout %v: must be positive", cfg.WebhookTimeout))
+	}
+	if cfg.MaxStatusWait < 0 {
+		errs = append(errs, fmt.Errorf("invalid max status wait %v: must not be negative", cfg.MaxStatusWait))
+	}
+	if cfg.MaxBodyBytes < 1 {
+		errs = append(errs, fmt.Errorf("invalid max body bytes %d: must be at least 1", cfg.MaxBodyBytes))
+	}
+	if cfg.MaxUploadBytes < 1 {
+		errs = append(errs, fmt.Errorf("invalid max upload bytes %d: must be at least 1", cfg.MaxUploadBytes))
+	}
+	if cfg.JobRetention < 0 {
+		errs = append(errs, fmt.Errorf("invalid job retention %v: must not be negative", cfg.JobRetention))
+	}
+	if cfg.StallTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid stall timeout %v: must not be negative", cfg.StallTimeout))
+	}
+	if cfg.WatchdogInterval <= 0 {
+		errs = append(errs, fmt.Errorf("invalid watchdog interval %v: must be positive", cfg.WatchdogInterval))
+	}
+	if cfg.JobArchiveRetention < 0 {
+		errs = append(errs, fmt.Errorf("invalid job archive retention %v: must not be negative", cfg.JobArchiveRetention))
+	}
+	if cfg.MaxStoredRequestBytes < 0 {
+		errs = append(errs, fmt.Errorf("invalid max stored request bytes %d: must not be negative", cfg.MaxStoredRequestBytes))
+	}
+	if cfg.MaxVisits < 1 {
+		errs = append(errs, fmt.Errorf("invalid max visits %d: must be at least 1", cfg.MaxVisits))
+	}
+	if cfg.MaxImages < 1 {
+		errs = append(errs, fmt.Errorf("invalid max images %d: must be at least 1", cfg.MaxImages))
+	}
+	if cfg.PreflightSyncLimit < 0 {
+		errs = append(errs, fmt.Errorf("invalid preflight sync limit %d: must not be negative", cfg.PreflightSyncLimit))
+	}
+	if cfg.ProcessingDelayMin < 0 || cfg.ProcessingDelayMax < cfg.ProcessingDelayMin {
+		errs = append(errs, fmt.Errorf("invalid processing delay %v-%v: must not be negative, and the maximum must not be less than the minimum", cfg.ProcessingDelayMin, cfg.ProcessingDelayMax))
+	}
+	if cfg.MaxPerHost < 0 {
+		errs = append(errs, fmt.Errorf("invalid max per host %d: must not be negative", cfg.MaxPerHost))
+	}
+	if cfg.BreakerThreshold < 0 {
+		errs = append(errs, fmt.Errorf("invalid breaker threshold %d: must not be negative", cfg.BreakerThreshold))
+	}
+	if cfg.BreakerCooldown <= 0 {
+		errs = append(errs, fmt.Errorf("invalid breaker cooldown %v: must be positive", cfg.BreakerCooldown))
+	}
+	if cfg.SubmitRate < 0 {
+		errs = append(errs, fmt.Errorf("invalid submit rate %d: must not be negative", cfg.SubmitRate))
+	}
+	if cfg.SubmitBurst < 1 {
+		errs = append(errs, fmt.Errorf("invalid submit burst %d: must be at least 1", cfg.SubmitBurst))
+	}
+	if cfg.MonthlyImageQuota < 0 {
+		errs = append(errs, fmt.Errorf("invalid monthly image quota %d: must not be negative", cfg.MonthlyImageQuota))
+	}
+	if err := validateAPIKeys(cfg.APIKeys); err != nil {
+		errs = append(errs, fmt.Errorf("invalid API keys: %v", err))
+	}
+	if !validLogLevel(cfg.LogLevel) {
+		errs = append(errs, fmt.Errorf("invalid log level %q: must be debug, info, warn or error", cfg.LogLevel))
+	}
+	if cfg.StoreMasterURL != "" {
+		if u, err := url.Parse(cfg.StoreMasterURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid store master URL %q: must be an http or https URL", cfg.StoreMasterURL))
+		}
+		if cfg.StoreMasterPath != "" {
+			errs = append(errs, errors.New("invalid store master: a file and a URL can't both be given"))
+		}
+	}
+	if cfg.StoreMasterRefresh < 0 {
+		errs = append(errs, fmt.Errorf("invalid store master refresh %v: must not be negative", cfg.StoreMasterRefresh))
+	}
+	if cfg.TraceEndpoint != "" {
+		if u, err := url.Parse(cfg.TraceEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid trace endpoint %q: must be an http or https URL", cfg.TraceEndpoint))
+		}
+	}
+	if len(cfg.VisitTimeLayouts) == 0 {
+		errs = append(errs, errors.New("invalid visit time layouts: at least one layout is required"))
+	}
+	if len(cfg.AllowedSchemes) == 0 {
+		errs = append(errs, errors.New("invalid allowed schemes: at least one scheme is required"))
+	}
+	if cfg.DownloadCAFile != "" {
+		if _, err := loadCABundle(cfg.DownloadCAFile); err != nil {
+			errs = append(errs, fmt.Errorf("invalid download CA file %q: %v", cfg.DownloadCAFile, err))
+		}
+	}
+	if strings.ContainsFunc(cfg.userAgent(), unicode.IsControl) {
+		errs = append(errs, fmt.Errorf("invalid user agent %q: must not contain control characters", cfg.userAgent()))
+	}
+	if cfg.AllowFileURLs && len(cfg.FileRoots) == 0 {
+		errs = append(errs, errors.New("invalid file roots: at least one root is required to allow file URLs"))
+	}
+	for _, root := range cfg.FileRoots {
+		if !filepath.IsAbs(root) {
+			errs = append(errs, fmt.Errorf("invalid file root %q: must be an absolute path", root))
+		}
+	}
+	if cfg.S3Region == "" {
+		errs = append(errs, errors.New("invalid S3 region: must not be empty"))
+	}
+	if cfg.S3Endpoint != "" {
+		if u, err := url.Parse(cfg.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid S3 endpoint %q: must be an http or https URL", cfg.S3Endpoint))
+		}
+	}
+	if cfg.DrainTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid drain timeout %v: must not be negative", cfg.DrainTimeout))
+	}
+	return errors.Join(errs...)
+}
+
+// stringList is a flag.Value holding a comma-separated list of strings
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// secretValue is a flag.Value for a secret, which is never printed, so a
+// secret set in the environment doesn't appear in the flag defaults
+type secretValue string
+
+func (v *secretValue) String() string {
+	return ""
+}
+
+func (v *secretValue) Set(value string) error {
+	*v = secretValue(value)
+	return nil
+}
+
+func (l *stringList) Set(value string) error {
+	var values []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			values = append(values, field)
+		}
+	}
+	*l = values
+	return nil
+}
+
+// envReader overrides settings from environment variables, collecting any
+// values that fail to parse
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) String(dst *string, key string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = v
+	}
+}
+
+func (e *envReader) Bool(dst *bool, key string) {
+	if v := os.Getenv(key); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("invalid %s %q: must be true or false", key, v))
+			return
+		}
+		*dst = b
+	}
+}
+
+func (e *envReader) Int(dst *int, key string) {
+	if v := os.Getenv(key); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("invalid %s %q: must be an integer", key, v))
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envReader) Int64(dst *int64, key string) {
+	if v := os.Getenv(key); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("invalid %s %q: must be an integer", key, v))
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envReader) Float64(dst *float64, key string) {
+	if v := os.Getenv(key); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("invalid %s %q: must be a number", key, v))
+			return
+		}
+		*dst = f
+	}
+}
+
+func (e *envReader) Value(dst flag.Value, key string) {
+	if v := os.Getenv(key); v != "" {
+		if err := dst.Set(v); err != nil {
+			e.errs = append(e.errs, fmt.Errorf("invalid %s %q: %v", key, v, err))
+		}
+	}
+}
+
+// Secret is Value for settings holding secrets, whose value is left out of
+// the error if it fails to parse
+func (e *envReader) Secret(dst flag.Value, key string) {
+	if v := os.Getenv(key); v != "" {
+		if err := dst.Set(v); err != nil {
+			e.errs = append(e.errs, fmt.Errorf("invalid %s: %v", key, err))
+		}
+	}
+}
+
+func (e *envReader) Duration(dst *time.Duration, key string) {
+	if v := os.Getenv(key); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("invalid %s %q: must be a duration such as 10s", key, v))
+			return
+		}
+		*dst = d
+	}
+}
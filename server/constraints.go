@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Violations reported on ImageResult when an image doesn't meet its store's
+// constraints
+const (
+	violationBelowMinResolution  = "below_min_resolution"
+	violationAspectRatioMismatch = "aspect_ratio_mismatch"
+)
+
+// aspectRatioTolerance is how far, relative to a store's expected aspect
+// ratio, an image's aspect ratio may be and still match it
+const aspectRatioTolerance = 0.01
+
+// Optional store master CSV columns giving a store's image constraints
+const (
+	columnMinWidth            = "minwidth"
+	columnMinHeight           = "minheight"
+	columnExpectedAspectRatio = "expectedaspectratio"
+)
+
+// hasConstraints reports whether the store constrains its images at all
+func (store Store) hasConstraints() bool {
+	return store.MinWidth > 0 || store.MinHeight > 0 || store.ExpectedAspectRatio > 0
+}
+
+// validateConstraints checks that the store's constraints make sense
+func (store Store) validateConstraints() error {
+	var errs []error
+	if store.MinWidth < 0 {
+		errs = append(errs, fmt.Errorf("invalid min_width %d: must not be negative", store.MinWidth))
+	}
+	if store.MinHeight < 0 {
+		errs = append(errs, fmt.Errorf("invalid min_height %d: must not be negative", store.MinHeight))
+	}
+	if store.ExpectedAspectRatio < 0 || math.IsNaN(store.ExpectedAspectRatio) || math.IsInf(store.ExpectedAspectRatio, 0) {
+		errs = append(errs, fmt.Errorf("invalid expected_aspect_ratio %v: must be a non-negative number", store.ExpectedAspectRatio))
+	}
+	return errors.Join(errs...)
+}
+
+// violations lists the store's constraints that an image of the given size
+// doesn't meet. An image with no height has no aspect ratio to check.
+func (store Store) violations(width, height int) []string {
+	var violations []string
+	if width < store.MinWidth || height < store.MinHeight {
+		violations = append(violations, violationBelowMinResolution)
+	}
+	if store.ExpectedAspectRatio > 0 && height > 0 {
+		ratio := float64(width) / float64(height)
+		if math.Abs(ratio-store.ExpectedAspectRatio) > aspectRatioTolerance*store.ExpectedAspectRatio {
+			violations = append(violations, violationAspectRatioMismatch)
+		}
+	}
+	return violations
+}
+
+// formatConstraint formats a constraint for the store master CSV, leaving it
+// empty if it is unset
+func formatConstraint(value float64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// parseStoreConstraints reads the optional constraint columns of a store
+// master row into store. Empty values leave the constraint unset.
+func parseStoreConstraints(store *Store, record []string, columns map[string]int) error {
+	value := func(column string) string {
+		if i, ok := columns[column]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var err error
+	if v := value(columnMinWidth); v != "" {
+		if store.MinWidth, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid min_width %q: must be a whole number", v)
+		}
+	}
+	if v := value(columnMinHeight); v != "" {
+		if store.MinHeight, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid min_height %q: must be a whole number", v)
+		}
+	}
+	if v := value(columnExpectedAspectRatio); v != "" {
+		if store.ExpectedAspectRatio, err = strconv.ParseFloat(v, 64); err != nil {
+			return fmt.Errorf("invalid expected_aspect_ratio %q: must be a number", v)
+		}
+	}
+	return store.validateConstraints()
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+)
+
+// dataURLScheme starts the image URLs that hold their image inline, as a
+// base64-encoded data: URL
+const dataURLScheme = "data:"
+
+// isDataURL reports whether imageURL is a data: URL
+func isDataURL(imageURL string) bool {
+	return len(imageURL) >= len(dataURLScheme) && strings.EqualFold(imageURL[:len(dataURLScheme)], dataURLScheme)
+}
+
+// parseDataURL splits a data: URL of the form data:image/png;base64,<data>
+// into its media type and base64 payload. Only base64-encoded images are
+// accepted.
+func parseDataURL(imageURL string) (mediaType, payload string, err error) {
+	header, payload, ok := strings.Cut(imageURL[len(dataURLScheme):], ",")
+	if !ok {
+		return "", "", &codedError{Code: codeInvalidURL, Err: errors.New("invalid data URL: missing comma before the data")}
+	}
+	header, isBase64 := strings.CutSuffix(header, ";base64")
+	if !isBase64 {
+		return "", "", &codedError{Code: codeInvalidURL, Err: errors.New("invalid data URL: data must be base64-encoded")}
+	}
+	mediaType, _, err = mime.ParseMediaType(header)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return "", "", &codedError{Code: codeUnsupportedFormat, Err: fmt.Errorf("unsupported data URL media type %q: must be an image", header)}
+	}
+	return mediaType, payload, nil
+}
+
+// decodeDataURL decodes the image held in a data: URL without making any
+// request, so it is a downloadFunc. The image is limited to MaxImageBytes
+// like a downloaded one.
+func (s *Server) decodeDataURL(ctx context.Context, imageURL string) (imageInfo, error) {
+	_, span := s.tracer.Start(ctx, "decode", spanKindInternal)
+	defer span.End()
+
+	mediaType, payload, err := parseDataURL(imageURL)
+	if err != nil {
+		span.SetError(err)
+		return imageInfo{}, err
+	}
+	// Padding is optional, as many encoders leave it out
+	payload = strings.TrimRight(payload, "=")
+	if int64(base64.RawStdEncoding.DecodedLen(len(payload))) > s.cfg.MaxImageBytes {
+		err := &imageTooLargeError{Limit: s.cfg.MaxImageBytes}
+		span.SetError(err)
+		return imageInfo{}, err
+	}
+
+	start := time.Now()
+	data, err := base64.RawStdEncoding.DecodeString(payload)
+	if err != nil {
+		err := &codedError{Code: codeCorruptImage, Err: fmt.Errorf("corrupt data URL: invalid base64: %v", err)}
+		span.SetError(err)
+		return imageInfo{}, err
+	}
+	body := &sizeLimitedReader{R: bytes.NewReader(data), Limit: s.cfg.MaxImageBytes}
+	info, err := s.decodeImage(ctx, body, mediaType)
+	span.SetError(err)
+	if err != nil {
+		return imageInfo{}, err
+	}
+	info.DecodeTime = time.Since(start)
+	info.Bytes = body.read
+	span.SetAttr("imgproc.image.format", info.Format)
+	return info, nil
+}
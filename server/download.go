@@ -0,0 +1,606 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// imageInfo is what downloading an image reveals about it
+type imageInfo struct {
+	// Width and Height are as stored, before Orientation is applied
+	Width  int
+	Height int
+
+	// Orientation is the image's EXIF orientation tag, or 0 if it has none
+	Orientation int
+
+	// DPIX and DPIY are the resolution the image's metadata declares, in
+	// dots per inch, also before Orientation is applied. They are 0 if it
+	// declares none.
+	DPIX float64
+	DPIY float64
+
+	// Format is the format name the image was decoded with, e.g. "png"
+	Format string
+
+	// ContentType is the media type the server reported for the image
+	ContentType string
+
+	// Pages is the number of pages in a multi-page format such as TIFF
+	Pages int
+
+	// SHA256 is the hex SHA-256 of the whole image, as it was received
+	SHA256 string
+
+	// PHash is the perceptual hash of the image's pixels, and BlankSuspect
+	// whether they look blank, if they were decoded
+	PHash        string
+	BlankSuspect bool
+
+	// PixelsUnsupported is set when they were asked for but the image's
+	// format is one whose pixels can't be decoded, and PixelsTooLarge when
+	// the image has too many pixels to decode
+	PixelsUnsupported bool
+	PixelsTooLarge    bool
+
+	// EXIF is the image's camera metadata, when it was asked for and the
+	// image has any
+	EXIF *EXIF
+
+	// DownloadTime is how long the request took up to the response headers,
+	// DecodeTime how long reading and decoding the body took, and Bytes the
+	// number of body bytes read. They are all zero when the image didn't
+	// have to be downloaded, such as when it was cached.
+	DownloadTime time.Duration
+	DecodeTime   time.Duration
+	Bytes        int64
+
+	// ContentLength is the body size the response declared, or zero if it
+	// didn't declare one. Truncated is set when the body ended before it.
+	ContentLength int64
+	Truncated     bool
+
+	// Attempts is the number of times the download was tried
+	Attempts int
+
+	// FinalURL is the URL the image was served from after following
+	// Redirects redirects. Both are zero when there were no redirects.
+	FinalURL  string
+	Redirects int
+
+	// ETag and LastModified are the validators the image was served with,
+	// used to revalidate it once its cache entry expires. NotModified is
+	// set instead of the image's details when a revalidation found it
+	// unchanged.
+	ETag         string
+	LastModified string
+	NotModified  bool
+
+	// Entries are the files in the archive when the download was a ZIP
+	// archive of images
+	Entries []archiveEntry
+}
+
+// withoutTransfer returns info as reported to an image that reused another
+// download of the same URL rather than transferring anything itself
+func (info imageInfo) withoutTransfer() imageInfo {
+	info.DownloadTime, info.DecodeTime, info.Bytes = 0, 0, 0
+	return info
+}
+
+// validatorsKey is the context key for the validators of a cached image
+type validatorsKey struct{}
+
+// cacheValidators are the ETag and Last-Modified a cached image was served
+// with
+type cacheValidators struct {
+	etag         string
+	lastModified string
+}
+
+// withValidators returns a context whose downloads are conditional on the
+// image having changed since it was served with etag and lastModified
+func withValidators(ctx context.Context, etag, lastModified string) context.Context {
+	return context.WithValue(ctx, validatorsKey{}, cacheValidators{etag, lastModified})
+}
+
+// validators returns the validators downloads made with ctx are conditional
+// on, if any
+func validators(ctx context.Context) (etag, lastModified string) {
+	v, _ := ctx.Value(validatorsKey{}).(cacheValidators)
+	return v.etag, v.lastModified
+}
+
+// imageTimeoutKey is the context key for a job's image download timeout
+type imageTimeoutKey struct{}
+
+// withImageTimeout returns a context that limits each download attempt made
+// with it to timeout, overriding the server's download timeout
+func withImageTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	if timeout <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, imageTimeoutKey{}, timeout)
+}
+
+// imageLimit returns the largest image in bytes that may be downloaded with
+// ctx: MaxArchiveBytes for ZIP archives and MaxImageBytes otherwise
+func (s *Server) imageLimit(ctx context.Context) int64 {
+	if isArchive(ctx) {
+		return s.cfg.MaxArchiveBytes
+	}
+	return s.cfg.MaxImageBytes
+}
+
+// imageTimeout returns the download timeout for ctx
+func (s *Server) imageTimeout(ctx context.Context) time.Duration {
+	if timeout, ok := ctx.Value(imageTimeoutKey{}).(time.Duration); ok {
+		return timeout
+	}
+	return s.cfg.DownloadTimeout
+}
+
+// downloadAndGetDimensions returns the dimensions of the image at url, from
+// the shared image cache when possible. Downloads sent with headers are
+// cached apart from the URL's other downloads, since the headers may decide
+// whether the image can be downloaded at all.
+func (s *Server) downloadAndGetDimensions(ctx context.Context, url string) (imageInfo, error) {
+	headers := downloadHeaders(ctx)
+	if len(headers) == 0 && !isArchive(ctx) && !includeEXIF(ctx) && !detectDuplicates(ctx) && !qualityChecks(ctx) {
+		return s.cache.Get(ctx, url, s.fetchFromHost)
+	}
+	// A URL downloaded as a ZIP archive is decoded differently from the same
+	// URL downloaded as an image, and images downloaded without their EXIF,
+	// perceptual hash or quality checks can't be reused by jobs that want them
+	key := url
+	if isArchive(ctx) {
+		key += " archive"
+	}
+	if len(headers) > 0 {
+		key += " " + headers.fingerprint()
+	}
+	if includeEXIF(ctx) {
+		key += " exif"
+	}
+	if detectDuplicates(ctx) {
+		key += " phash"
+	}
+	if qualityChecks(ctx) {
+		key += " quality"
+	}
+	return s.cache.Get(ctx, key, func(ctx context.Context, _ string) (imageInfo, error) {
+		return s.fetchFromHost(ctx, url)
+	})
+}
+
+// fetchDimensions downloads the image at url and reads its dimensions. When
+// tracing, the request up to the response headers is one span, and reading
+// and decoding the body another.
+func (s *Server) fetchDimensions(ctx context.Context, url string) (info imageInfo, err error) {
+	parentCtx := ctx
+	ctx, span := s.tracer.Start(ctx, "download", spanKindClient)
+	var body *sizeLimitedReader
+	var start, decodeStart time.Time
+	defer func() {
+		// The bytes read are reported even when the image failed, since
+		// they were still downloaded
+		if body != nil {
+			span.SetAttr("http.response.body.size", body.read)
+			info.Bytes = body.read
+		}
+		if err == nil && !info.NotModified {
+			info.DownloadTime = decodeStart.Sub(start)
+			info.DecodeTime = time.Since(decodeStart)
+			span.SetAttr("imgproc.image.format", info.Format)
+		}
+		span.SetError(err)
+		span.End()
+	}()
+	// A panicking decoder fails the image here, rather than further up, so
+	// the cache and host limits see the download finish
+	defer func() {
+		if panicErr := s.recoverImagePanic(ctx, url, recover()); panicErr != nil {
+			info, err = imageInfo{}, panicErr
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return imageInfo{}, &codedError{Code: codeInvalidURL, Err: fmt.Errorf("invalid image URL: %v", err)}
+	}
+	if req.URL.Host == "" {
+		return imageInfo{}, &codedError{Code: codeInvalidURL, Err: errors.New("invalid image URL: missing host")}
+	}
+
+	if err := s.policy.Check(req.URL); err != nil {
+		return imageInfo{}, err
+	}
+	for name, value := range downloadHeaders(ctx) {
+		req.Header.Set(name, value)
+	}
+	client := s.client
+	fromS3 := isS3URL(req.URL)
+	if fromS3 {
+		// The bucket is the URL's host, but the object is fetched from the
+		// S3 endpoint
+		if req, err = s.s3.request(ctx, req.URL); err != nil {
+			return imageInfo{}, err
+		}
+		client = s.s3.client
+	}
+	s.identifyRequest(ctx, req)
+	etag, lastModified := validators(ctx)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	span.SetAttr("http.request.method", req.Method)
+	span.SetAttr("server.address", req.URL.Host)
+
+	start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return imageInfo{}, fmt.Errorf("error downloading image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// The default client checks each redirect, but an injected one may not.
+	// The S3 client doesn't follow redirects.
+	if !fromS3 {
+		if err := s.policy.Check(resp.Request.URL); err != nil {
+			return imageInfo{}, err
+		}
+	}
+
+	span.SetAttr("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode == http.StatusNotModified && (etag != "" || lastModified != "") {
+		return imageInfo{NotModified: true, DownloadTime: time.Since(start)}, nil
+	}
+	redirects := redirectCount(resp)
+	if redirects > 0 {
+		span.SetAttr("imgproc.redirects", redirects)
+	}
+	if resp.StatusCode != http.StatusOK && fromS3 {
+		return imageInfo{}, s3ResponseError(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return imageInfo{}, &statusError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	// Reject oversized images up front when the size is declared, and abort
+	// the download once the limit is passed when it isn't
+	limit := s.imageLimit(ctx)
+	if resp.ContentLength > limit {
+		return imageInfo{}, &imageTooLargeError{Limit: limit}
+	}
+	span.End()
+	_, span = s.tracer.Start(parentCtx, "decode", spanKindInternal)
+	decodeStart = time.Now()
+
+	body = &sizeLimitedReader{R: resp.Body, Limit: limit}
+	if isArchive(ctx) {
+		info, err = s.decodeArchive(ctx, body, resp.Header.Get("Content-Type"))
+	} else {
+		info, err = s.decodeImage(ctx, body, resp.Header.Get("Content-Type"))
+	}
+	if err != nil {
+		if truncatedErr := verifyContentLength(body, resp.ContentLength); truncatedErr != nil {
+			return imageInfo{}, truncatedErr
+		}
+		return imageInfo{}, err
+	}
+	info.ContentLength = max(resp.ContentLength, 0)
+	info.Truncated = truncated(body, resp.ContentLength)
+	if redirects > 0 {
+		info.FinalURL, info.Redirects = resp.Request.URL.String(), redirects
+	}
+	info.ETag, info.LastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return info, nil
+}
+
+// decodeImage reads the format and dimensions of the image in body, whose
+// content type, if any, was reported by wherever it came from, and its EXIF,
+// perceptual hash and whether it looks blank if ctx asks for them
+func (s *Server) decodeImage(ctx context.Context, body *sizeLimitedReader, contentType string) (info imageInfo, err error) {
+	info = imageInfo{ContentType: contentType}
+	finishHash := hashBody(body)
+	defer func() {
+		if err != nil {
+			return
+		}
+		if info.SHA256, err = finishHash(); err != nil {
+			info = imageInfo{}
+		}
+	}()
+
+	// SVGs are XML rather than a binary format the image package can sniff,
+	// so they are recognised by their content type or opening tag
+	src := bufio.NewReader(body)
+	head, _ := src.Peek(svgSniffLen)
+	if isSVG(info.ContentType, head) {
+		info.Width, info.Height, err = decodeSVGDimensions(src)
+		if body.Exceeded {
+			return imageInfo{}, &imageTooLargeError{Limit: body.Limit}
+		}
+		if err != nil {
+			return imageInfo{}, err
+		}
+		info.Format = "svg"
+		info.PixelsUnsupported = analyzesPixels(ctx)
+		return info, nil
+	}
+
+	// Only the header is needed for the dimensions. The bytes DecodeConfig
+	// consumes are recorded so a full decode can replay them if needed, without
+	// buffering the rest of the body.
+	var header bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(src, &header))
+	if err == nil {
+		info.Width, info.Height, info.Format = config.Width, config.Height, format
+		info.PixelsUnsupported = analyzesPixels(ctx) && !pixelFormats[format]
+		analyze := analyzesPixels(ctx) && pixelFormats[format]
+		if format == "tiff" {
+			// The TIFF decoder reads the whole file, so every page is buffered
+			_, _, info.Pages, _ = parseTIFF(header.Bytes())
+		}
+		info.Orientation = exifOrientation(header.Bytes(), format)
+		rest := io.Reader(src)
+		if analyze {
+			// The pixels are decoded from the start of the image, so
+			// whatever reading its metadata consumes is recorded too
+			rest = io.TeeReader(src, &header)
+		}
+		info.DPIX, info.DPIY = imageResolution(header.Bytes(), format, rest)
+		if includeEXIF(ctx) {
+			info.EXIF = parseEXIF(header.Bytes(), format)
+		}
+		if analyze {
+			s.analyzePixels(ctx, &info, io.MultiReader(bytes.NewReader(header.Bytes()), src))
+			if body.Exceeded {
+				return imageInfo{}, &imageTooLargeError{Limit: body.Limit}
+			}
+		}
+		return info, nil
+	}
+	if body.Exceeded {
+		return imageInfo{}, &imageTooLargeError{Limit: body.Limit}
+	}
+	if coded := (*codedError)(nil); errors.As(err, &coded) {
+		// The decoder recognised the image but rejected it for a specific reason
+		return imageInfo{}, err
+	}
+	if readErr := bodyReadError(ctx, body); readErr != nil {
+		return imageInfo{}, readErr
+	}
+	if errors.Is(err, image.ErrFormat) {
+		// No registered format recognised the magic bytes
+		detected := http.DetectContentType(head)
+		return imageInfo{}, &codedError{Code: codeUnsupportedFormat, Err: fmt.Errorf("unsupported image format: detected %s", detected)}
+	}
+
+	// Fall back to a full decode for formats whose header could not be parsed
+	// on its own
+	img, format, decodeErr := image.Decode(io.MultiReader(&header, src))
+	if body.Exceeded {
+		return imageInfo{}, &imageTooLargeError{Limit: body.Limit}
+	}
+	if readErr := bodyReadError(ctx, body); readErr != nil {
+		return imageInfo{}, readErr
+	}
+	if decodeErr != nil {
+		return imageInfo{}, &codedError{Code: codeCorruptImage, Err: fmt.Errorf("corrupt %s image: %v", format, decodeErr)}
+	}
+
+	bounds := img.Bounds()
+	info.Width = bounds.Max.X - bounds.Min.X
+	info.Height = bounds.Max.Y - bounds.Min.Y
+	info.Format = format
+
+	return info, nil
+}
+
+// bodyReadError returns a decode_failed error if reading body failed while
+// its image was being decoded, since whether the image is corrupt can't be
+// told then. The read error is wrapped so that network errors are retried.
+// Timeouts and cancellations are returned as they are, so they are reported
+// as such.
+func bodyReadError(ctx context.Context, body *sizeLimitedReader) error {
+	if body.Err == nil {
+		return nil
+	}
+	var netErr net.Error
+	if ctx.Err() != nil || errors.As(body.Err, &netErr) && netErr.Timeout() {
+		return body.Err
+	}
+	return &codedError{Code: codeDecodeFailed, Err: fmt.Errorf("error decoding image: reading the body failed: %w", body.Err)}
+}
+
+// downloadFunc downloads an image and returns what it learned about it
+type downloadFunc func(ctx context.Context, url string) (imageInfo, error)
+
+func (s *Server) calculateImagePerimeter(ctx context.Context, store Store, imageURL string, download downloadFunc) (result ImageResult, err error) {
+	storeID := store.StoreID
+	ctx, span := s.tracer.Start(ctx, "image", spanKindInternal)
+	defer span.End()
+	defer func() {
+		if panicErr := s.recoverImagePanic(ctx, imageURL, recover()); panicErr != nil {
+			result, err = ImageResult{}, panicErr
+			span.SetAttr("imgproc.outcome", codeInternalPanic)
+			span.SetError(err)
+		}
+	}()
+	span.SetAttr("imgproc.store_id", storeID)
+	if u, err := url.Parse(imageURL); err == nil {
+		span.SetAttr("server.address", u.Host)
+	}
+
+	logger := s.logger(ctx)
+	info, err := download(ctx, imageURL)
+	if err != nil {
+		logger.Debug("image failed", "store_id", storeID, "image_url", imageURL, "error", err)
+		span.SetAttr("imgproc.outcome", errorCode(err))
+		span.SetError(err)
+		return ImageResult{}, err
+	}
+	span.SetAttr("imgproc.image.format", info.Format)
+
+	if err := s.simulateProcessingDelay(ctx); err != nil {
+		span.SetAttr("imgproc.outcome", errorCode(err))
+		span.SetError(err)
+		return ImageResult{}, err
+	}
+	span.SetAttr("imgproc.outcome", "success")
+
+	result = imageResult(store, imageURL, info)
+	logger.Debug("image processed", "store_id", storeID, "image_url", imageURL, "width", info.Width, "height", info.Height, "format", info.Format)
+	return result, nil
+}
+
+// imageResult builds the result of an image of the store from what
+// downloading it revealed
+func imageResult(store Store, imageURL string, info imageInfo) ImageResult {
+	// Images stored on their side are reported the way up they are
+	// displayed
+	width, height := info.Width, info.Height
+	dpiX, dpiY := info.DPIX, info.DPIY
+	if transposed(info.Orientation) {
+		width, height = height, width
+		dpiX, dpiY = dpiY, dpiX
+	}
+	result := ImageResult{
+		StoreID:    store.StoreID,
+		StoreName:  store.StoreName,
+		AreaCode:   store.AreaCode,
+		ImageURL:   imageURL,
+		Width:      width,
+		Height:     height,
+		Perimeter:  2.0 * float64(width+height),
+		Area:       width * height,
+		Megapixels: roundTo(float64(width*height)/1e6, 3),
+		Format:     info.Format,
+		Pages:      info.Pages,
+		EXIF:       info.EXIF,
+		SHA256:     info.SHA256,
+		PHash:      info.PHash,
+
+		BlankSuspect: info.BlankSuspect,
+
+		ContentType:         info.ContentType,
+		ContentTypeMismatch: contentTypeMismatch(info.ContentType, info.Format),
+
+		DownloadMS: durationMS(info.DownloadTime),
+		DecodeMS:   durationMS(info.DecodeTime),
+		Attempts:   info.Attempts,
+		Bytes:      info.Bytes,
+
+		ContentLength: info.ContentLength,
+		Truncated:     info.Truncated,
+
+		FinalURL:  info.FinalURL,
+		Redirects: info.Redirects,
+	}
+
+	if info.Orientation != 0 {
+		result.Orientation, result.RawWidth, result.RawHeight = info.Orientation, info.Width, info.Height
+	}
+	if dpiX > 0 && dpiY > 0 {
+		widthCM := float64(width) / dpiX * cmPerInch
+		heightCM := float64(height) / dpiY * cmPerInch
+		result.DPIX, result.DPIY = roundTo(dpiX, 2), roundTo(dpiY, 2)
+		result.PhysicalWidthCM = roundTo(widthCM, 2)
+		result.PhysicalHeightCM = roundTo(heightCM, 2)
+		result.PhysicalPerimeterCM = roundTo(2*(widthCM+heightCM), 2)
+	}
+
+	// An aspect ratio is undefined without a height, and Inf/NaN can't be
+	// encoded as JSON
+	if height > 0 {
+		result.AspectRatio = roundTo(float64(width)/float64(height), 3)
+	} else {
+		result.Warnings = append(result.Warnings, warningZeroHeight)
+	}
+	if info.PixelsUnsupported {
+		result.Warnings = append(result.Warnings, warningPixelsUnsupported)
+	}
+	if info.PixelsTooLarge {
+		result.Warnings = append(result.Warnings, warningPixelsTooLarge)
+	}
+	result.Violations = store.violations(width, height)
+	return result
+}
+
+// formatMediaTypes lists the media types a server may report for each image
+// format
+var formatMediaTypes = map[string][]string{
+	"jpeg": {"image/jpeg", "image/jpg", "image/pjpeg"},
+	"png":  {"image/png", "image/x-png"},
+	"gif":  {"image/gif"},
+	"bmp":  {"image/bmp", "image/x-bmp", "image/x-ms-bmp"},
+	"svg":  {"image/svg+xml"},
+}
+
+// contentTypeMismatch reports whether the Content-Type a server reported
+// contradicts the format the image decoded as. Missing and generic binary
+// content types make no claim about the format, so they never mismatch.
+func contentTypeMismatch(contentType, format string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return false
+	}
+	expected, ok := formatMediaTypes[format]
+	if !ok {
+		return mediaType != "image/"+format
+	}
+	return !slices.Contains(expected, mediaType)
+}
+
+// simulateProcessingDelay sleeps for a random time between the configured
+// minimum and maximum processing delays, to mimic GPU processing in demo
+// environments. It does nothing unless the delay is enabled, and returns
+// early with ctx's error if ctx is done first.
+func (s *Server) simulateProcessingDelay(ctx context.Context) error {
+	if !s.cfg.SimulateProcessingDelay {
+		return nil
+	}
+
+	delay := s.cfg.ProcessingDelayMin
+	if spread := s.cfg.ProcessingDelayMax - s.cfg.ProcessingDelayMin; spread > 0 {
+		delay += time.Duration(rand.Int63n(int64(spread) + 1))
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// roundTo rounds f to the given number of decimal places
+func roundTo(f float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(f*scale) / scale
+}
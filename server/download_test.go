@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// serveBytes serves each of files at its path until the test ends
+func serveBytes(t *testing.T, files map[string][]byte) *httptest.Server {
+	t.Helper()
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(host.Close)
+	return host
+}
+
+// encodeImage encodes a width by height image with encode
+func encodeImage(t *testing.T, width, height int, encode func(*bytes.Buffer, image.Image) error) []byte {
+	t.Helper()
+	img := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.Black, color.White})
+	var buf bytes.Buffer
+	if err := encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// runImages runs a job for urls, in a single visit, and returns its results
+// and errors by image URL
+func runImages(t *testing.T, s *Server, urls ...string) (map[string]ImageResult, map[string]StoreError) {
+	t.Helper()
+	jobID := submitJob(t, s, SubmitJobRequest{Count: 1, Visits: []Visit{{StoreID: "S00339218", ImageURLs: urls}}})
+	status := waitForJob(t, s, jobID)
+	results := make(map[string]ImageResult)
+	for _, result := range jobResults(t, s, jobID).Results {
+		results[result.ImageURL] = result
+	}
+	errs := make(map[string]StoreError)
+	for _, storeErr := range status.Errors {
+		errs[storeErr.ImageURL] = storeErr
+	}
+	return results, errs
+}
+
+func TestDecodeImageDimensions(t *testing.T) {
+	host := serveBytes(t, map[string][]byte{
+		"/a.png": encodeImage(t, 40, 30, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) }),
+		"/a.jpg": encodeImage(t, 17, 9, func(w *bytes.Buffer, img image.Image) error { return jpeg.Encode(w, img, nil) }),
+		"/a.gif": encodeImage(t, 5, 64, func(w *bytes.Buffer, img image.Image) error { return gif.Encode(w, img, nil) }),
+	})
+	s := newTestServer(t, nil)
+
+	tests := []struct {
+		path          string
+		width, height int
+		format        string
+	}{
+		{"/a.png", 40, 30, "png"},
+		{"/a.jpg", 17, 9, "jpeg"},
+		{"/a.gif", 5, 64, "gif"},
+	}
+	var urls []string
+	for _, tt := range tests {
+		urls = append(urls, host.URL+tt.path)
+	}
+	results, errs := runImages(t, s, urls...)
+	for _, tt := range tests {
+		result, ok := results[host.URL+tt.path]
+		if !ok {
+			t.Errorf("%s: no result, error %+v", tt.path, errs[host.URL+tt.path])
+			continue
+		}
+		if result.Width != tt.width || result.Height != tt.height || result.Format != tt.format {
+			t.Errorf("%s = %dx%d %s, want %dx%d %s", tt.path, result.Width, result.Height, result.Format, tt.width, tt.height, tt.format)
+		}
+	}
+}
+
+func TestDecodeImageReadsOnlyHeader(t *testing.T) {
+	// A 12 megapixel PNG, whose pixels would take 12 MB to decode. Only its
+	// header is decoded, and the rest of the body is only hashed.
+	data := encodeImage(t, 4000, 3000, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) })
+	s := &Server{cfg: DefaultConfig()}
+	body := &sizeLimitedReader{R: bytes.NewReader(data), Limit: int64(len(data))}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	info, err := s.decodeImage(t.Context(), body, "image/png")
+	runtime.ReadMemStats(&after)
+	if err != nil || info.Width != 4000 || info.Height != 3000 {
+		t.Fatalf("decodeImage() = %dx%d, %v, want 4000x3000", info.Width, info.Height, err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4<<20 {
+		t.Errorf("decodeImage allocated %d bytes, want a header-only decode", allocated)
+	}
+}
+
+func TestDecodeImageHeaderErrors(t *testing.T) {
+	valid := encodeImage(t, 40, 30, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) })
+	// The PNG signature followed by an IHDR chunk whose checksum is wrong
+	badHeader := bytes.Clone(valid)
+	badHeader[29] ^= 0xff
+	host := serveBytes(t, map[string][]byte{
+		"/text.png":   []byte("this is not an image, just some text that is long enough to sniff"),
+		"/header.png": badHeader,
+	})
+	s := newTestServer(t, nil)
+
+	_, errs := runImages(t, s, host.URL+"/text.png", host.URL+"/header.png")
+	if got := errs[host.URL+"/text.png"].Code; got != codeUnsupportedFormat {
+		t.Errorf("text code = %q, want %q", got, codeUnsupportedFormat)
+	}
+	if got := errs[host.URL+"/header.png"].Code; got != codeCorruptImage {
+		t.Errorf("corrupt header code = %q, want %q", got, codeCorruptImage)
+	}
+}
+
+func TestDecodeImageCorrupt(t *testing.T) {
+	shelf, err := os.ReadFile(filepath.Join("testdata", "shelf.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Seeded, so the bytes can't start with some format's magic by chance
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := make([]byte, 4096)
+	for i := range random {
+		random[i] = byte(rng.Uint32())
+	}
+	host := serveBytes(t, map[string][]byte{
+		// Cut off before the frame header, so the dimensions are missing
+		"/truncated.jpg": shelf[:100],
+		"/random.jpg":    random,
+	})
+	s := newTestServer(t, nil)
+
+	_, errs := runImages(t, s, host.URL+"/truncated.jpg", host.URL+"/random.jpg")
+	if got := errs[host.URL+"/truncated.jpg"]; got.Code != codeCorruptImage || !strings.Contains(got.Error, "corrupt jpeg image") {
+		t.Errorf("truncated JPEG error = %s %q, want %s", got.Code, got.Error, codeCorruptImage)
+	}
+	if got := errs[host.URL+"/random.jpg"]; got.Code != codeUnsupportedFormat || !strings.Contains(got.Error, "detected application/octet-stream") {
+		t.Errorf("random bytes error = %s %q, want %s with the detected type", got.Code, got.Error, codeUnsupportedFormat)
+	}
+}
+
+func TestImageResultJSON(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		want          map[string]any
+		warnings      []any
+	}{
+		{"landscape", 1920, 1080, map[string]any{"area": 2073600.0, "perimeter": 6000.0, "aspect_ratio": 1.778, "megapixels": 2.074}, nil},
+		{"portrait", 3, 7, map[string]any{"area": 21.0, "aspect_ratio": 0.429, "megapixels": 0.0}, nil},
+		{"thirds", 1000, 3, map[string]any{"aspect_ratio": 333.333, "megapixels": 0.003}, nil},
+		// The aspect ratio is undefined, and JSON can't hold Inf or NaN
+		{"zero height", 640, 0, map[string]any{"area": 0.0, "aspect_ratio": 0.0, "megapixels": 0.0}, []any{warningZeroHeight}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := imageResult(Store{StoreID: "S00339218"}, "http://127.0.0.1/a.jpg", imageInfo{Width: tt.width, Height: tt.height, Format: "jpeg"})
+			data, err := json.Marshal(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]any
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				if got, ok := fields[name]; !ok || got != want {
+					t.Errorf("%s = %v, want %v", name, got, want)
+				}
+			}
+			if got, _ := fields["warnings"].([]any); !slices.Equal(got, tt.warnings) {
+				t.Errorf("warnings = %v, want %v", got, tt.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// redactedHeaderValue replaces download header values wherever they are
+// stored or logged
+const redactedHeaderValue = "[REDACTED]"
+
+// deniedDownloadHeaders can't be set with download_headers, since they
+// describe the request itself or the connection it is sent on
+var deniedDownloadHeaders = []string{
+	"Host",
+	"Content-Length",
+	"Transfer-Encoding",
+	"Connection",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// DownloadHeaders are extra headers sent with each image download, such as
+// an Authorization header for an image host that requires one. Their values
+// are secrets, so they are redacted whenever they are encoded as JSON, which
+// is how jobs are persisted and archived, or logged. Only the job's own
+// memory ever holds them in plaintext.
+type DownloadHeaders map[string]string
+
+// MarshalJSON encodes the headers with their values redacted
+func (h DownloadHeaders) MarshalJSON() ([]byte, error) {
+	if h == nil {
+		return []byte("null"), nil
+	}
+	redacted := make(map[string]string, len(h))
+	for name := range h {
+		redacted[name] = redactedHeaderValue
+	}
+	return json.Marshal(redacted)
+}
+
+// LogValue logs the header names only
+func (h DownloadHeaders) LogValue() slog.Value {
+	return slog.StringValue(strings.Join(slices.Sorted(maps.Keys(h)), ","))
+}
+
+// redacted reports whether the headers' values were lost to redaction, as
+// they are for jobs restored from the job store
+func (h DownloadHeaders) redacted() bool {
+	for _, value := range h {
+		if value == redactedHeaderValue {
+			return true
+		}
+	}
+	return false
+}
+
+// merge returns the headers with the overrides applied on top, matching
+// names case-insensitively
+func (h DownloadHeaders) merge(overrides DownloadHeaders) DownloadHeaders {
+	if len(overrides) == 0 {
+		return h
+	}
+	merged := make(DownloadHeaders, len(h)+len(overrides))
+	for name, value := range h {
+		merged[http.CanonicalHeaderKey(name)] = value
+	}
+	for name, value := range overrides {
+		merged[http.CanonicalHeaderKey(name)] = value
+	}
+	return merged
+}
+
+// fingerprint identifies the headers without revealing them, so downloads
+// with different headers are never mistaken for one another. It is empty
+// when there are no headers.
+func (h DownloadHeaders) fingerprint() string {
+	if len(h) == 0 {
+		return ""
+	}
+	hash := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		fmt.Fprintf(hash, "%s\x00%s\x00", http.CanonicalHeaderKey(name), h[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// validateDownloadHeaders adds an error to errs for each header that isn't a
+// valid header or may not be overridden, reported under field
+func validateDownloadHeaders(errs *fieldErrors, field string, headers DownloadHeaders) {
+	for _, name := range slices.Sorted(maps.Keys(headers)) {
+		path := fmt.Sprintf("%s[%q]", field, name)
+		switch {
+		case !validHeaderName(name):
+			errs.add(path, "invalid header name")
+		case slices.Contains(deniedDownloadHeaders, http.CanonicalHeaderKey(name)):
+			errs.add(path, "header can't be overridden")
+		case strings.ContainsFunc(headers[name], func(r rune) bool { return r < ' ' && r != '\t' || r == 0x7f }):
+			// The value isn't echoed back, since it is likely a secret
+			errs.add(path, "invalid header value: must not contain control characters")
+		}
+	}
+}
+
+// validHeaderName reports whether name is an RFC 7230 token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// downloadHeadersKey is the context key for a download's extra headers
+type downloadHeadersKey struct{}
+
+// withDownloadHeaders returns a context whose downloads send headers
+func withDownloadHeaders(ctx context.Context, headers DownloadHeaders) context.Context {
+	if len(headers) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, downloadHeadersKey{}, headers)
+}
+
+// downloadHeaders returns the extra headers downloads made with ctx send
+func downloadHeaders(ctx context.Context) DownloadHeaders {
+	headers, _ := ctx.Value(downloadHeadersKey{}).(DownloadHeaders)
+	return headers
+}
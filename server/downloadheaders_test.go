@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// headerRecorder is an image host that serves a tiny PNG for every path and
+// records the headers of the last request for each
+type headerRecorder struct {
+	image []byte
+
+	mu      sync.Mutex
+	headers map[string]http.Header
+}
+
+func newHeaderRecorder(t *testing.T) (*headerRecorder, *httptest.Server) {
+	t.Helper()
+	rec := &headerRecorder{image: tinyPNG(t), headers: make(map[string]http.Header)}
+	host := httptest.NewServer(rec)
+	t.Cleanup(host.Close)
+	return rec, host
+}
+
+func (h *headerRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.headers[r.URL.Path] = r.Header.Clone()
+	h.mu.Unlock()
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(h.image)
+}
+
+// header returns the headers of the last request for path
+func (h *headerRecorder) header(path string) http.Header {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.headers[path]
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	recorder, host := newHeaderRecorder(t)
+	s := newTestServer(t, nil)
+
+	// Raw JSON, since DownloadHeaders are redacted when they are encoded.
+	// A visit's headers override the job's, whatever their case.
+	body := fmt.Sprintf(`{
+		"count": 2,
+		"visits": [
+			{"store_id": "S00339218", "image_url": [%q]},
+			{"store_id": "S01408764", "image_url": [%q], "download_headers": {"authorization": "Bearer visit", "X-Visit": "1"}}
+		],
+		"download_headers": {"Authorization": "Bearer job", "X-Tenant": "acme"}
+	}`, host.URL+"/a.png", host.URL+"/b.png")
+	var resp JobResponse
+	if rec := doRaw(t, s, "POST", "/api/submit", strings.NewReader(body), &resp); rec.Code != http.StatusCreated {
+		t.Fatalf("submitting the job: %d %s", rec.Code, rec.Body.String())
+	}
+	jobID := resp.JobID
+	if status := waitForJob(t, s, jobID); status.Status != statusCompleted {
+		t.Fatalf("status = %s with errors %+v, want %s", status.Status, status.Errors, statusCompleted)
+	}
+
+	tests := []struct {
+		path string
+		want map[string]string
+	}{
+		{"/a.png", map[string]string{"Authorization": "Bearer job", "X-Tenant": "acme", "X-Visit": ""}},
+		{"/b.png", map[string]string{"Authorization": "Bearer visit", "X-Tenant": "acme", "X-Visit": "1"}},
+	}
+	for _, tt := range tests {
+		header := recorder.header(tt.path)
+		for name, want := range tt.want {
+			if got := header.Get(name); got != want {
+				t.Errorf("%s %s = %q, want %q", tt.path, name, got, want)
+			}
+		}
+	}
+
+	// The values are secrets, so the stored request doesn't hold them
+	rec := doRaw(t, s, "GET", "/api/jobs/"+jobID+"/request", nil, nil)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "Bearer") || !strings.Contains(rec.Body.String(), redactedHeaderValue) {
+		t.Errorf("GET request: %d %s, want the header values redacted", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDownloadHeadersDenied(t *testing.T) {
+	s := newTestServer(t, nil)
+	for _, name := range []string{"Host", "host", "Content-Length", "Transfer-Encoding", "Connection", "Bad Name"} {
+		t.Run(name, func(t *testing.T) {
+			var resp ErrorResponse
+			rec := doJSON(t, s, "POST", "/api/submit", SubmitJobRequest{
+				Count:  1,
+				Visits: []Visit{{StoreID: "S00339218", ImageURLs: []string{"http://127.0.0.1/a.jpg"}, DownloadHeaders: DownloadHeaders{name: "x"}}},
+			}, &resp)
+			want := `visits[0].download_headers["` + name + `"]`
+			if rec.Code != http.StatusUnprocessableEntity || len(resp.Fields) != 1 || resp.Fields[0].Field != want {
+				t.Errorf("got %d %s, want 422 for %s", rec.Code, rec.Body.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// proxyEnvVars name the proxies http.ProxyFromEnvironment uses
+var proxyEnvVars = []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"}
+
+// loadCABundle returns the system's trusted CAs with those in the PEM file
+// at path added
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no PEM certificates found")
+	}
+	return pool, nil
+}
+
+// downloadTLSConfig returns the TLS configuration for image downloads, or
+// nil for the default one
+func downloadTLSConfig(cfg Config) *tls.Config {
+	if cfg.DownloadCAFile == "" && !cfg.DownloadInsecureSkipVerify {
+		return nil
+	}
+	config := &tls.Config{InsecureSkipVerify: cfg.DownloadInsecureSkipVerify}
+	if cfg.DownloadCAFile != "" {
+		// Validated with the rest of the configuration
+		config.RootCAs, _ = loadCABundle(cfg.DownloadCAFile)
+	}
+	return config
+}
+
+// proxyAddrs returns the host:port addresses of the proxies named by the
+// environment
+func proxyAddrs() map[string]bool {
+	addrs := make(map[string]bool)
+	for _, name := range proxyEnvVars {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		// http.ProxyFromEnvironment takes proxies without a scheme as http
+		if !strings.Contains(value, "://") {
+			value = "http://" + value
+		}
+		u, err := url.Parse(value)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"https": "443", "socks5": "1080"}[u.Scheme]
+		}
+		if port == "" {
+			port = "80"
+		}
+		addrs[net.JoinHostPort(u.Hostname(), port)] = true
+	}
+	return addrs
+}
+
+// useProxy sends the transport's requests through the proxy named by the
+// HTTPS_PROXY and HTTP_PROXY environment variables, except for hosts in
+// NO_PROXY. The proxy is usually internal itself, so connections to it skip
+// the guard, which checks the addresses the image host resolves to instead.
+func useProxy(transport *http.Transport, guard *destinationGuard) {
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := http.ProxyFromEnvironment(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+		if err := guard.CheckHost(req.Context(), req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+		return proxyURL, nil
+	}
+
+	proxies := proxyAddrs()
+	guarded := transport.DialContext
+	direct := (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if proxies[addr] {
+			return direct(ctx, network, addr)
+		}
+		return guarded(ctx, network, addr)
+	}
+}
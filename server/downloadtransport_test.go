@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPrivateCA returns a certificate for 127.0.0.1 issued by a CA generated
+// for the test, and the path of a PEM file holding the CA
+func newPrivateCA(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{leafDER}, PrivateKey: leafKey}, path
+}
+
+func TestDownloadCAFile(t *testing.T) {
+	cert, caFile := newPrivateCA(t)
+	image := tinyPNG(t)
+	host := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(image)
+	}))
+	host.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	host.StartTLS()
+	t.Cleanup(host.Close)
+	imageURL := host.URL + "/a.png"
+
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		wantErr   string
+	}{
+		{"untrusted", nil, "certificate signed by unknown authority"},
+		{"CA file", func(cfg *Config) { cfg.DownloadCAFile = caFile }, ""},
+		{"skip verify", func(cfg *Config) { cfg.DownloadInsecureSkipVerify = true }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.configure)
+			results, errs := runImages(t, s, imageURL)
+			if tt.wantErr == "" {
+				if _, ok := results[imageURL]; !ok {
+					t.Errorf("no result, error %+v", errs[imageURL])
+				}
+				return
+			}
+			if got := errs[imageURL]; got.Code != codeDownloadFailed || !strings.Contains(got.Error, tt.wantErr) {
+				t.Errorf("error = %s %q, want %s mentioning %q", got.Code, got.Error, codeDownloadFailed, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDownloadCAFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{notPEM, filepath.Join(dir, "missing.pem")} {
+		cfg := DefaultConfig()
+		cfg.DownloadCAFile = path
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "invalid download CA file") {
+			t.Errorf("Validate() with CA file %s = %v, want an invalid download CA file error", filepath.Base(path), err)
+		}
+	}
+}
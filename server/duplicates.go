@@ -0,0 +1,55 @@
+package server
+
+import "time"
+
+// defaultDuplicateWindow is how long identical submissions return the
+// existing job when neither the -duplicate-window flag nor
+// IMGPROC_DUPLICATE_WINDOW is set
+const defaultDuplicateWindow = 10 * time.Minute
+
+// recentPayload is a job recently submitted with a given payload hash
+type recentPayload struct {
+	jobID     string
+	createdAt time.Time
+}
+
+// findDuplicate returns the job owner submitted with the same payload hash
+// within the duplicate window, if there is one. Jobs that were cancelled or
+// interrupted will never produce results, so they aren't reused.
+func (s *Server) findDuplicate(owner, hash string) (*JobData, bool) {
+	if s.cfg.DuplicateWindow <= 0 {
+		return nil, false
+	}
+	s.jobsMu.Lock()
+	recent, ok := s.recentPayloads[ownerScoped(owner, hash)]
+	job := s.jobs[recent.jobID]
+	s.jobsMu.Unlock()
+	if !ok || job == nil || time.Since(recent.createdAt) > s.cfg.DuplicateWindow {
+		return nil, false
+	}
+
+	job.mu.Lock()
+	status := job.Status
+	job.mu.Unlock()
+	if status == statusCancelled || status == statusInterrupted {
+		return nil, false
+	}
+	return job, true
+}
+
+// recordPayload indexes a job by its payload hash, and forgets payloads
+// submitted before the duplicate window. Retry jobs have no payload hash, so
+// are never indexed. s.jobsMu must be held.
+func (s *Server) recordPayload(job *JobData) {
+	if s.cfg.DuplicateWindow <= 0 || job.PayloadHash == "" {
+		return
+	}
+	for hash, recent := range s.recentPayloads {
+		if time.Since(recent.createdAt) > s.cfg.DuplicateWindow {
+			delete(s.recentPayloads, hash)
+		}
+	}
+	if time.Since(job.CreatedAt) <= s.cfg.DuplicateWindow {
+		s.recentPayloads[ownerScoped(job.Owner, job.PayloadHash)] = recentPayload{jobID: job.ID, createdAt: job.CreatedAt}
+	}
+}
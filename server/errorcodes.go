@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes reported in the API's error responses, alongside the message
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeUnauthorized         = "unauthorized"
+	codeQuotaExceeded        = "quota_exceeded"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codeJobExpired           = "job_expired"
+	codePayloadTooLarge      = "payload_too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeValidationFailed     = "validation_failed"
+	codeLimitsExceeded       = "limits_exceeded"
+	codeQueueFull            = "queue_full"
+	codeInternalError        = "internal_error"
+	codeUnavailable          = "unavailable"
+	codeStreamOverflow       = "stream_overflow"
+)
+
+// ErrorCodeInfo describes an error code for the error codes endpoint.
+// Status is the HTTP status code an error response with the code has.
+type ErrorCodeInfo struct {
+	Code        string `json:"code"`
+	Status      int    `json:"status,omitempty"`
+	Description string `json:"description"`
+}
+
+// ErrorCodesResponse represents the response for the error codes endpoint:
+// the codes of the errors recorded on jobs, and of the API's error responses
+type ErrorCodesResponse struct {
+	Job     []ErrorCodeInfo `json:"job"`
+	Request []ErrorCodeInfo `json:"request"`
+}
+
+// jobErrorCodes describes the codes reported on a job's errors
+var jobErrorCodes = []ErrorCodeInfo{
+	{Code: codeStoreNotFound, Description: "the visit's store ID does not exist in the store master"},
+	{Code: codeInvalidURL, Description: "the image URL can't be parsed or has no host"},
+	{Code: codeHostNotAllowed, Description: "the image URL, or a redirect it led to, uses a scheme or host that is not allowed"},
+	{Code: codeForbiddenDestination, Description: "the image URL, or a redirect it led to, resolves to an internal address"},
+	{Code: codeDownloadFailed, Description: "the image could not be downloaded"},
+	{Code: codeDownloadTimeout, Description: "downloading the image took longer than the image timeout"},
+	{Code: codeTooManyRedirects, Description: "the image URL redirected more times than the redirect limit allows"},
+	{Code: codeTruncatedDownload, Description: "the image's body kept ending before its declared Content-Length, and what arrived could not be decoded"},
+	{Code: codeObjectNotFound, Description: "the S3 object or its bucket does not exist"},
+	{Code: codeAccessDenied, Description: "the S3 object could not be read with the server's AWS credentials"},
+	{Code: codeFileNotFound, Description: "the local file does not exist"},
+	{Code: codePermissionDenied, Description: "the local file could not be read with the server's permissions"},
+	{Code: codePathOutsideRoot, Description: "the local file, or a symlink it leads through, is outside the allowed file roots"},
+	{Code: codeRateLimited, Description: "the image host kept responding 429 Too Many Requests"},
+	{Code: codeCircuitOpen, Description: "the image's host has failed repeatedly, so the download was not attempted"},
+	{Code: codeImageTooLarge, Description: "the image exceeds the maximum image size"},
+	{Code: codeChecksumMismatch, Description: "the image's SHA-256 is not the expected_sha256 it was submitted with"},
+	{Code: codeCorruptImage, Description: "the image is in a supported format but could not be decoded"},
+	{Code: codeDecodeFailed, Description: "the image's body could not be read while it was being decoded"},
+	{Code: codeUnsupportedFormat, Description: "the image is not in a supported format"},
+	{Code: codeInvalidArchive, Description: "the ZIP archive is corrupt, exceeds the archive limits, has no images, or the entry is a nested archive"},
+	{Code: codeJobTimedOut, Description: "the job's deadline passed before the image was processed"},
+	{Code: codeJobStalled, Description: "the job stalled before the image was processed"},
+	{Code: codeCancelled, Description: "the job was cancelled before the image was processed"},
+	{Code: codeInternalPanic, Description: "processing the image crashed"},
+}
+
+// requestErrorCodes describes the codes of the API's error responses
+var requestErrorCodes = []ErrorCodeInfo{
+	{Code: codeInvalidRequest, Status: http.StatusBadRequest, Description: "the request is malformed or has an invalid parameter"},
+	{Code: codeUnauthorized, Status: http.StatusUnauthorized, Description: "the API key is missing or invalid"},
+	{Code: codeQuotaExceeded, Status: http.StatusPaymentRequired, Description: "the job would exceed the API key's monthly image quota"},
+	{Code: codeForbidden, Status: http.StatusForbidden, Description: "the API key may not make the request"},
+	{Code: codeNotFound, Status: http.StatusNotFound, Description: "the job, store or endpoint does not exist"},
+	{Code: codeMethodNotAllowed, Status: http.StatusMethodNotAllowed, Description: "the endpoint does not support the method"},
+	{Code: codeConflict, Status: http.StatusConflict, Description: "the job or store is not in a state that allows the request"},
+	{Code: codeJobExpired, Status: http.StatusGone, Description: "the job finished longer ago than the retention period"},
+	{Code: codePayloadTooLarge, Status: http.StatusRequestEntityTooLarge, Description: "the request body is larger than allowed"},
+	{Code: codeUnsupportedMediaType, Status: http.StatusUnsupportedMediaType, Description: "the request body's content encoding, or an uploaded part's content type, is not supported"},
+	{Code: codeValidationFailed, Status: http.StatusUnprocessableEntity, Description: "the request is well formed but its content is invalid"},
+	{Code: codeLimitsExceeded, Status: http.StatusUnprocessableEntity, Description: "the job has more visits or images than allowed"},
+	{Code: codeRateLimited, Status: http.StatusTooManyRequests, Description: "the client submitted too many jobs, and should retry after Retry-After"},
+	{Code: codeQueueFull, Status: http.StatusTooManyRequests, Description: "the job queue is full, and the job should be submitted again after Retry-After"},
+	{Code: codeInternalError, Status: http.StatusInternalServerError, Description: "the server failed to handle the request"},
+	{Code: codeUnavailable, Status: http.StatusServiceUnavailable, Description: "the server is shutting down"},
+	{Code: codeStreamOverflow, Description: "a progress stream fell too far behind its job, sent as the stream's overflow event"},
+}
+
+// requestErrorCode returns the code of an error response with the given
+// status, for responses that don't set a more specific one
+func requestErrorCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusPaymentRequired:
+		return codeQuotaExceeded
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusGone:
+		return codeJobExpired
+	case http.StatusRequestEntityTooLarge:
+		return codePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return codeUnsupportedMediaType
+	case http.StatusUnprocessableEntity:
+		return codeValidationFailed
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	}
+	if status >= 500 {
+		return codeInternalError
+	}
+	return codeInvalidRequest
+}
+
+// handleErrorCodes handles the error codes endpoint, which lists every error
+// code the API reports
+func (s *Server) handleErrorCodes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ErrorCodesResponse{
+		Job:     jobErrorCodes,
+		Request: requestErrorCodes,
+	})
+}
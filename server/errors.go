@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// Error codes reported on StoreError
+const (
+	codeStoreNotFound        = "store_not_found"
+	codeInvalidURL           = "invalid_url"
+	codeDownloadFailed       = "download_failed"
+	codeDownloadTimeout      = "download_timeout"
+	codeTooManyRedirects     = "too_many_redirects"
+	codeTruncatedDownload    = "truncated_download"
+	codeChecksumMismatch     = "checksum_mismatch"
+	codeObjectNotFound       = "object_not_found"
+	codeAccessDenied         = "access_denied"
+	codeFileNotFound         = "not_found"
+	codePermissionDenied     = "permission_denied"
+	codePathOutsideRoot      = "path_outside_root"
+	codeCorruptImage         = "corrupt_image"
+	codeDecodeFailed         = "decode_failed"
+	codeUnsupportedFormat    = "unsupported_format"
+	codeForbiddenDestination = "forbidden_destination"
+	codeHostNotAllowed       = "host_not_allowed"
+	codeCircuitOpen          = "circuit_open"
+	codeRateLimited          = "rate_limited"
+	codeJobTimedOut          = "job_timed_out"
+	codeJobStalled           = "job_stalled"
+	codeCancelled            = "cancelled"
+	codeImageTooLarge        = "image_too_large"
+	codeInvalidArchive       = "invalid_archive"
+	codeInternalPanic        = "internal_panic"
+)
+
+// errorCodes is the set of error codes, so codes given by clients can be
+// checked
+var errorCodes = func() map[string]bool {
+	codes := make(map[string]bool, len(jobErrorCodes))
+	for _, info := range jobErrorCodes {
+		codes[info.Code] = true
+	}
+	return codes
+}()
+
+// codedError attaches an error code to an error
+type codedError struct {
+	Code string
+	Err  error
+}
+
+func (e *codedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.Err
+}
+
+// errorCode returns the error code for an image processing error. Errors
+// without a more specific code happened while downloading the image.
+func errorCode(err error) string {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	var timeoutErr *downloadTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return codeDownloadTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return codeDownloadTimeout
+	}
+	var forbidden *forbiddenDestinationError
+	if errors.As(err, &forbidden) {
+		return codeForbiddenDestination
+	}
+	if isCircuitOpen(err) {
+		return codeCircuitOpen
+	}
+	var tooLarge *imageTooLargeError
+	if errors.As(err, &tooLarge) {
+		return codeImageTooLarge
+	}
+	var truncatedErr *truncatedDownloadError
+	if errors.As(err, &truncatedErr) {
+		return codeTruncatedDownload
+	}
+	return codeDownloadFailed
+}
@@ -0,0 +1,394 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// EXIF is the camera metadata embedded in a JPEG or TIFF image. Fields the
+// image doesn't carry, or carries in a form that can't be read, are omitted.
+type EXIF struct {
+	// DateTimeOriginal is when the photo was taken, in RFC 3339 form. It has
+	// no time zone unless the camera recorded its offset, since EXIF times
+	// are in the camera's local time.
+	DateTimeOriginal string `json:"date_time_original,omitempty"`
+
+	// GPSLatitude and GPSLongitude are in decimal degrees, negative south of
+	// the equator and west of Greenwich
+	GPSLatitude  *float64 `json:"gps_latitude,omitempty"`
+	GPSLongitude *float64 `json:"gps_longitude,omitempty"`
+
+	Make  string `json:"make,omitempty"`
+	Model string `json:"model,omitempty"`
+
+	// Orientation is the EXIF orientation tag, from 1, upright, to 8
+	Orientation int `json:"orientation,omitempty"`
+}
+
+// JPEG segments are a marker followed, for most markers, by a big-endian
+// length that includes itself. EXIF is an APP1 segment holding a TIFF
+// structure after its identifier.
+const (
+	jpegMarkerSOI  = 0xd8
+	jpegMarkerEOI  = 0xd9
+	jpegMarkerSOS  = 0xda
+	jpegMarkerAPP0 = 0xe0
+	jpegMarkerAPP1 = 0xe1
+	jpegMarkerRST0 = 0xd0
+	jpegMarkerRST7 = 0xd7
+	jpegMarkerTEM  = 0x01
+	exifIdentifier = "Exif\x00\x00"
+)
+
+// EXIF tags and field types, by the IFD they are found in
+const (
+	exifTagMake             = 0x010f
+	exifTagModel            = 0x0110
+	exifTagOrientation      = 0x0112
+	exifTagExifIFD          = 0x8769
+	exifTagGPSIFD           = 0x8825
+	exifTagDateTimeOriginal = 0x9003
+	exifTagOffsetOriginal   = 0x9011
+
+	exifTagGPSLatitudeRef  = 1
+	exifTagGPSLatitude     = 2
+	exifTagGPSLongitudeRef = 3
+	exifTagGPSLongitude    = 4
+
+	tiffTypeByte      = 1
+	tiffTypeASCII     = 2
+	tiffTypeRational  = 5
+	tiffTypeUndefined = 7
+	tiffTypeSLong     = 9
+	tiffTypeSRational = 10
+)
+
+// exifDateTimeLayout is how EXIF records dates and times
+const exifDateTimeLayout = "2006:01:02 15:04:05"
+
+// includeEXIFKey is the context key marking an image's EXIF as wanted
+type includeEXIFKey struct{}
+
+// withEXIF returns a context whose images have their EXIF read
+func withEXIF(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeEXIFKey{}, true)
+}
+
+// includeEXIF reports whether ctx's images have their EXIF read
+func includeEXIF(ctx context.Context) bool {
+	include, _ := ctx.Value(includeEXIFKey{}).(bool)
+	return include
+}
+
+// parseEXIF returns the EXIF in header, the bytes a decoder read to get an
+// image's dimensions, or nil if it has none. JPEG decoders stop at the frame
+// header, which comes after the APP1 segment EXIF is stored in, and TIFF
+// decoders read the whole file, so no more of the image needs to be read.
+// EXIF that is missing or corrupt is never an error: whatever could be read
+// is returned.
+func parseEXIF(header []byte, format string) *EXIF {
+	tiff, ok := exifTIFF(header, format)
+	if !ok {
+		return nil
+	}
+
+	exif := &EXIF{}
+	for _, entry := range tiff.ifd(tiff.firstIFD()) {
+		switch entry.tag {
+		case exifTagMake:
+			exif.Make = entry.string()
+		case exifTagModel:
+			exif.Model = entry.string()
+		case exifTagOrientation:
+			if orientation, ok := entry.uint(0); ok && orientation >= 1 && orientation <= 8 {
+				exif.Orientation = int(orientation)
+			}
+		case exifTagExifIFD:
+			if offset, ok := entry.uint(0); ok {
+				exif.DateTimeOriginal = tiff.dateTimeOriginal(offset)
+			}
+		case exifTagGPSIFD:
+			if offset, ok := entry.uint(0); ok {
+				exif.GPSLatitude, exif.GPSLongitude = tiff.gpsPosition(offset)
+			}
+		}
+	}
+	if *exif == (EXIF{}) {
+		return nil
+	}
+	return exif
+}
+
+// exifOrientation returns the EXIF orientation tag in header, the bytes a
+// decoder read to get an image's dimensions, or 0 if it has none. Unlike the
+// rest of the EXIF it is always read, since it decides which way up the
+// dimensions are, and only the first IFD has to be parsed for it.
+func exifOrientation(header []byte, format string) int {
+	tiff, ok := exifTIFF(header, format)
+	if !ok {
+		return 0
+	}
+	for _, entry := range tiff.ifd(tiff.firstIFD()) {
+		if entry.tag == exifTagOrientation {
+			if orientation, ok := entry.uint(0); ok && orientation >= 1 && orientation <= 8 {
+				return int(orientation)
+			}
+		}
+	}
+	return 0
+}
+
+// transposed reports whether an image with the EXIF orientation tag
+// orientation is stored rotated by 90° or 270°, possibly mirrored, so is
+// displayed with its width and height swapped
+func transposed(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// exifTIFF returns a reader for the TIFF structure holding the EXIF in
+// header: a JPEG's EXIF segment, or a TIFF file itself
+func exifTIFF(header []byte, format string) (*tiffReader, bool) {
+	switch format {
+	case "jpeg":
+		return newTIFFReader(jpegSegment(header, jpegMarkerAPP1, exifIdentifier))
+	case "tiff":
+		return newTIFFReader(header)
+	}
+	return nil, false
+}
+
+// jpegSegment returns what follows identifier in the first segment with the
+// marker want that starts with it, or nil if the segments before the image
+// data hold none
+func jpegSegment(data []byte, want byte, identifier string) []byte {
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegMarkerSOI {
+		return nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return nil
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte before a marker
+			i++
+			continue
+		case marker == jpegMarkerTEM || marker >= jpegMarkerRST0 && marker <= jpegMarkerRST7:
+			// Markers without a length
+			i += 2
+			continue
+		case marker == jpegMarkerSOS || marker == jpegMarkerEOI:
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == want && bytes.HasPrefix(segment, []byte(identifier)) {
+			return segment[len(identifier):]
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+// tiffReader reads the IFDs of a TIFF structure, checking every offset
+// against its bounds
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// tiffEntry is a tag of an IFD. value holds its count values, whether they
+// were stored in the entry itself or elsewhere in the structure.
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+	order binary.ByteOrder
+}
+
+// newTIFFReader returns a reader for data, which must start with a TIFF
+// header
+func newTIFFReader(data []byte) (*tiffReader, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	switch string(data[0:4]) {
+	case tiffLittleEndianHeader:
+		return &tiffReader{data: data, order: binary.LittleEndian}, true
+	case tiffBigEndianHeader:
+		return &tiffReader{data: data, order: binary.BigEndian}, true
+	}
+	return nil, false
+}
+
+// firstIFD returns the offset of the structure's first IFD
+func (t *tiffReader) firstIFD() uint32 {
+	return t.order.Uint32(t.data[4:8])
+}
+
+// ifd returns the entries of the IFD at offset, or nil if it is out of
+// bounds. Entries of unknown types, or whose values are out of bounds, are
+// left out.
+func (t *tiffReader) ifd(offset uint32) []tiffEntry {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	start := int(offset) + 2
+	if start+count*12 > len(t.data) {
+		return nil
+	}
+
+	entries := make([]tiffEntry, 0, count)
+	for i := 0; i < count; i++ {
+		raw := t.data[start+i*12 : start+(i+1)*12]
+		entry := tiffEntry{
+			tag:   t.order.Uint16(raw[0:2]),
+			typ:   t.order.Uint16(raw[2:4]),
+			count: t.order.Uint32(raw[4:8]),
+			order: t.order,
+		}
+		size := uint64(tiffTypeSize(entry.typ)) * uint64(entry.count)
+		switch {
+		case size == 0:
+			continue
+		case size <= 4:
+			entry.value = raw[8 : 8+size]
+		default:
+			valueOffset := uint64(t.order.Uint32(raw[8:12]))
+			if valueOffset+size > uint64(len(t.data)) {
+				continue
+			}
+			entry.value = t.data[valueOffset : valueOffset+size]
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// dateTimeOriginal returns the DateTimeOriginal of the Exif IFD at offset in
+// RFC 3339 form, with its offset if the camera recorded one
+func (t *tiffReader) dateTimeOriginal(offset uint32) string {
+	var dateTime, timeOffset string
+	for _, entry := range t.ifd(offset) {
+		switch entry.tag {
+		case exifTagDateTimeOriginal:
+			dateTime = entry.string()
+		case exifTagOffsetOriginal:
+			timeOffset = entry.string()
+		}
+	}
+	taken, err := time.Parse(exifDateTimeLayout, dateTime)
+	if err != nil {
+		return ""
+	}
+	if zoned, err := time.Parse(exifDateTimeLayout+"-07:00", dateTime+timeOffset); err == nil {
+		return zoned.Format(time.RFC3339)
+	}
+	return taken.Format("2006-01-02T15:04:05")
+}
+
+// gpsPosition returns the latitude and longitude of the GPS IFD at offset,
+// or nil for either that it doesn't hold
+func (t *tiffReader) gpsPosition(offset uint32) (latitude, longitude *float64) {
+	var latRef, lonRef string
+	var lat, lon tiffEntry
+	for _, entry := range t.ifd(offset) {
+		switch entry.tag {
+		case exifTagGPSLatitudeRef:
+			latRef = entry.string()
+		case exifTagGPSLatitude:
+			lat = entry
+		case exifTagGPSLongitudeRef:
+			lonRef = entry.string()
+		case exifTagGPSLongitude:
+			lon = entry
+		}
+	}
+	return gpsCoordinate(lat, latRef, "S", 90), gpsCoordinate(lon, lonRef, "W", 180)
+}
+
+// gpsCoordinate converts a GPS degrees, minutes and seconds entry to decimal
+// degrees, negated when ref is negativeRef. A missing entry, or coordinates
+// beyond limit degrees, return nil.
+func gpsCoordinate(entry tiffEntry, ref, negativeRef string, limit float64) *float64 {
+	if entry.typ != tiffTypeRational || entry.count != 3 {
+		return nil
+	}
+	var degrees float64
+	for i, unit := range []float64{1, 60, 3600} {
+		value, ok := entry.rational(i)
+		if !ok {
+			return nil
+		}
+		degrees += value / unit
+	}
+	if degrees > limit {
+		return nil
+	}
+	if ref == negativeRef {
+		degrees = -degrees
+	}
+	degrees = roundTo(degrees, 7)
+	return &degrees
+}
+
+// tiffTypeSize returns the size of a value of a TIFF field type, or 0 for
+// types EXIF doesn't use
+func tiffTypeSize(typ uint16) int {
+	switch typ {
+	case tiffTypeByte, tiffTypeASCII, tiffTypeUndefined:
+		return 1
+	case tiffTypeShort:
+		return 2
+	case tiffTypeLong, tiffTypeSLong:
+		return 4
+	case tiffTypeRational, tiffTypeSRational:
+		return 8
+	}
+	return 0
+}
+
+// string returns an ASCII entry's value, without its terminating NULs or
+// padding
+func (e tiffEntry) string() string {
+	if e.typ != tiffTypeASCII {
+		return ""
+	}
+	value, _, _ := bytes.Cut(e.value, []byte{0})
+	return strings.TrimSpace(string(value))
+}
+
+// uint returns the i-th value of a SHORT or LONG entry
+func (e tiffEntry) uint(i int) (uint32, bool) {
+	switch {
+	case i >= int(e.count):
+		return 0, false
+	case e.typ == tiffTypeShort:
+		return uint32(e.order.Uint16(e.value[i*2:])), true
+	case e.typ == tiffTypeLong:
+		return e.order.Uint32(e.value[i*4:]), true
+	}
+	return 0, false
+}
+
+// rational returns the i-th value of a RATIONAL entry
+func (e tiffEntry) rational(i int) (float64, bool) {
+	if e.typ != tiffTypeRational || i >= int(e.count) {
+		return 0, false
+	}
+	numerator := e.order.Uint32(e.value[i*8:])
+	denominator := e.order.Uint32(e.value[i*8+4:])
+	if denominator == 0 {
+		return 0, false
+	}
+	return float64(numerator) / float64(denominator), true
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvColumn is a column of the CSV results export
+type csvColumn struct {
+	name  string
+	value func(ImageResult) string
+}
+
+// csvColumns are the columns of the CSV results export, in order. New result
+// fields should be added here so analysts get them too.
+var csvColumns = []csvColumn{
+	{"store_id", func(r ImageResult) string { return r.StoreID }},
+	{"store_name", func(r ImageResult) string { return r.StoreName }},
+	{"area_code", func(r ImageResult) string { return r.AreaCode }},
+	{"image_url", func(r ImageResult) string { return r.ImageURL }},
+	{"width", func(r ImageResult) string { return strconv.Itoa(r.Width) }},
+	{"height", func(r ImageResult) string { return strconv.Itoa(r.Height) }},
+	{"perimeter", func(r ImageResult) string { return formatFloat(r.Perimeter) }},
+	{"area", func(r ImageResult) string { return strconv.Itoa(r.Area) }},
+	{"aspect_ratio", func(r ImageResult) string { return formatFloat(r.AspectRatio) }},
+	{"megapixels", func(r ImageResult) string { return formatFloat(r.Megapixels) }},
+	{"orientation", func(r ImageResult) string { return strconv.Itoa(r.Orientation) }},
+	{"raw_width", func(r ImageResult) string { return strconv.Itoa(r.RawWidth) }},
+	{"raw_height", func(r ImageResult) string { return strconv.Itoa(r.RawHeight) }},
+	{"dpi_x", func(r ImageResult) string { return formatFloat(r.DPIX) }},
+	{"dpi_y", func(r ImageResult) string { return formatFloat(r.DPIY) }},
+	{"physical_width_cm", func(r ImageResult) string { return formatFloat(r.PhysicalWidthCM) }},
+	{"physical_height_cm", func(r ImageResult) string { return formatFloat(r.PhysicalHeightCM) }},
+	{"physical_perimeter_cm", func(r ImageResult) string { return formatFloat(r.PhysicalPerimeterCM) }},
+	{"format", func(r ImageResult) string { return r.Format }},
+	{"pages", func(r ImageResult) string { return strconv.Itoa(r.Pages) }},
+	{"sha256", func(r ImageResult) string { return r.SHA256 }},
+	{"phash", func(r ImageResult) string { return r.PHash }},
+	{"blank_suspect", func(r ImageResult) string { return strconv.FormatBool(r.BlankSuspect) }},
+	{"content_type", func(r ImageResult) string { return r.ContentType }},
+	{"content_type_mismatch", func(r ImageResult) string { return strconv.FormatBool(r.ContentTypeMismatch) }},
+	{"warnings", func(r ImageResult) string { return strings.Join(r.Warnings, ";") }},
+	{"violations", func(r ImageResult) string { return strings.Join(r.Violations, ";") }},
+	{"download_ms", func(r ImageResult) string { return formatFloat(r.DownloadMS) }},
+	{"decode_ms", func(r ImageResult) string { return formatFloat(r.DecodeMS) }},
+	{"attempts", func(r ImageResult) string { return strconv.Itoa(r.Attempts) }},
+	{"bytes", func(r ImageResult) string { return strconv.FormatInt(r.Bytes, 10) }},
+	{"content_length", func(r ImageResult) string { return strconv.FormatInt(r.ContentLength, 10) }},
+	{"truncated", func(r ImageResult) string { return strconv.FormatBool(r.Truncated) }},
+	{"final_url", func(r ImageResult) string { return r.FinalURL }},
+	{"redirects", func(r ImageResult) string { return strconv.Itoa(r.Redirects) }},
+	{"exif_date_time_original", func(r ImageResult) string { return r.exif().DateTimeOriginal }},
+	{"exif_gps_latitude", func(r ImageResult) string { return formatOptionalFloat(r.exif().GPSLatitude) }},
+	{"exif_gps_longitude", func(r ImageResult) string { return formatOptionalFloat(r.exif().GPSLongitude) }},
+	{"exif_make", func(r ImageResult) string { return r.exif().Make }},
+	{"exif_model", func(r ImageResult) string { return r.exif().Model }},
+	{"exif_orientation", func(r ImageResult) string { return strconv.Itoa(r.exif().Orientation) }},
+	{"visit", func(r ImageResult) string { return strconv.Itoa(r.Visit) }},
+	{"image", func(r ImageResult) string { return strconv.Itoa(r.Image) }},
+	{"visit_time", func(r ImageResult) string { return formatTime(r.VisitTime) }},
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// formatTime formats t as RFC 3339, or as an empty string if it is zero
+// formatOptionalFloat formats f, or returns "" if it is nil
+func formatOptionalFloat(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return formatFloat(*f)
+}
+
+// exif returns the result's EXIF, or an empty one if it has none
+func (r ImageResult) exif() EXIF {
+	if r.EXIF == nil {
+		return EXIF{}
+	}
+	return *r.EXIF
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// exportChunk is how many results are copied from the job, written and
+// flushed at a time by the exports, so large exports reach the client as they
+// are written without holding the job's mutex throughout
+const exportChunk = 500
+
+// resultChunks returns up to n of the results being exported, starting at
+// index start
+type resultChunks func(start, n int) []ImageResult
+
+// exportJob looks up the job for an export request, writing an error
+// response and returning false if its results can't be exported yet. Results
+// are available under the same conditions as the results endpoint, except
+// that failed jobs can be exported too.
+//
+// A finished job's results are read from it a chunk at a time. Those of a
+// job still running can move as new results are inserted in submission
+// order, so a partial export copies them up front instead.
+func (s *Server) exportJob(w http.ResponseWriter, r *http.Request) (resultChunks, JobSnapshot, bool) {
+	partial, err := queryBool(r.URL.Query().Get("partial"), false)
+	if err != nil {
+		responseError(w, http.StatusBadRequest, "invalid partial: must be true or false")
+		return nil, JobSnapshot{}, false
+	}
+
+	job, ok := s.lookupJob(w, r)
+	if !ok {
+		return nil, JobSnapshot{}, false
+	}
+
+	snap := job.Snapshot()
+	if resultsFinal(snap.Status) {
+		return job.resultsFrom, snap, true
+	}
+	if !partial {
+		responseJobError(w, http.StatusConflict, fmt.Sprintf("job is %s, results are only available once it has finished", snap.Status), snap.ID)
+		return nil, JobSnapshot{}, false
+	}
+	snap, results := job.SnapshotWithResults()
+	return func(start, n int) []ImageResult {
+		return results[start:min(start+n, len(results))]
+	}, snap, true
+}
+
+// handleJobResultsCSV handles the CSV results export endpoint. Only
+// successful results are exported, and the X-Error-Count header reports how
+// many errors the job has.
+func (s *Server) handleJobResultsCSV(w http.ResponseWriter, r *http.Request) {
+	results, snap, ok := s.exportJob(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="job_%s_results.csv"`, snap.ID))
+	w.Header().Set("X-Error-Count", strconv.Itoa(len(snap.Errors)))
+
+	out := csv.NewWriter(w)
+	record := make([]string, len(csvColumns))
+	for i, column := range csvColumns {
+		record[i] = column.name
+	}
+	out.Write(record)
+
+	// Only the results the job had when the export began are exported
+	for start := 0; start < snap.ResultCount; start += exportChunk {
+		for _, result := range results(start, min(exportChunk, snap.ResultCount-start)) {
+			for i, column := range csvColumns {
+				record[i] = column.value(result)
+			}
+			out.Write(record)
+		}
+		if out.Flush(); out.Error() != nil {
+			// The client has gone away
+			return
+		}
+	}
+}
+
+// ndjsonResult and ndjsonError are the lines of an NDJSON export that
+// includes errors, told apart by their type
+type ndjsonResult struct {
+	Type string `json:"type"`
+	ImageResult
+}
+
+type ndjsonError struct {
+	Type string `json:"type"`
+	StoreError
+}
+
+// handleJobResultsNDJSON handles the NDJSON results export endpoint, which
+// writes a JSON object per line for each result. With errors=true, the job's
+// errors follow its results, and each line has a type of "result" or "error".
+func (s *Server) handleJobResultsNDJSON(w http.ResponseWriter, r *http.Request) {
+	withErrors, err := queryBool(r.URL.Query().Get("errors"), false)
+	if err != nil {
+		responseError(w, http.StatusBadRequest, "invalid errors: must be true or false")
+		return
+	}
+
+	results, snap, ok := s.exportJob(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="job_%s_results.ndjson"`, snap.ID))
+	w.Header().Set("X-Error-Count", strconv.Itoa(len(snap.Errors)))
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	// Only the results and errors the job had when the export began are
+	// exported
+	for start := 0; start < snap.ResultCount; start += exportChunk {
+		for _, result := range results(start, min(exportChunk, snap.ResultCount-start)) {
+			if withErrors {
+				err = enc.Encode(ndjsonResult{Type: "result", ImageResult: result})
+			} else {
+				err = enc.Encode(result)
+			}
+			if err != nil {
+				// The client has gone away
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if !withErrors {
+		return
+	}
+	for start := 0; start < len(snap.Errors); start += exportChunk {
+		for _, storeErr := range snap.Errors[start:min(start+exportChunk, len(snap.Errors))] {
+			if err := enc.Encode(ndjsonError{Type: "error", StoreError: storeErr}); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileURLScheme starts the image URLs of local files, which are only read
+// when -allow-file-urls is set and they are inside one of the -file-roots
+const fileURLScheme = "file:"
+
+// isFileURL reports whether imageURL is a file: URL
+func isFileURL(imageURL string) bool {
+	return len(imageURL) >= len(fileURLScheme) && strings.EqualFold(imageURL[:len(fileURLScheme)], fileURLScheme)
+}
+
+// withinRoot reports whether the clean absolute path is root or inside it
+func withinRoot(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// filePath returns the cleaned path of a file: URL and the allowed root it
+// is inside. Only the path itself is checked, not where its symlinks lead.
+func (s *Server) filePath(imageURL string) (path, root string, err error) {
+	if !s.cfg.AllowFileURLs {
+		return "", "", &codedError{Code: codeHostNotAllowed, Err: errors.New("file URLs are not enabled")}
+	}
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return "", "", &codedError{Code: codeInvalidURL, Err: fmt.Errorf("invalid image URL: %v", err)}
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", "", &codedError{Code: codeInvalidURL, Err: fmt.Errorf("invalid file URL: host %s is not local", u.Host)}
+	}
+	path = filepath.Clean(u.Path)
+	if !filepath.IsAbs(path) {
+		return "", "", &codedError{Code: codeInvalidURL, Err: errors.New("invalid file URL: path must be absolute")}
+	}
+	for _, allowed := range s.cfg.FileRoots {
+		allowed = filepath.Clean(allowed)
+		// The innermost root wins, in case roots are nested
+		if withinRoot(allowed, path) && len(allowed) > len(root) {
+			root = allowed
+		}
+	}
+	if root == "" {
+		return "", "", &codedError{Code: codePathOutsideRoot, Err: fmt.Errorf("%s is not inside an allowed root", path)}
+	}
+	return path, root, nil
+}
+
+// fileError returns the error for a file that couldn't be read
+func fileError(path string, err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return &codedError{Code: codeFileNotFound, Err: fmt.Errorf("file not found: %s", path)}
+	case errors.Is(err, fs.ErrPermission):
+		return &codedError{Code: codePermissionDenied, Err: fmt.Errorf("permission denied reading %s", path)}
+	}
+	return fmt.Errorf("error reading image: %w", err)
+}
+
+// openFile opens the local file at a file: URL and returns it with its
+// cleaned path. Symlinks are followed, but only while they stay inside the
+// file's root, and the file is opened through the root so a symlink swapped
+// in meanwhile can't escape it either. Files larger than the limit for ctx,
+// MaxImageBytes or MaxArchiveBytes for ZIP archives, aren't opened.
+func (s *Server) openFile(ctx context.Context, imageURL string) (f *os.File, path string, err error) {
+	path, root, err := s.filePath(imageURL)
+	if err != nil {
+		return nil, "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, "", fileError(path, err)
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, "", fileError(root, err)
+	}
+	if !withinRoot(resolvedRoot, resolved) {
+		return nil, "", &codedError{Code: codePathOutsideRoot, Err: fmt.Errorf("%s links outside its root %s", path, root)}
+	}
+
+	dir, err := os.OpenRoot(resolvedRoot)
+	if err != nil {
+		return nil, "", fileError(root, err)
+	}
+	defer dir.Close()
+	rel, _ := filepath.Rel(resolvedRoot, resolved)
+	f, err = dir.Open(rel)
+	if err != nil {
+		return nil, "", fileError(path, err)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, "", fileError(path, err)
+	}
+	if stat.IsDir() {
+		f.Close()
+		return nil, "", &codedError{Code: codeInvalidURL, Err: fmt.Errorf("invalid file URL: %s is a directory", path)}
+	}
+	if limit := s.imageLimit(ctx); stat.Size() > limit {
+		f.Close()
+		return nil, "", &imageTooLargeError{Limit: limit}
+	}
+	return f, path, nil
+}
+
+// readFileImage reads and decodes the local file at a file: URL, so it is a
+// downloadFunc. Files are limited to MaxImageBytes, or MaxArchiveBytes for
+// ZIP archives, like downloads.
+func (s *Server) readFileImage(ctx context.Context, imageURL string) (info imageInfo, err error) {
+	_, span := s.tracer.Start(ctx, "decode", spanKindInternal)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	f, path, err := s.openFile(ctx, imageURL)
+	if err != nil {
+		return imageInfo{}, err
+	}
+	defer f.Close()
+	limit := s.imageLimit(ctx)
+
+	start := time.Now()
+	body := &sizeLimitedReader{R: f, Limit: limit}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if isArchive(ctx) {
+		info, err = s.decodeArchive(ctx, body, contentType)
+	} else {
+		info, err = s.decodeImage(ctx, body, contentType)
+	}
+	if err != nil {
+		return imageInfo{}, err
+	}
+	info.DecodeTime = time.Since(start)
+	info.Bytes = body.read
+	span.SetAttr("imgproc.image.format", info.Format)
+	return info, nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"time"
+)
+
+// groupByVisit is the group_by value that groups a job's results by visit
+const groupByVisit = "visit"
+
+// JobVisit is a visit of a job, as submitted
+type JobVisit struct {
+	StoreID   string    `json:"store_id"`
+	ImageURLs []string  `json:"image_url"`
+	VisitTime time.Time `json:"visit_time,omitzero"`
+	Archive   bool      `json:"archive,omitempty"`
+
+	// DownloadHeaders are the job's download headers merged with the
+	// visit's own
+	DownloadHeaders DownloadHeaders `json:"download_headers,omitempty"`
+
+	ExpectedSHA256 []string `json:"expected_sha256,omitempty"`
+}
+
+// jobVisits returns the JobVisits of a submission's visits once their visit
+// times have been normalized and their download headers merged
+func jobVisits(req SubmitJobRequest) []JobVisit {
+	jobVisits := make([]JobVisit, len(req.Visits))
+	for i, visit := range req.Visits {
+		jobVisits[i] = JobVisit{
+			StoreID:         visit.StoreID,
+			ImageURLs:       visit.ImageURLs,
+			VisitTime:       visitTime(visit),
+			Archive:         visit.Archive,
+			DownloadHeaders: req.DownloadHeaders.merge(visit.DownloadHeaders),
+			ExpectedSHA256:  visit.ExpectedSHA256,
+		}
+	}
+	return jobVisits
+}
+
+// VisitResults represents a visit in the results grouped by visit, with the
+// results and errors of its images
+type VisitResults struct {
+	Visit     int           `json:"visit"`
+	StoreID   string        `json:"store_id"`
+	StoreName string        `json:"store_name,omitempty"`
+	AreaCode  string        `json:"area_code,omitempty"`
+	VisitTime time.Time     `json:"visit_time,omitzero"`
+	Results   []ImageResult `json:"results"`
+	Errors    []StoreError  `json:"errors,omitempty"`
+}
+
+// GroupedResultsResponse represents the response for job results grouped by
+// visit. Count is the number of results across all visits.
+type GroupedResultsResponse struct {
+	JobID    string         `json:"job_id"`
+	Status   string         `json:"status"`
+	Partial  bool           `json:"partial,omitempty"`
+	Progress JobProgress    `json:"progress"`
+	Count    int            `json:"count"`
+	Visits   []VisitResults `json:"visits"`
+}
+
+// groupResultsByVisit groups a job's results and errors by visit, in the
+// order the visits were submitted
+func (s *Server) groupResultsByVisit(visits []JobVisit, results []ImageResult, errs []StoreError) []VisitResults {
+	grouped := make([]VisitResults, len(visits))
+	for i, visit := range visits {
+		grouped[i] = VisitResults{
+			Visit:     i,
+			StoreID:   visit.StoreID,
+			VisitTime: visit.VisitTime,
+			Results:   []ImageResult{},
+		}
+		if store, ok := s.getStore(visit.StoreID); ok {
+			grouped[i].StoreName, grouped[i].AreaCode = store.StoreName, store.AreaCode
+		}
+	}
+	for _, result := range results {
+		if result.Visit < len(grouped) {
+			grouped[result.Visit].Results = append(grouped[result.Visit].Results, result)
+		}
+	}
+	for _, storeErr := range errs {
+		if storeErr.Visit < len(grouped) {
+			grouped[storeErr.Visit].Errors = append(grouped[storeErr.Visit].Errors, storeErr)
+		}
+	}
+	return grouped
+}
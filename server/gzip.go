@@ -0,0 +1,170 @@
+package server
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipMinSize is the smallest response body that is compressed. Smaller
+// bodies gain little and aren't worth the CPU.
+const gzipMinSize = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// withGzip wraps next so that responses are gzip compressed for clients that
+// accept it. Responses smaller than gzipMinSize, event streams and bodies
+// that are already compressed are sent as they are.
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		// gzip;q=0 explicitly refuses it
+		name, value, _ := strings.Cut(strings.TrimSpace(params), "=")
+		if strings.TrimSpace(name) == "q" {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the start of a response until it knows
+// whether to compress it: once the body reaches gzipMinSize, or the handler
+// flushes, or the handler finishes
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < gzipMinSize {
+			return len(p), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends what has been written so far, compressed if the response may
+// be, so streaming handlers keep working
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		w.start(true)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close finishes the response, sending a body too small to be worth
+// compressing as it is
+func (w *gzipResponseWriter) Close() error {
+	if !w.decided {
+		return w.start(false)
+	}
+	if w.gz != nil {
+		err := w.gz.Close()
+		w.gz.Reset(nil)
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+		return err
+	}
+	return nil
+}
+
+// start sends the status and headers followed by the buffered body,
+// compressing the response if compress is set and it is compressible
+func (w *gzipResponseWriter) start(compress bool) error {
+	w.decided = true
+	header := w.Header()
+	if compress && compressible(w.status, header) {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", "gzip")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.gz != nil {
+		_, err := w.gz.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// compressible reports whether a response with the given status and headers
+// may be compressed
+func compressible(status int, header http.Header) bool {
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch {
+	case mediaType == "text/event-stream":
+		// Proxies may hold back compressed events until a buffer fills
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "video/"), strings.HasPrefix(mediaType, "audio/"):
+		return false
+	case mediaType == "application/zip", mediaType == "application/gzip", mediaType == "application/x-gzip":
+		return false
+	}
+	return true
+}
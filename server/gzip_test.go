@@ -0,0 +1,118 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getWithEncoding sends a GET request for path to h, accepting the given
+// encodings
+func getWithEncoding(h http.Handler, path, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGzipResponses(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	rec := getWithEncoding(s, "/api/errors/codes", "deflate, gzip")
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) < gzipMinSize || !json.Valid(body) {
+		t.Errorf("decompressed %d bytes, want a JSON body of at least %d", len(body), gzipMinSize)
+	}
+	plain := getWithEncoding(s, "/api/errors/codes", "")
+	if plain.Header().Get("Content-Encoding") != "" || plain.Body.String() != string(body) {
+		t.Error("the uncompressed response differs from the decompressed one")
+	}
+}
+
+func TestGzipResponsesSentAsIs(t *testing.T) {
+	s := newTestServer(t, nil)
+	tests := []struct {
+		name, path, acceptEncoding string
+	}{
+		{"not accepted", "/api/errors/codes", ""},
+		{"refused", "/api/errors/codes", "gzip;q=0, identity"},
+		{"small body", "/healthz", "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := getWithEncoding(s, tt.path, tt.acceptEncoding)
+			if got := rec.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want none", got)
+			}
+			if !json.Valid(rec.Body.Bytes()) {
+				t.Errorf("body %q isn't JSON", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"br, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"gzip;q=bad", false},
+		{"deflate, br", false},
+		{"x-gzip", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		status      int
+		contentType string
+		want        bool
+	}{
+		{http.StatusOK, "application/json", true},
+		{http.StatusNotFound, "application/json", true},
+		{http.StatusNoContent, "", false},
+		{http.StatusNotModified, "application/json", false},
+		{http.StatusOK, "text/event-stream", false},
+		{http.StatusOK, "image/png", false},
+		{http.StatusOK, "application/gzip", false},
+	}
+	for _, tt := range tests {
+		header := http.Header{"Content-Type": {tt.contentType}}
+		if got := compressible(tt.status, header); got != tt.want {
+			t.Errorf("compressible(%d, %q) = %v, want %v", tt.status, tt.contentType, got, tt.want)
+		}
+	}
+	if compressible(http.StatusOK, http.Header{"Content-Encoding": {"br"}}) {
+		t.Error("compressible() = true for an already encoded body")
+	}
+}
@@ -0,0 +1,626 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func responseError(w http.ResponseWriter, status int, message string) {
+	writeErrorResponse(w, status, ErrorResponse{Error: message})
+}
+
+func responseJobError(w http.ResponseWriter, status int, message, jobID string) {
+	writeErrorResponse(w, status, ErrorResponse{Error: message, JobID: jobID})
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, resp ErrorResponse) {
+	if resp.Code == "" {
+		resp.Code = requestErrorCode(status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// lookupJob parses the jobid path parameter, or on legacy routes the jobid
+// query parameter, and retrieves the matching job, writing an error response
+// and returning false if either step fails
+func (s *Server) lookupJob(w http.ResponseWriter, r *http.Request) (*JobData, bool) {
+	jobID := r.PathValue("jobid")
+	if jobID == "" {
+		jobID = r.URL.Query().Get("jobid")
+	}
+	if jobID == "" {
+		responseError(w, http.StatusBadRequest, "missing jobid query parameter")
+		return nil, false
+	}
+
+	// Integer IDs of jobs created before job IDs were UUIDs are still
+	// accepted, so clients can migrate
+	if !isJobID(jobID) {
+		responseJobError(w, http.StatusBadRequest, "invalid jobid: must be a UUID or legacy numeric ID", jobID)
+		return nil, false
+	}
+
+	s.jobsMu.Lock()
+	job, exists := s.jobs[jobID]
+	s.jobsMu.Unlock()
+
+	if !exists && s.writeExpiredJob(w, r, jobID) {
+		return nil, false
+	}
+	// Other clients' jobs are reported as not found, so their IDs can't be
+	// probed
+	if !exists || !canAccess(callerKey(r.Context()), job) {
+		responseJobError(w, http.StatusNotFound, "job not found", jobID)
+		return nil, false
+	}
+	return job, true
+}
+
+// handleSubmitJob handles the job submission endpoint
+func (s *Server) handleSubmitJob(w http.ResponseWriter, r *http.Request) {
+	if !s.allowSubmit(w, r) {
+		return
+	}
+	req, ok := s.decodeSubmission(w, r)
+	if !ok {
+		return
+	}
+
+	// Visit times are normalized before the payload is hashed, so the same
+	// time written differently is still a duplicate
+	if !s.checkSubmission(w, &req) {
+		return
+	}
+
+	// A retried submission with the same Idempotency-Key gets the job the
+	// first one created instead of a new one
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > maxIdempotencyKeyLen {
+		responseError(w, http.StatusBadRequest, fmt.Sprintf("invalid Idempotency-Key: must be at most %d characters", maxIdempotencyKeyLen))
+		return
+	}
+	// Idempotency keys and duplicate payloads are scoped to the API key, so
+	// one client's submissions never return another's job
+	owner := ownerID(r.Context())
+	hash := payloadHash(req)
+	var createdJobID string
+	if idempotencyKey != "" {
+		scopedKey := ownerScoped(owner, idempotencyKey)
+		entry, replay, err := s.claimIdempotencyKey(scopedKey, hash)
+		if err != nil {
+			responseError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		if replay {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(JobResponse{JobID: entry.jobID})
+			return
+		}
+		defer func() { s.releaseIdempotencyKey(scopedKey, entry, createdJobID) }()
+	}
+
+	// An identical payload submitted recently returns that job instead of
+	// processing the same images again, unless the client forces a new job
+	if !req.Force {
+		if existing, ok := s.findDuplicate(owner, hash); ok {
+			createdJobID = existing.ID
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(JobResponse{JobID: existing.ID, Deduplicated: true})
+			return
+		}
+	}
+
+	job, ok := s.enqueueJob(w, r, req, jobOrigin{idempotencyKey: idempotencyKey, payloadHash: hash})
+	if !ok {
+		return
+	}
+	createdJobID = job.ID
+
+	// Return the job ID
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(JobResponse{JobID: job.ID, TraceID: job.span.TraceID()})
+}
+
+// decodeSubmission decodes the submission in the request body. It writes an
+// error response and returns false if the body is too large or isn't a valid
+// submission.
+func (s *Server) decodeSubmission(w http.ResponseWriter, r *http.Request) (SubmitJobRequest, bool) {
+	body, err := requestBody(w, r, s.cfg.MaxBodyBytes)
+	if err != nil {
+		writeBodyError(w, err)
+		return SubmitJobRequest{}, false
+	}
+	defer body.Close()
+
+	var req SubmitJobRequest
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&req)
+	if err != nil && writeBodyError(w, err) {
+		return SubmitJobRequest{}, false
+	}
+	if err != nil {
+		if fieldErr, ok := decodeFieldError(err); ok {
+			writeFieldErrors(w, []FieldError{fieldErr})
+			return SubmitJobRequest{}, false
+		}
+		responseError(w, http.StatusBadRequest, "invalid request payload")
+		return SubmitJobRequest{}, false
+	}
+	// A gzipped body's checksum follows the compressed data, so the rest of
+	// the body is read to check it
+	if _, err := io.Copy(io.Discard, body); err != nil && writeBodyError(w, err) {
+		return SubmitJobRequest{}, false
+	}
+	return req, true
+}
+
+// checkSubmission checks the fields of a submission and its size against
+// the limits, fills in its default priority and error policy, and normalizes
+// its visit times. It writes an error response and returns false if the
+// submission can't be accepted.
+func (s *Server) checkSubmission(w http.ResponseWriter, req *SubmitJobRequest) bool {
+	if !s.checkJobSize(w, req.Visits) {
+		return false
+	}
+
+	if req.Priority == "" {
+		req.Priority = priorityNormal
+	}
+	if req.OnError == "" {
+		req.OnError = onErrorContinue
+	}
+	errs := s.validateSubmission(*req)
+	errs = append(errs, s.normalizeVisitTimes(req.Visits, req.Strict)...)
+	if len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return false
+	}
+	return true
+}
+
+// jobOrigin is what a job is created from besides its submission: the
+// Idempotency-Key and payload hash of a submitted job, the job a retry job
+// retries, or the images uploaded with an upload
+type jobOrigin struct {
+	idempotencyKey string
+	payloadHash    string
+	retryOf        string
+	uploads        map[string]uploadedImage
+}
+
+// enqueueJob creates a job for a validated submission, reserves its images
+// against the caller's quota and queues it. It writes an error response and
+// returns false if the job can't be queued.
+func (s *Server) enqueueJob(w http.ResponseWriter, r *http.Request, req SubmitJobRequest, origin jobOrigin) (*JobData, bool) {
+	// Refuse new jobs once shutdown has begun
+	if !s.runningJobs.Start() {
+		responseError(w, http.StatusServiceUnavailable, "server is shutting down")
+		return nil, false
+	}
+
+	totalImages := 0
+	for _, visit := range req.Visits {
+		totalImages += len(visit.ImageURLs)
+	}
+	owner := ownerID(r.Context())
+	if !s.reserveQuota(w, owner, totalImages) {
+		s.runningJobs.Done()
+		return nil, false
+	}
+
+	// Create a new job, with a deadline if it has a timeout
+	now := time.Now()
+	timeout := s.cfg.JobTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+	var deadline time.Time
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		deadline = now.Add(timeout)
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	}
+	// Everything logged about the job carries its ID and the ID of the
+	// request that submitted it
+	jobID := newJobID()
+	logger := s.logger(r.Context()).With("job_id", jobID)
+	ctx = withJobID(withLogger(ctx, logger), jobID)
+
+	// The job runs long after the request, so it gets a trace of its own,
+	// linked to the request's
+	ctx, jobSpan := s.tracer.Start(ctx, "job", spanKindInternal)
+	jobSpan.AddLink(spanFromContext(r.Context()))
+	jobSpan.SetAttr("imgproc.job.id", jobID)
+	jobSpan.SetAttr("imgproc.job.images", totalImages)
+	jobSpan.SetAttr("imgproc.job.priority", req.Priority)
+	job := &JobData{
+		ID:        jobID,
+		Status:    statusQueued,
+		Priority:  req.Priority,
+		Progress:  JobProgress{Total: totalImages},
+		CreatedAt: now,
+		Deadline:  deadline,
+
+		IdempotencyKey: origin.idempotencyKey,
+		PayloadHash:    origin.payloadHash,
+		Owner:          owner,
+		Visits:         jobVisits(req),
+		RetryOf:        origin.retryOf,
+		includeResults: req.IncludeResults,
+		failFast:       req.OnError == onErrorFailFast,
+
+		failureThreshold: s.cfg.FailureThresholdPercent,
+
+		ctx:    withImageTimeout(ctx, time.Duration(req.ImageTimeoutMS)*time.Millisecond),
+		cancel: cancel,
+		span:   jobSpan,
+	}
+
+	// Uploaded images aren't kept after the job, so it couldn't be rerun
+	if origin.uploads != nil {
+		job.uploads = origin.uploads
+	} else {
+		job.Request = s.storedRequest(req)
+	}
+	if req.CallbackURL != "" {
+		job.Webhook = &WebhookDelivery{URL: req.CallbackURL, State: webhookPending}
+	}
+	if req.FailureThresholdPercent != nil {
+		job.failureThreshold = *req.FailureThresholdPercent
+	}
+	job.ctx = withBytesCounter(job.ctx, job.addBytes)
+	if req.IncludeEXIF {
+		job.ctx = withEXIF(job.ctx)
+	}
+	if req.DetectDuplicates {
+		job.ctx = withDuplicateDetection(job.ctx)
+	}
+	if req.QualityChecks {
+		job.ctx = withQualityChecks(job.ctx)
+	}
+
+	// Hold the job's mutex until it is registered and persisted, so a runner
+	// that takes it straight off the queue can't start it before then
+	job.mu.Lock()
+	if !s.queue.Push(job, req) {
+		job.mu.Unlock()
+		cancel()
+		s.quotas.Release(owner, job.CreatedAt, totalImages)
+		s.runningJobs.Done()
+		jobSpan.SetError(errors.New("job queue is full"))
+		jobSpan.End()
+		w.Header().Set("Retry-After", strconv.Itoa(int(queueFullRetryAfter/time.Second)))
+		writeErrorResponse(w, http.StatusTooManyRequests, ErrorResponse{Error: "job queue is full, try again later", Code: codeQueueFull})
+		return nil, false
+	}
+	s.jobsMu.Lock()
+	s.jobs[job.ID] = job
+	s.recordPayload(job)
+	s.jobsMu.Unlock()
+	s.persist(s.jobStore.SaveJob(job.record()))
+	job.mu.Unlock()
+	if job.RetryOf != "" {
+		logger = logger.With("retry_of", job.RetryOf)
+	}
+	logger.Info("job submitted", "images", totalImages, "priority", job.Priority)
+	return job, true
+}
+
+// handleJobStatus handles the job status endpoint
+func (s *Server) handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	// Long polling clients can wait for the job to change instead of
+	// repeatedly asking for its status
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		wait, err = time.ParseDuration(value)
+		if err != nil || wait < 0 {
+			responseError(w, http.StatusBadRequest, "invalid wait: must be a non-negative duration such as 30s")
+			return
+		}
+		wait = min(wait, s.cfg.MaxStatusWait)
+	}
+
+	job, ok := s.lookupJob(w, r)
+	if !ok {
+		return
+	}
+	if wait > 0 {
+		job.waitForChange(r.Context(), wait)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.jobStatus(job))
+}
+
+// jobStatus returns the job's status, with its place in the queue if it is
+// waiting
+func (s *Server) jobStatus(job *JobData) JobStatusResponse {
+	response := job.Snapshot().statusResponse()
+	response.Timings = job.timings()
+	if response.Status == statusQueued {
+		response.QueuePosition = s.queue.Position(job)
+	}
+	return response
+}
+
+// maxBatchStatusJobs is the most job IDs a batch status request may ask for
+const maxBatchStatusJobs = 100
+
+// BatchStatusRequest represents the request payload for batch status
+type BatchStatusRequest struct {
+	JobIDs []jsonJobID `json:"job_ids"`
+}
+
+// handleBatchStatus handles the batch status endpoint, which returns the
+// status of several jobs at once. The job IDs are given as a job_ids list in
+// a POST body, or as a comma-separated jobids query parameter on a GET.
+func (s *Server) handleBatchStatus(w http.ResponseWriter, r *http.Request) {
+	var jobIDs []string
+	switch r.Method {
+	case http.MethodGet:
+		for _, jobID := range strings.Split(r.URL.Query().Get("jobids"), ",") {
+			if jobID = strings.TrimSpace(jobID); jobID != "" {
+				jobIDs = append(jobIDs, jobID)
+			}
+		}
+	case http.MethodPost:
+		var req BatchStatusRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			responseError(w, http.StatusBadRequest, "invalid request payload")
+			return
+		}
+		for _, jobID := range req.JobIDs {
+			jobIDs = append(jobIDs, string(jobID))
+		}
+	}
+
+	if len(jobIDs) == 0 {
+		responseError(w, http.StatusBadRequest, "missing job IDs")
+		return
+	}
+	if len(jobIDs) > maxBatchStatusJobs {
+		responseError(w, http.StatusBadRequest, fmt.Sprintf("too many job IDs: at most %d may be requested at once", maxBatchStatusJobs))
+		return
+	}
+	for _, jobID := range jobIDs {
+		if !isJobID(jobID) {
+			responseJobError(w, http.StatusBadRequest, "invalid job ID: must be a UUID or legacy numeric ID", jobID)
+			return
+		}
+	}
+
+	// Only hold jobsMu long enough to look the jobs up; their statuses are
+	// taken under each job's own mutex
+	apiKey := callerKey(r.Context())
+	jobs := make(map[string]*JobData, len(jobIDs))
+	s.jobsMu.Lock()
+	for _, jobID := range jobIDs {
+		if job, ok := s.jobs[jobID]; ok && canAccess(apiKey, job) {
+			jobs[jobID] = job
+		}
+	}
+	s.jobsMu.Unlock()
+
+	response := BatchStatusResponse{Jobs: make(map[string]any, len(jobIDs))}
+	for _, jobID := range jobIDs {
+		if job, ok := jobs[jobID]; ok {
+			response.Jobs[jobID] = s.jobStatus(job)
+		} else if s.isExpiredJob(apiKey, jobID) {
+			response.Jobs[jobID] = JobNotFound{Status: statusExpired, JobID: jobID}
+		} else {
+			response.Jobs[jobID] = JobNotFound{Status: statusNotFound, JobID: jobID}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleCancelJob handles the job cancellation endpoint. Results gathered
+// before the cancellation are kept, and each image that hadn't finished gets
+// a cancelled error.
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.lookupJob(w, r)
+	if !ok {
+		return
+	}
+
+	job.mu.Lock()
+	if job.Status != statusQueued && job.Status != statusOngoing {
+		status := job.Status
+		job.mu.Unlock()
+		responseJobError(w, http.StatusConflict, fmt.Sprintf("job is already %s", status), job.ID)
+		return
+	}
+	queued := job.Status == statusQueued
+	errs := job.unfinishedImagesLocked(StoreError{
+		Code:  codeCancelled,
+		Error: "job was cancelled before the image was processed",
+	})
+	for _, storeErr := range errs {
+		job.addErrorLocked(storeErr)
+		job.Progress.Failed++
+		job.publishLocked(streamEventError, storeErr)
+	}
+	job.Status = statusCancelled
+	job.CompletedAt = time.Now()
+	rec := job.record()
+	snap := job.snapshotLocked()
+	job.mu.Unlock()
+
+	// Abort the job's queued and in-flight downloads
+	job.cancel()
+	if queued {
+		s.dequeueJob(job)
+	}
+	for _, storeErr := range errs {
+		s.persist(s.jobStore.AppendError(job.ID, storeErr, 1))
+	}
+	s.metrics.imagesFailed(codeCancelled, len(errs))
+	s.persist(s.jobStore.SaveJob(rec))
+	s.finishJob(job)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap.statusResponse())
+}
+
+// Default and maximum page sizes for the list-jobs endpoint
+const (
+	defaultJobListLimit = 50
+	maxJobListLimit     = 1000
+)
+
+// handleListJobs handles the list-jobs endpoint, returning job summaries
+// newest first, optionally filtered by status
+func (s *Server) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), defaultJobListLimit)
+	if err != nil || limit < 1 || limit > maxJobListLimit {
+		responseError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit: must be between 1 and %d", maxJobListLimit))
+		return
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		responseError(w, http.StatusBadRequest, "invalid offset: must be a non-negative integer")
+		return
+	}
+	status := query.Get("status")
+
+	// Only hold jobsMutex long enough to collect the jobs; their summaries
+	// are taken under each job's own mutex. Clients only see their own jobs.
+	apiKey := callerKey(r.Context())
+	s.jobsMu.Lock()
+	all := make([]*JobData, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		if canAccess(apiKey, job) {
+			all = append(all, job)
+		}
+	}
+	s.jobsMu.Unlock()
+
+	summaries := make([]JobSummary, 0, len(all))
+	for _, job := range all {
+		summary := job.Summary()
+		if status != "" && summary.Status != status {
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if !summaries[i].CreatedAt.Equal(summaries[j].CreatedAt) {
+			return summaries[i].CreatedAt.After(summaries[j].CreatedAt)
+		}
+		return summaries[i].JobID < summaries[j].JobID
+	})
+
+	response := JobListResponse{
+		Jobs:   []JobSummary{},
+		Total:  len(summaries),
+		Limit:  limit,
+		Offset: offset,
+	}
+	if offset < len(summaries) {
+		response.Jobs = summaries[offset:min(offset+limit, len(summaries))]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// queryInt parses an integer query parameter, returning def if it is empty
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// queryBool parses a boolean query parameter, returning def if it is empty
+func queryBool(value string, def bool) (bool, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// resultsFinal reports whether a job with the given status has all the
+// results it will ever have, which is the case once it has finished however
+// it finished. A failed, cancelled or timed out job's finished results are
+// as final as a completed job's.
+func resultsFinal(status string) bool {
+	return status != statusQueued && status != statusOngoing
+}
+
+// handleJobResults handles the job results endpoint. Results are only
+// returned once the job has finished, unless partial=true is given, in which
+// case whatever results have accumulated so far are returned. With
+// group_by=visit, they are grouped by visit along with the visits' errors.
+func (s *Server) handleJobResults(w http.ResponseWriter, r *http.Request) {
+	partial, err := queryBool(r.URL.Query().Get("partial"), false)
+	if err != nil {
+		responseError(w, http.StatusBadRequest, "invalid partial: must be true or false")
+		return
+	}
+	groupBy := r.URL.Query().Get("group_by")
+	if groupBy != "" && groupBy != groupByVisit {
+		responseError(w, http.StatusBadRequest, "invalid group_by: must be visit")
+		return
+	}
+
+	job, ok := s.lookupJob(w, r)
+	if !ok {
+		return
+	}
+
+	// Snapshot the results, since image workers may still be appending to them
+	snap, results := job.SnapshotWithResults()
+
+	completed := resultsFinal(snap.Status)
+	if !completed && !partial {
+		responseJobError(w, http.StatusConflict, fmt.Sprintf("job is %s, results are only available once it has finished", snap.Status), snap.ID)
+		return
+	}
+
+	if groupBy == groupByVisit {
+		// Jobs persisted before visits were recorded can't be grouped
+		if len(job.Visits) == 0 && snap.Progress.Total > 0 {
+			responseJobError(w, http.StatusConflict, "job was submitted before results could be grouped by visit", snap.ID)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GroupedResultsResponse{
+			JobID:    snap.ID,
+			Status:   snap.Status,
+			Partial:  !completed,
+			Progress: snap.Progress,
+			Count:    len(results),
+			Visits:   s.groupResultsByVisit(job.Visits, results, snap.Errors),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ResultsResponse{
+		JobID:    snap.ID,
+		Status:   snap.Status,
+		Partial:  !completed,
+		Progress: snap.Progress,
+		Count:    len(results),
+		Results:  results,
+	})
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJobStatusErrors(t *testing.T) {
+	s := newTestServer(t, nil)
+	fixtures := serveFixtures(t)
+	jobID := submitJob(t, s, SubmitJobRequest{
+		Count:  1,
+		Visits: []Visit{{StoreID: "S00339218", ImageURLs: []string{fixtures.URL + "/shelf.jpg"}}},
+	})
+	waitForJob(t, s, jobID)
+
+	const unknownID = "3f2b9c1e-8d4a-4f6b-9e21-7c5d0a1b2c3d"
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		code   string
+		jobID  string
+	}{
+		{"existing job", "/api/status/" + jobID, http.StatusOK, "", ""},
+		{"unknown job", "/api/status/" + unknownID, http.StatusNotFound, codeNotFound, unknownID},
+		{"legacy unknown job", "/status?jobid=" + unknownID, http.StatusNotFound, codeNotFound, unknownID},
+		{"legacy integer ID", "/status?jobid=42", http.StatusNotFound, codeNotFound, "42"},
+		{"malformed ID", "/api/status/abc", http.StatusBadRequest, codeInvalidRequest, "abc"},
+		{"uppercase UUID", "/api/status/" + strings.ToUpper(unknownID), http.StatusBadRequest, codeInvalidRequest, strings.ToUpper(unknownID)},
+		{"legacy missing ID", "/status", http.StatusBadRequest, codeInvalidRequest, ""},
+		{"legacy empty ID", "/status?jobid=", http.StatusBadRequest, codeInvalidRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ErrorResponse
+			rec := doJSON(t, s, "GET", tt.path, nil, &resp)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			if tt.status == http.StatusOK {
+				return
+			}
+			if resp.Error == "" || resp.Code != tt.code || resp.JobID != tt.jobID {
+				t.Errorf("error = %+v, want code %q and job_id %q", resp, tt.code, tt.jobID)
+			}
+		})
+	}
+}
+
+func TestSubmitJobErrorEnvelope(t *testing.T) {
+	s := newTestServer(t, nil)
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"malformed JSON", `{"count":`, http.StatusBadRequest, codeInvalidRequest},
+		{"no visits", `{"count":1,"visits":[]}`, http.StatusUnprocessableEntity, codeValidationFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ErrorResponse
+			rec := doRaw(t, s, "POST", "/api/submit", strings.NewReader(tt.body), &resp)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if resp.Error == "" || resp.Code != tt.code {
+				t.Errorf("error = %+v, want code %q", resp, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Server lifecycle states reported by the readiness endpoint
+const (
+	stateStarting int32 = iota
+	stateReady
+	stateShuttingDown
+)
+
+// HealthResponse represents the response for the health endpoint
+type HealthResponse struct {
+	Status        string             `json:"status"`
+	StartedAt     time.Time          `json:"started_at"`
+	UptimeSeconds float64            `json:"uptime_seconds"`
+	Build         BuildInfo          `json:"build"`
+	StoreMaster   *StoreMasterHealth `json:"store_master,omitempty"`
+}
+
+// StoreMasterHealth reports how stale the store master is, when it is
+// loaded from a file or URL. AgeSeconds is the time since it was last
+// loaded, or found to be unchanged, and grows while refreshes fail.
+type StoreMasterHealth struct {
+	Path        string    `json:"path,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	Stores      int       `json:"stores"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+	AgeSeconds  float64   `json:"age_seconds"`
+}
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	GoVersion string `json:"go_version"`
+	Version   string `json:"version,omitempty"`
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// ReadyResponse represents the response for the readiness endpoint
+type ReadyResponse struct {
+	Status string `json:"status"`
+}
+
+// buildInfo is read once, since it can't change while the server runs
+var buildInfo = readBuildInfo()
+
+func readBuildInfo() BuildInfo {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return BuildInfo{}
+	}
+
+	build := BuildInfo{
+		GoVersion: info.GoVersion,
+		Version:   info.Main.Version,
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			build.Revision = setting.Value
+		case "vcs.time":
+			build.BuildTime = setting.Value
+		case "vcs.modified":
+			build.Modified = setting.Value == "true"
+		}
+	}
+	return build
+}
+
+// handleHealth handles the health endpoint, which reports that the process is
+// alive regardless of whether it is ready for traffic
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	response := HealthResponse{
+		Status:        "ok",
+		StartedAt:     s.startTime,
+		UptimeSeconds: time.Since(s.startTime).Seconds(),
+		Build:         buildInfo,
+	}
+	if s.cfg.StoreMasterPath != "" || s.cfg.StoreMasterURL != "" {
+		response.StoreMaster = &StoreMasterHealth{
+			Path:        s.cfg.StoreMasterPath,
+			URL:         s.cfg.StoreMasterURL,
+			Stores:      len(s.storeMaster()),
+			RefreshedAt: time.Unix(0, s.storesRefreshedAt.Load()).UTC(),
+			AgeSeconds:  s.storesAge().Seconds(),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleReady handles the readiness endpoint. It returns 503 until the store
+// master is loaded and the worker pool is running, and again once shutdown
+// has begun, so load balancers stop routing traffic here.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	status, code := "ready", http.StatusOK
+	switch s.state.Load() {
+	case stateStarting:
+		status, code = "starting", http.StatusServiceUnavailable
+	case stateShuttingDown:
+		status, code = "shutting_down", http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ReadyResponse{Status: status})
+}
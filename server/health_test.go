@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	s := newTestServer(t, nil)
+	var health HealthResponse
+	if rec := doJSON(t, s, "GET", "/healthz", nil, &health); rec.Code != http.StatusOK {
+		t.Fatalf("GET /healthz: %d %s", rec.Code, rec.Body.String())
+	}
+	if health.Status != "ok" || health.StartedAt.IsZero() {
+		t.Errorf("health = %+v, want ok with a start time", health)
+	}
+}
+
+func TestReadyUntilDrained(t *testing.T) {
+	s := newTestServer(t, nil)
+	var ready ReadyResponse
+	if rec := doJSON(t, s, "GET", "/readyz", nil, &ready); rec.Code != http.StatusOK || ready.Status != "ready" {
+		t.Fatalf("GET /readyz before draining: %d %s", rec.Code, rec.Body.String())
+	}
+
+	s.Drain(t.Context())
+	if rec := doJSON(t, s, "GET", "/readyz", nil, &ready); rec.Code != http.StatusServiceUnavailable || ready.Status != "shutting_down" {
+		t.Errorf("GET /readyz after draining: %d %s, want 503 shutting_down", rec.Code, rec.Body.String())
+	}
+	// Liveness doesn't depend on draining, so the process isn't restarted
+	// while it finishes its jobs
+	if rec := doRaw(t, s, "GET", "/healthz", nil, nil); rec.Code != http.StatusOK {
+		t.Errorf("GET /healthz after draining: %d, want 200", rec.Code)
+	}
+	rec := doJSON(t, s, "POST", "/api/submit", SubmitJobRequest{
+		Count:  1,
+		Visits: []Visit{{StoreID: "S00339218", ImageURLs: []string{"http://127.0.0.1/a.jpg"}}},
+	}, nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("submitting while drained: %d %s, want 503", rec.Code, rec.Body.String())
+	}
+}
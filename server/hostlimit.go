@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultMaxPerHost is the number of concurrent downloads allowed per host
+// when neither the -max-per-host flag nor IMGPROC_MAX_PER_HOST is set
+const defaultMaxPerHost = 8
+
+// hostLimiter limits the number of concurrent downloads from each host,
+// independently of the worker pool, so a large job can't overwhelm a single
+// CDN. Downloads beyond the limit wait for a slot. A limit of 0 disables it.
+type hostLimiter struct {
+	mu    sync.Mutex
+	limit int
+	hosts map[string]*hostSlots
+}
+
+// hostSlots is a host's semaphore, shared by every download waiting on or
+// holding one of its slots
+type hostSlots struct {
+	slots chan struct{}
+	refs  int
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, hosts: make(map[string]*hostSlots)}
+}
+
+// Acquire waits for a download slot for host, returning a function that
+// releases it, or ctx's error if ctx is done first
+func (l *hostLimiter) Acquire(ctx context.Context, host string) (release func(), err error) {
+	if l.limit == 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostSlots{slots: make(chan struct{}, l.limit)}
+		l.hosts[host] = h
+	}
+	h.refs++
+	l.mu.Unlock()
+
+	select {
+	case h.slots <- struct{}{}:
+		return func() {
+			<-h.slots
+			l.unref(host, h)
+		}, nil
+	case <-ctx.Done():
+		l.unref(host, h)
+		return nil, ctx.Err()
+	}
+}
+
+// unref drops a reference to a host's semaphore, forgetting the host once no
+// download is using it
+func (l *hostLimiter) unref(host string, h *hostSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h.refs--
+	if h.refs == 0 {
+		delete(l.hosts, host)
+	}
+}
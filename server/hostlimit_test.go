@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHostLimitBoundsConcurrency(t *testing.T) {
+	const perHost, images = 3, 60
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Workers = 16
+		cfg.MaxPerHost = perHost
+	})
+	recorder, host := newConcurrencyRecorder(t, 5*time.Millisecond)
+
+	jobID := submitJob(t, s, SubmitJobRequest{Count: 1, Visits: []Visit{{StoreID: "S00339218", ImageURLs: imageURLs(host.URL, images)}}})
+	if status := waitForJob(t, s, jobID); status.Progress.Completed != images {
+		t.Fatalf("progress = %+v, want all %d images completed", status.Progress, images)
+	}
+	maxInFlight, _ := recorder.stats()
+	// With more workers than slots, the host should be kept at its limit
+	if maxInFlight != perHost {
+		t.Errorf("%d downloads from one host ran at once, want %d", maxInFlight, perHost)
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	l := newHostLimiter(1)
+	release, err := l.Acquire(context.Background(), "a.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other hosts have slots of their own
+	releaseB, err := l.Acquire(context.Background(), "b.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseB()
+
+	// A download waiting for a full host gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx, "a.example"); err != context.DeadlineExceeded {
+		t.Errorf("Acquire() on a full host = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	release()
+	if n := len(l.hosts); n != 0 {
+		t.Errorf("%d hosts still tracked after every slot was released", n)
+	}
+}
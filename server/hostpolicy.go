@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// defaultAllowedSchemes are the URL schemes images may be downloaded with
+// when neither the -allowed-schemes flag nor IMGPROC_ALLOWED_SCHEMES is set
+var defaultAllowedSchemes = []string{"http", "https"}
+
+// urlPolicy restricts the schemes and hosts images may be downloaded from.
+// Host patterns match the host exactly, or with a leading "*." any of its
+// subdomains. A host must match an allowed pattern, if there are any, and
+// must not match a denied pattern.
+type urlPolicy struct {
+	schemes      []string
+	allowedHosts []string
+	deniedHosts  []string
+}
+
+func newURLPolicy(cfg Config) urlPolicy {
+	lower := func(values []string) []string {
+		lowered := make([]string, len(values))
+		for i, v := range values {
+			lowered[i] = strings.ToLower(v)
+		}
+		return lowered
+	}
+	return urlPolicy{
+		schemes:      lower(cfg.AllowedSchemes),
+		allowedHosts: lower(cfg.AllowedHosts),
+		deniedHosts:  lower(cfg.DeniedHosts),
+	}
+}
+
+// Check returns a host_not_allowed error if u may not be downloaded
+func (p urlPolicy) Check(u *url.URL) error {
+	if !slices.Contains(p.schemes, strings.ToLower(u.Scheme)) {
+		return &codedError{Code: codeHostNotAllowed, Err: fmt.Errorf("scheme %q is not allowed", u.Scheme)}
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range p.deniedHosts {
+		if matchHost(pattern, host) {
+			return &codedError{Code: codeHostNotAllowed, Err: fmt.Errorf("host %s is not allowed", host)}
+		}
+	}
+	if len(p.allowedHosts) == 0 {
+		return nil
+	}
+	for _, pattern := range p.allowedHosts {
+		if matchHost(pattern, host) {
+			return nil
+		}
+	}
+	return &codedError{Code: codeHostNotAllowed, Err: fmt.Errorf("host %s is not allowed", host)}
+}
+
+// matchHost reports whether host matches pattern, where "*.example.com"
+// matches every subdomain of example.com but not example.com itself
+func matchHost(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
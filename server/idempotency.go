@@ -0,0 +1,151 @@
+package server
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+)
+
+// defaultIdempotencyTTL is how long an Idempotency-Key is remembered when
+// neither the -idempotency-ttl flag nor IMGPROC_IDEMPOTENCY_TTL is set
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLen is the longest Idempotency-Key header accepted
+const maxIdempotencyKeyLen = 255
+
+// errIdempotencyKeyReused is returned when an Idempotency-Key is submitted
+// again with a different payload
+var errIdempotencyKeyReused = errors.New("Idempotency-Key was already used with a different payload")
+
+// idempotencyEntry records the job created for an Idempotency-Key
+type idempotencyEntry struct {
+	hash      string
+	createdAt time.Time
+
+	// jobID is the job created for the key. It is set before done is closed,
+	// and left empty if the submission failed without creating a job.
+	jobID string
+	done  chan struct{}
+}
+
+// payloadHash returns a canonical hash of a job submission, used to tell a
+// reused Idempotency-Key apart from a retry and to detect duplicate
+// submissions. The decoded request is hashed rather than the body, so
+// formatting differences don't matter, and each visit's image URLs are
+// sorted since their order doesn't change the job. Their expected checksums
+// are sorted along with them, so each stays paired with its image. Force
+// only affects how the submission is accepted, so it is left out.
+func payloadHash(req SubmitJobRequest) string {
+	req.Force = false
+	visits := make([]Visit, len(req.Visits))
+	for i, visit := range req.Visits {
+		type image struct{ url, checksum string }
+		images := make([]image, len(visit.ImageURLs))
+		for j, imageURL := range visit.ImageURLs {
+			images[j] = image{imageURL, expectedChecksum(visit.ExpectedSHA256, j)}
+		}
+		slices.SortFunc(images, func(a, b image) int {
+			return cmp.Or(cmp.Compare(a.url, b.url), cmp.Compare(a.checksum, b.checksum))
+		})
+		visit.ImageURLs = make([]string, len(images))
+		for j, image := range images {
+			visit.ImageURLs[j] = image.url
+		}
+		if len(visit.ExpectedSHA256) > 0 {
+			visit.ExpectedSHA256 = make([]string, len(images))
+			for j, image := range images {
+				visit.ExpectedSHA256[j] = image.checksum
+			}
+		}
+		visits[i] = visit
+	}
+	req.Visits = visits
+
+	data, _ := json.Marshal(req)
+	hash := sha256.New()
+	hash.Write(data)
+	// Download header values are redacted from the JSON, but submissions
+	// sent with different ones are still different
+	if len(req.DownloadHeaders) > 0 || slices.ContainsFunc(visits, func(visit Visit) bool { return len(visit.DownloadHeaders) > 0 }) {
+		hash.Write([]byte(req.DownloadHeaders.fingerprint()))
+		for _, visit := range visits {
+			hash.Write([]byte("\x00" + visit.DownloadHeaders.fingerprint()))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// claimIdempotencyKey looks up key. If a job was already created for it
+// within the retention window, that entry is returned with replay set. If
+// another submission with the key is still in progress, it waits for that one
+// to finish first. Otherwise the key is claimed for the caller, which must
+// call releaseIdempotencyKey once it has created the job or given up. Keys
+// older than the retention window are forgotten along the way.
+func (s *Server) claimIdempotencyKey(key, hash string) (entry *idempotencyEntry, replay bool, err error) {
+	for {
+		s.jobsMu.Lock()
+		for k, entry := range s.idempotencyKeys {
+			// Keys still being claimed have no job yet, and are kept for
+			// the submissions waiting on them
+			if entry.jobID != "" && time.Since(entry.createdAt) > s.cfg.IdempotencyTTL {
+				delete(s.idempotencyKeys, k)
+			}
+		}
+		entry, ok := s.idempotencyKeys[key]
+		if ok && time.Since(entry.createdAt) > s.cfg.IdempotencyTTL {
+			ok = false
+		}
+		if !ok {
+			entry = &idempotencyEntry{hash: hash, createdAt: time.Now(), done: make(chan struct{})}
+			s.idempotencyKeys[key] = entry
+			s.jobsMu.Unlock()
+			return entry, false, nil
+		}
+		s.jobsMu.Unlock()
+
+		if entry.hash != hash {
+			return nil, false, errIdempotencyKeyReused
+		}
+		<-entry.done
+		if entry.jobID != "" {
+			return entry, true, nil
+		}
+		// The submission holding the key failed, so try to claim it again
+	}
+}
+
+// releaseIdempotencyKey records the job created for a claimed key, or frees
+// the key if jobID is empty, and wakes any submissions waiting on it
+func (s *Server) releaseIdempotencyKey(key string, entry *idempotencyEntry, jobID string) {
+	s.jobsMu.Lock()
+	entry.jobID = jobID
+	if jobID == "" && s.idempotencyKeys[key] == entry {
+		delete(s.idempotencyKeys, key)
+	}
+	s.jobsMu.Unlock()
+	close(entry.done)
+}
+
+// restoreIdempotencyKey remembers the key of a job restored from the job
+// store. s.jobsMu must be held.
+func (s *Server) restoreIdempotencyKey(rec JobRecord) {
+	if rec.IdempotencyKey == "" {
+		return
+	}
+	key := ownerScoped(rec.Owner, rec.IdempotencyKey)
+	if existing, ok := s.idempotencyKeys[key]; ok && existing.createdAt.After(rec.CreatedAt) {
+		return
+	}
+	done := make(chan struct{})
+	close(done)
+	s.idempotencyKeys[key] = &idempotencyEntry{
+		hash:      rec.PayloadHash,
+		createdAt: rec.CreatedAt,
+		jobID:     rec.ID,
+		done:      done,
+	}
+}
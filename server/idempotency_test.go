@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// submitWithKey submits req to h with the given Idempotency-Key
+func submitWithKey(t *testing.T, h http.Handler, key string, req SubmitJobRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/api/submit", bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Idempotency-Key", key)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestIdempotencyKeyConcurrentSubmissions(t *testing.T) {
+	const submissions = 8
+	s := newTestServer(t, nil)
+	fixtures := serveFixtures(t)
+	// Forced, so only the key stops the payload being processed twice
+	req := SubmitJobRequest{
+		Count:  1,
+		Visits: []Visit{{StoreID: "S00339218", ImageURLs: []string{fixtures.URL + "/shelf.jpg"}}},
+		Force:  true,
+	}
+
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, submissions)
+	for i := range recs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recs[i] = submitWithKey(t, s, "order-1", req)
+		}()
+	}
+	wg.Wait()
+
+	created := 0
+	jobIDs := make(map[string]bool)
+	for _, rec := range recs {
+		var resp JobResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+		}
+		switch rec.Code {
+		case http.StatusCreated:
+			created++
+		case http.StatusOK:
+		default:
+			t.Errorf("submission: %d %s", rec.Code, rec.Body.String())
+		}
+		jobIDs[resp.JobID] = true
+	}
+	if created != 1 || len(jobIDs) != 1 {
+		t.Errorf("%d submissions created %d jobs with IDs %v, want one job", submissions, created, jobIDs)
+	}
+	for jobID := range jobIDs {
+		waitForJob(t, s, jobID)
+	}
+}
+
+func TestIdempotencyKeyReused(t *testing.T) {
+	s := newTestServer(t, nil)
+	fixtures := serveFixtures(t)
+	req := SubmitJobRequest{Count: 1, Visits: []Visit{{StoreID: "S00339218", ImageURLs: []string{fixtures.URL + "/shelf.jpg"}}}}
+	first := submitWithKey(t, s, "order-1", req)
+	var resp JobResponse
+	if err := json.Unmarshal(first.Body.Bytes(), &resp); err != nil || first.Code != http.StatusCreated {
+		t.Fatalf("first submission: %d %s", first.Code, first.Body.String())
+	}
+	defer waitForJob(t, s, resp.JobID)
+
+	req.Visits[0].ImageURLs = []string{fixtures.URL + "/solid.png"}
+	rec := submitWithKey(t, s, "order-1", req)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), errIdempotencyKeyReused.Error()) {
+		t.Errorf("reusing the key for another payload: %d %s, want 422", rec.Code, rec.Body.String())
+	}
+
+	if rec := submitWithKey(t, s, strings.Repeat("k", maxIdempotencyKeyLen+1), req); rec.Code != http.StatusBadRequest {
+		t.Errorf("overlong key: %d %s, want 400", rec.Code, rec.Body.String())
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.IdempotencyTTL = 10 * time.Millisecond })
+	fixtures := serveFixtures(t)
+	req := SubmitJobRequest{Count: 1, Visits: []Visit{{StoreID: "S00339218", ImageURLs: []string{fixtures.URL + "/shelf.jpg"}}}, Force: true}
+	var jobIDs []string
+	defer func() {
+		for _, jobID := range jobIDs {
+			waitForJob(t, s, jobID)
+		}
+	}()
+	submit := func(key string) {
+		t.Helper()
+		rec := submitWithKey(t, s, key, req)
+		var resp JobResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusCreated {
+			t.Fatalf("submitting %s: %d %s, want 201", key, rec.Code, rec.Body.String())
+		}
+		jobIDs = append(jobIDs, resp.JobID)
+	}
+	submit("order-1")
+	submit("order-2")
+
+	// Once expired, the key can be used for another payload, and keys that
+	// are never used again are forgotten
+	time.Sleep(20 * time.Millisecond)
+	req.Visits[0].ImageURLs = []string{fixtures.URL + "/solid.png"}
+	submit("order-1")
+	s.jobsMu.Lock()
+	_, remembered := s.idempotencyKeys[ownerScoped("", "order-2")]
+	s.jobsMu.Unlock()
+	if remembered {
+		t.Error("expired key order-2 is still remembered")
+	}
+}
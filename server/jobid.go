@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// newJobID returns a random (version 4) UUID for a new job. Unlike a counter,
+// it can't collide with the ID of a job from before a restart.
+func newJobID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// isJobID reports whether id is a well-formed job ID: a UUID, or a positive
+// integer for jobs created before job IDs were UUIDs
+func isJobID(id string) bool {
+	if isUUID(id) {
+		return true
+	}
+	n, err := strconv.Atoi(id)
+	return err == nil && n > 0 && strconv.Itoa(n) == id
+}
+
+// isUUID reports whether s is a UUID in its canonical hyphenated form, in
+// lowercase as IDs are generated, since they are looked up exactly
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// jsonJobID is a job ID decoded from JSON, which may be a number for jobs
+// created before job IDs were UUIDs
+type jsonJobID string
+
+func (id *jsonJobID) UnmarshalJSON(data []byte) error {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		*id = jsonJobID(strconv.Itoa(n))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*id = jsonJobID(s)
+	return nil
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+)
+
+// JobRetryRequest represents the optional request payload for retrying a job
+type JobRetryRequest struct {
+	// Include limits the retry to the images that failed with these error
+	// codes. Every failed image is retried if it is empty.
+	Include []string `json:"include,omitempty"`
+}
+
+// handleRetryJob handles the job retry endpoint, which creates a new job for
+// the images a finished job failed to process. The new job links back to the
+// original through its retry_of, and the original lists it in its retries,
+// but is otherwise left as it was.
+func (s *Server) handleRetryJob(w http.ResponseWriter, r *http.Request) {
+	if !s.allowSubmit(w, r) {
+		return
+	}
+
+	body, err := requestBody(w, r, s.cfg.MaxBodyBytes)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	defer body.Close()
+
+	// The body is optional, and retries every failed image when empty
+	var req JobRetryRequest
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&req)
+	if err != nil && writeBodyError(w, err) {
+		return
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		responseError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	for _, code := range req.Include {
+		if !errorCodes[code] {
+			responseError(w, http.StatusBadRequest, fmt.Sprintf("invalid include: unknown error code %q", code))
+			return
+		}
+	}
+
+	job, ok := s.lookupJob(w, r)
+	if !ok {
+		return
+	}
+	snap := job.Snapshot()
+	if snap.Status == statusQueued || snap.Status == statusOngoing {
+		responseJobError(w, http.StatusConflict, fmt.Sprintf("job is %s, it can only be retried once it has finished", snap.Status), snap.ID)
+		return
+	}
+	// Jobs persisted before visits were recorded don't have the image URLs
+	// of unknown stores' visits
+	if len(job.Visits) == 0 && snap.Progress.Total > 0 {
+		responseJobError(w, http.StatusConflict, "job was submitted before it could be retried", snap.ID)
+		return
+	}
+	// Uploaded images are released once their job finishes
+	if hasUploads(job.Visits) {
+		responseJobError(w, http.StatusConflict, "job's images were uploaded, so they must be uploaded again", snap.ID)
+		return
+	}
+	// Download headers aren't persisted, so a restored job no longer has them
+	if slices.ContainsFunc(job.Visits, func(visit JobVisit) bool { return visit.DownloadHeaders.redacted() }) {
+		responseJobError(w, http.StatusConflict, "job's download headers weren't stored, so it must be submitted again", snap.ID)
+		return
+	}
+	visits := retryVisits(job.Visits, snap.Errors, req.Include)
+	if len(visits) == 0 {
+		responseJobError(w, http.StatusConflict, "job has no failed images to retry", snap.ID)
+		return
+	}
+
+	retry, ok := s.enqueueJob(w, r, SubmitJobRequest{
+		Count:    len(visits),
+		Visits:   visits,
+		Priority: snap.Priority,
+	}, jobOrigin{retryOf: job.ID})
+	if !ok {
+		return
+	}
+
+	job.mu.Lock()
+	job.Retries = append(job.Retries, retry.ID)
+	rec := job.record()
+	job.mu.Unlock()
+	s.persist(s.jobStore.SaveJob(rec))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(JobResponse{JobID: retry.ID, TraceID: retry.span.TraceID(), RetryOf: job.ID})
+}
+
+// retryVisits returns the visits of a retry job: each of the job's visits
+// with failed images, in order, with its store and visit time and only the
+// images that failed with one of the codes in include, or with any code if
+// include is empty. A visit that failed as a whole, because its store was
+// unknown, is retried with all its images.
+func retryVisits(visits []JobVisit, errs []StoreError, include []string) []Visit {
+	var retries []Visit
+	last, lastImage := -1, -1
+	for _, storeErr := range errs {
+		if storeErr.Visit >= len(visits) || len(include) > 0 && !slices.Contains(include, storeErr.Code) {
+			continue
+		}
+		visit := visits[storeErr.Visit]
+		if storeErr.Visit != last {
+			retries = append(retries, Visit{
+				StoreID:         visit.StoreID,
+				VisitTime:       formatTime(visit.VisitTime),
+				Archive:         visit.Archive,
+				DownloadHeaders: visit.DownloadHeaders,
+			})
+			last, lastImage = storeErr.Visit, -1
+		}
+		retry := &retries[len(retries)-1]
+		// Expected checksums stay with their images
+		checked := len(visit.ExpectedSHA256) > 0
+		switch {
+		case storeErr.Image == nil:
+			retry.ImageURLs = append(retry.ImageURLs, visit.ImageURLs...)
+			if checked {
+				for i := range visit.ImageURLs {
+					retry.ExpectedSHA256 = append(retry.ExpectedSHA256, expectedChecksum(visit.ExpectedSHA256, i))
+				}
+			}
+		case *storeErr.Image == lastImage:
+			// Another failed image of the same ZIP archive
+		case *storeErr.Image < len(visit.ImageURLs):
+			// The errors of a ZIP archive's images name the image in the
+			// archive, but it is the archive that is retried
+			retry.ImageURLs = append(retry.ImageURLs, visit.ImageURLs[*storeErr.Image])
+			if checked {
+				retry.ExpectedSHA256 = append(retry.ExpectedSHA256, expectedChecksum(visit.ExpectedSHA256, *storeErr.Image))
+			}
+			lastImage = *storeErr.Image
+		default:
+			retry.ImageURLs = append(retry.ImageURLs, storeErr.ImageURL)
+			if checked {
+				retry.ExpectedSHA256 = append(retry.ExpectedSHA256, "")
+			}
+		}
+	}
+	return retries
+}
@@ -0,0 +1,435 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Job statuses
+const (
+	statusQueued              = "queued"
+	statusOngoing             = "ongoing"
+	statusCompleted           = "completed"
+	statusCompletedWithErrors = "completed_with_errors"
+	statusFailed              = "failed"
+	statusInterrupted         = "interrupted"
+	statusCancelled           = "cancelled"
+	statusTimedOut            = "timed_out"
+	statusStalled             = "stalled"
+
+	// statusNotFound and statusExpired are reported by the batch status
+	// endpoint for unknown and expired jobs, and are never a job's status
+	statusNotFound = "not_found"
+	statusExpired  = "expired"
+)
+
+// defaultFailureThresholdPercent is the failure threshold used when neither
+// the -failure-threshold-percent flag nor IMGPROC_FAILURE_THRESHOLD_PERCENT
+// is set, which only fails jobs none of whose images succeeded
+const defaultFailureThresholdPercent = 100
+
+// Policies for a job's errors, chosen by SubmitJobRequest.OnError
+const (
+	onErrorContinue = "continue"
+	onErrorFailFast = "fail_fast"
+)
+
+type JobData struct {
+	ID          string
+	Status      string
+	Priority    string
+	Results     []ImageResult
+	Errors      []StoreError
+	Progress    JobProgress
+	CreatedAt   time.Time
+	CompletedAt time.Time
+	Deadline    time.Time
+
+	// TotalBytes is the number of body bytes downloaded for the job's
+	// images, including failed images and retried attempts
+	TotalBytes int64
+
+	// Warnings are the things the job skipped without failing an image. It
+	// is only appended to, so snapshots can share it.
+	Warnings []JobWarning
+
+	// IdempotencyKey is the Idempotency-Key the job was submitted with, and
+	// PayloadHash the hash of its submission
+	IdempotencyKey string
+	PayloadHash    string
+
+	// Owner is the ID of the API key the job was submitted with, if
+	// authentication was on. It never changes.
+	Owner string
+
+	// Visits are the job's visits in the order they were submitted, so its
+	// results can be grouped by visit. It never changes.
+	Visits []JobVisit
+
+	// RetryOf is the ID of the job whose failed images this job retries. It
+	// never changes. Retries are the IDs of the jobs retrying this job's
+	// failed images, oldest first. It is only appended to, so snapshots can
+	// share it.
+	RetryOf string
+	Retries []string
+
+	// Request is the submission the job was created from, so it can be
+	// rerun, or nil if it wasn't kept. It never changes.
+	Request *SubmitJobRequest
+
+	// Webhook tracks the delivery of the job's callback, if it has one.
+	// It is replaced rather than modified, so snapshots can share it.
+	Webhook        *WebhookDelivery
+	includeResults bool
+
+	mu sync.Mutex
+
+	// ctx is cancelled to stop the job's queued and in-flight downloads,
+	// expires at the job's deadline if it has one, and carries the job's
+	// image timeout
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// span covers the job from its submission until it finishes, and is the
+	// parent of its images' spans. It is nil unless tracing is enabled.
+	span *span
+
+	// subscribers receive the job's progress events while it runs, and
+	// changed is closed to wake status requests waiting for the next event
+	subscribers map[*jobSubscriber]struct{}
+	changed     chan struct{}
+
+	// timedOut is set once an image is abandoned because of the deadline
+	timedOut bool
+
+	// failFast stops the job at its first error, and failedFast is set once
+	// it has been stopped that way
+	failFast   bool
+	failedFast bool
+
+	// uploads are the images uploaded with the job, by part name. They are
+	// set before the job is queued and released, under mu, once it has
+	// finished.
+	uploads map[string]uploadedImage
+
+	// failureThreshold is the percentage of the job's images that may fail
+	// before it ends as failed rather than completed_with_errors
+	failureThreshold int
+
+	// lastProgress is when the job started or last processed an image, so
+	// the watchdog can tell when it has stalled
+	lastProgress time.Time
+
+	// duplicates are the job's duplicate images, which are only looked for
+	// once its results are final, and duplicatesFound is set once they have
+	// been
+	duplicates      []DuplicateImages
+	duplicatesFound bool
+}
+
+// JobSnapshot is a copy of a job's state taken under its mutex, so it can be
+// read while image workers keep updating the job
+type JobSnapshot struct {
+	ID          string
+	Status      string
+	Priority    string
+	ResultCount int
+	Errors      []StoreError
+	Warnings    []JobWarning
+	Progress    JobProgress
+	CreatedAt   time.Time
+	CompletedAt time.Time
+	Deadline    time.Time
+	TotalBytes  int64
+	Webhook     *WebhookDelivery
+	RetryOf     string
+	Retries     []string
+}
+
+// Snapshot returns a copy of the job's state, excluding its results
+func (job *JobData) Snapshot() JobSnapshot {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.snapshotLocked()
+}
+
+// SnapshotWithResults returns a copy of the job's state along with a copy of
+// its results
+func (job *JobData) SnapshotWithResults() (JobSnapshot, []ImageResult) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	results := make([]ImageResult, len(job.Results))
+	copy(results, job.Results)
+	return job.snapshotLocked(), results
+}
+
+// resultsFrom returns a copy of up to n of the job's results starting at
+// index start, so long exports can copy the results a chunk at a time
+// rather than holding the job's mutex throughout. Results are kept in
+// submission order, so indexes only stay put once the job has finished.
+func (job *JobData) resultsFrom(start, n int) []ImageResult {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	end := min(start+n, len(job.Results))
+	if start >= end {
+		return nil
+	}
+	return append([]ImageResult(nil), job.Results[start:end]...)
+}
+
+func (job *JobData) snapshotLocked() JobSnapshot {
+	return JobSnapshot{
+		ID:          job.ID,
+		Status:      job.Status,
+		Priority:    job.Priority,
+		ResultCount: len(job.Results),
+		Errors:      append([]StoreError(nil), job.Errors...),
+		Warnings:    job.Warnings,
+		Progress:    job.Progress,
+		CreatedAt:   job.CreatedAt,
+		CompletedAt: job.CompletedAt,
+		Deadline:    job.Deadline,
+		TotalBytes:  job.TotalBytes,
+		Webhook:     job.Webhook,
+		RetryOf:     job.RetryOf,
+		Retries:     job.Retries,
+	}
+}
+
+// Summary returns the job's list-jobs entry, taken under its mutex
+func (job *JobData) Summary() JobSummary {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	summary := JobSummary{
+		JobID:       job.ID,
+		Status:      job.Status,
+		Priority:    job.Priority,
+		CreatedAt:   job.CreatedAt,
+		ResultCount: len(job.Results),
+		ErrorCount:  len(job.Errors),
+	}
+	if !job.CompletedAt.IsZero() {
+		completedAt := job.CompletedAt
+		summary.CompletedAt = &completedAt
+	}
+	return summary
+}
+
+// statusResponse builds the status endpoint's response from the snapshot
+func (snap JobSnapshot) statusResponse() JobStatusResponse {
+	response := JobStatusResponse{
+		Status:             snap.Status,
+		JobID:              snap.ID,
+		Priority:           snap.Priority,
+		SuccessfulCount:    snap.ResultCount,
+		FailedCount:        snap.Progress.Failed,
+		Progress:           snap.Progress,
+		FailureRatePercent: snap.Progress.failureRate(),
+		CreatedAt:          snap.CreatedAt,
+		TotalBytes:         snap.TotalBytes,
+		Errors:             snap.Errors,
+		Warnings:           snap.Warnings,
+		Webhook:            snap.Webhook,
+		RetryOf:            snap.RetryOf,
+		Retries:            snap.Retries,
+	}
+	if !snap.CompletedAt.IsZero() {
+		completedAt := snap.CompletedAt
+		response.CompletedAt = &completedAt
+	}
+	if !snap.Deadline.IsZero() {
+		deadline := snap.Deadline
+		response.Deadline = &deadline
+	}
+	return response
+}
+
+// processJob processes a job. Unknown stores and failed images are recorded
+// as errors without stopping the remaining visits from being processed,
+// unless the job fails fast.
+func (s *Server) processJob(job *JobData, req SubmitJobRequest) {
+	// Release the deadline's timer and any uploaded images once the job is
+	// done
+	defer job.cancel()
+	defer func() {
+		job.mu.Lock()
+		job.uploads = nil
+		job.mu.Unlock()
+	}()
+
+	// A job cancelled or interrupted while it was queued is already finalized
+	job.mu.Lock()
+	if job.Status != statusQueued {
+		job.mu.Unlock()
+		return
+	}
+	job.Status = statusOngoing
+	job.lastProgress = time.Now()
+	job.publishLocked(streamEventStatus, job.snapshotLocked().statusResponse())
+	rec := job.record()
+	job.mu.Unlock()
+	s.metrics.jobStarted()
+	defer s.metrics.jobStopped()
+	s.logger(job.ctx).Info("job started", "images", rec.Progress.Total, "queued_ms", time.Since(rec.CreatedAt).Milliseconds())
+	s.persist(s.jobStore.SaveJob(rec))
+
+	var wg sync.WaitGroup
+
+	// The job sticks to the store master as it was when it started, even if
+	// it is reloaded meanwhile
+	stores := s.storeMaster()
+
+	// Images are queued once every visit has been checked, so that identical
+	// URLs can be grouped into a single task when deduplicating
+	var tasks []*imageTask
+	tasksByURL := make(map[string]*imageTask)
+
+	// Process each visit
+	for i, visit := range req.Visits {
+		storeID := visit.StoreID
+		store, exists := stores[storeID]
+		image := taskImage{visit: i, store: store, visitTime: visitTime(visit)}
+
+		// Check if the store exists
+		if !exists {
+			storeErr := StoreError{
+				StoreID: storeID,
+				Code:    codeStoreNotFound,
+				Error:   "Store ID does not exist",
+				Visit:   i,
+			}
+			job.mu.Lock()
+			job.addErrorLocked(storeErr)
+			job.Progress.Failed += len(visit.ImageURLs)
+			job.publishLocked(streamEventError, storeErr)
+			job.stopOnErrorLocked()
+			job.mu.Unlock()
+			s.persist(s.jobStore.AppendError(job.ID, storeErr, len(visit.ImageURLs)))
+			s.metrics.imagesFailed(codeStoreNotFound, len(visit.ImageURLs))
+			if job.failFast {
+				break
+			}
+			continue
+		}
+
+		headers := req.DownloadHeaders.merge(visit.DownloadHeaders)
+		for j, imageURL := range visit.ImageURLs {
+			image.image = j
+			image.expectedSHA256 = expectedChecksum(visit.ExpectedSHA256, j)
+			archive := visit.Archive || isArchiveURL(imageURL)
+			// Only downloads sent with the same headers are shared
+			key := imageURL + " " + headers.fingerprint()
+			if task, ok := tasksByURL[key]; ok && req.Dedupe {
+				task.images = append(task.images, image)
+				task.archive = task.archive || archive
+				continue
+			}
+			task := &imageTask{
+				job:      job,
+				imageURL: imageURL,
+				images:   []taskImage{image},
+				wg:       &wg,
+				archive:  archive,
+				headers:  headers,
+			}
+			tasks = append(tasks, task)
+			tasksByURL[key] = task
+		}
+	}
+
+	// Queue the images on the shared worker pool
+	for _, task := range tasks {
+		wg.Add(1)
+		select {
+		case s.tasks <- *task:
+		case <-job.ctx.Done():
+			s.recordTimedOut(job, task.imageURL, task.images)
+			wg.Done()
+		}
+	}
+
+	// Wait for all image processing to complete
+	wg.Wait()
+
+	job.mu.Lock()
+	if job.Status != statusOngoing {
+		// The job was cancelled or interrupted, which already finalized it
+		job.mu.Unlock()
+		return
+	}
+	switch {
+	case job.timedOut:
+		job.Status = statusTimedOut
+	case job.failedFast:
+		job.Status = statusFailed
+	case len(job.Errors) == 0:
+		job.Status = statusCompleted
+	case len(job.Results) > 0 && !job.Progress.exceeds(job.failureThreshold):
+		job.Status = statusCompletedWithErrors
+	default:
+		// Failed only judges the job as a whole. Whatever results it has are
+		// kept and served like any finished job's.
+		job.Status = statusFailed
+	}
+	job.CompletedAt = time.Now()
+	rec = job.record()
+	job.mu.Unlock()
+
+	s.persist(s.jobStore.SaveJob(rec))
+	s.finishJob(job)
+}
+
+// exceeds reports whether more than thresholdPercent of the images have
+// failed
+func (p JobProgress) exceeds(thresholdPercent int) bool {
+	return p.Failed*100 > thresholdPercent*p.Total
+}
+
+// failureRate returns the percentage of the images that have failed so far,
+// rounded to 2 decimals
+func (p JobProgress) failureRate() float64 {
+	if p.Total == 0 {
+		return 0
+	}
+	return roundTo(float64(p.Failed)*100/float64(p.Total), 2)
+}
+
+// stopOnErrorLocked stops a fail-fast job once it has recorded an error,
+// cancelling its context so that its in-flight downloads abort and its
+// queued images are skipped. The job's mutex must be held.
+func (job *JobData) stopOnErrorLocked() {
+	if job.failFast && !job.failedFast {
+		job.failedFast = true
+		job.cancel()
+	}
+}
+
+// recordTimedOut records an error for each image of a job that was abandoned
+// because the job's deadline passed. Images abandoned because the job was
+// cancelled already have their errors, and those of an interrupted job are
+// not recorded.
+func (s *Server) recordTimedOut(job *JobData, imageURL string, images []taskImage) {
+	if !errors.Is(job.ctx.Err(), context.DeadlineExceeded) {
+		return
+	}
+	for _, image := range images {
+		storeErr := StoreError{
+			StoreID:  image.store.StoreID,
+			ImageURL: imageURL,
+			Code:     codeJobTimedOut,
+			Error:    "job deadline passed before the image was processed",
+			Visit:    image.visit,
+			Image:    &image.image,
+		}
+		job.mu.Lock()
+		job.addErrorLocked(storeErr)
+		job.Progress.Failed++
+		job.timedOut = true
+		job.publishLocked(streamEventError, storeErr)
+		job.mu.Unlock()
+		s.persist(s.jobStore.AppendError(job.ID, storeErr, 1))
+		s.metrics.imagesFailed(codeJobTimedOut, 1)
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestJobStatusDuringProcessing reads a job through every status endpoint
+// while its images are processed, so `go test -race` catches reads that
+// don't go through a snapshot
+func TestJobStatusDuringProcessing(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Workers = 4 })
+	_, host := newConcurrencyRecorder(t, time.Millisecond)
+	fixtures := serveFixtures(t)
+
+	jobID := submitJob(t, s, SubmitJobRequest{
+		Count: 3,
+		Visits: []Visit{
+			{StoreID: "S00339218", ImageURLs: imageURLs(host.URL, 30)},
+			{StoreID: "S01408764", ImageURLs: []string{fixtures.URL + "/missing.jpg"}},
+			// Unknown stores fail as soon as the job starts
+			{StoreID: "unknown", ImageURLs: []string{fixtures.URL + "/shelf.jpg"}},
+		},
+	})
+
+	paths := []string{
+		"/api/jobs/" + jobID,
+		"/status?jobid=" + jobID,
+		"/api/jobs/" + jobID + "/results?partial=true",
+		"/api/jobs/" + jobID + "/summary?partial=true",
+		"/api/jobs/" + jobID + "/results.csv?partial=true",
+		"/api/jobs",
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if rec := doRaw(t, s, "GET", path, nil, nil); rec.Code != http.StatusOK {
+					t.Errorf("GET %s: %d %s", path, rec.Code, rec.Body.String())
+					return
+				}
+				// Leave the workers some CPU on small machines
+				time.Sleep(2 * time.Millisecond)
+			}
+		}()
+	}
+
+	status := waitForJob(t, s, jobID)
+	close(done)
+	wg.Wait()
+	if want := (JobProgress{Total: 32, Completed: 30, Failed: 2}); status.Progress != want {
+		t.Errorf("progress = %+v, want %+v", status.Progress, want)
+	}
+	if status.CompletedAt == nil {
+		t.Error("completed_at is missing")
+	}
+}
+
+func TestOnError(t *testing.T) {
+	image := tinyPNG(t)
+	tests := []struct {
+		onError  string
+		status   string
+		progress JobProgress
+		fetched  int
+	}{
+		// The queued images are never fetched once the first one fails
+		{onErrorFailFast, statusFailed, JobProgress{Total: 6, Failed: 1}, 0},
+		{onErrorContinue, statusCompletedWithErrors, JobProgress{Total: 6, Completed: 5, Failed: 1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onError, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := make(map[string]int)
+			host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests[r.URL.Path]++
+				mu.Unlock()
+				if r.URL.Path == "/missing.png" {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write(image)
+			}))
+			t.Cleanup(host.Close)
+			// A single worker fetches the images in order, so the rest are
+			// queued behind the failing one
+			s := newTestServer(t, func(cfg *Config) { cfg.Workers = 1 })
+
+			urls := []string{host.URL + "/missing.png"}
+			for i := range 5 {
+				urls = append(urls, fmt.Sprintf("%s/queued%d.png", host.URL, i))
+			}
+			jobID := submitJob(t, s, SubmitJobRequest{
+				Count:   1,
+				Visits:  []Visit{{StoreID: "S00339218", ImageURLs: urls}},
+				OnError: tt.onError,
+			})
+			status := waitForJob(t, s, jobID)
+			if status.Status != tt.status {
+				t.Errorf("status = %s, want %s", status.Status, tt.status)
+			}
+			if status.Progress.Total != tt.progress.Total || status.Progress.Completed != tt.progress.Completed {
+				t.Errorf("progress = %+v, want %+v", status.Progress, tt.progress)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if requests["/missing.png"] != 1 {
+				t.Errorf("the failing image was fetched %d times, want 1", requests["/missing.png"])
+			}
+			for i := range 5 {
+				if got := requests[fmt.Sprintf("/queued%d.png", i)]; got != tt.fetched {
+					t.Errorf("queued image %d was fetched %d times, want %d", i, got, tt.fetched)
+				}
+			}
+		})
+	}
+}
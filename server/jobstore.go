@@ -0,0 +1,484 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobRecord is the persisted form of a job
+type JobRecord struct {
+	ID          string        `json:"id"`
+	Status      string        `json:"status"`
+	Priority    string        `json:"priority,omitempty"`
+	Results     []ImageResult `json:"results,omitempty"`
+	Errors      []StoreError  `json:"errors,omitempty"`
+	Warnings    []JobWarning  `json:"warnings,omitempty"`
+	Progress    JobProgress   `json:"progress"`
+	CreatedAt   time.Time     `json:"created_at"`
+	CompletedAt time.Time     `json:"completed_at,omitempty"`
+	Deadline    time.Time     `json:"deadline,omitempty"`
+	TotalBytes  int64         `json:"total_bytes,omitempty"`
+
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	PayloadHash    string `json:"payload_hash,omitempty"`
+	Owner          string `json:"owner,omitempty"`
+
+	Webhook *WebhookDelivery `json:"webhook,omitempty"`
+	Visits  []JobVisit       `json:"visits,omitempty"`
+	RetryOf string           `json:"retry_of,omitempty"`
+	Retries []string         `json:"retries,omitempty"`
+
+	Request *SubmitJobRequest `json:"request,omitempty"`
+
+	// Expired is set once the job has been removed after its retention
+	// period. Only its metadata is kept, so its images still count towards
+	// its owner's quota.
+	Expired   bool      `json:"expired,omitempty"`
+	ExpiredAt time.Time `json:"expired_at,omitzero"`
+}
+
+// UnmarshalJSON decodes a record, accepting the integer IDs of jobs created
+// before job IDs were UUIDs
+func (rec *JobRecord) UnmarshalJSON(data []byte) error {
+	type plainRecord JobRecord
+	aux := struct {
+		*plainRecord
+		ID jsonJobID `json:"id"`
+	}{plainRecord: (*plainRecord)(rec)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	rec.ID = string(aux.ID)
+	return nil
+}
+
+// JobStore persists jobs as they are processed so they survive restarts.
+// SaveJob records a job's metadata (status, progress totals and timestamps)
+// and is called when the job is created and when it finishes, while results
+// and errors are appended as they are produced. images is the number of
+// images a StoreError accounts for. ExpireJob drops everything but the
+// metadata of a job removed after its retention period.
+type JobStore interface {
+	SaveJob(rec JobRecord) error
+	AppendResult(jobID string, result ImageResult) error
+	AppendError(jobID string, storeErr StoreError, images int) error
+	ExpireJob(jobID string) error
+	LoadJobs() ([]JobRecord, error)
+}
+
+// compactingJobStore is implemented by job stores that grow as jobs change,
+// and can be rewritten to hold only the jobs that keep returns true for
+type compactingJobStore interface {
+	Compact(keep func(JobRecord) bool) error
+}
+
+// nopJobStore is the JobStore used when jobs aren't persisted. The server
+// already holds every job in memory, so there is nothing to keep.
+type nopJobStore struct{}
+
+func (nopJobStore) SaveJob(JobRecord) error                   { return nil }
+func (nopJobStore) AppendResult(string, ImageResult) error    { return nil }
+func (nopJobStore) AppendError(string, StoreError, int) error { return nil }
+func (nopJobStore) ExpireJob(string) error                    { return nil }
+func (nopJobStore) LoadJobs() ([]JobRecord, error)            { return nil, nil }
+
+// jobEvent is a single line of a fileJobStore log
+type jobEvent struct {
+	Type   string       `json:"type"`
+	JobID  jsonJobID    `json:"job_id"`
+	Job    *JobRecord   `json:"job,omitempty"`
+	Result *ImageResult `json:"result,omitempty"`
+	Error  *StoreError  `json:"error,omitempty"`
+	Images int          `json:"images,omitempty"`
+
+	// KeyID and At are set for quota resets, which belong to an API key
+	// rather than a job
+	KeyID string    `json:"key_id,omitempty"`
+	At    time.Time `json:"at,omitzero"`
+}
+
+// Job event types
+const (
+	eventJob    = "job"
+	eventResult = "result"
+	eventError  = "error"
+	eventExpiry = "expiry"
+
+	// eventSnapshot replaces a job with the whole of Job, as written by
+	// compaction
+	eventSnapshot = "snapshot"
+
+	eventQuotaReset = "quota_reset"
+)
+
+// fileJobStore is a JobStore that appends every change as a JSON line to a
+// log file, which is replayed to rebuild the jobs on startup. Compact
+// rewrites the log with a single line per job.
+type fileJobStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	enc  *json.Encoder
+}
+
+// OpenFileJobStore opens (creating if needed) the job log at path
+func OpenFileJobStore(path string) (JobStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening job store: %v", err)
+	}
+	return &fileJobStore{path: path, file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (s *fileJobStore) append(event jobEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(event); err != nil {
+		return fmt.Errorf("error writing job store: %v", err)
+	}
+	return nil
+}
+
+func (s *fileJobStore) SaveJob(rec JobRecord) error {
+	rec.Results = nil
+	rec.Errors = nil
+	return s.append(jobEvent{Type: eventJob, JobID: jsonJobID(rec.ID), Job: &rec})
+}
+
+func (s *fileJobStore) AppendResult(jobID string, result ImageResult) error {
+	return s.append(jobEvent{Type: eventResult, JobID: jsonJobID(jobID), Result: &result})
+}
+
+func (s *fileJobStore) AppendError(jobID string, storeErr StoreError, images int) error {
+	return s.append(jobEvent{Type: eventError, JobID: jsonJobID(jobID), Error: &storeErr, Images: images})
+}
+
+func (s *fileJobStore) ExpireJob(jobID string) error {
+	return s.append(jobEvent{Type: eventExpiry, JobID: jsonJobID(jobID), At: time.Now()})
+}
+
+func (s *fileJobStore) LoadJobs() ([]JobRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadJobsLocked()
+}
+
+// loadJobsLocked replays the log. s.mu must be held.
+func (s *fileJobStore) loadJobsLocked() ([]JobRecord, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening job store: %v", err)
+	}
+	defer file.Close()
+
+	jobs := make(map[string]*JobRecord)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var event jobEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// A crash can leave a partially written last line behind
+			slog.Warn("skipping malformed job store line", "path", s.path, "line", line, "error", err)
+			continue
+		}
+
+		if event.Type == eventQuotaReset {
+			continue
+		}
+		jobID := string(event.JobID)
+		rec, ok := jobs[jobID]
+		if !ok {
+			rec = &JobRecord{ID: jobID}
+			jobs[jobID] = rec
+		}
+		switch {
+		case event.Type == eventJob && event.Job != nil:
+			applyJobMetadata(rec, *event.Job)
+		case event.Type == eventResult && event.Result != nil:
+			applyResult(rec, *event.Result)
+		case event.Type == eventError && event.Error != nil:
+			applyError(rec, *event.Error, event.Images)
+		case event.Type == eventExpiry:
+			applyExpiry(rec, event.At)
+		case event.Type == eventSnapshot && event.Job != nil:
+			*rec = *event.Job
+			rec.ID = jobID
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading job store: %v", err)
+	}
+
+	records := make([]JobRecord, 0, len(jobs))
+	for _, rec := range jobs {
+		records = append(records, *rec)
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+func (s *fileJobStore) SaveQuotaReset(keyID string, at time.Time) error {
+	return s.append(jobEvent{Type: eventQuotaReset, KeyID: keyID, At: at})
+}
+
+// LoadQuotaResets returns the time each API key's quota was last reset
+func (s *fileJobStore) LoadQuotaResets() (map[string]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadQuotaResetsLocked()
+}
+
+// loadQuotaResetsLocked reads the quota resets from the log. s.mu must be
+// held.
+func (s *fileJobStore) loadQuotaResetsLocked() (map[string]time.Time, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening job store: %v", err)
+	}
+	defer file.Close()
+
+	resets := make(map[string]time.Time)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event jobEvent
+		if json.Unmarshal(scanner.Bytes(), &event) != nil || event.Type != eventQuotaReset {
+			continue
+		}
+		if event.At.After(resets[event.KeyID]) {
+			resets[event.KeyID] = event.At
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading job store: %v", err)
+	}
+	return resets, nil
+}
+
+// Compact rewrites the log with a snapshot of each job that keep returns true
+// for and the last reset of each quota, dropping the results and errors of
+// expired jobs along with the lines they were spread over. The new log is
+// written to a temporary file and renamed into place, so a crash leaves
+// either log whole.
+func (s *fileJobStore) Compact(keep func(JobRecord) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.loadJobsLocked()
+	if err != nil {
+		return err
+	}
+	resets, err := s.loadQuotaResetsLocked()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error compacting job store: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if !keep(rec) {
+			continue
+		}
+		if err := enc.Encode(jobEvent{Type: eventSnapshot, JobID: jsonJobID(rec.ID), Job: &rec}); err != nil {
+			tmp.Close()
+			return fmt.Errorf("error compacting job store: %v", err)
+		}
+	}
+	for keyID, at := range resets {
+		if err := enc.Encode(jobEvent{Type: eventQuotaReset, KeyID: keyID, At: at}); err != nil {
+			tmp.Close()
+			return fmt.Errorf("error compacting job store: %v", err)
+		}
+	}
+	if err := errors.Join(w.Flush(), tmp.Sync(), tmp.Close()); err != nil {
+		return fmt.Errorf("error compacting job store: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("error compacting job store: %v", err)
+	}
+
+	// Appends go to the new log from now on
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("error reopening job store: %v", err)
+	}
+	s.file.Close()
+	s.file, s.enc = file, json.NewEncoder(file)
+	return nil
+}
+
+// applyJobMetadata updates rec with the metadata saved in update. Completed
+// and failed counts are derived from the results and errors instead.
+func applyJobMetadata(rec *JobRecord, update JobRecord) {
+	rec.Status = update.Status
+	rec.Priority = update.Priority
+	rec.Progress.Total = update.Progress.Total
+	rec.Warnings = update.Warnings
+	rec.CreatedAt = update.CreatedAt
+	rec.CompletedAt = update.CompletedAt
+	rec.Deadline = update.Deadline
+	rec.TotalBytes = update.TotalBytes
+	rec.IdempotencyKey = update.IdempotencyKey
+	rec.PayloadHash = update.PayloadHash
+	rec.Owner = update.Owner
+	rec.Webhook = update.Webhook
+	rec.Visits = update.Visits
+	rec.RetryOf = update.RetryOf
+	rec.Retries = update.Retries
+	rec.Request = update.Request
+}
+
+func applyResult(rec *JobRecord, result ImageResult) {
+	rec.Results = append(rec.Results, result)
+	rec.Progress.Completed++
+}
+
+func applyError(rec *JobRecord, storeErr StoreError, images int) {
+	rec.Errors = append(rec.Errors, storeErr)
+	rec.Progress.Failed += images
+}
+
+// applyExpiry drops everything but the metadata of an expired job. Its
+// completed and failed counts are kept, since they can no longer be derived
+// from its results and errors.
+func applyExpiry(rec *JobRecord, at time.Time) {
+	rec.Expired = true
+	rec.ExpiredAt = at
+	rec.Results = nil
+	rec.Errors = nil
+	rec.Warnings = nil
+	rec.Visits = nil
+	rec.Request = nil
+}
+
+// sortRecords sorts records oldest first
+func sortRecords(records []JobRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].CreatedAt.Equal(records[j].CreatedAt) {
+			return records[i].CreatedAt.Before(records[j].CreatedAt)
+		}
+		return records[i].ID < records[j].ID
+	})
+}
+
+// RestoreJobs rebuilds the jobs map from the job store. Jobs that were still
+// queued or ongoing when the server stopped can never finish, so they are marked as
+// interrupted. It must be called before the server starts handling requests.
+func (s *Server) RestoreJobs() error {
+	records, err := s.jobStore.LoadJobs()
+	if err != nil {
+		return err
+	}
+
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	for _, rec := range records {
+		if rec.Expired {
+			s.expiredJobs[rec.ID] = expiredJob{
+				owner:     rec.Owner,
+				createdAt: rec.CreatedAt,
+				images:    rec.Progress.Completed + rec.Progress.Failed,
+				// Jobs expired before expiry times were stored count from now
+				expiredAt: cmp.Or(rec.ExpiredAt, time.Now()),
+			}
+			continue
+		}
+		// Jobs persisted before priorities were added are normal priority
+		if rec.Priority == "" {
+			rec.Priority = priorityNormal
+		}
+		if rec.Status == statusQueued || rec.Status == statusOngoing {
+			rec.Status = statusInterrupted
+			if err := s.jobStore.SaveJob(rec); err != nil {
+				return err
+			}
+		}
+
+		sortResults(rec.Results, rec.Errors)
+		job := &JobData{
+			ID:          rec.ID,
+			Status:      rec.Status,
+			Priority:    rec.Priority,
+			Results:     rec.Results,
+			Errors:      rec.Errors,
+			Warnings:    rec.Warnings,
+			Progress:    rec.Progress,
+			CreatedAt:   rec.CreatedAt,
+			CompletedAt: rec.CompletedAt,
+			Deadline:    rec.Deadline,
+			TotalBytes:  rec.TotalBytes,
+
+			IdempotencyKey: rec.IdempotencyKey,
+			PayloadHash:    rec.PayloadHash,
+			Owner:          rec.Owner,
+			Webhook:        rec.Webhook,
+			Visits:         rec.Visits,
+			RetryOf:        rec.RetryOf,
+			Retries:        rec.Retries,
+			Request:        rec.Request,
+		}
+		s.jobs[rec.ID] = job
+		s.restoreIdempotencyKey(rec)
+		if rec.PayloadHash != "" {
+			s.recordPayload(job)
+		}
+	}
+	if err := s.restoreQuotas(); err != nil {
+		return err
+	}
+
+	if len(records) > 0 {
+		s.log.Info("restored jobs from the job store", "jobs", len(records))
+	}
+	return nil
+}
+
+// record returns the persisted form of the job's metadata. The caller must
+// hold job.mu.
+func (job *JobData) record() JobRecord {
+	return JobRecord{
+		ID:          job.ID,
+		Status:      job.Status,
+		Priority:    job.Priority,
+		Warnings:    job.Warnings,
+		Progress:    job.Progress,
+		CreatedAt:   job.CreatedAt,
+		CompletedAt: job.CompletedAt,
+		Deadline:    job.Deadline,
+		TotalBytes:  job.TotalBytes,
+
+		IdempotencyKey: job.IdempotencyKey,
+		PayloadHash:    job.PayloadHash,
+		Owner:          job.Owner,
+		Webhook:        job.Webhook,
+		Visits:         job.Visits,
+		RetryOf:        job.RetryOf,
+		Retries:        job.Retries,
+		Request:        job.Request,
+	}
+}
+
+// persist runs a job store write, logging failures rather than failing the
+// job, since the job itself is still held in memory
+func (s *Server) persist(err error) {
+	if err != nil {
+		s.log.Error("job store error", "error", err)
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultMaxVisits is the largest number of visits a job may have when
+// neither the -max-visits flag nor IMGPROC_MAX_VISITS is set
+const defaultMaxVisits = 10000
+
+// defaultMaxImages is the largest number of image URLs a job may have, across
+// all of its visits, when neither the -max-images flag nor IMGPROC_MAX_IMAGES
+// is set
+const defaultMaxImages = 100000
+
+// LimitsResponse represents the response for the limits endpoint, and is
+// included in errors for submissions that exceed them
+type LimitsResponse struct {
+	MaxBodyBytes      int64 `json:"max_body_bytes"`
+	MaxVisits         int   `json:"max_visits"`
+	MaxImages         int   `json:"max_images"`
+	MaxImageTimeoutMS int   `json:"max_image_timeout_ms"`
+
+	// JobRetentionSeconds is how long finished jobs are kept, or 0 if they
+	// are kept forever
+	JobRetentionSeconds float64 `json:"job_retention_seconds"`
+}
+
+func (s *Server) limits() *LimitsResponse {
+	return &LimitsResponse{
+		MaxBodyBytes:      s.cfg.MaxBodyBytes,
+		MaxVisits:         s.cfg.MaxVisits,
+		MaxImages:         s.cfg.MaxImages,
+		MaxImageTimeoutMS: int(s.cfg.MaxImageTimeout / time.Millisecond),
+
+		JobRetentionSeconds: s.cfg.JobRetention.Seconds(),
+	}
+}
+
+// checkJobSize writes a 422 response and returns false if a submission has
+// more visits or images than the server accepts
+func (s *Server) checkJobSize(w http.ResponseWriter, visits []Visit) bool {
+	images := 0
+	for _, visit := range visits {
+		images += len(visit.ImageURLs)
+	}
+
+	var message string
+	switch {
+	case len(visits) > s.cfg.MaxVisits:
+		message = fmt.Sprintf("too many visits: %d exceeds the limit of %d", len(visits), s.cfg.MaxVisits)
+	case images > s.cfg.MaxImages:
+		message = fmt.Sprintf("too many images: %d exceeds the limit of %d", images, s.cfg.MaxImages)
+	default:
+		return true
+	}
+	writeErrorResponse(w, http.StatusUnprocessableEntity, ErrorResponse{
+		Error:  message,
+		Code:   codeLimitsExceeded,
+		Limits: s.limits(),
+	})
+	return false
+}
+
+// handleLimits handles the limits endpoint, which reports the limits job
+// submissions must stay within
+func (s *Server) handleLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.limits())
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// defaultLogLevel is the log level when neither the -log-level flag nor
+// IMGPROC_LOG_LEVEL is set. Per-image logs are only written at debug level,
+// to keep the volume of large jobs down.
+const defaultLogLevel = "info"
+
+// RequestIDHeader carries the ID of a request, so a client can quote it in a
+// bug report. An ID sent by the client is used if it is valid, otherwise one
+// is generated.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen is the longest request ID accepted from a client
+const maxRequestIDLen = 128
+
+// NewLogger returns a logger writing JSON lines to w at the configured log
+// level
+func NewLogger(cfg Config, w io.Writer) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.LogLevel))
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// validLogLevel reports whether level is a log level NewLogger understands
+func validLogLevel(level string) bool {
+	var l slog.Level
+	return l.UnmarshalText([]byte(level)) == nil
+}
+
+// loggerKey is the context key for a logger carrying a request's or job's
+// correlation IDs
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// logger returns the logger for ctx, which carries the request or job
+// IDs the context belongs to, or the server's logger
+func (s *Server) logger(ctx context.Context) *slog.Logger {
+	if ctx == nil {
+		// Jobs restored from the job store have no context
+		return s.log
+	}
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return s.log
+}
+
+// requestIDKey is the context key for a request's ID
+type requestIDKey struct{}
+
+// requestID returns the ID of the request ctx belongs to
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether a client's request ID can be used as is. It
+// ends up in logs and headers, so only short IDs of safe characters are.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// quietPaths are polled by health checks and scrapers, so their requests are
+// only logged at debug level
+var quietPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// withRequestLogging wraps next so that every request has an ID, returned
+// in the X-Request-ID header and attached to everything logged while
+// handling it, and is logged once it has been handled
+func (s *Server) withRequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		logger := s.log.With("request_id", id)
+		if sp := spanFromContext(r.Context()); sp != nil {
+			logger = logger.With("trace_id", sp.TraceID())
+		}
+		ctx := withLogger(context.WithValue(r.Context(), requestIDKey{}, id), logger)
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if quietPaths[r.URL.Path] {
+			level = slog.LevelDebug
+		}
+		logger.Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.Status(),
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	})
+}
+
+// statusRecorder records the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status returns the response's status code, which is 200 if the handler
+// wrote nothing
+func (w *statusRecorder) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
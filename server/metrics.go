@@ -0,0 +1,216 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bucket upper bounds, in seconds, of the duration histograms
+var (
+	imageDurationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	jobDurationBuckets   = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+)
+
+// metrics are the server's Prometheus metrics. Counters and histograms are
+// updated as jobs and images are processed, while gauges that reflect the
+// server's state, such as the queue depth, are read when scraped. stats
+// keeps the stats endpoint's totals alongside them, so the two agree.
+type metrics struct {
+	jobsFinished      *counterVec
+	imagesProcessed   *counterVec
+	imageDuration     *histogram
+	jobDuration       *histogram
+	downloadsInFlight atomic.Int64
+	stats             serviceStats
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		jobsFinished:    newCounterVec("imgproc_jobs_finished_total", "Jobs that reached a terminal status, by status.", "status"),
+		imagesProcessed: newCounterVec("imgproc_images_processed_total", "Images processed, by outcome (success or error) and error code.", "outcome", "code"),
+		imageDuration:   newHistogram("imgproc_image_download_duration_seconds", "Time taken to download and decode an image, per download attempt.", imageDurationBuckets),
+		jobDuration:     newHistogram("imgproc_job_duration_seconds", "Time from a job's submission until it reached a terminal status.", jobDurationBuckets),
+	}
+}
+
+// imageSucceeded counts a successfully processed image
+func (m *metrics) imageSucceeded() {
+	m.imagesProcessed.Add(1, "success", "")
+	m.stats.imagesSucceeded.Add(1)
+}
+
+// imagesFailed counts images that failed with the given error code
+func (m *metrics) imagesFailed(code string, images int) {
+	m.imagesProcessed.Add(float64(images), "error", code)
+	counter(&m.stats.imagesFailed, code).Add(int64(images))
+}
+
+// imageProcessed records how long an image took to process, including its
+// retries
+func (m *metrics) imageProcessed(duration time.Duration) {
+	m.stats.latency.Observe(duration)
+}
+
+// imageDownloaded records the body bytes read downloading an image, whether
+// or not it could be decoded
+func (m *metrics) imageDownloaded(bytes int64) {
+	m.stats.bytesDownloaded.Add(bytes)
+}
+
+// jobStarted counts a job that a job runner started on
+func (m *metrics) jobStarted() {
+	m.stats.jobsRunning.Add(1)
+}
+
+// jobStopped counts a job that its job runner is done with
+func (m *metrics) jobStopped() {
+	m.stats.jobsRunning.Add(-1)
+}
+
+// jobFinished counts a job that reached a terminal status
+func (m *metrics) jobFinished(status string, duration time.Duration) {
+	m.jobsFinished.Add(1, status)
+	m.jobDuration.Observe(duration.Seconds())
+	counter(&m.stats.jobsFinished, status).Add(1)
+}
+
+// counterVec is a counter with labels
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Add adds delta to the counter with the given label values, which must be
+// in the order the labels were declared
+func (c *counterVec) Add(delta float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += delta
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]float64, len(keys))
+	for i, key := range keys {
+		values[i] = c.values[key]
+	}
+	c.mu.Unlock()
+
+	writeMetricHeader(w, c.name, c.help, "counter")
+	for i, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, strings.Split(key, "\xff")), formatMetricValue(values[i]))
+	}
+}
+
+// histogram counts observations into buckets by their upper bounds
+type histogram struct {
+	name, help string
+	bounds     []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, bounds []float64) *histogram {
+	return &histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.bounds, value)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += value
+	h.count++
+	h.mu.Unlock()
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatMetricValue(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatMetricValue(sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, count)
+}
+
+// writeGauge writes a metric with a single value, such as a gauge or a
+// counter read from elsewhere
+func writeGauge(w io.Writer, name, help, kind string, value float64) {
+	writeMetricHeader(w, name, help, kind)
+	fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(value))
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// handleMetrics handles the metrics endpoint, which serves the metrics in
+// the Prometheus text exposition format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.jobsFinished.write(w)
+	s.metrics.imagesProcessed.write(w)
+	s.metrics.imageDuration.write(w)
+	s.metrics.jobDuration.write(w)
+	writeGauge(w, "imgproc_downloads_in_flight", "Image downloads in progress.", "gauge", float64(s.metrics.downloadsInFlight.Load()))
+	writeGauge(w, "imgproc_jobs_queued", "Jobs waiting in the queue for a job runner.", "gauge", float64(s.queue.Len()))
+
+	stats := s.cache.Stats()
+	writeGauge(w, "imgproc_cache_entries", "Image URLs whose dimensions are cached.", "gauge", float64(stats.Entries))
+	writeGauge(w, "imgproc_cache_hits_total", "Image dimension lookups answered from the cache.", "counter", float64(stats.Hits))
+	writeGauge(w, "imgproc_cache_misses_total", "Image dimension lookups that had to download the image.", "counter", float64(stats.Misses))
+	writeGauge(w, "imgproc_cache_revalidations_total", "Expired image cache entries refreshed by a 304 Not Modified instead of downloading the image.", "counter", float64(stats.Revalidated))
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// A job's results and errors are kept in the order their images were
+// submitted, by visit and then by the image's position in the visit, however
+// the workers happen to finish them. Consumers can then zip them against the
+// submitted URLs, whatever the retries, deduplication or download times.
+
+// compareResults orders results by visit and image index, and the results
+// of a ZIP archive's images, which share its indexes, by image URL
+func compareResults(a, b ImageResult) int {
+	return cmp.Or(cmp.Compare(a.Visit, b.Visit), cmp.Compare(a.Image, b.Image), cmp.Compare(a.ImageURL, b.ImageURL))
+}
+
+// compareErrors orders errors by visit and image index, and then by image
+// URL. An error for a whole visit, which has no image index, comes before its
+// visit's image errors.
+func compareErrors(a, b StoreError) int {
+	return cmp.Or(cmp.Compare(a.Visit, b.Visit), cmp.Compare(errorImage(a), errorImage(b)), cmp.Compare(a.ImageURL, b.ImageURL))
+}
+
+func errorImage(storeErr StoreError) int {
+	if storeErr.Image == nil {
+		return -1
+	}
+	return *storeErr.Image
+}
+
+// addResultLocked inserts result among the job's results in submission
+// order, and notes the job's progress. job.mu must be held.
+func (job *JobData) addResultLocked(result ImageResult) {
+	i, _ := slices.BinarySearchFunc(job.Results, result, compareResults)
+	job.Results = slices.Insert(job.Results, i, result)
+	job.lastProgress = time.Now()
+}
+
+// addErrorLocked inserts storeErr among the job's errors in submission
+// order, and notes the job's progress. job.mu must be held.
+func (job *JobData) addErrorLocked(storeErr StoreError) {
+	i, _ := slices.BinarySearchFunc(job.Errors, storeErr, compareErrors)
+	job.Errors = slices.Insert(job.Errors, i, storeErr)
+	job.lastProgress = time.Now()
+}
+
+// sortResults puts results and errors restored from the job store, which
+// records them as they complete, back into submission order
+func sortResults(results []ImageResult, errs []StoreError) {
+	slices.SortStableFunc(results, compareResults)
+	slices.SortStableFunc(errs, compareErrors)
+}
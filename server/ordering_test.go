@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestResultOrdering processes images that take random times, some of which
+// are retried, failed or shared between visits, and checks that the results
+// and errors still come back in submission order
+func TestResultOrdering(t *testing.T) {
+	image := tinyPNG(t)
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path]++
+		attempt := attempts[r.URL.Path]
+		mu.Unlock()
+
+		time.Sleep(rand.N(20 * time.Millisecond))
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/missing"):
+			http.NotFound(w, r)
+		case strings.HasPrefix(r.URL.Path, "/flaky") && attempt == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write(image)
+		}
+	}))
+	t.Cleanup(host.Close)
+	s := newTestServer(t, nil)
+
+	// Every visit holds the shared images, at a different position each
+	// time, among images of its own
+	const visits, perVisit = 4, 6
+	req := SubmitJobRequest{Count: visits, Dedupe: true}
+	failed := make(map[[2]int]bool)
+	for i := range visits {
+		visit := Visit{StoreID: "S00339218"}
+		for j := range perVisit {
+			var path string
+			switch j {
+			case i:
+				path = "/shared.png"
+			case (i + 3) % perVisit:
+				path = "/missing-shared.png"
+			case (i + 1) % perVisit:
+				path = fmt.Sprintf("/flaky-%d-%d.png", i, j)
+			case (i + 2) % perVisit:
+				path = fmt.Sprintf("/missing-%d-%d.png", i, j)
+			default:
+				path = fmt.Sprintf("/image-%d-%d.png", i, j)
+			}
+			if strings.HasPrefix(path, "/missing") {
+				failed[[2]int{i, j}] = true
+			}
+			visit.ImageURLs = append(visit.ImageURLs, host.URL+path)
+		}
+		req.Visits = append(req.Visits, visit)
+	}
+
+	jobID := submitJob(t, s, req)
+	status := waitForJob(t, s, jobID)
+	results := jobResults(t, s, jobID).Results
+	if len(results)+len(status.Errors) != visits*perVisit {
+		t.Fatalf("got %d results and %d errors, want %d in all", len(results), len(status.Errors), visits*perVisit)
+	}
+
+	// Successful images are listed in submission order, skipping the failed
+	// ones, which have an error at their index instead
+	var wantResults, wantErrors [][2]int
+	for i := range visits {
+		for j := range perVisit {
+			if failed[[2]int{i, j}] {
+				wantErrors = append(wantErrors, [2]int{i, j})
+			} else {
+				wantResults = append(wantResults, [2]int{i, j})
+			}
+		}
+	}
+	for k, want := range wantResults {
+		if k >= len(results) {
+			t.Fatalf("result %d is missing, want visit %d image %d", k, want[0], want[1])
+		}
+		got := results[k]
+		if [2]int{got.Visit, got.Image} != want || got.ImageURL != req.Visits[want[0]].ImageURLs[want[1]] {
+			t.Errorf("result %d is visit %d image %d (%s), want visit %d image %d", k, got.Visit, got.Image, got.ImageURL, want[0], want[1])
+		}
+	}
+	for k, want := range wantErrors {
+		if k >= len(status.Errors) {
+			t.Fatalf("error %d is missing, want visit %d image %d", k, want[0], want[1])
+		}
+		got := status.Errors[k]
+		if got.Image == nil || [2]int{got.Visit, *got.Image} != want || got.ImageURL != req.Visits[want[0]].ImageURLs[want[1]] {
+			t.Errorf("error %d is visit %d image %v (%s), want visit %d image %d", k, got.Visit, got.Image, got.ImageURL, want[0], want[1])
+		}
+	}
+
+	// The shared images were downloaded once for all the visits, and the
+	// flaky ones retried
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts["/shared.png"] != 1 || attempts["/missing-shared.png"] != 1 {
+		t.Errorf("shared images were requested %d and %d times, want once each", attempts["/shared.png"], attempts["/missing-shared.png"])
+	}
+	if attempts["/flaky-0-1.png"] != 2 {
+		t.Errorf("a flaky image was requested %d times, want 2", attempts["/flaky-0-1.png"])
+	}
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+	"slices"
+	"strconv"
+)
+
+// defaultPHashDistance is the most bits the perceptual hashes of two images
+// may differ by for them to be reported as duplicates when neither the
+// -phash-distance flag nor IMGPROC_PHASH_DISTANCE is set
+const defaultPHashDistance = 6
+
+// The size of the grayscale thumbnail a perceptual hash is computed from.
+// Each row's 9 pixels give 8 bits, one per pair of neighbours.
+const (
+	phashWidth  = 9
+	phashHeight = 8
+)
+
+// phashSamples is the most pixels along each side of a thumbnail cell that
+// are averaged for it, so large photos cost no more to hash than small ones
+const phashSamples = 8
+
+// pixelFormats are the formats whose pixels can be decoded. The others'
+// decoders only read their dimensions, so their images are neither hashed
+// nor checked for being blank, and get a pixels_unsupported warning instead.
+var pixelFormats = map[string]bool{"jpeg": true, "png": true, "gif": true}
+
+// detectDuplicatesKey is the context key marking an image's perceptual hash
+// as wanted
+type detectDuplicatesKey struct{}
+
+// withDuplicateDetection returns a context whose images have their
+// perceptual hash computed
+func withDuplicateDetection(ctx context.Context) context.Context {
+	return context.WithValue(ctx, detectDuplicatesKey{}, true)
+}
+
+// detectDuplicates reports whether ctx's images have their perceptual hash
+// computed
+func detectDuplicates(ctx context.Context) bool {
+	detect, _ := ctx.Value(detectDuplicatesKey{}).(bool)
+	return detect
+}
+
+// analyzesPixels reports whether ctx asks for anything that needs an image's
+// pixels
+func analyzesPixels(ctx context.Context) bool {
+	return detectDuplicates(ctx) || qualityChecks(ctx)
+}
+
+// maxAnalyzedPixels is the largest image, in pixels, whose pixels are
+// decoded to be analysed. The standard library's decoders can't decode at a
+// reduced scale, so an image is held in memory at full size until it has been
+// reduced to a thumbnail, which for a 64 megapixel RGBA image is 256 MB.
+const maxAnalyzedPixels = 64 << 20
+
+// thumbnailSize is the most pixels along each side of the thumbnail an image
+// is reduced to before its pixels are analysed
+const thumbnailSize = qualitySamples
+
+// analyzePixels decodes the image in r as it is read, reduces it to a
+// thumbnail and records what ctx asks to know about its pixels in info. An
+// image whose pixels can't be decoded, such as a truncated one, is left as it
+// is, since its dimensions were still read. One larger than
+// maxAnalyzedPixels isn't decoded at all, and is marked PixelsTooLarge.
+func (s *Server) analyzePixels(ctx context.Context, info *imageInfo, r io.Reader) {
+	if int64(info.Width)*int64(info.Height) > maxAnalyzedPixels {
+		info.PixelsTooLarge = true
+		return
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return
+	}
+	thumbnail := pixelThumbnail(img, thumbnailSize)
+	if detectDuplicates(ctx) {
+		info.PHash = perceptualHash(thumbnail)
+	}
+	if qualityChecks(ctx) {
+		info.BlankSuspect = blankSuspect(thumbnail, s.cfg.BlankMaxStddev, s.cfg.BlankMaxColorRatio)
+	}
+}
+
+// pixelThumbnail returns up to size by size of img's pixels, spread evenly
+// over it, so the full image can be released before it is analysed
+func pixelThumbnail(img image.Image, size int) *image.RGBA64 {
+	bounds := img.Bounds()
+	xs := samplePoints(bounds.Min.X, bounds.Max.X, size)
+	ys := samplePoints(bounds.Min.Y, bounds.Max.Y, size)
+	thumbnail := image.NewRGBA64(image.Rect(0, 0, len(xs), len(ys)))
+	for ty, y := range ys {
+		for tx, x := range xs {
+			thumbnail.SetRGBA64(tx, ty, color.RGBA64Model.Convert(img.At(x, y)).(color.RGBA64))
+		}
+	}
+	return thumbnail
+}
+
+// perceptualHash returns the difference hash of img, in hex: each bit says
+// whether a pixel of its grayscale thumbnail is brighter than the one to its
+// right. Resizing, recompressing or slightly brightening a photo leaves most
+// bits unchanged, so photos of the same scene have hashes a few bits apart.
+func perceptualHash(img image.Image) string {
+	thumbnail := grayThumbnail(img, phashWidth, phashHeight)
+	var hash uint64
+	for y := range phashHeight {
+		for x := range phashWidth - 1 {
+			hash <<= 1
+			if thumbnail[y*phashWidth+x] > thumbnail[y*phashWidth+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+// grayThumbnail scales img down to width by height grayscale pixels, row by
+// row, each the average luminance of up to phashSamples² pixels spread over
+// its part of img
+func grayThumbnail(img image.Image, width, height int) []float64 {
+	bounds := img.Bounds()
+	thumbnail := make([]float64, width*height)
+	for ty := range height {
+		for tx := range width {
+			x0, x1 := cellBounds(bounds.Min.X, bounds.Dx(), tx, width)
+			y0, y1 := cellBounds(bounds.Min.Y, bounds.Dy(), ty, height)
+			var sum float64
+			var n int
+			for _, y := range samplePoints(y0, y1, phashSamples) {
+				for _, x := range samplePoints(x0, x1, phashSamples) {
+					sum += float64(color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y)
+					n++
+				}
+			}
+			if n > 0 {
+				thumbnail[ty*width+tx] = sum / float64(n)
+			}
+		}
+	}
+	return thumbnail
+}
+
+// cellBounds returns the pixels of a side size pixels long starting at min
+// that fall in cell i of n, which is at least one pixel wide
+func cellBounds(min, size, i, n int) (start, end int) {
+	start = min + i*size/n
+	end = min + (i+1)*size/n
+	return start, max(end, start+1)
+}
+
+// samplePoints spreads up to samples points evenly over [start, end)
+func samplePoints(start, end, samples int) []int {
+	n := min(end-start, samples)
+	points := make([]int, n)
+	for i := range n {
+		points[i] = start + (2*i+1)*(end-start)/(2*n)
+	}
+	return points
+}
+
+// DuplicateImages is a pair of a job's images whose perceptual hashes are
+// within -phash-distance bits of each other, so they are likely the same
+// photo. Distance is the number of bits they differ by, 0 for identical
+// hashes.
+type DuplicateImages struct {
+	Distance int              `json:"distance"`
+	Images   []DuplicateImage `json:"images"`
+}
+
+// DuplicateImage identifies one of a pair of duplicate images
+type DuplicateImage struct {
+	StoreID  string `json:"store_id"`
+	ImageURL string `json:"image_url"`
+	Visit    int    `json:"visit"`
+	Image    int    `json:"image"`
+}
+
+// maxPHashBands is the most bands hashes are split into to find duplicates.
+// A larger -phash-distance would leave bands so narrow that most hashes
+// share one, so every pair is compared instead.
+const maxPHashBands = 16
+
+// findDuplicateImages returns the pairs of results, which are in submission
+// order, whose perceptual hashes are no more than maxDistance bits apart,
+// closest first and then in submission order. Results without a hash, whose
+// job didn't set detect_duplicates or whose format can't be hashed, are left
+// out.
+//
+// Two hashes at most maxDistance bits apart have at least one of
+// maxDistance+1 bands of their bits in common, so only the images that share
+// a band are compared, rather than every pair of images. Each pair is counted
+// at the first band they share.
+func findDuplicateImages(results []ImageResult, maxDistance int) []DuplicateImages {
+	type hashed struct {
+		hash   uint64
+		result ImageResult
+	}
+	var images []hashed
+	for _, result := range results {
+		if hash, err := strconv.ParseUint(result.PHash, 16, 64); err == nil {
+			images = append(images, hashed{hash, result})
+		}
+	}
+
+	type pair struct{ a, b, distance int }
+	var pairs []pair
+	compare := func(a, b int) {
+		if distance := bits.OnesCount64(images[a].hash ^ images[b].hash); distance <= maxDistance {
+			pairs = append(pairs, pair{a, b, distance})
+		}
+	}
+	if bands := maxDistance + 1; bands > maxPHashBands {
+		for a := range images {
+			for b := a + 1; b < len(images); b++ {
+				compare(a, b)
+			}
+		}
+	} else {
+		masks := make([]uint64, bands)
+		for i := range masks {
+			start, end := cellBounds(0, 64, i, bands)
+			masks[i] = (1<<(end-start) - 1) << start
+		}
+		for band, mask := range masks {
+			buckets := make(map[uint64][]int)
+			for i, image := range images {
+				buckets[image.hash&mask] = append(buckets[image.hash&mask], i)
+			}
+			for _, bucket := range buckets {
+				for i, a := range bucket {
+					for _, b := range bucket[i+1:] {
+						// Pairs sharing an earlier band were compared there
+						if !slices.ContainsFunc(masks[:band], func(mask uint64) bool {
+							return images[a].hash&mask == images[b].hash&mask
+						}) {
+							compare(a, b)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(pairs, func(x, y pair) int {
+		return cmp.Or(cmp.Compare(x.distance, y.distance), cmp.Compare(x.a, y.a), cmp.Compare(x.b, y.b))
+	})
+	duplicates := make([]DuplicateImages, len(pairs))
+	for i, p := range pairs {
+		duplicates[i] = DuplicateImages{
+			Distance: p.distance,
+			Images:   []DuplicateImage{duplicateImage(images[p.a].result), duplicateImage(images[p.b].result)},
+		}
+	}
+	return duplicates
+}
+
+// jobDuplicates returns the duplicates among job's results. A finished job's
+// results no longer change, so they are only looked for the first time its
+// summary is requested.
+func (s *Server) jobDuplicates(job *JobData, results []ImageResult, final bool) []DuplicateImages {
+	if !final {
+		return findDuplicateImages(results, s.cfg.PHashDistance)
+	}
+	job.mu.Lock()
+	duplicates, found := job.duplicates, job.duplicatesFound
+	job.mu.Unlock()
+	if found {
+		return duplicates
+	}
+
+	duplicates = findDuplicateImages(results, s.cfg.PHashDistance)
+	job.mu.Lock()
+	job.duplicates, job.duplicatesFound = duplicates, true
+	job.mu.Unlock()
+	return duplicates
+}
+
+func duplicateImage(result ImageResult) DuplicateImage {
+	return DuplicateImage{StoreID: result.StoreID, ImageURL: result.ImageURL, Visit: result.Visit, Image: result.Image}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestPerceptualHash(t *testing.T) {
+	hash := func(fixture string) uint64 {
+		h, err := strconv.ParseUint(perceptualHash(pixelThumbnail(decodeFixture(t, fixture), thumbnailSize)), 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	shelf, small, other := hash("shelf.jpg"), hash("shelf_small.jpg"), hash("other.jpg")
+	if d := bits.OnesCount64(shelf ^ small); d > defaultPHashDistance {
+		t.Errorf("a resized, recompressed copy is %d bits away, want at most %d", d, defaultPHashDistance)
+	}
+	if d := bits.OnesCount64(shelf ^ other); d <= defaultPHashDistance {
+		t.Errorf("a different photo is %d bits away, want more than %d", d, defaultPHashDistance)
+	}
+}
+
+// bruteForceDuplicates compares every pair of results, as findDuplicateImages
+// must find the same pairs in the same order
+func bruteForceDuplicates(results []ImageResult, maxDistance int) []DuplicateImages {
+	var duplicates []DuplicateImages
+	for i, a := range results {
+		for _, b := range results[i+1:] {
+			ha, _ := strconv.ParseUint(a.PHash, 16, 64)
+			hb, _ := strconv.ParseUint(b.PHash, 16, 64)
+			if d := bits.OnesCount64(ha ^ hb); d <= maxDistance {
+				duplicates = append(duplicates, DuplicateImages{Distance: d, Images: []DuplicateImage{duplicateImage(a), duplicateImage(b)}})
+			}
+		}
+	}
+	slices.SortStableFunc(duplicates, func(a, b DuplicateImages) int { return a.Distance - b.Distance })
+	return duplicates
+}
+
+func TestFindDuplicateImages(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var results []ImageResult
+	for i := range 200 {
+		hash := rng.Uint64()
+		if i > 0 && i%3 == 0 {
+			// A near copy of an earlier image
+			hash = mustParseHash(results[rng.IntN(i)].PHash)
+			for range rng.IntN(12) {
+				hash ^= 1 << rng.IntN(64)
+			}
+		}
+		results = append(results, ImageResult{StoreID: fmt.Sprint("S", i), Image: i, PHash: fmt.Sprintf("%016x", hash)})
+	}
+	// Images without a hash are left out
+	results = append(results, ImageResult{StoreID: "unhashed"})
+
+	for _, maxDistance := range []int{0, 1, 6, 15, 16, 30, 64} {
+		got := findDuplicateImages(results, maxDistance)
+		want := bruteForceDuplicates(results[:len(results)-1], maxDistance)
+		if maxDistance == defaultPHashDistance && len(want) == 0 {
+			t.Fatal("no near copies to find")
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("maxDistance %d: found %d pairs, want %d", maxDistance, len(got), len(want))
+		}
+	}
+}
+
+func mustParseHash(s string) uint64 {
+	hash, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultWorkers is the number of image workers used when neither the
+// -workers flag nor IMGPROC_WORKERS is set
+const defaultWorkers = 16
+
+// imageTask is an image URL waiting to be processed by the worker pool
+type imageTask struct {
+	job      *JobData
+	imageURL string
+	// images has an entry for each logical image with this URL, which is
+	// only ever more than one when the job deduplicates identical URLs
+	images []taskImage
+	wg     *sync.WaitGroup
+
+	// archive is set when the URL is a ZIP archive of images
+	archive bool
+
+	// headers are sent with the image's download
+	headers DownloadHeaders
+}
+
+// taskImage is one of the logical images an image task stands for: an
+// occurrence of its URL in one of the job's visits
+type taskImage struct {
+	visit     int
+	image     int
+	store     Store
+	visitTime time.Time
+
+	// expectedSHA256 is the checksum the image must have, if any
+	expectedSHA256 string
+}
+
+// startWorkers starts n workers pulling image tasks from the shared queue
+func (s *Server) startWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go s.imageWorker()
+	}
+}
+
+func (s *Server) imageWorker() {
+	for task := range s.tasks {
+		s.processImage(task)
+	}
+}
+
+// processImage processes a task's image and records a result or error on the
+// owning job for each logical image, or for each image in it if it is a ZIP
+// archive
+func (s *Server) processImage(task imageTask) {
+	defer task.wg.Done()
+
+	job := task.job
+	ctx := job.ctx
+	if task.archive {
+		ctx = withArchive(ctx)
+	}
+	ctx = withDownloadHeaders(ctx, task.headers)
+	download := downloadFunc(s.downloadWithRetry)
+	switch {
+	case isUploadURL(task.imageURL):
+		download = s.uploadedImages(job)
+	case isDataURL(task.imageURL):
+		download = s.decodeDataURL
+	case isFileURL(task.imageURL):
+		download = s.readFileImage
+	}
+	if len(task.images) > 1 {
+		download = downloadOnce(download)
+	}
+
+	for i, image := range task.images {
+		if job.ctx.Err() != nil {
+			// The job was cancelled or timed out while this image was queued
+			s.recordTimedOut(job, task.imageURL, task.images[i:])
+			return
+		}
+
+		start := time.Now()
+		var err error
+		if task.archive {
+			err = s.processArchive(ctx, job, task.imageURL, image, download)
+		} else {
+			var result ImageResult
+			result, err = s.calculateImagePerimeter(ctx, image.store, task.imageURL, download)
+			if err == nil {
+				err = checkChecksum(result, image.expectedSHA256)
+			}
+			if err == nil {
+				result.Visit, result.Image, result.VisitTime = image.visit, image.image, image.visitTime
+				if !s.recordResult(job, result) {
+					return
+				}
+			}
+		}
+		if i == 0 {
+			// Later images of the task only reuse its download
+			s.metrics.imageProcessed(time.Since(start))
+		}
+		if err != nil && job.ctx.Err() != nil {
+			// The download was aborted by the cancellation or deadline, not a
+			// real failure
+			s.recordTimedOut(job, task.imageURL, task.images[i:])
+			return
+		}
+		if err != nil {
+			storeErr := StoreError{
+				StoreID:  image.store.StoreID,
+				ImageURL: task.imageURL,
+				Code:     errorCode(err),
+				Error:    err.Error(),
+				Visit:    image.visit,
+				Image:    &image.image,
+			}
+			if !s.recordError(job, storeErr) {
+				return
+			}
+		}
+	}
+}
+
+// recordResult records an image's result on its job. It returns false if
+// the job was stopped while the image was being processed, and has already
+// been finalized.
+func (s *Server) recordResult(job *JobData, result ImageResult) bool {
+	job.mu.Lock()
+	if job.Status != statusOngoing {
+		job.mu.Unlock()
+		return false
+	}
+	job.addResultLocked(result)
+	job.Progress.Completed++
+	job.publishLocked(streamEventResult, result)
+	job.mu.Unlock()
+	s.persist(s.jobStore.AppendResult(job.ID, result))
+	s.metrics.imageSucceeded()
+	return true
+}
+
+// recordError records an image's error on its job, stopping the job if it
+// fails fast. It returns false if the job had already been finalized.
+func (s *Server) recordError(job *JobData, storeErr StoreError) bool {
+	job.mu.Lock()
+	if job.Status != statusOngoing {
+		job.mu.Unlock()
+		return false
+	}
+	job.addErrorLocked(storeErr)
+	job.Progress.Failed++
+	job.publishLocked(streamEventError, storeErr)
+	job.stopOnErrorLocked()
+	job.mu.Unlock()
+	s.persist(s.jobStore.AppendError(job.ID, storeErr, 1))
+	s.metrics.imagesFailed(storeErr.Code, 1)
+	return true
+}
+
+// recordWarning records a warning on the job, unless it had already been
+// finalized. Warnings are persisted with the job once it finishes.
+func (s *Server) recordWarning(job *JobData, warning JobWarning) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.Status == statusOngoing {
+		job.Warnings = append(job.Warnings, warning)
+	}
+}
+
+// downloadOnce wraps download so that only the first call downloads the
+// image, and later calls reuse its outcome without its transfer figures
+func downloadOnce(download downloadFunc) downloadFunc {
+	var (
+		once sync.Once
+		info imageInfo
+		err  error
+	)
+	return func(ctx context.Context, url string) (imageInfo, error) {
+		first := false
+		once.Do(func() {
+			info, err = download(ctx, url)
+			first = true
+		})
+		if !first {
+			return info.withoutTransfer(), err
+		}
+		return info, err
+	}
+}
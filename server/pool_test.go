@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrencyRecorder is an image host that serves a tiny PNG for every
+// path, taking delay to do so, and records the most requests it served at
+// once
+type concurrencyRecorder struct {
+	delay time.Duration
+	image []byte
+
+	mu       sync.Mutex
+	inFlight int
+	max      int
+	requests int
+}
+
+func newConcurrencyRecorder(t *testing.T, delay time.Duration) (*concurrencyRecorder, *httptest.Server) {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 2, 1))); err != nil {
+		t.Fatal(err)
+	}
+	rec := &concurrencyRecorder{delay: delay, image: encoded.Bytes()}
+	host := httptest.NewServer(rec)
+	t.Cleanup(host.Close)
+	return rec, host
+}
+
+func (c *concurrencyRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	c.inFlight++
+	c.requests++
+	c.max = max(c.max, c.inFlight)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.inFlight--
+		c.mu.Unlock()
+	}()
+
+	time.Sleep(c.delay)
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(c.image)
+}
+
+// stats returns the most requests served at once and the number served
+func (c *concurrencyRecorder) stats() (max, requests int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.max, c.requests
+}
+
+// imageURLs returns n distinct image URLs on host, so none are cached
+func imageURLs(host string, n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("%s/image.png?%d", host, i)
+	}
+	return urls
+}
+
+func TestWorkerPoolBoundsConcurrency(t *testing.T) {
+	const workers, images = 4, 5000
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.Workers = workers
+		cfg.MaxPerHost = 100
+	})
+	recorder, host := newConcurrencyRecorder(t, 100*time.Microsecond)
+
+	// Two jobs at once share the pool, rather than each getting its own
+	all := imageURLs(host.URL, images)
+	var jobIDs []string
+	for _, urls := range [][]string{all[:images/2], all[images/2:]} {
+		jobIDs = append(jobIDs, submitJob(t, s, SubmitJobRequest{
+			Count:  1,
+			Visits: []Visit{{StoreID: "S00339218", ImageURLs: urls}},
+		}))
+	}
+	for _, jobID := range jobIDs {
+		status := waitForJob(t, s, jobID)
+		if status.Status != statusCompleted || status.Progress.Completed != images/2 {
+			t.Errorf("job %s = %s with %+v, want all %d images completed", jobID, status.Status, status.Progress, images/2)
+		}
+	}
+
+	maxInFlight, requests := recorder.stats()
+	if maxInFlight > workers {
+		t.Errorf("%d downloads ran at once, want at most %d", maxInFlight, workers)
+	}
+	if requests != images {
+		t.Errorf("%d images were downloaded, want %d", requests, images)
+	}
+}
+
+func TestWorkerPoolCompletesWithErrors(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.Workers = 2 })
+	fixtures := serveFixtures(t)
+
+	var urls []string
+	for i := range 10 {
+		if i%2 == 0 {
+			urls = append(urls, fmt.Sprintf("%s/shelf.jpg?%d", fixtures.URL, i))
+		} else {
+			urls = append(urls, fmt.Sprintf("%s/missing.jpg?%d", fixtures.URL, i))
+		}
+	}
+	jobID := submitJob(t, s, SubmitJobRequest{Count: 1, Visits: []Visit{{StoreID: "S00339218", ImageURLs: urls}}})
+	status := waitForJob(t, s, jobID)
+	if want := (JobProgress{Total: 10, Completed: 5, Failed: 5}); status.Progress != want {
+		t.Errorf("progress = %+v, want %+v", status.Progress, want)
+	}
+	if status.Status != statusCompletedWithErrors {
+		t.Errorf("status = %s, want %s", status.Status, statusCompletedWithErrors)
+	}
+}
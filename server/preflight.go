@@ -0,0 +1,435 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPreflightSyncLimit is the most images a preflight checks before
+// responding, when neither the -preflight-sync-limit flag nor
+// IMGPROC_PREFLIGHT_SYNC_LIMIT is set. Larger preflights run in the
+// background.
+const defaultPreflightSyncLimit = 100
+
+// preflightSniffBytes is how much of an image is asked for when its host
+// doesn't support HEAD requests
+const preflightSniffBytes = 512
+
+// Preflight statuses
+const (
+	preflightRunning   = "running"
+	preflightCompleted = "completed"
+)
+
+// PreflightResult reports whether one of a submission's images looks like
+// it can be processed, without downloading it
+type PreflightResult struct {
+	Visit    int    `json:"visit"`
+	Image    int    `json:"image"`
+	StoreID  string `json:"store_id"`
+	ImageURL string `json:"image_url"`
+	OK       bool   `json:"ok"`
+
+	// Method is the request method the image was checked with: HEAD, or a
+	// ranged GET when the host doesn't support HEAD. It is empty for images
+	// checked without a request, such as data: URLs.
+	Method     string `json:"method,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+
+	// ContentType and ContentLength are as reported by the image's host,
+	// and are omitted when it didn't report them
+	ContentType   string `json:"content_type,omitempty"`
+	ContentLength int64  `json:"content_length,omitempty"`
+
+	// FinalURL and Redirects are set when the image URL redirected
+	FinalURL  string `json:"final_url,omitempty"`
+	Redirects int    `json:"redirects,omitempty"`
+
+	// Code and Error say why the image would fail, when it would
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// PreflightResponse represents the response for a preflight. Preflights of
+// at most -preflight-sync-limit images are returned completed, while larger
+// ones are returned running, with a PreflightID to poll them with.
+// Progress counts the images that passed as completed.
+type PreflightResponse struct {
+	PreflightID string            `json:"preflight_id,omitempty"`
+	Status      string            `json:"status"`
+	CreatedAt   time.Time         `json:"created_at"`
+	CompletedAt time.Time         `json:"completed_at,omitzero"`
+	Progress    JobProgress       `json:"progress"`
+	Results     []PreflightResult `json:"results"`
+}
+
+// preflight is a running or completed check of a submission's images
+type preflight struct {
+	id    string
+	owner string
+
+	mu          sync.Mutex
+	createdAt   time.Time
+	completedAt time.Time
+	total       int
+	results     []PreflightResult
+}
+
+// record records the result of one of the preflight's images
+func (p *preflight) record(result PreflightResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.results = append(p.results, result)
+}
+
+// finish marks the preflight completed
+func (p *preflight) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.completedAt = time.Now()
+}
+
+// response returns the preflight's report so far, with its results in the
+// order of the submission's images
+func (p *preflight) response() PreflightResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	resp := PreflightResponse{
+		PreflightID: p.id,
+		Status:      preflightRunning,
+		CreatedAt:   p.createdAt,
+		CompletedAt: p.completedAt,
+		Progress:    JobProgress{Total: p.total},
+		Results:     append([]PreflightResult{}, p.results...),
+	}
+	if !p.completedAt.IsZero() {
+		resp.Status = preflightCompleted
+	}
+	for _, result := range resp.Results {
+		if result.OK {
+			resp.Progress.Completed++
+		} else {
+			resp.Progress.Failed++
+		}
+	}
+	sort.Slice(resp.Results, func(i, j int) bool {
+		a, b := resp.Results[i], resp.Results[j]
+		return a.Visit < b.Visit || a.Visit == b.Visit && a.Image < b.Image
+	})
+	return resp
+}
+
+// handlePreflight handles the preflight endpoint, which checks that each of
+// a submission's images can be reached and is within the limits, without
+// creating a job or downloading the images
+func (s *Server) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	if !s.allowSubmit(w, r) {
+		return
+	}
+	req, ok := s.decodeSubmission(w, r)
+	if !ok {
+		return
+	}
+	if !s.checkSubmission(w, &req) {
+		return
+	}
+
+	p := &preflight{owner: ownerID(r.Context()), createdAt: time.Now()}
+	for _, visit := range req.Visits {
+		p.total += len(visit.ImageURLs)
+	}
+	timeout := time.Duration(req.ImageTimeoutMS) * time.Millisecond
+
+	w.Header().Set("Content-Type", "application/json")
+	if p.total <= s.cfg.PreflightSyncLimit {
+		s.runPreflight(withImageTimeout(r.Context(), timeout), p, req)
+		json.NewEncoder(w).Encode(p.response())
+		return
+	}
+
+	// Large preflights outlive the request, and are polled until done
+	p.id = newJobID()
+	s.preflightsMu.Lock()
+	s.preflights[p.id] = p
+	s.preflightsMu.Unlock()
+	go s.runPreflight(withImageTimeout(context.WithoutCancel(r.Context()), timeout), p, req)
+
+	w.Header().Set("Location", "/api/validate/"+p.id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(p.response())
+}
+
+// handlePreflightStatus handles the preflight status endpoint, which reports
+// the progress and results of a preflight that runs in the background
+func (s *Server) handlePreflightStatus(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("preflightid")
+	if !isUUID(id) {
+		responseError(w, http.StatusBadRequest, "invalid preflight ID: must be a UUID")
+		return
+	}
+	s.preflightsMu.Lock()
+	p, exists := s.preflights[id]
+	s.preflightsMu.Unlock()
+	// Other clients' preflights are reported as not found, like their jobs
+	if !exists || !canAccessOwner(callerKey(r.Context()), p.owner) {
+		responseError(w, http.StatusNotFound, "preflight not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.response())
+}
+
+// runPreflight checks each of the submission's images, as many at once as
+// there are image workers, and marks the preflight completed once they have
+// all been checked
+func (s *Server) runPreflight(ctx context.Context, p *preflight, req SubmitJobRequest) {
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		p.finish()
+	}()
+
+	for i, visit := range jobVisits(req) {
+		_, known := s.getStore(visit.StoreID)
+		visitCtx := withDownloadHeaders(ctx, visit.DownloadHeaders)
+		for j, imageURL := range visit.ImageURLs {
+			imageCtx := visitCtx
+			if visit.Archive || isArchiveURL(imageURL) {
+				imageCtx = withArchive(visitCtx)
+			}
+			result := PreflightResult{Visit: i, Image: j, StoreID: visit.StoreID, ImageURL: imageURL}
+			if !known {
+				result.Code, result.Error = codeStoreNotFound, "Store ID does not exist"
+				p.record(result)
+				continue
+			}
+
+			select {
+			case s.preflightSlots <- struct{}{}:
+			case <-ctx.Done():
+				result.Code, result.Error = codeDownloadFailed, "preflight cancelled: "+ctx.Err().Error()
+				p.record(result)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-s.preflightSlots
+					wg.Done()
+				}()
+				start := time.Now()
+				if err := s.preflightImage(imageCtx, imageURL, &result); err != nil {
+					result.Code, result.Error = errorCode(err), err.Error()
+				} else {
+					result.OK = true
+				}
+				result.DurationMS = durationMS(time.Since(start))
+				p.record(result)
+			}()
+		}
+	}
+}
+
+// preflightImage checks an image the way it would be fetched, recording what
+// was learned about it on result, and returns the error the image would fail
+// with, if any. Images are checked against the same URL policy and size
+// limits as when they are processed.
+func (s *Server) preflightImage(ctx context.Context, imageURL string, result *PreflightResult) error {
+	if err := s.validateImageURL(imageURL); err != nil {
+		return err
+	}
+
+	switch {
+	case isDataURL(imageURL):
+		mediaType, payload, _ := parseDataURL(imageURL)
+		result.ContentType = mediaType
+		result.ContentLength = int64(base64.RawStdEncoding.DecodedLen(len(strings.TrimRight(payload, "="))))
+		if result.ContentLength > s.cfg.MaxImageBytes {
+			return &imageTooLargeError{Limit: s.cfg.MaxImageBytes}
+		}
+		return nil
+	case isFileURL(imageURL):
+		f, path, err := s.openFile(ctx, imageURL)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if stat, err := f.Stat(); err == nil {
+			result.ContentLength = stat.Size()
+		}
+		result.ContentType = mime.TypeByExtension(filepath.Ext(path))
+		return checkPreflightContentType(ctx, result.ContentType)
+	}
+	return s.preflightRequest(ctx, imageURL, result)
+}
+
+// preflightRequest checks an image with a HEAD request, or with a ranged GET
+// of its first bytes if the host doesn't support HEAD. The request waits for
+// a slot from the image's host like a download, is limited to the image
+// timeout and goes through the download client, so the same internal address
+// and redirect checks apply. Preflight requests don't count towards the
+// host's circuit breaker.
+func (s *Server) preflightRequest(ctx context.Context, imageURL string, result *PreflightResult) error {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return &codedError{Code: codeInvalidURL, Err: fmt.Errorf("invalid image URL: %v", err)}
+	}
+	release, err := s.limiter.Acquire(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	timeout := s.imageTimeout(ctx)
+	requestCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// S3 objects are always checked with a GET, which S3 answers with an
+	// error body
+	method := http.MethodHead
+	if isS3URL(u) {
+		method = http.MethodGet
+	}
+	resp, err := s.preflightDo(requestCtx, u, method)
+	if err == nil && method == http.MethodHead && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		resp, err = s.preflightDo(requestCtx, u, http.MethodGet)
+	}
+	if err != nil && errors.Is(requestCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return &downloadTimeoutError{Timeout: timeout}
+	}
+	if err != nil {
+		return fmt.Errorf("error downloading image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// The default client checks each redirect, but an injected one may not
+	if !isS3URL(u) {
+		if err := s.policy.Check(resp.Request.URL); err != nil {
+			return err
+		}
+	}
+	result.Method, result.StatusCode = resp.Request.Method, resp.StatusCode
+	if redirects := redirectCount(resp); redirects > 0 {
+		result.FinalURL, result.Redirects = resp.Request.URL.String(), redirects
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent:
+	case isS3URL(u):
+		return s3ResponseError(resp)
+	default:
+		return &statusError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	result.ContentType = resp.Header.Get("Content-Type")
+	if result.ContentType == "" && resp.Request.Method == http.MethodGet {
+		sniff, _ := io.ReadAll(io.LimitReader(resp.Body, preflightSniffBytes))
+		if len(sniff) > 0 {
+			result.ContentType = http.DetectContentType(sniff)
+		}
+	}
+	if size := responseSize(resp); size > 0 {
+		result.ContentLength = size
+		if limit := s.imageLimit(ctx); size > limit {
+			return &imageTooLargeError{Limit: limit}
+		}
+	}
+	return checkPreflightContentType(ctx, result.ContentType)
+}
+
+// preflightDo sends a preflight request for the image at u, with the image's
+// download headers. GET requests only ask for the image's first bytes.
+func (s *Server) preflightDo(ctx context.Context, u *url.URL, method string) (*http.Response, error) {
+	client := s.client
+	var req *http.Request
+	var err error
+	if isS3URL(u) {
+		// The Range header isn't signed, so it can be added afterwards
+		req, err = s.s3.request(ctx, u)
+		client = s.s3.client
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, u.String(), nil)
+		for name, value := range downloadHeaders(ctx) {
+			req.Header.Set(name, value)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if req.Method == http.MethodGet {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", preflightSniffBytes-1))
+	}
+	s.identifyRequest(ctx, req)
+	return client.Do(req)
+}
+
+// responseSize returns the size of the image a preflight response is for:
+// the total from the Content-Range of a partial response, and otherwise its
+// Content-Length. It is -1 if the size isn't known.
+func responseSize(resp *http.Response) int64 {
+	if resp.StatusCode != http.StatusPartialContent {
+		return resp.ContentLength
+	}
+	_, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	if !ok {
+		return -1
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// checkPreflightContentType returns an unsupported_format error if an image
+// was served with a content type it can't be, such as an HTML error page
+// served with a 200. A missing or generic content type passes, since the
+// image's format is only known once it is decoded.
+func checkPreflightContentType(ctx context.Context, contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case mediaType == "application/octet-stream", mediaType == "binary/octet-stream":
+		return nil
+	case isArchive(ctx) && (mediaType == "application/zip" || mediaType == "application/x-zip-compressed"):
+		return nil
+	case strings.HasPrefix(mediaType, "image/"):
+		return nil
+	}
+	return &codedError{Code: codeUnsupportedFormat, Err: fmt.Errorf("unexpected content type %s", mediaType)}
+}
+
+// expirePreflights removes the background preflights that completed more
+// than the retention period before now
+func (s *Server) expirePreflights(now time.Time) {
+	s.preflightsMu.Lock()
+	defer s.preflightsMu.Unlock()
+	for id, p := range s.preflights {
+		p.mu.Lock()
+		completedAt := p.completedAt
+		p.mu.Unlock()
+		if !completedAt.IsZero() && now.Sub(completedAt) > s.cfg.JobRetention {
+			delete(s.preflights, id)
+		}
+	}
+}
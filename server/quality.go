@@ -0,0 +1,110 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+)
+
+// The thresholds below which an image is suspected of being blank when
+// neither their flags nor environment variables are set: a luminance
+// standard deviation of 5 levels out of 255, or distinct colours among 1% of
+// the pixels sampled
+const (
+	defaultBlankMaxStddev     = 5
+	defaultBlankMaxColorRatio = 0.01
+)
+
+// qualitySamples is the most pixels sampled along each side of an image to
+// judge whether it is blank, so the check costs the same for any image size
+const qualitySamples = 64
+
+// qualityColorBits is how many bits of each colour channel distinguish
+// colours, so that compression noise on a plain frame doesn't count as
+// colours of its own
+const qualityColorBits = 5
+
+// qualityChecksKey is the context key marking images as to be checked for
+// being blank
+type qualityChecksKey struct{}
+
+// withQualityChecks returns a context whose images are checked for being
+// blank
+func withQualityChecks(ctx context.Context) context.Context {
+	return context.WithValue(ctx, qualityChecksKey{}, true)
+}
+
+// qualityChecks reports whether ctx's images are checked for being blank
+func qualityChecks(ctx context.Context) bool {
+	check, _ := ctx.Value(qualityChecksKey{}).(bool)
+	return check
+}
+
+// blankSuspect reports whether img looks blank or nearly a solid colour, such
+// as a photo taken in a pocket or a white frame, going by a grid of up to
+// qualitySamples² of its pixels. It is suspect when their luminance varies
+// by no more than maxStddev, or they have no more than maxColorRatio
+// distinct colours per pixel sampled.
+func blankSuspect(img image.Image, maxStddev, maxColorRatio float64) bool {
+	bounds := img.Bounds()
+	xs := samplePoints(bounds.Min.X, bounds.Max.X, qualitySamples)
+	ys := samplePoints(bounds.Min.Y, bounds.Max.Y, qualitySamples)
+	n := len(xs) * len(ys)
+	if n == 0 {
+		return false
+	}
+
+	const shift = 16 - qualityColorBits
+	colors := make(map[uint64]struct{})
+	var sum, sumSquares float64
+	for _, y := range ys {
+		for _, x := range xs {
+			c := img.At(x, y)
+			luminance := float64(color.GrayModel.Convert(c).(color.Gray).Y)
+			sum += luminance
+			sumSquares += luminance * luminance
+			r, g, b, _ := c.RGBA()
+			colors[uint64(r>>shift)<<(2*qualityColorBits)|uint64(g>>shift)<<qualityColorBits|uint64(b>>shift)] = struct{}{}
+		}
+	}
+	mean := sum / float64(n)
+	stddev := math.Sqrt(max(sumSquares/float64(n)-mean*mean, 0))
+	return stddev <= maxStddev || float64(len(colors))/float64(n) <= maxColorRatio
+}
+
+// StoreBlankSuspects counts the images of one store suspected of being
+// blank
+type StoreBlankSuspects struct {
+	StoreID  string `json:"store_id"`
+	AreaCode string `json:"area_code"`
+	Images   int    `json:"images"`
+}
+
+// summarizeBlankSuspects counts each store's images suspected of being
+// blank, in store ID order. Stores with none are left out.
+func summarizeBlankSuspects(results []ImageResult) []StoreBlankSuspects {
+	stores := make(map[string]*StoreBlankSuspects)
+	for _, result := range results {
+		if !result.BlankSuspect {
+			continue
+		}
+		store := stores[result.StoreID]
+		if store == nil {
+			store = &StoreBlankSuspects{StoreID: result.StoreID, AreaCode: result.AreaCode}
+			stores[result.StoreID] = store
+		}
+		store.Images++
+	}
+
+	summaries := make([]StoreBlankSuspects, 0, len(stores))
+	for _, store := range stores {
+		summaries = append(summaries, *store)
+	}
+	slices.SortFunc(summaries, func(a, b StoreBlankSuspects) int {
+		return cmp.Compare(a.StoreID, b.StoreID)
+	})
+	return summaries
+}
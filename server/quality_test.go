@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// decodeFixture decodes the image in testdata/name
+func decodeFixture(t *testing.T, name string) image.Image {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding %s: %v", name, err)
+	}
+	return img
+}
+
+func TestBlankSuspect(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    bool
+	}{
+		{"solid.png", true},
+		{"lowgrad.jpg", true},
+		{"shelf.jpg", false},
+		{"other.jpg", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			thumbnail := pixelThumbnail(decodeFixture(t, tt.fixture), thumbnailSize)
+			if got := blankSuspect(thumbnail, defaultBlankMaxStddev, defaultBlankMaxColorRatio); got != tt.want {
+				t.Errorf("blankSuspect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPixelThumbnail(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          image.Rectangle
+	}{
+		{640, 480, image.Rect(0, 0, thumbnailSize, thumbnailSize)},
+		{20, 480, image.Rect(0, 0, 20, thumbnailSize)},
+		{3, 2, image.Rect(0, 0, 3, 2)},
+	}
+	for _, tt := range tests {
+		img := image.NewGray(image.Rect(0, 0, tt.width, tt.height))
+		if got := pixelThumbnail(img, thumbnailSize).Bounds(); got != tt.want {
+			t.Errorf("pixelThumbnail(%dx%d) bounds = %v, want %v", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeImageQualityChecks(t *testing.T) {
+	s := &Server{cfg: DefaultConfig()}
+	ctx := withQualityChecks(context.Background())
+	tests := []struct {
+		fixture string
+		want    bool
+	}{
+		{"solid.png", true},
+		{"lowgrad.jpg", true},
+		{"shelf.jpg", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := &sizeLimitedReader{R: bytes.NewReader(data), Limit: int64(len(data))}
+			info, err := s.decodeImage(ctx, body, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.BlankSuspect != tt.want {
+				t.Errorf("BlankSuspect = %v, want %v", info.BlankSuspect, tt.want)
+			}
+			// The pixels are decoded as the body is read, which is still
+			// hashed whole
+			if sum := sha256.Sum256(data); info.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("SHA256 = %q, want the fixture's", info.SHA256)
+			}
+		})
+	}
+}
+
+func TestDecodeImageQualityChecksReadsResolution(t *testing.T) {
+	// A 300 dpi solid PNG, whose pHYs chunk is read past the header before
+	// its pixels are decoded
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 100, 100))); err != nil {
+		t.Fatal(err)
+	}
+	const ihdrEnd = 8 + 8 + 13 + 4
+	phys := []byte("pHYs\x00\x00\x2e\x23\x00\x00\x2e\x23\x01")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(phys)-4))
+	chunk = append(chunk, phys...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(phys))
+	data := slices.Concat(encoded.Bytes()[:ihdrEnd], chunk, encoded.Bytes()[ihdrEnd:])
+
+	s := &Server{cfg: DefaultConfig()}
+	body := &sizeLimitedReader{R: bytes.NewReader(data), Limit: int64(len(data))}
+	info, err := s.decodeImage(withQualityChecks(context.Background()), body, "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.BlankSuspect {
+		t.Error("BlankSuspect = false, want true")
+	}
+	if math.Round(info.DPIX) != 300 || math.Round(info.DPIY) != 300 {
+		t.Errorf("resolution = %vx%v dpi, want 300x300", info.DPIX, info.DPIY)
+	}
+}
+
+func TestAnalyzePixelsTooLarge(t *testing.T) {
+	s := &Server{cfg: DefaultConfig()}
+	info := imageInfo{Width: 10000, Height: 10000}
+	// The image isn't decoded, so nothing is read
+	s.analyzePixels(withQualityChecks(context.Background()), &info, nil)
+	if !info.PixelsTooLarge {
+		t.Error("PixelsTooLarge = false, want true")
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultJobRunners is the number of jobs processed at once when neither the
+// -job-runners flag nor IMGPROC_JOB_RUNNERS is set
+const defaultJobRunners = 4
+
+// defaultMaxQueueDepth is the number of jobs that may wait for a runner when
+// neither the -max-queue-depth flag nor IMGPROC_MAX_QUEUE_DEPTH is set
+const defaultMaxQueueDepth = 100
+
+// defaultPriorityAging is how long a queued job waits before its priority is
+// raised a level when neither the -priority-aging flag nor
+// IMGPROC_PRIORITY_AGING is set
+const defaultPriorityAging = time.Minute
+
+// Job priorities, from the most to the least urgent
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+// priorityLevels ranks the priorities, higher levels being dequeued first
+var priorityLevels = map[string]int{
+	priorityHigh:   2,
+	priorityNormal: 1,
+	priorityLow:    0,
+}
+
+// queueFullRetryAfter is how long clients are asked to wait before submitting
+// again when the queue is full
+const queueFullRetryAfter = 5 * time.Second
+
+// queuedJob is a submitted job waiting for a runner
+type queuedJob struct {
+	job *JobData
+	req SubmitJobRequest
+
+	// level is the job's priority level when it was queued, seq the order
+	// it was queued in
+	level    int
+	seq      uint64
+	queuedAt time.Time
+}
+
+// jobQueue holds submitted jobs until a runner is free to process them.
+// Higher priority jobs are dequeued first, and jobs of the same priority in
+// the order they were submitted. So that a steady stream of urgent jobs can't
+// starve the rest, a job's priority is raised a level for every aging
+// interval it has waited; an aging interval of 0 disables this. A maximum
+// depth of 0 means no limit.
+type jobQueue struct {
+	mu       sync.Mutex
+	ready    *sync.Cond
+	jobs     []queuedJob
+	nextSeq  uint64
+	maxDepth int
+	aging    time.Duration
+}
+
+func newJobQueue(maxDepth int, aging time.Duration) *jobQueue {
+	q := &jobQueue{maxDepth: maxDepth, aging: aging}
+	q.ready = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds a job to the queue, returning false if the queue is full
+func (q *jobQueue) Push(job *JobData, req SubmitJobRequest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.maxDepth > 0 && len(q.jobs) >= q.maxDepth {
+		return false
+	}
+	q.jobs = append(q.jobs, queuedJob{
+		job:      job,
+		req:      req,
+		level:    priorityLevels[job.Priority],
+		seq:      q.nextSeq,
+		queuedAt: time.Now(),
+	})
+	q.nextSeq++
+	q.ready.Signal()
+	return true
+}
+
+// Pop removes the next job to run from the queue, waiting for one to be
+// pushed if the queue is empty
+func (q *jobQueue) Pop() queuedJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 {
+		q.ready.Wait()
+	}
+	now := time.Now()
+	best := 0
+	for i := 1; i < len(q.jobs); i++ {
+		if q.before(q.jobs[i], q.jobs[best], now) {
+			best = i
+		}
+	}
+	next := q.jobs[best]
+	q.jobs = slices.Delete(q.jobs, best, best+1)
+	return next
+}
+
+// Remove takes a job out of the queue, returning false if it isn't queued
+// because a runner has already taken it
+func (q *jobQueue) Remove(job *JobData) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.index(job)
+	if i < 0 {
+		return false
+	}
+	q.jobs = slices.Delete(q.jobs, i, i+1)
+	return true
+}
+
+// Len returns the number of jobs waiting in the queue
+func (q *jobQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+// Position returns the job's 1-based position in the queue, counting the
+// jobs that would currently be dequeued before it, or 0 if it isn't queued
+func (q *jobQueue) Position(job *JobData) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.index(job)
+	if i < 0 {
+		return 0
+	}
+	now := time.Now()
+	position := 1
+	for _, other := range q.jobs {
+		if q.before(other, q.jobs[i], now) {
+			position++
+		}
+	}
+	return position
+}
+
+// before reports whether a should be dequeued before b
+func (q *jobQueue) before(a, b queuedJob, now time.Time) bool {
+	if levelA, levelB := q.level(a, now), q.level(b, now); levelA != levelB {
+		return levelA > levelB
+	}
+	return a.seq < b.seq
+}
+
+// level returns a queued job's priority level, raised for the time it has
+// waited
+func (q *jobQueue) level(queued queuedJob, now time.Time) int {
+	if q.aging <= 0 {
+		return queued.level
+	}
+	return queued.level + int(now.Sub(queued.queuedAt)/q.aging)
+}
+
+func (q *jobQueue) index(job *JobData) int {
+	return slices.IndexFunc(q.jobs, func(queued queuedJob) bool {
+		return queued.job == job
+	})
+}
+
+// startJobRunners starts n runners processing queued jobs one at a time
+func (s *Server) startJobRunners(n int) {
+	for i := 0; i < n; i++ {
+		go s.jobRunner()
+	}
+}
+
+func (s *Server) jobRunner() {
+	for {
+		next := s.queue.Pop()
+		s.processJob(next.job, next.req)
+		s.runningJobs.Done()
+	}
+}
+
+// dequeueJob takes a job that was cancelled or interrupted while queued out
+// of the queue. If a runner has already taken it, the runner finishes it
+// instead, since processJob skips jobs that are no longer queued.
+func (s *Server) dequeueJob(job *JobData) {
+	if s.queue.Remove(job) {
+		job.cancel()
+		s.runningJobs.Done()
+	}
+}
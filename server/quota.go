@@ -0,0 +1,273 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultMonthlyImageQuota is the number of images each API key may submit a
+// month when neither the -monthly-image-quota flag nor
+// IMGPROC_MONTHLY_IMAGE_QUOTA is set. 0 means no quota.
+const defaultMonthlyImageQuota = 0
+
+// QuotaResponse represents an API key's monthly image quota. Quota is 0 if
+// the key has no quota, in which case Remaining is omitted.
+type QuotaResponse struct {
+	KeyID     string    `json:"key_id"`
+	Quota     int       `json:"quota"`
+	Used      int       `json:"used"`
+	Remaining *int      `json:"remaining,omitempty"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// quotaResetStore is implemented by job stores that can persist quota resets,
+// so a reset isn't undone when usage is rebuilt from the jobs on restart
+type quotaResetStore interface {
+	SaveQuotaReset(keyID string, at time.Time) error
+	LoadQuotaResets() (map[string]time.Time, error)
+}
+
+// quotaLedger tracks the images each API key has used in the current
+// calendar month (UTC). A job's images are reserved when it is submitted,
+// and those it didn't get to are given back when it finishes, so a key can't
+// get ahead of its quota by submitting several jobs at once.
+type quotaLedger struct {
+	mu     sync.Mutex
+	month  time.Time
+	used   map[string]int
+	resets map[string]time.Time
+}
+
+func newQuotaLedger() *quotaLedger {
+	return &quotaLedger{
+		month:  monthStart(time.Now()),
+		used:   make(map[string]int),
+		resets: make(map[string]time.Time),
+	}
+}
+
+// monthStart returns the start of t's calendar month in UTC
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// rolloverLocked starts a new month's usage once the month has changed.
+// l.mu must be held.
+func (l *quotaLedger) rolloverLocked(now time.Time) {
+	if month := monthStart(now); !month.Equal(l.month) {
+		l.month = month
+		l.used = make(map[string]int)
+	}
+}
+
+// countsLocked reports whether the images of a job created at createdAt
+// count towards key's usage this month. l.mu must be held.
+func (l *quotaLedger) countsLocked(key string, createdAt time.Time) bool {
+	return !createdAt.Before(l.month) && createdAt.After(l.resets[key])
+}
+
+// Reserve adds images to key's usage if that keeps it within quota, or quota
+// is 0. It returns the key's usage after the reservation, or before it if
+// the reservation was refused.
+func (l *quotaLedger) Reserve(key string, images, quota int) (ok bool, used int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rolloverLocked(time.Now())
+	if quota > 0 && l.used[key]+images > quota {
+		return false, l.used[key]
+	}
+	l.used[key] += images
+	return true, l.used[key]
+}
+
+// Release gives back images reserved by a job created at createdAt that
+// were never processed
+func (l *quotaLedger) Release(key string, createdAt time.Time, images int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rolloverLocked(time.Now())
+	if images > 0 && l.countsLocked(key, createdAt) {
+		l.used[key] = max(0, l.used[key]-images)
+	}
+}
+
+// Used returns key's usage this month
+func (l *quotaLedger) Used(key string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rolloverLocked(time.Now())
+	return l.used[key]
+}
+
+// Reset clears key's usage as of at. Jobs created before then no longer
+// count towards it, even once they finish.
+func (l *quotaLedger) Reset(key string, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rolloverLocked(time.Now())
+	l.resets[key] = at
+	delete(l.used, key)
+}
+
+// restore adds the images a restored job used to key's usage
+func (l *quotaLedger) restore(key string, createdAt time.Time, images int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rolloverLocked(time.Now())
+	if l.countsLocked(key, createdAt) {
+		l.used[key] += images
+	}
+}
+
+// restoreQuotas rebuilds the quota ledger from the restored and expired jobs
+// and any persisted resets. s.jobsMu must be held.
+func (s *Server) restoreQuotas() error {
+	if store, ok := s.jobStore.(quotaResetStore); ok {
+		resets, err := store.LoadQuotaResets()
+		if err != nil {
+			return err
+		}
+		for key, at := range resets {
+			s.quotas.Reset(key, at)
+		}
+	}
+	for _, job := range s.jobs {
+		if job.Owner != "" {
+			s.quotas.restore(job.Owner, job.CreatedAt, job.Progress.Completed+job.Progress.Failed)
+		}
+	}
+	for _, job := range s.expiredJobs {
+		if job.owner != "" {
+			s.quotas.restore(job.owner, job.createdAt, job.images)
+		}
+	}
+	return nil
+}
+
+// imageQuota returns the monthly image quota of the API key with the given
+// ID, or 0 if it has none
+func (s *Server) imageQuota(keyID string) int {
+	if apiKey, ok := s.apiKeys.ByID(keyID); ok && apiKey.Quota > 0 {
+		return apiKey.Quota
+	}
+	return s.cfg.MonthlyImageQuota
+}
+
+// quotaResponse reports the quota of the API key with the given ID
+func (s *Server) quotaResponse(keyID string) *QuotaResponse {
+	response := &QuotaResponse{
+		KeyID:    keyID,
+		Quota:    s.imageQuota(keyID),
+		Used:     s.quotas.Used(keyID),
+		ResetsAt: monthStart(time.Now()).AddDate(0, 1, 0),
+	}
+	if response.Quota > 0 {
+		remaining := max(0, response.Quota-response.Used)
+		response.Remaining = &remaining
+	}
+	return response
+}
+
+// reserveQuota reserves a job's images against its owner's quota, writing an
+// error response and returning false if the job would exceed it. Jobs
+// submitted without authentication have no quota.
+func (s *Server) reserveQuota(w http.ResponseWriter, owner string, images int) bool {
+	if owner == "" {
+		return true
+	}
+	quota := s.imageQuota(owner)
+	if ok, used := s.quotas.Reserve(owner, images, quota); !ok {
+		writeErrorResponse(w, http.StatusPaymentRequired, ErrorResponse{
+			Error: fmt.Sprintf("monthly image quota exceeded: job has %d images but only %d remain", images, max(0, quota-used)),
+			Quota: s.quotaResponse(owner),
+		})
+		return false
+	}
+	return true
+}
+
+// abandonedCodes are the codes of the errors recorded for images a job gave
+// up on without processing them
+var abandonedCodes = map[string]bool{codeCancelled: true, codeJobTimedOut: true, codeJobStalled: true}
+
+// releaseQuota gives back the images of a finished job that were never
+// processed. job.mu must not be held.
+func (s *Server) releaseQuota(job *JobData) {
+	if job.Owner == "" {
+		return
+	}
+	job.mu.Lock()
+	unprocessed := job.Progress.Total - job.Progress.Completed - job.Progress.Failed
+	for _, storeErr := range job.Errors {
+		// Images the job gave up on were never processed, though they
+		// count as failed
+		if abandonedCodes[storeErr.Code] {
+			unprocessed++
+		}
+	}
+	job.mu.Unlock()
+	s.quotas.Release(job.Owner, job.CreatedAt, unprocessed)
+}
+
+// quotaKeyID returns the ID of the key whose quota a quota request is about:
+// the caller's, or for admins, the one named by the key_id parameter. It
+// writes an error response and returns false if there is none, or the caller
+// may not see it.
+func (s *Server) quotaKeyID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	apiKey := callerKey(r.Context())
+	if apiKey == nil {
+		responseError(w, http.StatusNotFound, "quotas require API key authentication")
+		return "", false
+	}
+	keyID := r.URL.Query().Get("key_id")
+	if keyID == "" || keyID == apiKey.ID {
+		return apiKey.ID, true
+	}
+	if !apiKey.IsAdmin() {
+		responseError(w, http.StatusForbidden, "admin API key required to see another key's quota")
+		return "", false
+	}
+	if _, ok := s.apiKeys.ByID(keyID); !ok {
+		responseError(w, http.StatusNotFound, "API key not found")
+		return "", false
+	}
+	return keyID, true
+}
+
+// handleQuota handles the quota endpoint, which reports the caller's monthly
+// image quota, or with key_id, an admin can see any key's
+func (s *Server) handleQuota(w http.ResponseWriter, r *http.Request) {
+	keyID, ok := s.quotaKeyID(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.quotaResponse(keyID))
+}
+
+// handleResetQuota handles the admin quota reset endpoint, which clears the
+// usage of the key named by key_id for the rest of the month
+func (s *Server) handleResetQuota(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("key_id") == "" {
+		responseError(w, http.StatusBadRequest, "missing key_id query parameter")
+		return
+	}
+	keyID, ok := s.quotaKeyID(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	s.quotas.Reset(keyID, now)
+	if store, ok := s.jobStore.(quotaResetStore); ok {
+		s.persist(store.SaveQuotaReset(keyID, now))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.quotaResponse(keyID))
+}
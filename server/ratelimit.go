@@ -0,0 +1,124 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultSubmitRate is the number of jobs each client may submit per minute
+// when neither the -submit-rate flag nor IMGPROC_SUBMIT_RATE is set
+const defaultSubmitRate = 60
+
+// defaultSubmitBurst is the number of jobs each client may submit at once
+// when neither the -submit-burst flag nor IMGPROC_SUBMIT_BURST is set
+const defaultSubmitBurst = 20
+
+// submitBucketSweep is how often buckets that have refilled are removed.
+// A full bucket is the same as no bucket, so idle clients cost nothing.
+const submitBucketSweep = time.Minute
+
+// submitLimiter limits how quickly each client may submit jobs, with a token
+// bucket per client that holds up to burst tokens and refills at rate tokens
+// per second. A rate of 0 disables it.
+type submitLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket is a client's bucket as of updated
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newSubmitLimiter(perMinute, burst int) *submitLimiter {
+	return &submitLimiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from client's bucket if it has one. It returns the
+// tokens left, and if there were none, how long until there will be one.
+func (l *submitLimiter) Allow(client string) (ok bool, remaining int, retryAfter time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= submitBucketSweep {
+		l.sweepLocked(now)
+	}
+
+	b, exists := l.buckets[client]
+	if !exists {
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[client] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.updated = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, 0, wait
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// refill returns the tokens in b as of now
+func (l *submitLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+}
+
+// sweepLocked removes the buckets that have refilled. l.mu must be held.
+func (l *submitLimiter) sweepLocked(now time.Time) {
+	for client, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// submitClient identifies the client of a submission for rate limiting: the
+// ID of its API key, or its IP address when authentication is off
+func submitClient(r *http.Request) string {
+	if owner := ownerID(r.Context()); owner != "" {
+		return "key:" + owner
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// allowSubmit applies the submission rate limit to r, setting the
+// X-RateLimit-* headers. If the client is over its limit, it writes a 429
+// response and returns false.
+func (s *Server) allowSubmit(w http.ResponseWriter, r *http.Request) bool {
+	if s.cfg.SubmitRate == 0 {
+		return true
+	}
+
+	ok, remaining, retryAfter := s.submitLimiter.Allow(submitClient(r))
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(s.cfg.SubmitBurst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	if ok {
+		return true
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(seconds))
+	responseError(w, http.StatusTooManyRequests, "submission rate limit exceeded, try again later")
+	return false
+}
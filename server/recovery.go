@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// withRecovery wraps next so that a panicking handler fails only its own
+// request, with a 500 response carrying the request ID, instead of taking
+// down the server
+func (s *Server) withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			if value == http.ErrAbortHandler {
+				// Deliberately aborted, so there is nothing to report
+				panic(value)
+			}
+			s.logger(r.Context()).Error("panic handling request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(value),
+				"stack", string(debug.Stack()),
+			)
+			if rec.status != 0 {
+				// Part of the response has been sent, so all that can be
+				// done is to cut it short
+				panic(http.ErrAbortHandler)
+			}
+			writeErrorResponse(w, http.StatusInternalServerError, ErrorResponse{
+				Error:     "internal server error",
+				RequestID: requestID(r.Context()),
+			})
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// recoverImagePanic turns value, recovered from a panic while processing
+// imageURL, such as a decoder choking on a malformed image, into an
+// internal_panic error for that image, so the rest of its job carries on. It
+// returns nil if there was no panic.
+func (s *Server) recoverImagePanic(ctx context.Context, imageURL string, value any) error {
+	if value == nil {
+		return nil
+	}
+	s.logger(ctx).Error("panic processing image",
+		"image_url", imageURL,
+		"panic", fmt.Sprint(value),
+		"stack", string(debug.Stack()),
+	)
+	return &codedError{Code: codeInternalPanic, Err: fmt.Errorf("internal error processing image: %v", value)}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// panicImageHeader starts images whose decoder panics
+const panicImageHeader = "PANIC!"
+
+func init() {
+	image.RegisterFormat("panic", panicImageHeader,
+		func(io.Reader) (image.Image, error) { panic("decoder bug") },
+		func(io.Reader) (image.Config, error) { panic("decoder bug") },
+	)
+}
+
+func TestDecoderPanic(t *testing.T) {
+	host := serveBytes(t, map[string][]byte{"/panic.img": []byte(panicImageHeader + " and then some")})
+	fixtures := serveFixtures(t)
+	s := newTestServer(t, nil)
+
+	jobID := submitJob(t, s, SubmitJobRequest{Count: 1, Visits: []Visit{{StoreID: "S00339218", ImageURLs: []string{host.URL + "/panic.img", fixtures.URL + "/shelf.jpg"}}}})
+	status := waitForJob(t, s, jobID)
+	if want := (JobProgress{Total: 2, Completed: 1, Failed: 1}); status.Progress != want || status.Status != statusCompletedWithErrors {
+		t.Errorf("job = %s with %+v, want %s with %+v", status.Status, status.Progress, statusCompletedWithErrors, want)
+	}
+	if len(status.Errors) != 1 || status.Errors[0].Code != codeInternalPanic {
+		t.Errorf("errors = %+v, want one %s error", status.Errors, codeInternalPanic)
+	}
+}
+
+func TestImagePanic(t *testing.T) {
+	s := newTestServer(t, nil)
+	panicking := func(context.Context, string) (imageInfo, error) { panic("processor bug") }
+	_, err := s.calculateImagePerimeter(context.Background(), Store{StoreID: "S00339218"}, "http://127.0.0.1/a.jpg", panicking)
+	if code := errorCode(err); code != codeInternalPanic {
+		t.Errorf("error = %v with code %q, want %s", err, code, codeInternalPanic)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	s := newTestServer(t, nil)
+	h := s.withRecovery(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic("handler bug") }))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/api/jobs", nil))
+	var resp ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusInternalServerError {
+		t.Fatalf("panicking handler: %d %s, want a 500 error response", rec.Code, rec.Body.String())
+	}
+	if resp.Error != "internal server error" {
+		t.Errorf("error = %q, want internal server error", resp.Error)
+	}
+
+	// A deliberately aborted handler is left to net/http
+	aborted := s.withRecovery(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic(http.ErrAbortHandler) }))
+	defer func() {
+		if value := recover(); value != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", value)
+		}
+	}()
+	aborted.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/jobs", nil))
+}
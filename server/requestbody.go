@@ -0,0 +1,89 @@
+package server
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// defaultMaxBodyBytes is the largest job submission accepted when neither
+// the -max-body-bytes flag nor IMGPROC_MAX_BODY_BYTES is set. The limit
+// applies after decompression, so a small gzipped body can't expand without
+// bound.
+const defaultMaxBodyBytes = 32 << 20
+
+// errUnsupportedEncoding is returned for request bodies in a content encoding
+// other than gzip
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding: must be gzip or identity")
+
+// gzipBodyError is a failure to decompress a gzipped request body
+type gzipBodyError struct {
+	Err error
+}
+
+func (e *gzipBodyError) Error() string {
+	return "invalid gzip request body: " + e.Err.Error()
+}
+
+func (e *gzipBodyError) Unwrap() error {
+	return e.Err
+}
+
+// gzipBody decompresses a request body, reporting any failure other than the
+// end of the stream as a gzipBodyError
+type gzipBody struct {
+	zr   *gzip.Reader
+	body io.Closer
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	n, err := b.zr.Read(p)
+	if err != nil && err != io.EOF {
+		err = &gzipBodyError{Err: err}
+	}
+	return n, err
+}
+
+func (b *gzipBody) Close() error {
+	b.zr.Close()
+	return b.body.Close()
+}
+
+// requestBody returns the body of r, decompressed if it was sent with
+// Content-Encoding: gzip, and limited to limit bytes after decompression.
+// Reading past the limit fails with an *http.MaxBytesError.
+func requestBody(w http.ResponseWriter, r *http.Request, limit int64) (io.ReadCloser, error) {
+	switch encoding := strings.TrimSpace(r.Header.Get("Content-Encoding")); {
+	case encoding == "" || strings.EqualFold(encoding, "identity"):
+		return http.MaxBytesReader(w, r.Body, limit), nil
+	case strings.EqualFold(encoding, "gzip"):
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, &gzipBodyError{Err: err}
+		}
+		return http.MaxBytesReader(w, &gzipBody{zr: zr, body: r.Body}, limit), nil
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
+// writeBodyError writes the error response for a request body that couldn't
+// be read or decoded, returning false if err isn't a body error
+func writeBodyError(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	var badGzip *gzipBodyError
+	switch {
+	case errors.As(err, &tooLarge):
+		responseError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body too large: must be at most %d bytes", tooLarge.Limit))
+	case errors.As(err, &badGzip):
+		responseError(w, http.StatusBadRequest, badGzip.Error())
+	case errors.Is(err, errUnsupportedEncoding):
+		responseError(w, http.StatusUnsupportedMediaType, err.Error())
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gzipped returns data gzip compressed
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// submitEncoded submits body to h with the given Content-Encoding
+func submitEncoded(h http.Handler, encoding string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/submit", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", encoding)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSubmitGzipBody(t *testing.T) {
+	s := newTestServer(t, nil)
+	fixtures := serveFixtures(t)
+	data, err := json.Marshal(SubmitJobRequest{Count: 1, Visits: []Visit{{StoreID: "S00339218", ImageURLs: []string{fixtures.URL + "/shelf.jpg"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := submitEncoded(s, "gzip", gzipped(t, data))
+	var resp JobResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("submitting a gzipped body: %d %s", rec.Code, rec.Body.String())
+	}
+	if status := waitForJob(t, s, resp.JobID); status.Status != statusCompleted {
+		t.Errorf("status = %s, want %s", status.Status, statusCompleted)
+	}
+}
+
+func TestSubmitBodyEncodingErrors(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.MaxBodyBytes = 1 << 10 })
+	valid := gzipped(t, []byte(`{"count":1,"visits":[]}`))
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+		want     string
+	}{
+		{"not gzip", "gzip", []byte(`{"count":1}`), http.StatusBadRequest, "invalid gzip request body"},
+		{"corrupt stream", "gzip", append(bytes.Clone(valid[:len(valid)-8]), 0, 0, 0, 0, 0, 0, 0, 0), http.StatusBadRequest, "invalid gzip request body"},
+		{"truncated stream", "gzip", valid[:len(valid)/2], http.StatusBadRequest, "invalid gzip request body"},
+		// The limit applies to the decompressed body
+		{"too large once decompressed", "gzip", gzipped(t, []byte(`{"visits":[`+strings.Repeat(" ", 4<<10)+`]}`)), http.StatusRequestEntityTooLarge, "request body too large"},
+		{"unsupported encoding", "br", []byte(`{}`), http.StatusUnsupportedMediaType, "unsupported Content-Encoding"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := submitEncoded(s, tt.encoding, tt.body)
+			var resp ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding response %q: %v", rec.Body.String(), err)
+			}
+			if rec.Code != tt.status || !strings.Contains(resp.Error, tt.want) {
+				t.Errorf("got %d %q, want %d with %q", rec.Code, resp.Error, tt.status, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+)
+
+// defaultMaxStoredRequestBytes is the largest submission kept with its job
+// when neither the -max-stored-request-bytes flag nor
+// IMGPROC_MAX_STORED_REQUEST_BYTES is set
+const defaultMaxStoredRequestBytes = 1 << 20
+
+// storedRequest returns the submission to keep with its job, or nil if
+// submissions aren't kept or this one is too large to
+func (s *Server) storedRequest(req SubmitJobRequest) *SubmitJobRequest {
+	if s.cfg.MaxStoredRequestBytes == 0 {
+		return nil
+	}
+	data, err := json.Marshal(req)
+	if err != nil || int64(len(data)) > s.cfg.MaxStoredRequestBytes {
+		return nil
+	}
+	return &req
+}
+
+// storedJobRequest looks up the job for a request about its stored
+// submission, writing an error response and returning false if it has none
+func (s *Server) storedJobRequest(w http.ResponseWriter, r *http.Request) (*JobData, bool) {
+	job, ok := s.lookupJob(w, r)
+	if !ok {
+		return nil, false
+	}
+	if job.Request == nil {
+		responseJobError(w, http.StatusNotFound, "job's request was not stored", job.ID)
+		return nil, false
+	}
+	return job, true
+}
+
+// handleJobRequest handles the job request endpoint, which returns the
+// submission a job was created from, with its visit times normalized
+func (s *Server) handleJobRequest(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.storedJobRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.Request)
+}
+
+// handleRerunJob handles the job rerun endpoint, which submits a new job
+// identical to the one a job was created from. The submission is checked
+// against the current limits again, but is never deduplicated.
+func (s *Server) handleRerunJob(w http.ResponseWriter, r *http.Request) {
+	if !s.allowSubmit(w, r) {
+		return
+	}
+
+	job, ok := s.storedJobRequest(w, r)
+	if !ok {
+		return
+	}
+	req := *job.Request
+	// Download headers aren't persisted, so a restored job no longer has them
+	if req.DownloadHeaders.redacted() || slices.ContainsFunc(req.Visits, func(visit Visit) bool { return visit.DownloadHeaders.redacted() }) {
+		responseJobError(w, http.StatusConflict, "job's download headers weren't stored, so it must be submitted again", job.ID)
+		return
+	}
+	if !s.checkSubmission(w, &req) {
+		return
+	}
+
+	rerun, ok := s.enqueueJob(w, r, req, jobOrigin{payloadHash: payloadHash(req)})
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(JobResponse{JobID: rerun.ID, TraceID: rerun.span.TraceID(), RerunOf: job.ID})
+}
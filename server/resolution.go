@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// pngMetadataLimit bounds how much of a PNG is read past its header looking
+// for its pHYs chunk, which comes before the image data but may follow large
+// chunks such as an ICC profile
+const pngMetadataLimit = 64 << 10
+
+// pngSignature starts every PNG, before its chunks
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// JFIF APP0 segments start with jfifIdentifier, followed by a 2 byte
+// version, a units byte and 2 byte horizontal and vertical densities
+const jfifIdentifier = "JFIF\x00"
+
+// Resolution tags of an image's first IFD
+const (
+	exifTagXResolution    = 0x011a
+	exifTagYResolution    = 0x011b
+	exifTagResolutionUnit = 0x0128
+)
+
+// The units resolutions are declared in. Only the ones that are physical
+// lengths are listed: the others mean the resolution is only an aspect
+// ratio.
+const (
+	jfifUnitInch = 1
+	jfifUnitCM   = 2
+	exifUnitInch = 2
+	exifUnitCM   = 3
+	pngUnitMetre = 1
+)
+
+const cmPerInch = 2.54
+
+// imageResolution returns the horizontal and vertical resolution, in dots per
+// inch, that an image's metadata declares, or zeros if it declares none or
+// only an aspect ratio. header is the bytes the decoder read to get the
+// dimensions, which hold a JPEG's JFIF and EXIF segments and a whole TIFF.
+// A PNG's pHYs chunk may come after what the decoder read, so its chunks are
+// read on from header into rest, the remainder of the body.
+func imageResolution(header []byte, format string, rest io.Reader) (dpiX, dpiY float64) {
+	switch format {
+	case "jpeg":
+		dpiX, dpiY = jfifResolution(jpegSegment(header, jpegMarkerAPP0, jfifIdentifier))
+		if dpiX == 0 {
+			dpiX, dpiY = exifResolution(header, format)
+		}
+	case "tiff":
+		dpiX, dpiY = exifResolution(header, format)
+	case "png":
+		if len(header) < len(pngSignature) {
+			return 0, 0
+		}
+		chunks := io.MultiReader(bytes.NewReader(header[len(pngSignature):]), io.LimitReader(rest, pngMetadataLimit))
+		dpiX, dpiY = pngResolution(chunks)
+	}
+	if dpiX <= 0 || dpiY <= 0 {
+		return 0, 0
+	}
+	return dpiX, dpiY
+}
+
+// jfifResolution returns the density in a JPEG's JFIF segment
+func jfifResolution(segment []byte) (dpiX, dpiY float64) {
+	if len(segment) < 7 {
+		return 0, 0
+	}
+	x := float64(binary.BigEndian.Uint16(segment[3:5]))
+	y := float64(binary.BigEndian.Uint16(segment[5:7]))
+	switch segment[2] {
+	case jfifUnitInch:
+		return x, y
+	case jfifUnitCM:
+		return x * cmPerInch, y * cmPerInch
+	}
+	return 0, 0
+}
+
+// exifResolution returns the resolution in the first IFD of an image's EXIF,
+// which is in inches unless it says otherwise
+func exifResolution(header []byte, format string) (dpiX, dpiY float64) {
+	tiff, ok := exifTIFF(header, format)
+	if !ok {
+		return 0, 0
+	}
+	var x, y float64
+	var unit uint32 = exifUnitInch
+	for _, entry := range tiff.ifd(tiff.firstIFD()) {
+		switch entry.tag {
+		case exifTagXResolution:
+			x, _ = entry.rational(0)
+		case exifTagYResolution:
+			y, _ = entry.rational(0)
+		case exifTagResolutionUnit:
+			unit, _ = entry.uint(0)
+		}
+	}
+	switch unit {
+	case exifUnitInch:
+		return x, y
+	case exifUnitCM:
+		return x * cmPerInch, y * cmPerInch
+	}
+	return 0, 0
+}
+
+// pngResolution reads the chunks of a PNG up to its image data, and returns
+// the resolution in its pHYs chunk
+func pngResolution(r io.Reader) (dpiX, dpiY float64) {
+	var chunk [8]byte
+	for {
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return 0, 0
+		}
+		length := binary.BigEndian.Uint32(chunk[0:4])
+		switch string(chunk[4:8]) {
+		case "pHYs":
+			var phys [9]byte
+			if length != uint32(len(phys)) {
+				return 0, 0
+			}
+			if _, err := io.ReadFull(r, phys[:]); err != nil || phys[8] != pngUnitMetre {
+				return 0, 0
+			}
+			x := float64(binary.BigEndian.Uint32(phys[0:4]))
+			y := float64(binary.BigEndian.Uint32(phys[4:8]))
+			return x * cmPerInch / 100, y * cmPerInch / 100
+		case "IDAT", "IEND":
+			return 0, 0
+		}
+		// Skip the chunk's data and CRC
+		if _, err := io.CopyN(io.Discard, r, int64(length)+4); err != nil {
+			return 0, 0
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import "testing"
+
+func TestImageResolutionFixtures(t *testing.T) {
+	s := newTestServer(t, nil)
+	fixtures := serveFixtures(t)
+	tests := []struct {
+		fixture           string
+		dpiX, dpiY        float64
+		widthCM, heightCM float64
+	}{
+		{"dpi300.jpg", 300, 300, 3.39, 2.54},
+		// JFIF densities in dots per centimetre, differing per axis
+		{"dpcm.jpg", 299.72, 149.86, 3.39, 5.08},
+		// A JFIF segment with only an aspect ratio, and the resolution in EXIF
+		{"exif96.jpg", 96, 96, 10.58, 7.94},
+		// The pHYs chunk follows a text chunk, past what the header decode reads
+		{"dpi300.png", 300, 300, 5.08, 3.81},
+		// Only an aspect ratio, which isn't a physical size
+		{"aspect.png", 0, 0, 0, 0},
+		{"shelf.jpg", 0, 0, 0, 0},
+	}
+	var urls []string
+	for _, tt := range tests {
+		urls = append(urls, fixtures.URL+"/"+tt.fixture)
+	}
+	results, errs := runImages(t, s, urls...)
+	for _, tt := range tests {
+		result, ok := results[fixtures.URL+"/"+tt.fixture]
+		if !ok {
+			t.Errorf("%s: no result, error %+v", tt.fixture, errs[fixtures.URL+"/"+tt.fixture])
+			continue
+		}
+		if result.DPIX != tt.dpiX || result.DPIY != tt.dpiY {
+			t.Errorf("%s resolution = %vx%v dpi, want %vx%v", tt.fixture, result.DPIX, result.DPIY, tt.dpiX, tt.dpiY)
+		}
+		if result.PhysicalWidthCM != tt.widthCM || result.PhysicalHeightCM != tt.heightCM {
+			t.Errorf("%s physical size = %vx%v cm, want %vx%v", tt.fixture, result.PhysicalWidthCM, result.PhysicalHeightCM, tt.widthCM, tt.heightCM)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultJobRetention is how long finished jobs are kept when neither the
+// -job-retention flag nor IMGPROC_JOB_RETENTION is set
+const defaultJobRetention = 24 * time.Hour
+
+// janitorInterval is how often the janitor looks for expired jobs, unless the
+// retention period is so short that it needs to look more often
+const janitorInterval = time.Minute
+
+// expiredJob is what is remembered of a job once it has expired, so requests
+// for it can be told apart from requests for jobs that never existed, and
+// its images still count towards its owner's quota on restart
+type expiredJob struct {
+	owner     string
+	createdAt time.Time
+	images    int
+	expiredAt time.Time
+}
+
+// startJanitor starts the janitor, which removes finished jobs, and
+// completed background preflights, once they have been kept for the
+// retention period. They are kept forever if it is 0.
+func (s *Server) startJanitor() {
+	if s.cfg.JobRetention <= 0 {
+		return
+	}
+	interval := min(janitorInterval, max(s.cfg.JobRetention/2, time.Second))
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if s.expireJobs(now) {
+				s.compactJobStore(now)
+			}
+			s.expirePreflights(now)
+		}
+	}()
+}
+
+// finishedAtLocked returns when a finished job finished, and false if it hasn't.
+// Jobs interrupted by a restart have no completion time, so their creation
+// time is used. job.mu must be held.
+func (job *JobData) finishedAtLocked() (time.Time, bool) {
+	if job.Status == statusQueued || job.Status == statusOngoing {
+		return time.Time{}, false
+	}
+	if job.CompletedAt.IsZero() {
+		return job.CreatedAt, true
+	}
+	return job.CompletedAt, true
+}
+
+// expireJobs removes the jobs that finished more than the retention period
+// before now, archiving them first if an archive directory is configured.
+// jobsMu is only held to list the jobs and to remove the expired ones, so
+// handlers aren't held up while each job is checked and archived. It reports
+// whether any job expired or was forgotten.
+func (s *Server) expireJobs(now time.Time) bool {
+	s.jobsMu.Lock()
+	all := make([]*JobData, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		all = append(all, job)
+	}
+	s.jobsMu.Unlock()
+
+	var expired []*JobData
+	for _, job := range all {
+		job.mu.Lock()
+		finishedAt, finished := job.finishedAtLocked()
+		job.mu.Unlock()
+		if !finished || now.Sub(finishedAt) < s.cfg.JobRetention {
+			continue
+		}
+		if err := s.archiveJob(job); err != nil {
+			// Keep the job until it can be archived
+			s.log.Error("error archiving job", "job_id", job.ID, "error", err)
+			continue
+		}
+		s.persist(s.jobStore.ExpireJob(job.ID))
+		expired = append(expired, job)
+	}
+
+	s.removeOldArchives(now)
+
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	for _, job := range expired {
+		job.mu.Lock()
+		images := job.Progress.Completed + job.Progress.Failed
+		job.mu.Unlock()
+		delete(s.jobs, job.ID)
+		// The job can't be replayed once it's gone, so its key may be
+		// used for a new one
+		if job.IdempotencyKey != "" {
+			key := ownerScoped(job.Owner, job.IdempotencyKey)
+			if entry, ok := s.idempotencyKeys[key]; ok && entry.jobID == job.ID {
+				delete(s.idempotencyKeys, key)
+			}
+		}
+		s.expiredJobs[job.ID] = expiredJob{owner: job.Owner, createdAt: job.CreatedAt, images: images, expiredAt: now}
+	}
+	// Expired jobs are forgotten altogether after another retention period
+	forgotten := 0
+	for id, job := range s.expiredJobs {
+		if now.Sub(job.expiredAt) >= s.cfg.JobRetention {
+			delete(s.expiredJobs, id)
+			forgotten++
+		}
+	}
+	if len(expired) > 0 {
+		s.log.Info("expired jobs", "jobs", len(expired), "remaining", len(s.jobs))
+	}
+	return len(expired) > 0 || forgotten > 0
+}
+
+// compactJobStore rewrites the job store, if it is one that grows, without
+// the results and errors of expired jobs. Expired jobs are dropped from it
+// altogether once they have been forgotten and no longer count towards
+// their owner's quota for this month.
+func (s *Server) compactJobStore(now time.Time) {
+	store, ok := s.jobStore.(compactingJobStore)
+	if !ok {
+		return
+	}
+	month := monthStart(now)
+	err := store.Compact(func(rec JobRecord) bool {
+		return !rec.Expired || now.Sub(rec.ExpiredAt) < s.cfg.JobRetention || !rec.CreatedAt.Before(month)
+	})
+	if err != nil {
+		s.log.Error("error compacting the job store", "error", err)
+	}
+}
+
+// isExpiredJob reports whether the job with the given ID has expired and
+// apiKey may see it. s.jobsMu must not be held.
+func (s *Server) isExpiredJob(apiKey *APIKey, jobID string) bool {
+	s.jobsMu.Lock()
+	job, ok := s.expiredJobs[jobID]
+	s.jobsMu.Unlock()
+	return ok && canAccessOwner(apiKey, job.owner)
+}
+
+// writeExpiredJob writes the 410 response for a job that has expired,
+// returning false if there is no such expired job or the caller may not see
+// it. s.jobsMu must not be held.
+func (s *Server) writeExpiredJob(w http.ResponseWriter, r *http.Request, jobID string) bool {
+	if !s.isExpiredJob(callerKey(r.Context()), jobID) {
+		return false
+	}
+	writeErrorResponse(w, http.StatusGone, ErrorResponse{
+		Error: fmt.Sprintf("job has expired: finished jobs are kept for %s", s.cfg.JobRetention),
+		Code:  codeJobExpired,
+		JobID: jobID,
+	})
+	return true
+}
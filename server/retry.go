@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// defaultDownloadAttempts is the number of attempts made for each image when
+// neither the -download-attempts flag nor IMGPROC_DOWNLOAD_ATTEMPTS is set
+const defaultDownloadAttempts = 3
+
+// defaultMaxRetryAfter is the longest Retry-After that is waited for when
+// neither the -max-retry-after flag nor IMGPROC_MAX_RETRY_AFTER is set
+const defaultMaxRetryAfter = 30 * time.Second
+
+const (
+	retryBaseDelay = 250 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// statusError is returned when an image host responds with a status other
+// than 200 OK. RetryAfter is the wait the host asked for with a Retry-After
+// header, if any.
+type statusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+// downloadTimeoutError is returned when a download attempt takes longer than
+// the image timeout
+type downloadTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *downloadTimeoutError) Error() string {
+	return fmt.Sprintf("error downloading image: timed out after %v", e.Timeout)
+}
+
+// parseRetryAfter parses a Retry-After header in either its delta-seconds or
+// HTTP-date form, returning 0 if it is missing or invalid
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// rateLimitedError is returned when an image host keeps rate limiting the
+// service, or asks it to wait longer than it is willing to
+func rateLimitedError(err error) error {
+	return &codedError{Code: codeRateLimited, Err: err}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("error downloading image: status code %d", e.StatusCode)
+}
+
+// isRetryable reports whether a failed download may succeed if it is
+// attempted again: network errors, timeouts, truncated transfers, 429 and 5xx
+// responses. Other 4xx responses, forbidden destinations and decode errors are
+// permanent.
+func isRetryable(err error) bool {
+	var forbidden *forbiddenDestinationError
+	if errors.As(err, &forbidden) {
+		return false
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+
+	var timeoutErr *downloadTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return true
+	}
+	var truncatedErr *truncatedDownloadError
+	if errors.As(err, &truncatedErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// retryDelay returns the backoff before the given retry (1 for the first
+// retry), doubling each time up to retryMaxDelay with up to 50% jitter so
+// images failing together don't retry in lockstep
+func retryDelay(retry int) time.Duration {
+	delay := retryBaseDelay << (retry - 1)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// downloadWithRetry downloads an image and returns its dimensions, retrying
+// transient failures with exponential backoff up to the configured number of
+// attempts. A 429 response's Retry-After is honoured instead of the backoff,
+// unless it exceeds the configured maximum or ctx's deadline, in which case
+// the image fails as rate limited. Retries stop as soon as ctx is cancelled.
+func (s *Server) downloadWithRetry(ctx context.Context, url string) (imageInfo, error) {
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		var info imageInfo
+		info, err = s.downloadAndGetDimensions(ctx, url)
+		if err == nil {
+			info.Attempts = attempt
+			return info, nil
+		}
+		if attempt >= s.cfg.DownloadAttempts || !isRetryable(err) || ctx.Err() != nil {
+			break
+		}
+
+		delay := retryDelay(attempt)
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+			delay = statusErr.RetryAfter
+			if delay > s.cfg.MaxRetryAfter {
+				return imageInfo{}, rateLimitedError(fmt.Errorf("%w: host asked to retry after %v, more than the maximum of %v", err, delay, s.cfg.MaxRetryAfter))
+			}
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			if statusErr != nil && statusErr.StatusCode == http.StatusTooManyRequests {
+				return imageInfo{}, rateLimitedError(fmt.Errorf("%w: host asked to retry after %v, past the image's deadline", err, delay))
+			}
+			break
+		}
+
+		s.logger(ctx).Debug("retrying image download", "image_url", url, "attempt", attempt, "delay_ms", delay.Milliseconds(), "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return imageInfo{}, ctx.Err()
+		}
+	}
+
+	if attempt == 1 {
+		err = fmt.Errorf("%w (1 attempt)", err)
+	} else {
+		err = fmt.Errorf("%w (after %d attempts)", err, attempt)
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests {
+		return imageInfo{}, rateLimitedError(err)
+	}
+	return imageInfo{}, err
+}
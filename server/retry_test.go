@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rateLimitingHost responds 429 Too Many Requests with retryAfter to the
+// first limited requests for each path, then serves image
+func rateLimitingHost(t *testing.T, limited int, retryAfter string, image []byte) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+		if n <= limited {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write(image)
+	}))
+	t.Cleanup(host.Close)
+	return host
+}
+
+// tinyPNG returns a 1x1 PNG
+func tinyPNG(t *testing.T) []byte {
+	t.Helper()
+	return encodeImage(t, 1, 1, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) })
+}
+
+func TestRetryAfter(t *testing.T) {
+	host := rateLimitingHost(t, 2, "1", tinyPNG(t))
+	s := newTestServer(t, nil)
+
+	start := time.Now()
+	results, errs := runImages(t, s, host.URL+"/a.png")
+	result, ok := results[host.URL+"/a.png"]
+	if !ok {
+		t.Fatalf("no result, error %+v", errs[host.URL+"/a.png"])
+	}
+	if result.Attempts != 3 {
+		t.Errorf("attempts = %d, want 3", result.Attempts)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Errorf("succeeded after %v, want the 2s the host asked for", elapsed)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	data := tinyPNG(t)
+	tests := []struct {
+		name       string
+		retryAfter string
+		want       string
+	}{
+		{"retry after too long", "60", "more than the maximum of 5s"},
+		{"attempts exhausted", "", "after 2 attempts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := rateLimitingHost(t, 10, tt.retryAfter, data)
+			s := newTestServer(t, func(cfg *Config) {
+				cfg.DownloadAttempts = 2
+				cfg.MaxRetryAfter = 5 * time.Second
+			})
+
+			_, errs := runImages(t, s, host.URL+"/a.png")
+			if got := errs[host.URL+"/a.png"]; got.Code != codeRateLimited || !strings.Contains(got.Error, tt.want) {
+				t.Errorf("error = %s %q, want %s mentioning %q", got.Code, got.Error, codeRateLimited, tt.want)
+			}
+		})
+	}
+}
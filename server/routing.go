@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+)
+
+// route registers handler for pattern, and for each of the legacy patterns
+// it replaces. Responses on legacy routes carry a Deprecation header, since
+// the legacy routes will be removed in the next release.
+func (s *Server) route(pattern string, handler http.HandlerFunc, legacy ...string) {
+	s.mux.HandleFunc(pattern, handler)
+	for _, legacyPattern := range legacy {
+		s.mux.HandleFunc(legacyPattern, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			handler(w, r)
+		})
+	}
+}
+
+// withRouteErrors wraps mux so that requests for unknown paths, or with a
+// method the path doesn't support, get the same JSON errors as the rest of
+// the API. The 405 responses keep the mux's Allow header.
+func withRouteErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		// The mux has no route for the request, so its handler only writes
+		// an error, which is replaced
+		rec := &routeErrorRecorder{header: make(http.Header)}
+		handler.ServeHTTP(rec, r)
+		if rec.status == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", rec.header.Get("Allow"))
+			responseError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		responseError(w, http.StatusNotFound, "not found")
+	})
+}
+
+// routeErrorRecorder records the status and headers of the mux's error
+// responses, discarding their bodies
+type routeErrorRecorder struct {
+	header http.Header
+	status int
+}
+
+func (w *routeErrorRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *routeErrorRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *routeErrorRecorder) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
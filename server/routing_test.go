@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRouteErrors(t *testing.T) {
+	s := newTestServer(t, nil)
+	tests := []struct {
+		method, path string
+		status       int
+		code         string
+		allow        string
+	}{
+		{"GET", "/api/submit", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST"},
+		{"DELETE", "/submit", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST"},
+		{"POST", "/api/jobs/8f14e45f-ceea-467f-a0e6-1c0b7e3c5a1a", http.StatusMethodNotAllowed, codeMethodNotAllowed, "GET, HEAD"},
+		{"GET", "/api/jobs/8f14e45f-ceea-467f-a0e6-1c0b7e3c5a1a/cancel", http.StatusMethodNotAllowed, codeMethodNotAllowed, "POST"},
+		{"GET", "/api/nope", http.StatusNotFound, codeNotFound, ""},
+		{"GET", "/", http.StatusNotFound, codeNotFound, ""},
+		{"POST", "/api/jobs/8f14e45f-ceea-467f-a0e6-1c0b7e3c5a1a/unknown", http.StatusNotFound, codeNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			var resp ErrorResponse
+			rec := doJSON(t, s, tt.method, tt.path, nil, &resp)
+			if rec.Code != tt.status || resp.Code != tt.code {
+				t.Errorf("got %d %s, want %d %s", rec.Code, resp.Code, tt.status, tt.code)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Allow = %q, want %q", got, tt.allow)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+		})
+	}
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	s := newTestServer(t, nil)
+	fixtures := serveFixtures(t)
+	req := SubmitJobRequest{Count: 1, Visits: []Visit{{StoreID: "S00339218", ImageURLs: []string{fixtures.URL + "/shelf.jpg"}}}, Force: true}
+
+	var jobIDs []string
+	for _, path := range []string{"/submit", "/submit/"} {
+		var resp JobResponse
+		rec := doJSON(t, s, "POST", path, req, &resp)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("POST %s: %d %s", path, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("Deprecation") != "true" {
+			t.Errorf("POST %s has no Deprecation header", path)
+		}
+		jobIDs = append(jobIDs, resp.JobID)
+	}
+	for _, jobID := range jobIDs {
+		waitForJob(t, s, jobID)
+		var status JobStatusResponse
+		rec := doJSON(t, s, "GET", "/status?jobid="+jobID, nil, &status)
+		if rec.Code != http.StatusOK || status.Status != statusCompleted {
+			t.Errorf("GET /status: %d %s", rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("Deprecation") != "true" {
+			t.Error("GET /status has no Deprecation header")
+		}
+	}
+
+	// The API routes aren't deprecated
+	if rec := doRaw(t, s, "GET", "/api/status/"+jobIDs[0], nil, nil); rec.Code != http.StatusOK || rec.Header().Get("Deprecation") != "" {
+		t.Errorf("GET /api/status: %d with Deprecation %q", rec.Code, rec.Header().Get("Deprecation"))
+	}
+}
@@ -0,0 +1,363 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3Scheme is the URL scheme of images stored in S3, as s3://bucket/key
+const s3Scheme = "s3"
+
+// defaultS3Region is the AWS region S3 objects are fetched from when none of
+// the -s3-region flag, IMGPROC_S3_REGION or AWS_REGION is set
+const defaultS3Region = "us-east-1"
+
+// S3 error codes that have an error code of their own
+const (
+	s3NoSuchKey    = "NoSuchKey"
+	s3NoSuchBucket = "NoSuchBucket"
+	s3AccessDenied = "AccessDenied"
+)
+
+const (
+	// emptyPayloadHash is the SHA-256 of the empty body every GET request
+	// is signed with
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// maxS3ErrorBytes is the most of an S3 error response that is read
+	maxS3ErrorBytes = 64 << 10
+)
+
+// Instance role credentials are fetched from the EC2 instance metadata
+// service, and fetched again this long before they expire
+const (
+	instanceMetadataURL        = "http://169.254.169.254/latest"
+	instanceMetadataTimeout    = 5 * time.Second
+	credentialsRefreshInterval = 5 * time.Minute
+)
+
+// awsCredentials sign S3 requests. Expires is zero for credentials that
+// don't expire.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// s3Client fetches objects from S3, or an S3-compatible service such as
+// MinIO, signing each request with AWS Signature Version 4. Credentials come
+// from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables, or otherwise the EC2 instance role.
+type s3Client struct {
+	region string
+
+	// endpoint is the S3-compatible service objects are fetched from with
+	// path-style URLs, or nil for AWS
+	endpoint *url.URL
+
+	// client doesn't go through the download guard, since the endpoint is
+	// configured rather than submitted, and doesn't follow redirects, since
+	// S3 only redirects requests signed for the wrong region. It uses the
+	// download proxy and CAs.
+	client *http.Client
+
+	// metadata fetches instance role credentials
+	metadata *http.Client
+
+	// static are the credentials from the environment, if any
+	static awsCredentials
+
+	// mu guards the instance role credentials, so only one fetch of them
+	// happens at a time
+	mu    sync.Mutex
+	creds awsCredentials
+}
+
+func newS3Client(cfg Config) *s3Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = downloadTLSConfig(cfg)
+	if !cfg.DownloadProxy {
+		transport.Proxy = nil
+	}
+	c := &s3Client{
+		region: cfg.S3Region,
+		client: &http.Client{
+			Transport: transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		// The instance metadata service is only reachable directly
+		metadata: &http.Client{Transport: &http.Transport{Proxy: nil}},
+		static: awsCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+	if cfg.S3Endpoint != "" {
+		// Validated with the rest of the configuration
+		c.endpoint, _ = url.Parse(strings.TrimSuffix(cfg.S3Endpoint, "/"))
+	}
+	return c
+}
+
+// isS3URL reports whether u is an s3:// URL
+func isS3URL(u *url.URL) bool {
+	return strings.EqualFold(u.Scheme, s3Scheme)
+}
+
+// request returns a signed request for the object at the s3://bucket/key
+// URL u
+func (c *s3Client) request(ctx context.Context, u *url.URL) (*http.Request, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if key == "" {
+		return nil, &codedError{Code: codeInvalidURL, Err: errors.New("invalid image URL: missing S3 object key")}
+	}
+
+	// Bucket names with dots don't match AWS's wildcard certificate as a
+	// subdomain, so they are fetched path-style like custom endpoints
+	var target string
+	switch {
+	case c.endpoint != nil:
+		target = c.endpoint.String() + awsURIEncode("/"+bucket+"/"+key)
+	case strings.Contains(bucket, "."):
+		target = fmt.Sprintf("https://s3.%s.amazonaws.com%s", c.region, awsURIEncode("/"+bucket+"/"+key))
+	default:
+		target = fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", bucket, c.region, awsURIEncode("/"+key))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, &codedError{Code: codeInvalidURL, Err: fmt.Errorf("invalid image URL: %v", err)}
+	}
+
+	creds, err := c.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	signRequest(req, creds, c.region, time.Now())
+	return req, nil
+}
+
+// credentials returns the credentials from the environment if there are
+// any, and otherwise the instance role's, fetching them if they are missing
+// or about to expire
+func (c *s3Client) credentials(ctx context.Context) (awsCredentials, error) {
+	if c.static.AccessKeyID != "" && c.static.SecretAccessKey != "" {
+		return c.static, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds.AccessKeyID != "" && time.Until(c.creds.Expires) > credentialsRefreshInterval {
+		return c.creds, nil
+	}
+	creds, err := c.instanceRoleCredentials(ctx)
+	if err != nil {
+		// Not wrapped, so a missing role isn't retried or held against the
+		// bucket like a failed download
+		return awsCredentials{}, fmt.Errorf("no AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or run with an instance role: %v", err)
+	}
+	c.creds = creds
+	return creds, nil
+}
+
+// instanceRoleCredentials fetches the instance role's credentials from the
+// instance metadata service, using an IMDSv2 session token
+func (c *s3Client) instanceRoleCredentials(ctx context.Context) (awsCredentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, instanceMetadataTimeout)
+	defer cancel()
+
+	metadata := func(method, path string, header http.Header) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, method, instanceMetadataURL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := c.metadata.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("instance metadata %s responded with status code %d", path, resp.StatusCode)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, maxS3ErrorBytes))
+	}
+
+	token, err := metadata("PUT", "/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"}})
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	roles, err := metadata("GET", "/meta-data/iam/security-credentials/", header)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+	if role == "" {
+		return awsCredentials{}, errors.New("instance has no role")
+	}
+	body, err := metadata("GET", "/meta-data/iam/security-credentials/"+role, header)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	var doc struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid instance role credentials: %v", err)
+	}
+	return awsCredentials{
+		AccessKeyID:     doc.AccessKeyID,
+		SecretAccessKey: doc.SecretAccessKey,
+		SessionToken:    doc.Token,
+		Expires:         doc.Expiration,
+	}, nil
+}
+
+// signRequest signs a GET request for an S3 object with AWS Signature
+// Version 4, adding the Authorization header and the headers it covers
+func signRequest(req *http.Request, creds awsCredentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	headers := [][2]string{
+		{"host", req.URL.Host},
+		{"x-amz-content-sha256", emptyPayloadHash},
+		{"x-amz-date", amzDate},
+	}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+		headers = append(headers, [2]string{"x-amz-security-token", creds.SessionToken})
+	}
+
+	var canonicalHeaders strings.Builder
+	names := make([]string, len(headers))
+	for i, header := range headers {
+		canonicalHeaders.WriteString(header[0] + ":" + header[1] + "\n")
+		names[i] = header[0]
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := signingKey(creds.SecretAccessKey, amzDate[:8], region, "s3")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// signingKey derives the key that signs a day's requests to a service in a
+// region from a secret access key
+func signingKey(secret, date, region, service string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+// canonicalQuery returns query as Signature Version 4 signs it: every
+// parameter encoded, sorted by name and then value, and given a value even
+// when it has none
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsEncode(name, false)+"="+awsEncode(value, false))
+		}
+	}
+	slices.Sort(params)
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes an object path the way Signature Version 4
+// expects: everything but unreserved characters and slashes
+func awsURIEncode(path string) string {
+	return awsEncode(path, true)
+}
+
+// awsEncode percent-encodes everything in s but unreserved characters, and
+// slashes if keepSlashes is set
+func awsEncode(s string, keepSlashes bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 || c == '/' && keepSlashes {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3ResponseError returns the error for an S3 response other than 200 OK,
+// read from the error document S3 responds with. Missing objects and denied
+// access have codes of their own, and other responses are status errors, so
+// throttling and server errors are retried like any download.
+func s3ResponseError(resp *http.Response) error {
+	var doc struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, maxS3ErrorBytes)).Decode(&doc)
+	detail := fmt.Sprintf("status code %d", resp.StatusCode)
+	if doc.Code != "" {
+		detail = strings.TrimSuffix(doc.Code+": "+doc.Message, ": ")
+	}
+
+	switch {
+	case doc.Code == s3NoSuchKey || doc.Code == s3NoSuchBucket || (doc.Code == "" && resp.StatusCode == http.StatusNotFound):
+		return &codedError{Code: codeObjectNotFound, Err: fmt.Errorf("S3 object not found: %s", detail)}
+	case doc.Code == s3AccessDenied || resp.StatusCode == http.StatusForbidden:
+		return &codedError{Code: codeAccessDenied, Err: fmt.Errorf("access to S3 object denied: %s", detail)}
+	}
+	statusErr := &statusError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+	if doc.Code != "" {
+		return fmt.Errorf("%w (%s)", statusErr, detail)
+	}
+	return statusErr
+}
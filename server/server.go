@@ -0,0 +1,219 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SampleStoreMaster returns the small store master used when no store master
+// file is configured
+func SampleStoreMaster() StoreMaster {
+	return StoreMaster{
+		"S00339218": {StoreID: "S00339218", StoreName: "Store A", AreaCode: "NYC"},
+		"S01408764": {StoreID: "S01408764", StoreName: "Store B", AreaCode: "LA"},
+	}
+}
+
+// Server is the image processing service. It owns the jobs, the worker pool
+// and the image download client, and serves the API as an http.Handler.
+type Server struct {
+	cfg       Config
+	log       *slog.Logger
+	mux       *http.ServeMux
+	handler   http.Handler
+	client    *http.Client
+	webhooks  *http.Client
+	s3        *s3Client
+	policy    urlPolicy
+	cache     *dimensionCache
+	breakers  *hostBreakers
+	limiter   *hostLimiter
+	jobStore  JobStore
+	apiKeys   *apiKeys
+	startTime time.Time
+
+	// stores is the store master. It is replaced rather than modified when
+	// the store master is reloaded, so jobs can keep using the one they
+	// started with, and storesMu serializes the reloads. storesRefreshedAt
+	// is when it was last loaded, or found to be unchanged, in Unix
+	// nanoseconds.
+	stores            atomic.Pointer[StoreMaster]
+	storesMu          sync.Mutex
+	storesValidators  storeMasterValidators
+	storesRefreshedAt atomic.Int64
+
+	// submitLimiter limits how quickly each client may submit jobs
+	submitLimiter *submitLimiter
+
+	// quotas tracks the images each API key has used this month
+	quotas  *quotaLedger
+	metrics *metrics
+
+	// tracer is nil unless spans are exported
+	tracer *tracer
+
+	// queue holds submitted jobs until one of the job runners is free
+	queue *jobQueue
+
+	jobsMu sync.Mutex
+	jobs   map[string]*JobData
+
+	// expiredJobs remembers the jobs removed by the janitor for a while
+	expiredJobs map[string]expiredJob
+
+	// idempotencyKeys maps each Idempotency-Key to the job submitted with it
+	idempotencyKeys map[string]*idempotencyEntry
+
+	// recentPayloads maps the payload hashes of recent submissions to their
+	// jobs, to detect duplicate submissions
+	recentPayloads map[string]recentPayload
+
+	// tasks is shared by every job, so the number of images being downloaded
+	// and decoded at once never exceeds the number of workers, no matter how
+	// many jobs are running
+	tasks       chan imageTask
+	runningJobs jobTracker
+	state       atomic.Int32
+
+	// preflights holds the preflights running in the background, and
+	// preflightSlots limits how many images all preflights check at once to
+	// the number of workers
+	preflightsMu   sync.Mutex
+	preflights     map[string]*preflight
+	preflightSlots chan struct{}
+}
+
+// New creates a server for the given configuration and store master and
+// starts its worker pool. Jobs persisted in cfg.JobStore are not visible
+// until RestoreJobs is called.
+func New(cfg Config, stores StoreMaster) *Server {
+	jobStore := cfg.JobStore
+	if jobStore == nil {
+		jobStore = nopJobStore{}
+	}
+	policy := newURLPolicy(cfg)
+	client, webhookClient := cfg.HTTPClient, cfg.HTTPClient
+	if client == nil {
+		client = newDownloadClient(cfg, policy)
+		webhookClient = client
+		if !cfg.WebhookUseDownloadTransport {
+			// Callbacks go out directly, with the default CAs
+			direct := cfg
+			direct.DownloadProxy, direct.DownloadCAFile, direct.DownloadInsecureSkipVerify = false, "", false
+			webhookClient = newDownloadClient(direct, policy)
+		}
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = NewLogger(cfg, os.Stderr)
+	}
+	if cfg.DownloadInsecureSkipVerify {
+		logger.Warn("TLS certificate verification is disabled for image downloads, so any host can impersonate an image host; never use -download-insecure-skip-verify in production")
+	}
+
+	s := &Server{
+		cfg:       cfg,
+		log:       logger,
+		mux:       http.NewServeMux(),
+		client:    client,
+		webhooks:  webhookClient,
+		s3:        newS3Client(cfg),
+		policy:    policy,
+		cache:     newDimensionCache(cfg.CacheSize, cfg.CacheTTL, cfg.CacheStaleTTL),
+		breakers:  newHostBreakers(cfg.BreakerThreshold, cfg.BreakerCooldown),
+		limiter:   newHostLimiter(cfg.MaxPerHost),
+		jobStore:  jobStore,
+		apiKeys:   newAPIKeys(cfg.APIKeys),
+		startTime: time.Now(),
+		jobs:      make(map[string]*JobData),
+
+		submitLimiter:   newSubmitLimiter(cfg.SubmitRate, cfg.SubmitBurst),
+		quotas:          newQuotaLedger(),
+		metrics:         newMetrics(),
+		tracer:          newTracer(cfg.TraceEndpoint, logger),
+		idempotencyKeys: make(map[string]*idempotencyEntry),
+		recentPayloads:  make(map[string]recentPayload),
+		expiredJobs:     make(map[string]expiredJob),
+		queue:           newJobQueue(cfg.MaxQueueDepth, cfg.PriorityAging),
+		tasks:           make(chan imageTask),
+		preflights:      make(map[string]*preflight),
+		preflightSlots:  make(chan struct{}, cfg.Workers),
+	}
+	s.stores.Store(&stores)
+	s.storesRefreshedAt.Store(time.Now().UnixNano())
+	s.routes()
+	s.handler = s.withTracing(s.withRequestLogging(withGzip(s.withRecovery(s.withAuth(withRouteErrors(s.mux))))))
+	s.startWorkers(cfg.Workers)
+	s.startJobRunners(cfg.JobRunners)
+	s.startJanitor()
+	s.startCacheSaver()
+	s.startWatchdog()
+	s.startStoreRefresh()
+
+	// The store master is loaded and the worker pool is running
+	s.state.Store(stateReady)
+	return s
+}
+
+// routes registers the API routes, each followed by the legacy routes it
+// replaces
+func (s *Server) routes() {
+	s.route("POST /api/submit", s.handleSubmitJob, "POST /submit", "POST /submit/")
+	s.route("POST /api/submit/upload", s.handleSubmitUpload, "POST /submit/upload")
+	s.route("POST /api/validate", s.handlePreflight)
+	s.route("GET /api/validate/{preflightid}", s.handlePreflightStatus)
+	s.route("GET /api/status/{jobid}", s.handleJobStatus, "GET /status")
+	s.route("GET /api/status/batch", s.handleBatchStatus, "GET /status/batch")
+	s.route("POST /api/status/batch", s.handleBatchStatus, "POST /status/batch")
+	s.route("GET /api/jobs", s.handleListJobs, "GET /jobs")
+	s.route("GET /api/jobs/{jobid}", s.handleJobStatus)
+	s.route("GET /api/jobs/{jobid}/results", s.handleJobResults, "GET /results")
+	s.route("GET /api/jobs/{jobid}/results.csv", s.handleJobResultsCSV, "GET /results.csv")
+	s.route("GET /api/jobs/{jobid}/results.ndjson", s.handleJobResultsNDJSON, "GET /results.ndjson")
+	s.route("GET /api/jobs/{jobid}/summary", s.handleJobSummary)
+	s.route("GET /api/jobs/{jobid}/stream", s.handleJobStream, "GET /jobs/stream")
+	s.route("POST /api/jobs/{jobid}/cancel", s.handleCancelJob, "POST /jobs/cancel")
+	s.route("POST /api/jobs/{jobid}/retry", s.handleRetryJob)
+	s.route("POST /api/jobs/{jobid}/rerun", s.handleRerunJob)
+	s.route("GET /api/jobs/{jobid}/request", s.handleJobRequest)
+	s.route("GET /api/jobs/{jobid}/archive", s.handleJobArchive)
+	s.route("GET /api/limits", s.handleLimits, "GET /limits")
+	s.route("GET /api/quota", s.handleQuota, "GET /quota")
+	s.route("GET /api/cache", s.handleCacheStats, "GET /cache")
+	s.route("GET /api/errors/codes", s.handleErrorCodes)
+	s.route("GET /api/admin/breakers", s.handleBreakers, "GET /admin/breakers")
+	s.route("POST /api/admin/quota/reset", s.handleResetQuota, "POST /admin/quota/reset")
+	s.route("POST /api/admin/stores/reload", s.handleReloadStores, "POST /admin/stores/reload")
+	s.route("GET /api/admin/stores", s.handleListStores, "GET /admin/stores")
+	s.route("POST /api/admin/stores/import", s.handleImportStores, "POST /admin/stores/import")
+	s.route("POST /api/admin/stores", s.handleCreateStore, "POST /admin/stores")
+	s.route("GET /api/admin/stores/{storeid}", s.handleGetStore, "GET /admin/stores/{storeid}")
+	s.route("DELETE /api/admin/stores/{storeid}", s.handleDeleteStore, "DELETE /admin/stores/{storeid}")
+
+	// Operational endpoints stay outside the API
+	s.route("GET /metrics", s.handleMetrics)
+	s.route("GET /stats", s.handleStats)
+	s.route("GET /errors/codes", s.handleErrorCodes)
+	s.route("GET /healthz", s.handleHealth)
+	s.route("GET /readyz", s.handleReady)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// storeMaster returns the current store master, which must not be modified
+func (s *Server) storeMaster() StoreMaster {
+	return *s.stores.Load()
+}
+
+// getStore retrieves a store from the Store Master by ID
+func (s *Server) getStore(storeID string) (Store, bool) {
+	store, ok := s.storeMaster()[storeID]
+	return store, ok
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server for the sample store master that may
+// download from loopback addresses, such as those of serveFixtures, and
+// doesn't log. configure, if given, adjusts its configuration first.
+func newTestServer(t *testing.T, configure func(*Config)) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.AllowedDestinations = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if configure != nil {
+		configure(&cfg)
+	}
+	return New(cfg, SampleStoreMaster())
+}
+
+// serveFixtures serves the images in testdata until the test ends
+func serveFixtures(t *testing.T) *httptest.Server {
+	t.Helper()
+	fixtures := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	t.Cleanup(fixtures.Close)
+	return fixtures
+}
+
+// doJSON sends a request with body, if it isn't nil, encoded as JSON to h,
+// and decodes the response into out, if it isn't nil
+func doJSON(t *testing.T, h http.Handler, method, path string, body, out any) *httptest.ResponseRecorder {
+	t.Helper()
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	return doRaw(t, h, method, path, reqBody, out)
+}
+
+// doRaw sends a request with body as it is to h, as JSON if it isn't nil, and
+// decodes the response into out, if it isn't nil
+func doRaw(t *testing.T, h http.Handler, method, path string, body io.Reader, out any) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, body)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decoding response %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec
+}
+
+// submitJob submits req to h and returns the new job's ID
+func submitJob(t *testing.T, h http.Handler, req SubmitJobRequest) string {
+	t.Helper()
+	var resp JobResponse
+	rec := doJSON(t, h, "POST", "/api/submit", req, &resp)
+	if rec.Code != http.StatusCreated && rec.Code != http.StatusOK {
+		t.Fatalf("submitting the job: %d %s", rec.Code, rec.Body.String())
+	}
+	if resp.JobID == "" {
+		t.Fatalf("submitting the job: no job ID in %s", rec.Body.String())
+	}
+	return resp.JobID
+}
+
+// waitForJob polls the status of the job with the given ID until it has
+// finished, and returns its final status
+func waitForJob(t *testing.T, h http.Handler, jobID string) JobStatusResponse {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var status JobStatusResponse
+		rec := doJSON(t, h, "GET", "/api/jobs/"+jobID, nil, &status)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("getting the job's status: %d %s", rec.Code, rec.Body.String())
+		}
+		if resultsFinal(status.Status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is still %s with %+v", jobID, status.Status, status.Progress)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// jobResults returns the results of the finished job with the given ID
+func jobResults(t *testing.T, h http.Handler, jobID string) ResultsResponse {
+	t.Helper()
+	var results ResultsResponse
+	if rec := doJSON(t, h, "GET", "/api/jobs/"+jobID+"/results", nil, &results); rec.Code != http.StatusOK {
+		t.Fatalf("getting the job's results: %d %s", rec.Code, rec.Body.String())
+	}
+	return results
+}
+
+func TestSubmitJob(t *testing.T) {
+	s := newTestServer(t, nil)
+	fixtures := serveFixtures(t)
+
+	jobID := submitJob(t, s, SubmitJobRequest{
+		Count: 2,
+		Visits: []Visit{
+			{StoreID: "S00339218", ImageURLs: []string{fixtures.URL + "/shelf.jpg", fixtures.URL + "/solid.png"}, VisitTime: "2024-01-01T09:00:00Z"},
+			{StoreID: "S01408764", ImageURLs: []string{fixtures.URL + "/missing.jpg"}, VisitTime: "2024-01-01T10:00:00Z"},
+		},
+	})
+	status := waitForJob(t, s, jobID)
+	if status.Status != statusCompletedWithErrors {
+		t.Errorf("status = %s, want %s", status.Status, statusCompletedWithErrors)
+	}
+	if want := (JobProgress{Total: 3, Completed: 2, Failed: 1}); status.Progress != want {
+		t.Errorf("progress = %+v, want %+v", status.Progress, want)
+	}
+	if len(status.Errors) != 1 || status.Errors[0].Code != codeDownloadFailed || status.Errors[0].StoreID != "S01408764" {
+		t.Errorf("errors = %+v, want one download_failed error for S01408764", status.Errors)
+	}
+
+	results := jobResults(t, s, jobID)
+	want := []struct {
+		url           string
+		width, height int
+		format        string
+	}{
+		{fixtures.URL + "/shelf.jpg", 800, 600, "jpeg"},
+		{fixtures.URL + "/solid.png", 640, 480, "png"},
+	}
+	if len(results.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results.Results), len(want))
+	}
+	for i, w := range want {
+		got := results.Results[i]
+		if got.ImageURL != w.url || got.Width != w.width || got.Height != w.height || got.Format != w.format {
+			t.Errorf("result %d = %s %dx%d %s, want %s %dx%d %s", i, got.ImageURL, got.Width, got.Height, got.Format, w.url, w.width, w.height, w.format)
+		}
+		if got.StoreName != "Store A" || got.AreaCode != "NYC" {
+			t.Errorf("result %d store = %s %s, want Store A NYC", i, got.StoreName, got.AreaCode)
+		}
+	}
+}
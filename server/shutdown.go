@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultDrainTimeout is how long shutdown waits for running jobs when
+// neither the -drain-timeout flag nor IMGPROC_DRAIN_TIMEOUT is set
+const defaultDrainTimeout = 30 * time.Second
+
+// jobTracker tracks running jobs so shutdown can wait for them to finish
+type jobTracker struct {
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// Start registers a new running job. It returns false once draining has
+// begun, in which case the job must not be started.
+func (t *jobTracker) Start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+// Done marks a running job as finished
+func (t *jobTracker) Done() {
+	t.wg.Done()
+}
+
+// Drain stops new jobs from starting and waits for the running ones to
+// finish, returning false if ctx expires first
+func (t *jobTracker) Drain(ctx context.Context) bool {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// interruptJobs marks every job that is still queued or ongoing as
+// interrupted and cancels its remaining downloads
+func (s *Server) interruptJobs() {
+	s.jobsMu.Lock()
+	all := make([]*JobData, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		all = append(all, job)
+	}
+	s.jobsMu.Unlock()
+
+	for _, job := range all {
+		job.mu.Lock()
+		if job.Status != statusQueued && job.Status != statusOngoing {
+			job.mu.Unlock()
+			continue
+		}
+		queued := job.Status == statusQueued
+		job.Status = statusInterrupted
+		job.CompletedAt = time.Now()
+		rec := job.record()
+		job.mu.Unlock()
+
+		job.cancel()
+		if queued {
+			s.dequeueJob(job)
+		}
+		s.persist(s.jobStore.SaveJob(rec))
+		s.finishJob(job)
+		s.logger(job.ctx).Warn("job interrupted by shutdown")
+	}
+}
+
+// Drain stops the server accepting new jobs and waits for the running ones
+// to finish until ctx is done. Jobs still running after that are marked as
+// interrupted.
+func (s *Server) Drain(ctx context.Context) {
+	s.state.Store(stateShuttingDown)
+	if !s.runningJobs.Drain(ctx) {
+		s.log.Warn("jobs did not finish before the drain timeout", "drain_timeout", s.cfg.DrainTimeout.String())
+		s.interruptJobs()
+	}
+	s.saveCache()
+
+	// Export the spans of the jobs that just finished before exiting
+	flushCtx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+	defer cancel()
+	s.tracer.Shutdown(flushCtx)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers that sign a job's callback. The signature is an HMAC-SHA256 of the
+// timestamp, a '.', and the request body, so a captured callback can't be
+// replayed later with a fresh timestamp.
+const (
+	SignatureHeader = "X-Signature"
+	TimestampHeader = "X-Signature-Timestamp"
+)
+
+// signaturePrefix names the algorithm in the signature header
+const signaturePrefix = "sha256="
+
+// SignatureTolerance is how old a callback's timestamp may be before
+// VerifySignature rejects it as a possible replay
+const SignatureTolerance = 5 * time.Minute
+
+// Errors returned by VerifySignature
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrStaleTimestamp   = errors.New("signature timestamp is missing, malformed or too old")
+)
+
+// signPayload returns the signature header value for body sent at timestamp
+func signPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks a callback received from the server: timestamp and
+// signature are the values of its TimestampHeader and SignatureHeader, and
+// body the raw request body. It returns ErrStaleTimestamp if the timestamp is
+// more than SignatureTolerance away from now, and ErrInvalidSignature if the
+// signature doesn't match. It only depends on the standard library, so
+// receivers can copy it.
+func VerifySignature(secret, timestamp string, body []byte, signature string) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrStaleTimestamp
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > SignatureTolerance || age < -SignatureTolerance {
+		return ErrStaleTimestamp
+	}
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return ErrInvalidSignature
+	}
+	expected := signPayload(secret, timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
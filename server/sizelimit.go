@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"hash"
+	"io"
+)
+
+// defaultMaxImageBytes is the largest image downloaded when neither the
+// -max-image-bytes flag nor IMGPROC_MAX_IMAGE_BYTES is set
+const defaultMaxImageBytes = 25 << 20
+
+// imageTooLargeError is returned when an image is larger than maxImageBytes,
+// either according to its Content-Length or while streaming its body
+type imageTooLargeError struct {
+	Limit int64
+}
+
+func (e *imageTooLargeError) Error() string {
+	return fmt.Sprintf("image exceeds maximum size of %s", formatBytes(e.Limit))
+}
+
+// sizeLimitedReader reads from R until more than Limit bytes have been read,
+// after which it fails with an imageTooLargeError. Exceeded records the
+// overflow, since decoders don't always pass reader errors through. EOF
+// records that R was read to its end, whether or not it ended early, and Err
+// the first other error R returned, for the same reason. If Hash is set,
+// every byte read within the limit is written to it.
+type sizeLimitedReader struct {
+	R        io.Reader
+	Limit    int64
+	Hash     hash.Hash
+	read     int64
+	Exceeded bool
+	EOF      bool
+	Err      error
+}
+
+func (r *sizeLimitedReader) Read(p []byte) (int, error) {
+	if r.Exceeded {
+		return 0, &imageTooLargeError{Limit: r.Limit}
+	}
+	n, err := r.R.Read(p)
+	r.read += int64(n)
+	if r.read > r.Limit {
+		r.Exceeded = true
+		return n - int(r.read-r.Limit), &imageTooLargeError{Limit: r.Limit}
+	}
+	if r.Hash != nil {
+		r.Hash.Write(p[:n])
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		r.EOF = true
+	} else if err != nil && r.Err == nil {
+		r.Err = err
+	}
+	return n, err
+}
+
+// formatBytes formats n using the largest whole binary unit, e.g. 25MB
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dGB", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", n>>10)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDownloadSizeLimit(t *testing.T) {
+	const limit = 2 << 10
+	small := encodeImage(t, 4, 4, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) })
+	// A valid header followed by more than limit bytes, so the image is only
+	// found to be too large after its header has been decoded
+	large := append(bytes.Clone(small), make([]byte, 4*limit)...)
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		switch r.URL.Path {
+		case "/small.png":
+			w.Write(small)
+		case "/declared.png":
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+			w.Write(large)
+		case "/streamed.png":
+			// Flushing each chunk as it's written sends the body chunked,
+			// without a Content-Length
+			for chunk := range slices.Chunk(large, 512) {
+				w.Write(chunk)
+				w.(http.Flusher).Flush()
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(host.Close)
+	s := newTestServer(t, func(cfg *Config) { cfg.MaxImageBytes = limit })
+
+	results, errs := runImages(t, s, host.URL+"/small.png", host.URL+"/declared.png", host.URL+"/streamed.png")
+	if _, ok := results[host.URL+"/small.png"]; !ok {
+		t.Errorf("image within the limit failed: %+v", errs[host.URL+"/small.png"])
+	}
+	for _, path := range []string{"/declared.png", "/streamed.png"} {
+		storeErr, ok := errs[host.URL+path]
+		if !ok {
+			t.Errorf("%s: no error, want %s", path, codeImageTooLarge)
+			continue
+		}
+		if storeErr.Code != codeImageTooLarge || !strings.Contains(storeErr.Error, "image exceeds maximum size of 2KB") {
+			t.Errorf("%s error = %s %q, want %s exceeding 2KB", path, storeErr.Code, storeErr.Error, codeImageTooLarge)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// forbiddenDestinationError is returned when an image URL, or a redirect it
+// led to, resolves to an address the service must not connect to
+type forbiddenDestinationError struct {
+	Addr   netip.Addr
+	Reason string
+}
+
+func (e *forbiddenDestinationError) Error() string {
+	return fmt.Sprintf("forbidden destination: %s (%s address)", e.Addr, e.Reason)
+}
+
+// destinationGuard refuses connections to loopback, private (RFC 1918 and
+// IPv6 ULA), carrier-grade NAT, link-local and unspecified (including all of
+// 0.0.0.0/8) addresses, unless they fall within an allowed prefix. It checks
+// the address actually being dialed, so hosts that resolve or redirect to
+// internal addresses are caught too.
+type destinationGuard struct {
+	allowed []netip.Prefix
+}
+
+// Control is a net.Dialer Control function, called after the host has been
+// resolved and before each connection is made
+func (g *destinationGuard) Control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid destination address %q: %v", address, err)
+	}
+	return g.check(addrPort.Addr())
+}
+
+// CheckHost resolves host and checks every address it resolves to. It is
+// for connections made by a proxy, whose address the guard never sees. A
+// host that doesn't resolve is left to the proxy, since egress proxies are
+// often the only way to resolve public hosts.
+func (g *destinationGuard) CheckHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if err := g.check(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns a forbiddenDestinationError if addr is internal and not
+// allowed
+func (g *destinationGuard) check(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, prefix := range g.allowed {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+
+	if reason := forbiddenReason(addr); reason != "" {
+		return &forbiddenDestinationError{Addr: addr, Reason: reason}
+	}
+	return nil
+}
+
+var (
+	// thisNetwork is 0.0.0.0/8 (RFC 1122), which Linux dials as the local
+	// host
+	thisNetwork = netip.MustParsePrefix("0.0.0.0/8")
+	// sharedAddressSpace is 100.64.0.0/10 (RFC 6598), used for carrier-grade
+	// NAT and by some clouds for internal services
+	sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+// forbiddenReason describes why addr is internal, or returns "" if it is a
+// public address
+func forbiddenReason(addr netip.Addr) string {
+	switch {
+	case addr.IsLoopback():
+		return "loopback"
+	case addr.IsPrivate():
+		return "private"
+	case sharedAddressSpace.Contains(addr):
+		return "shared"
+	case addr.IsLinkLocalUnicast(), addr.IsLinkLocalMulticast(), addr.IsInterfaceLocalMulticast():
+		return "link-local"
+	case addr.IsUnspecified(), thisNetwork.Contains(addr):
+		return "unspecified"
+	}
+	return ""
+}
+
+// newDownloadClient creates the HTTP client used to download images, guarded
+// against connecting to internal addresses and following redirects to URLs
+// the policy doesn't allow, and going through the configured proxy and CAs.
+// It has no timeout of its own, since each download is limited to its job's
+// image timeout.
+func newDownloadClient(cfg Config, policy urlPolicy) *http.Client {
+	guard := &destinationGuard{allowed: cfg.AllowedDestinations}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   guard.Control,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// A proxy would make the dialed address the proxy's rather than the
+	// image host's, bypassing the guard, so one is only used when enabled
+	transport.Proxy = nil
+	if cfg.DownloadProxy {
+		useProxy(transport, guard)
+	}
+	transport.TLSClientConfig = downloadTLSConfig(cfg)
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.MaxRedirects {
+				return &codedError{Code: codeTooManyRedirects, Err: fmt.Errorf("stopped after %d redirects", cfg.MaxRedirects)}
+			}
+			return policy.Check(req.URL)
+		},
+	}
+}
+
+// defaultMaxRedirects is the default number of redirects a download follows
+const defaultMaxRedirects = 5
+
+// redirectCount returns the number of redirects followed to get resp
+func redirectCount(resp *http.Response) int {
+	count := 0
+	for req := resp.Request; req.Response != nil; req = req.Response.Request {
+		count++
+	}
+	return count
+}
+
+// prefixList is a flag.Value holding a comma-separated list of IP prefixes.
+// A bare address is treated as a single-address prefix.
+type prefixList []netip.Prefix
+
+func (l *prefixList) String() string {
+	prefixes := make([]string, len(*l))
+	for i, prefix := range *l {
+		prefixes[i] = prefix.String()
+	}
+	return strings.Join(prefixes, ",")
+}
+
+func (l *prefixList) Set(value string) error {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return fmt.Errorf("invalid address %q", field)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return fmt.Errorf("invalid prefix %q", field)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	*l = prefixes
+	return nil
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestDestinationGuard(t *testing.T) {
+	guard := &destinationGuard{allowed: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}}
+	tests := []struct {
+		addr   string
+		reason string
+	}{
+		{"93.184.216.34", ""},
+		{"2606:2800:220:1::1", ""},
+		{"127.0.0.1", "loopback"},
+		{"::1", "loopback"},
+		{"::ffff:127.0.0.1", "loopback"},
+		{"10.0.0.1", "private"},
+		{"172.16.5.4", "private"},
+		{"192.168.1.1", "private"},
+		{"fd00::1", "private"},
+		{"10.1.2.3", ""},
+		{"100.64.0.1", "shared"},
+		{"100.127.255.254", "shared"},
+		{"100.63.255.255", ""},
+		{"100.128.0.0", ""},
+		{"169.254.169.254", "link-local"},
+		{"fe80::1", "link-local"},
+		{"0.0.0.0", "unspecified"},
+		{"0.1.2.3", "unspecified"},
+		{"::", "unspecified"},
+		{"1.0.0.0", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			err := guard.check(netip.MustParseAddr(tt.addr))
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("check = %v, want allowed", err)
+				}
+				return
+			}
+			var forbidden *forbiddenDestinationError
+			if !errors.As(err, &forbidden) {
+				t.Fatalf("check = %v, want a forbidden destination", err)
+			}
+			if forbidden.Reason != tt.reason {
+				t.Errorf("reason = %q, want %q", forbidden.Reason, tt.reason)
+			}
+		})
+	}
+}
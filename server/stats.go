@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds of the window the stats endpoint's image latency percentiles cover
+const (
+	statsLatencyWindow  = 5 * time.Minute
+	statsLatencySamples = 10000
+)
+
+// StatsResponse represents the response for the stats endpoint. Totals are
+// counted since the server started, and agree with the corresponding
+// Prometheus metrics.
+type StatsResponse struct {
+	StartedAt     time.Time    `json:"started_at"`
+	UptimeSeconds float64      `json:"uptime_seconds"`
+	Jobs          JobStats     `json:"jobs"`
+	Images        ImageStats   `json:"images"`
+	Latency       LatencyStats `json:"latency"`
+}
+
+// JobStats counts the jobs that finished, by status, and the jobs currently
+// waiting in the queue or being run
+type JobStats struct {
+	Finished map[string]int64 `json:"finished"`
+	Queued   int              `json:"queued"`
+	Running  int64            `json:"running"`
+}
+
+// ImageStats counts the images processed, those that failed by error code,
+// the image body bytes downloaded, which is the sum of the jobs' total_bytes,
+// and the downloads currently in progress
+type ImageStats struct {
+	Processed         int64            `json:"processed"`
+	Succeeded         int64            `json:"succeeded"`
+	Failed            int64            `json:"failed"`
+	FailedByCode      map[string]int64 `json:"failed_by_code"`
+	BytesDownloaded   int64            `json:"bytes_downloaded"`
+	DownloadsInFlight int64            `json:"downloads_in_flight"`
+}
+
+// LatencyStats gives percentiles of how long images took to process, over
+// the images that finished in the last WindowSeconds. They are 0 if none
+// did.
+type LatencyStats struct {
+	WindowSeconds float64 `json:"window_seconds"`
+	Count         int     `json:"count"`
+	P50MS         float64 `json:"p50_ms"`
+	P95MS         float64 `json:"p95_ms"`
+}
+
+// serviceStats are the totals behind the stats endpoint. They are kept with
+// atomic counters as jobs and images are processed, so the endpoint never
+// has to walk the jobs.
+type serviceStats struct {
+	jobsFinished    sync.Map // status -> *atomic.Int64
+	jobsRunning     atomic.Int64
+	imagesSucceeded atomic.Int64
+	imagesFailed    sync.Map // code -> *atomic.Int64
+	bytesDownloaded atomic.Int64
+	latency         latencyWindow
+}
+
+// counter returns the counter for key in m, creating it if needed
+func counter(m *sync.Map, key string) *atomic.Int64 {
+	if c, ok := m.Load(key); ok {
+		return c.(*atomic.Int64)
+	}
+	c, _ := m.LoadOrStore(key, new(atomic.Int64))
+	return c.(*atomic.Int64)
+}
+
+// counts returns the values of the counters in m
+func counts(m *sync.Map) map[string]int64 {
+	values := make(map[string]int64)
+	m.Range(func(key, c any) bool {
+		values[key.(string)] = c.(*atomic.Int64).Load()
+		return true
+	})
+	return values
+}
+
+// latencyWindow keeps the most recent image latencies, up to
+// statsLatencySamples of them, in a ring
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []latencySample
+	next    int
+}
+
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+func (w *latencyWindow) Observe(d time.Duration) {
+	sample := latencySample{at: time.Now(), duration: d}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < statsLatencySamples {
+		w.samples = append(w.samples, sample)
+		return
+	}
+	w.samples[w.next] = sample
+	w.next = (w.next + 1) % statsLatencySamples
+}
+
+// Stats returns the percentiles of the latencies observed within the window
+func (w *latencyWindow) Stats() LatencyStats {
+	since := time.Now().Add(-statsLatencyWindow)
+	var durations []float64
+	w.mu.Lock()
+	for _, sample := range w.samples {
+		if sample.at.After(since) {
+			durations = append(durations, durationMS(sample.duration))
+		}
+	}
+	w.mu.Unlock()
+
+	stats := LatencyStats{WindowSeconds: statsLatencyWindow.Seconds(), Count: len(durations)}
+	if len(durations) > 0 {
+		slices.Sort(durations)
+		stats.P50MS = percentile(durations, 50)
+		stats.P95MS = percentile(durations, 95)
+	}
+	return stats
+}
+
+// handleStats handles the stats endpoint, an at-a-glance JSON view of the
+// service's totals since startup, its current load and recent image latency
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := &s.metrics.stats
+	response := StatsResponse{
+		StartedAt:     s.startTime,
+		UptimeSeconds: time.Since(s.startTime).Seconds(),
+		Jobs: JobStats{
+			Finished: counts(&stats.jobsFinished),
+			Queued:   s.queue.Len(),
+			Running:  stats.jobsRunning.Load(),
+		},
+		Images: ImageStats{
+			Succeeded:         stats.imagesSucceeded.Load(),
+			FailedByCode:      counts(&stats.imagesFailed),
+			BytesDownloaded:   stats.bytesDownloaded.Load(),
+			DownloadsInFlight: s.metrics.downloadsInFlight.Load(),
+		},
+		Latency: stats.latency.Stats(),
+	}
+	for _, failed := range response.Images.FailedByCode {
+		response.Images.Failed += failed
+	}
+	response.Images.Processed = response.Images.Succeeded + response.Images.Failed
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
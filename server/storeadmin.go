@@ -0,0 +1,203 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Default and maximum page sizes for the list-stores endpoint
+const (
+	defaultStoreListLimit = 100
+	maxStoreListLimit     = 1000
+)
+
+// Errors returned by the changes updateStores applies
+var (
+	errStoreExists       = errors.New("store already exists")
+	errStoreNotFound     = errors.New("store not found")
+	errLastStore         = errors.New("cannot delete the last store")
+	errStoreMasterRemote = errors.New("store master is fetched from a URL, so stores must be changed there")
+)
+
+// StoreListResponse represents the response for the list-stores endpoint
+type StoreListResponse struct {
+	Stores []Store `json:"stores"`
+	Total  int     `json:"total"`
+	Limit  int     `json:"limit"`
+	Offset int     `json:"offset"`
+}
+
+// updateStores applies change to a copy of the store master and swaps the
+// copy in, so lookups from running jobs never see it half changed. If the
+// store master came from a file, the file is rewritten first, and the
+// change is abandoned if that fails.
+func (s *Server) updateStores(change func(StoreMaster) error) error {
+	if s.cfg.StoreMasterURL != "" {
+		return errStoreMasterRemote
+	}
+
+	s.storesMu.Lock()
+	defer s.storesMu.Unlock()
+	stores := maps.Clone(s.storeMaster())
+	if stores == nil {
+		stores = make(StoreMaster)
+	}
+	if err := change(stores); err != nil {
+		return err
+	}
+	if path := s.cfg.StoreMasterPath; path != "" {
+		if err := SaveStoreMaster(path, stores); err != nil {
+			return err
+		}
+	}
+	s.stores.Store(&stores)
+	return nil
+}
+
+// writeStoreUpdateError writes the response for an error from updateStores
+func writeStoreUpdateError(w http.ResponseWriter, storeID string, err error) {
+	switch {
+	case errors.Is(err, errStoreExists):
+		responseError(w, http.StatusConflict, fmt.Sprintf("store %s already exists; set upsert=true to replace it", storeID))
+	case errors.Is(err, errStoreNotFound):
+		responseError(w, http.StatusNotFound, "store not found")
+	case errors.Is(err, errLastStore), errors.Is(err, errStoreMasterRemote):
+		responseError(w, http.StatusConflict, err.Error())
+	default:
+		responseError(w, http.StatusInternalServerError, "error saving the store master: "+err.Error())
+	}
+}
+
+// handleCreateStore handles the admin create store endpoint. A store that
+// already exists is only replaced if upsert is set.
+func (s *Server) handleCreateStore(w http.ResponseWriter, r *http.Request) {
+	upsert, err := queryBool(r.URL.Query().Get("upsert"), false)
+	if err != nil {
+		responseError(w, http.StatusBadRequest, "invalid upsert: must be true or false")
+		return
+	}
+
+	var store Store
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&store); err != nil {
+		responseError(w, http.StatusBadRequest, "invalid request payload")
+		return
+	}
+	store.StoreID = strings.TrimSpace(store.StoreID)
+	store.StoreName = strings.TrimSpace(store.StoreName)
+	store.AreaCode = strings.TrimSpace(store.AreaCode)
+	if store.StoreID == "" || store.AreaCode == "" {
+		responseError(w, http.StatusUnprocessableEntity, "store_id and area_code are required")
+		return
+	}
+	if err := store.validateConstraints(); err != nil {
+		responseError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	created := true
+	err = s.updateStores(func(stores StoreMaster) error {
+		if _, exists := stores[store.StoreID]; exists {
+			if !upsert {
+				return errStoreExists
+			}
+			created = false
+		}
+		stores[store.StoreID] = store
+		return nil
+	})
+	if err != nil {
+		writeStoreUpdateError(w, store.StoreID, err)
+		return
+	}
+	s.logger(r.Context()).Info("store saved", "store_id", store.StoreID, "created", created)
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(store)
+}
+
+// handleGetStore handles the admin get store endpoint
+func (s *Server) handleGetStore(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.getStore(r.PathValue("storeid"))
+	if !ok {
+		responseError(w, http.StatusNotFound, "store not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(store)
+}
+
+// handleDeleteStore handles the admin delete store endpoint. Jobs already
+// running keep seeing the store.
+func (s *Server) handleDeleteStore(w http.ResponseWriter, r *http.Request) {
+	storeID := r.PathValue("storeid")
+	err := s.updateStores(func(stores StoreMaster) error {
+		if _, exists := stores[storeID]; !exists {
+			return errStoreNotFound
+		}
+		if len(stores) == 1 {
+			// An empty store master file couldn't be loaded again
+			return errLastStore
+		}
+		delete(stores, storeID)
+		return nil
+	})
+	if err != nil {
+		writeStoreUpdateError(w, storeID, err)
+		return
+	}
+	s.logger(r.Context()).Info("store deleted", "store_id", storeID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListStores handles the admin list stores endpoint, which returns a
+// page of the stores in store ID order, optionally only those in area_code
+func (s *Server) handleListStores(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := queryInt(query.Get("limit"), defaultStoreListLimit)
+	if err != nil || limit < 1 || limit > maxStoreListLimit {
+		responseError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit: must be between 1 and %d", maxStoreListLimit))
+		return
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		responseError(w, http.StatusBadRequest, "invalid offset: must be a non-negative integer")
+		return
+	}
+	areaCode := query.Get("area_code")
+
+	var stores []Store
+	for _, store := range s.storeMaster() {
+		if areaCode == "" || store.AreaCode == areaCode {
+			stores = append(stores, store)
+		}
+	}
+	slices.SortFunc(stores, func(a, b Store) int {
+		return cmp.Compare(a.StoreID, b.StoreID)
+	})
+
+	response := StoreListResponse{
+		Stores: []Store{},
+		Total:  len(stores),
+		Limit:  limit,
+		Offset: offset,
+	}
+	if offset < len(stores) {
+		response.Stores = stores[offset:min(offset+limit, len(stores))]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultStoreMasterRefresh is how often a store master URL is fetched again
+// when neither the -store-master-refresh flag nor
+// IMGPROC_STORE_MASTER_REFRESH is set
+const defaultStoreMasterRefresh = 15 * time.Minute
+
+// storeMasterFetchTimeout limits each fetch of the store master URL
+const storeMasterFetchTimeout = 30 * time.Second
+
+// storeMasterValidators are the validators of the last store master fetched
+// from a URL, sent with the next fetch so an unchanged file isn't downloaded
+// again
+type storeMasterValidators struct {
+	etag         string
+	lastModified string
+}
+
+// fetchStoreMaster downloads and parses the store master CSV at url. If the
+// server reports that it hasn't changed since the fetch prev came from, it
+// returns a nil store master and prev.
+func fetchStoreMaster(ctx context.Context, url string, prev storeMasterValidators) (StoreMaster, storeMasterValidators, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, prev, fmt.Errorf("error fetching store master: %v", err)
+	}
+	if prev.etag != "" {
+		req.Header.Set("If-None-Match", prev.etag)
+	}
+	if prev.lastModified != "" {
+		req.Header.Set("If-Modified-Since", prev.lastModified)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, prev, fmt.Errorf("error fetching store master: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, prev, nil
+	default:
+		return nil, prev, fmt.Errorf("error fetching store master %s: status code %d", url, resp.StatusCode)
+	}
+
+	stores, err := parseStoreMaster(resp.Body)
+	if err != nil {
+		return nil, prev, fmt.Errorf("error loading store master %s: %v", url, err)
+	}
+	return stores, storeMasterValidators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// startStoreRefresh fetches the store master URL again every
+// StoreMasterRefresh in the background. A failed refresh is logged, and the
+// last store master fetched is kept until a refresh succeeds.
+func (s *Server) startStoreRefresh() {
+	if s.cfg.StoreMasterURL == "" || s.cfg.StoreMasterRefresh <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.cfg.StoreMasterRefresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := s.ReloadStores(); err != nil {
+				s.log.Warn("error refreshing the store master, keeping the last one",
+					"error", err,
+					"age_seconds", s.storesAge().Seconds(),
+				)
+			}
+		}
+	}()
+}
+
+// storesAge returns how long ago the store master was last loaded, or found
+// to be unchanged
+func (s *Server) storesAge() time.Duration {
+	return time.Since(time.Unix(0, s.storesRefreshedAt.Load()))
+}
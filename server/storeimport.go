@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Store import modes: merge adds the imported stores to the store master,
+// replacing those with the same store IDs, while replace swaps the whole
+// store master for the imported stores
+const (
+	storeImportMerge   = "merge"
+	storeImportReplace = "replace"
+)
+
+// maxStoreImportErrors is the most row errors a store import reports. Rows
+// past it are still skipped and counted.
+const maxStoreImportErrors = 1000
+
+// StoreImportResponse represents the response for the store import
+// endpoint. Imported counts the rows that were imported and Skipped those
+// that were invalid, which Errors describes. Stores is the number of stores
+// after the import, and Added, Removed and Changed how the import changed
+// them.
+type StoreImportResponse struct {
+	Mode     string             `json:"mode"`
+	Imported int                `json:"imported"`
+	Skipped  int                `json:"skipped"`
+	Errors   []StoreImportError `json:"errors,omitempty"`
+	Stores   int                `json:"stores"`
+	Added    int                `json:"added"`
+	Removed  int                `json:"removed"`
+	Changed  int                `json:"changed"`
+}
+
+// StoreImportError describes an invalid row of a store import, by its line
+// in the CSV file
+type StoreImportError struct {
+	Line    int    `json:"line"`
+	StoreID string `json:"store_id,omitempty"`
+	Error   string `json:"error"`
+}
+
+// readStoreImport reads store rows from a CSV file with a header row naming
+// the store_id, store_name and area_code columns, one row at a time. Invalid
+// rows are skipped and reported in response rather than failing the import.
+func readStoreImport(r io.Reader, response *StoreImportResponse) (StoreMaster, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("invalid CSV: file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header: %w", err)
+	}
+	columns, err := storeMasterColumns(header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header: %w", err)
+	}
+
+	skip := func(line int, storeID, message string) {
+		response.Skipped++
+		if len(response.Errors) < maxStoreImportErrors {
+			response.Errors = append(response.Errors, StoreImportError{Line: line, StoreID: storeID, Error: message})
+		}
+	}
+
+	stores := make(StoreMaster)
+	lines := make(map[string]int)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			skip(parseErr.StartLine, "", parseErr.Err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) != len(header) {
+			skip(line, "", fmt.Sprintf("expected %d columns, got %d", len(header), len(record)))
+			continue
+		}
+		store := Store{
+			StoreID:   strings.TrimSpace(record[columns[columnStoreID]]),
+			StoreName: strings.TrimSpace(record[columns[columnStoreName]]),
+			AreaCode:  strings.TrimSpace(record[columns[columnAreaCode]]),
+		}
+		constraintsErr := parseStoreConstraints(&store, record, columns)
+		switch {
+		case store.StoreID == "":
+			skip(line, "", "missing store_id")
+		case store.AreaCode == "":
+			skip(line, store.StoreID, "missing area_code")
+		case constraintsErr != nil:
+			skip(line, store.StoreID, constraintsErr.Error())
+		case lines[store.StoreID] != 0:
+			skip(line, store.StoreID, fmt.Sprintf("duplicate store_id, first seen on line %d", lines[store.StoreID]))
+		default:
+			stores[store.StoreID] = store
+			lines[store.StoreID] = line
+			response.Imported++
+		}
+	}
+	return stores, nil
+}
+
+// storeImportBody returns the CSV file of a store import: the request body,
+// or the file part of a multipart/form-data upload
+func (s *Server) storeImportBody(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return requestBody(w, r, s.cfg.MaxBodyBytes)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+	parts, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("multipart upload has no file part")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" || part.FormName() == "file" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// handleImportStores handles the admin store import endpoint. The CSV is
+// read before the store master is touched, so lookups and running jobs carry
+// on meanwhile, and the imported stores are then swapped in at once.
+func (s *Server) handleImportStores(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = storeImportMerge
+	}
+	if mode != storeImportMerge && mode != storeImportReplace {
+		responseError(w, http.StatusBadRequest, "invalid mode: must be merge or replace")
+		return
+	}
+	if s.cfg.StoreMasterURL != "" {
+		responseError(w, http.StatusConflict, errStoreMasterRemote.Error())
+		return
+	}
+
+	body, err := s.storeImportBody(w, r)
+	if err != nil {
+		if !writeBodyError(w, err) {
+			responseError(w, http.StatusBadRequest, "invalid upload: "+err.Error())
+		}
+		return
+	}
+	defer body.Close()
+
+	response := StoreImportResponse{Mode: mode}
+	imported, err := readStoreImport(body, &response)
+	if err != nil {
+		if !writeBodyError(w, err) {
+			responseError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	if mode == storeImportReplace && len(imported) == 0 {
+		// An empty store master file couldn't be loaded again
+		writeErrorResponse(w, http.StatusUnprocessableEntity, ErrorResponse{
+			Error: "no valid stores to replace the store master with",
+			Rows:  response.Errors,
+		})
+		return
+	}
+
+	err = s.updateStores(func(stores StoreMaster) error {
+		response.Added, response.Removed, response.Changed = diffStores(stores, imported)
+		if mode == storeImportReplace {
+			clear(stores)
+		} else {
+			response.Removed = 0
+		}
+		maps.Copy(stores, imported)
+		response.Stores = len(stores)
+		return nil
+	})
+	if err != nil {
+		writeStoreUpdateError(w, "", err)
+		return
+	}
+	s.logger(r.Context()).Info("imported stores",
+		"mode", mode,
+		"imported", response.Imported,
+		"skipped", response.Skipped,
+		"stores", response.Stores,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errNoStoreMasterSource is returned when reloading the store master while
+// the sample store master is in use, since there is nothing to reload it from
+var errNoStoreMasterSource = errors.New("no store master file or URL is configured")
+
+// StoreReloadResponse represents the response for the store master reload
+// endpoint: how many stores there are now, and how many were added, removed
+// or changed by the reload. NotModified is set when the store master URL
+// reported that the file hadn't changed, so it wasn't downloaded again.
+type StoreReloadResponse struct {
+	Path        string `json:"path,omitempty"`
+	URL         string `json:"url,omitempty"`
+	NotModified bool   `json:"not_modified,omitempty"`
+	Stores      int    `json:"stores"`
+	Added       int    `json:"added"`
+	Removed     int    `json:"removed"`
+	Changed     int    `json:"changed"`
+}
+
+// ReloadStores re-reads the store master from its file or URL and swaps it
+// in for the current one. Jobs already running keep the store master they
+// started with. If it can't be loaded, the current store master is kept.
+func (s *Server) ReloadStores() (StoreReloadResponse, error) {
+	path, url := s.cfg.StoreMasterPath, s.cfg.StoreMasterURL
+	if path == "" && url == "" {
+		return StoreReloadResponse{}, errNoStoreMasterSource
+	}
+
+	s.storesMu.Lock()
+	defer s.storesMu.Unlock()
+	var stores StoreMaster
+	var err error
+	if url != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), storeMasterFetchTimeout)
+		defer cancel()
+		stores, s.storesValidators, err = fetchStoreMaster(ctx, url, s.storesValidators)
+	} else {
+		stores, err = LoadStoreMaster(path)
+	}
+	if err != nil {
+		return StoreReloadResponse{}, err
+	}
+	s.storesRefreshedAt.Store(time.Now().UnixNano())
+
+	response := StoreReloadResponse{Path: path, URL: url}
+	if stores == nil {
+		response.NotModified = true
+		response.Stores = len(s.storeMaster())
+		s.log.Debug("store master not modified", "stores", response.Stores, "source", url)
+		return response, nil
+	}
+	response.Stores = len(stores)
+	response.Added, response.Removed, response.Changed = diffStores(s.storeMaster(), stores)
+	s.stores.Store(&stores)
+
+	source := path
+	if url != "" {
+		source = url
+	}
+	s.log.Info("reloaded stores",
+		"stores", response.Stores,
+		"added", response.Added,
+		"removed", response.Removed,
+		"changed", response.Changed,
+		"source", source,
+	)
+	return response, nil
+}
+
+// diffStores counts the stores that are in next but not prev, in prev but not
+// next, and in both but different
+func diffStores(prev, next StoreMaster) (added, removed, changed int) {
+	for id, store := range next {
+		old, ok := prev[id]
+		switch {
+		case !ok:
+			added++
+		case old != store:
+			changed++
+		}
+	}
+	for id := range prev {
+		if _, ok := next[id]; !ok {
+			removed++
+		}
+	}
+	return added, removed, changed
+}
+
+// handleReloadStores handles the admin store master reload endpoint
+func (s *Server) handleReloadStores(w http.ResponseWriter, r *http.Request) {
+	response, err := s.ReloadStores()
+	if errors.Is(err, errNoStoreMasterSource) {
+		responseError(w, http.StatusConflict, "cannot reload the store master: "+err.Error())
+		return
+	}
+	if err != nil {
+		responseError(w, http.StatusInternalServerError, "error reloading the store master, keeping the current one: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
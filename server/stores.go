@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// StoreMaster maps store IDs to the stores jobs may reference
+type StoreMaster map[string]Store
+
+// Store master CSV columns
+const (
+	columnAreaCode  = "areacode"
+	columnStoreName = "storename"
+	columnStoreID   = "storeid"
+)
+
+// LoadStoreMaster reads a store master CSV file with a header row naming the
+// AreaCode, StoreName and StoreID columns, and optionally the MinWidth,
+// MinHeight and ExpectedAspectRatio columns
+func LoadStoreMaster(path string) (StoreMaster, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening store master: %v", err)
+	}
+	defer file.Close()
+
+	stores, err := parseStoreMaster(file)
+	if err != nil {
+		return nil, fmt.Errorf("error loading store master %s: %v", path, err)
+	}
+	return stores, nil
+}
+
+// SaveStoreMaster writes stores to a store master CSV file, in store ID
+// order. The file is replaced in one go, so a crash can't leave it half
+// written.
+func SaveStoreMaster(path string, stores StoreMaster) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if info, err := os.Stat(path); err == nil {
+		// Keep the permissions of the file being replaced
+		file.Chmod(info.Mode())
+	}
+
+	// The constraint columns are only written if a store has constraints,
+	// so store masters without them keep their original columns
+	constrained := false
+	for _, store := range stores {
+		constrained = constrained || store.hasConstraints()
+	}
+	header := []string{"AreaCode", "StoreName", "StoreID"}
+	if constrained {
+		header = append(header, "MinWidth", "MinHeight", "ExpectedAspectRatio")
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Write(header)
+	for _, id := range slices.Sorted(maps.Keys(stores)) {
+		store := stores[id]
+		row := []string{store.AreaCode, store.StoreName, store.StoreID}
+		if constrained {
+			row = append(row, formatConstraint(float64(store.MinWidth)), formatConstraint(float64(store.MinHeight)), formatConstraint(store.ExpectedAspectRatio))
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	if err = errors.Join(writer.Error(), file.Close()); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// parseStoreMaster parses store master CSV rows, rejecting missing columns,
+// empty store IDs and duplicate store IDs
+func parseStoreMaster(r io.Reader) (StoreMaster, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := storeMasterColumns(header)
+	if err != nil {
+		return nil, err
+	}
+
+	stores := make(StoreMaster)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) != len(header) {
+			return nil, fmt.Errorf("line %d: expected %d columns, got %d", line, len(header), len(record))
+		}
+
+		store := Store{
+			StoreID:   strings.TrimSpace(record[columns[columnStoreID]]),
+			StoreName: strings.TrimSpace(record[columns[columnStoreName]]),
+			AreaCode:  strings.TrimSpace(record[columns[columnAreaCode]]),
+		}
+		if store.StoreID == "" {
+			return nil, fmt.Errorf("line %d: missing StoreID", line)
+		}
+		if err := parseStoreConstraints(&store, record, columns); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if _, exists := stores[store.StoreID]; exists {
+			return nil, fmt.Errorf("line %d: duplicate StoreID %s", line, store.StoreID)
+		}
+		stores[store.StoreID] = store
+	}
+
+	if len(stores) == 0 {
+		return nil, errors.New("no stores found")
+	}
+	return stores, nil
+}
+
+// storeMasterColumns maps each required column to its index in the header
+// row. Column names are matched case-insensitively, ignoring spaces and
+// underscores, so both "StoreID" and "store_id" are accepted.
+func storeMasterColumns(header []string) (map[string]int, error) {
+	columns := make(map[string]int)
+	for i, name := range header {
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		name = strings.ToLower(strings.NewReplacer(" ", "", "_", "").Replace(name))
+		columns[name] = i
+	}
+
+	for _, required := range []string{columnAreaCode, columnStoreName, columnStoreID} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("header row is missing the %s column (expected AreaCode,StoreName,StoreID)", required)
+		}
+	}
+	return columns, nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadStoreMaster(t *testing.T) {
+	const stores = 5000
+	var csv strings.Builder
+	csv.WriteString("AreaCode,StoreName,StoreID\n")
+	for i := range stores {
+		fmt.Fprintf(&csv, "A%02d,\"Store %d, Main St\",S%08d\n", i%40, i, i)
+	}
+	path := filepath.Join(t.TempDir(), "stores.csv")
+	if err := os.WriteFile(path, []byte(csv.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	master, err := LoadStoreMaster(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(master) != stores {
+		t.Fatalf("loaded %d stores, want %d", len(master), stores)
+	}
+	want := Store{StoreID: "S00004321", StoreName: "Store 4321, Main St", AreaCode: "A01"}
+	if got := master["S00004321"]; got != want {
+		t.Errorf("store S00004321 = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadStoreMasterMissingFile(t *testing.T) {
+	if _, err := LoadStoreMaster(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("LoadStoreMaster() succeeded for a missing file")
+	}
+}
+
+func TestParseStoreMaster(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		stores  int
+		wantErr string
+	}{
+		{"columns in any order", "StoreID,AreaCode,StoreName\nS1,NYC,Store A\n", 1, ""},
+		{"snake case header with BOM", "\ufeffarea_code,store_name,store_id\nNYC,Store A,S1\nLA,Store B,S2\n", 2, ""},
+		{"empty file", "", 0, "file is empty"},
+		{"header only", "AreaCode,StoreName,StoreID\n", 0, "no stores found"},
+		{"missing column", "AreaCode,StoreName\nNYC,Store A\n", 0, "missing the storeid column"},
+		{"no header row", "NYC,Store A,S1\n", 0, "header row is missing"},
+		{"short row", "AreaCode,StoreName,StoreID\nNYC,Store A,S1\nLA,S2\n", 0, "line 3: expected 3 columns, got 2"},
+		{"missing store ID", "AreaCode,StoreName,StoreID\nNYC,Store A, \n", 0, "line 2: missing StoreID"},
+		{"duplicate store ID", "AreaCode,StoreName,StoreID\nNYC,Store A,S1\nLA,Store B,S1\n", 0, "line 3: duplicate StoreID S1"},
+		{"unterminated quote", "AreaCode,StoreName,StoreID\nNYC,\"Store A,S1\n", 0, "quote"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stores, err := parseStoreMaster(strings.NewReader(tt.csv))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stores) != tt.stores {
+				t.Errorf("parsed %d stores, want %d", len(stores), tt.stores)
+			}
+			if got := stores["S1"]; got.StoreName != "Store A" || got.AreaCode != "NYC" {
+				t.Errorf("store S1 = %+v, want Store A in NYC", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// streamBuffer is the number of events buffered for each stream subscriber.
+// A subscriber that falls this far behind is disconnected rather than
+// slowing down the job.
+const streamBuffer = 256
+
+// streamKeepAlive is how often an idle stream sends a comment, so proxies
+// don't close it
+const streamKeepAlive = 15 * time.Second
+
+// defaultMaxStatusWait is the longest a status request may wait for its job
+// to change when neither the -max-status-wait flag nor
+// IMGPROC_MAX_STATUS_WAIT is set
+const defaultMaxStatusWait = time.Minute
+
+// Stream event names
+const (
+	streamEventStatus   = "status"
+	streamEventResult   = "result"
+	streamEventError    = "error"
+	streamEventDone     = "done"
+	streamEventOverflow = "overflow"
+)
+
+// progressEvent is a server-sent event about a job's progress
+type progressEvent struct {
+	name string
+	data any
+}
+
+// jobSubscriber receives a job's progress events until the job finishes or
+// the subscriber falls too far behind, at which point events is closed
+type jobSubscriber struct {
+	events chan progressEvent
+
+	// overflowed is set before events is closed if the subscriber was
+	// disconnected for falling behind
+	overflowed bool
+}
+
+// subscribe registers a subscriber for the job's progress events, returning
+// a snapshot of the job as of subscribing. It returns nil if the job is no
+// longer queued or ongoing, since no more events will be published.
+func (job *JobData) subscribe() (*jobSubscriber, JobSnapshot) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	snap := job.snapshotLocked()
+	if job.Status != statusQueued && job.Status != statusOngoing {
+		return nil, snap
+	}
+	sub := &jobSubscriber{events: make(chan progressEvent, streamBuffer)}
+	if job.subscribers == nil {
+		job.subscribers = make(map[*jobSubscriber]struct{})
+	}
+	job.subscribers[sub] = struct{}{}
+	return sub, snap
+}
+
+// changedLocked returns a channel that is closed the next time the job's
+// status or progress changes. job.mu must be held.
+func (job *JobData) changedLocked() <-chan struct{} {
+	if job.changed == nil {
+		job.changed = make(chan struct{})
+	}
+	return job.changed
+}
+
+// waitForChange waits until the job's status or progress changes, timeout
+// passes or ctx is done. It returns immediately if the job has finished.
+func (job *JobData) waitForChange(ctx context.Context, timeout time.Duration) {
+	job.mu.Lock()
+	if job.Status != statusQueued && job.Status != statusOngoing {
+		job.mu.Unlock()
+		return
+	}
+	changed := job.changedLocked()
+	job.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// unsubscribe removes a subscriber whose client has gone away
+func (job *JobData) unsubscribe(sub *jobSubscriber) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	delete(job.subscribers, sub)
+}
+
+// publishLocked sends an event to every subscriber without blocking, and
+// disconnects subscribers whose buffers are full. It also wakes status
+// requests waiting for the job to change. job.mu must be held.
+func (job *JobData) publishLocked(name string, data any) {
+	if job.changed != nil {
+		close(job.changed)
+		job.changed = nil
+	}
+	for sub := range job.subscribers {
+		select {
+		case sub.events <- progressEvent{name: name, data: data}:
+		default:
+			sub.overflowed = true
+			close(sub.events)
+			delete(job.subscribers, sub)
+		}
+	}
+}
+
+// finishSubscribersLocked sends the done event to every subscriber and ends
+// their streams. job.mu must be held.
+func (job *JobData) finishSubscribersLocked() {
+	job.publishLocked(streamEventDone, job.snapshotLocked().statusResponse())
+	for sub := range job.subscribers {
+		close(sub.events)
+	}
+	job.subscribers = nil
+}
+
+// handleJobStream handles the job stream endpoint, which sends the job's
+// progress as server-sent events: its status on connecting, a result or
+// error event for each image as it is processed, and a done event with the
+// final status, after which the stream ends.
+func (s *Server) handleJobStream(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.lookupJob(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		responseError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	sub, snap := job.subscribe()
+	if sub != nil {
+		defer job.unsubscribe(sub)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if sub == nil {
+		// The job had already finished
+		writeStreamEvent(w, streamEventDone, snap.statusResponse())
+		flusher.Flush()
+		return
+	}
+	writeStreamEvent(w, streamEventStatus, snap.statusResponse())
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				if sub.overflowed {
+					writeStreamEvent(w, streamEventOverflow, ErrorResponse{
+						Error: "stream fell too far behind the job, reconnect or poll the status instead",
+						Code:  codeStreamOverflow,
+						JobID: job.ID,
+					})
+					flusher.Flush()
+				}
+				return
+			}
+			writeStreamEvent(w, event.name, event.data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeStreamEvent writes a server-sent event with data encoded as JSON
+func writeStreamEvent(w http.ResponseWriter, name string, data any) {
+	encoded, _ := json.Marshal(data)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, encoded)
+}
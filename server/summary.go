@@ -0,0 +1,243 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// JobResultsSummary represents the response for the job summary endpoint,
+// which rolls a job's results up by area code
+type JobResultsSummary struct {
+	JobID     string        `json:"job_id"`
+	Status    string        `json:"status"`
+	Partial   bool          `json:"partial,omitempty"`
+	Progress  JobProgress   `json:"progress"`
+	Totals    ResultsStats  `json:"totals"`
+	AreaCodes []AreaSummary `json:"area_codes"`
+
+	// Stores lists the stores with images that violate their constraints
+	Stores []StoreViolations `json:"stores,omitempty"`
+
+	// Duplicates lists the pairs of images that are likely the same photo,
+	// for jobs that set detect_duplicates
+	Duplicates []DuplicateImages `json:"duplicates,omitempty"`
+
+	// BlankSuspects lists the stores with images that look blank, for jobs
+	// that set quality_checks
+	BlankSuspects []StoreBlankSuspects `json:"blank_suspects,omitempty"`
+}
+
+// StoreViolations counts the images of one store that violate its
+// constraints, by violation. An image can have more than one violation.
+type StoreViolations struct {
+	StoreID    string         `json:"store_id"`
+	AreaCode   string         `json:"area_code"`
+	Images     int            `json:"images"`
+	Violations map[string]int `json:"violations"`
+}
+
+// AreaSummary represents the results of a job's images from stores in one
+// area code. Images whose store isn't in the store master have an empty
+// area code.
+type AreaSummary struct {
+	AreaCode string `json:"area_code"`
+	ResultsStats
+}
+
+// ResultsStats counts the images processed successfully and the images that
+// failed, and describes the dimensions of the successful ones. The
+// dimensions are omitted if there are none. Violations counts the
+// successful images that violate their store's constraints, by violation.
+type ResultsStats struct {
+	Images     int            `json:"images"`
+	Failed     int            `json:"failed"`
+	Width      *RangeStats    `json:"width,omitempty"`
+	Height     *RangeStats    `json:"height,omitempty"`
+	Perimeter  *RangeStats    `json:"perimeter,omitempty"`
+	Violations map[string]int `json:"violations,omitempty"`
+}
+
+// RangeStats is the average, minimum and maximum of a result field
+type RangeStats struct {
+	Average float64 `json:"average"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+}
+
+// rangeAccumulator builds RangeStats one value at a time
+type rangeAccumulator struct {
+	n             int
+	sum, min, max float64
+}
+
+func (a *rangeAccumulator) add(v float64) {
+	if a.n == 0 || v < a.min {
+		a.min = v
+	}
+	if a.n == 0 || v > a.max {
+		a.max = v
+	}
+	a.n++
+	a.sum += v
+}
+
+func (a *rangeAccumulator) stats() *RangeStats {
+	if a.n == 0 {
+		return nil
+	}
+	return &RangeStats{Average: roundTo(a.sum/float64(a.n), 3), Min: a.min, Max: a.max}
+}
+
+// resultsAccumulator builds ResultsStats one result or error at a time
+type resultsAccumulator struct {
+	images, failed           int
+	width, height, perimeter rangeAccumulator
+	violations               map[string]int
+}
+
+func (a *resultsAccumulator) addResult(result ImageResult) {
+	a.images++
+	a.width.add(float64(result.Width))
+	a.height.add(float64(result.Height))
+	a.perimeter.add(result.Perimeter)
+	a.violations = countViolations(a.violations, result.Violations)
+}
+
+func (a *resultsAccumulator) stats() ResultsStats {
+	return ResultsStats{
+		Images:     a.images,
+		Failed:     a.failed,
+		Width:      a.width.stats(),
+		Height:     a.height.stats(),
+		Perimeter:  a.perimeter.stats(),
+		Violations: a.violations,
+	}
+}
+
+// countViolations adds violations to counts, allocating counts if needed
+func countViolations(counts map[string]int, violations []string) map[string]int {
+	for _, violation := range violations {
+		if counts == nil {
+			counts = make(map[string]int)
+		}
+		counts[violation]++
+	}
+	return counts
+}
+
+// summarizeViolations counts the violations of each store's images, in
+// store ID order. Stores whose images have no violations are left out.
+func summarizeViolations(results []ImageResult) []StoreViolations {
+	stores := make(map[string]*StoreViolations)
+	for _, result := range results {
+		if len(result.Violations) == 0 {
+			continue
+		}
+		store := stores[result.StoreID]
+		if store == nil {
+			store = &StoreViolations{StoreID: result.StoreID, AreaCode: result.AreaCode}
+			stores[result.StoreID] = store
+		}
+		store.Images++
+		store.Violations = countViolations(store.Violations, result.Violations)
+	}
+
+	summaries := make([]StoreViolations, 0, len(stores))
+	for _, store := range stores {
+		summaries = append(summaries, *store)
+	}
+	slices.SortFunc(summaries, func(a, b StoreViolations) int {
+		return cmp.Compare(a.StoreID, b.StoreID)
+	})
+	return summaries
+}
+
+// summarizeResults rolls a job's results and errors up by area code, in
+// area code order. Every area code with a store among the job's visits is
+// included, even if none of its images succeeded or have been processed yet.
+func (s *Server) summarizeResults(visits []JobVisit, results []ImageResult, errs []StoreError) (ResultsStats, []AreaSummary) {
+	var totals resultsAccumulator
+	areas := make(map[string]*resultsAccumulator)
+	area := func(areaCode string) *resultsAccumulator {
+		if areas[areaCode] == nil {
+			areas[areaCode] = &resultsAccumulator{}
+		}
+		return areas[areaCode]
+	}
+	areaCode := func(storeID string) string {
+		if store, ok := s.getStore(storeID); ok {
+			return store.AreaCode
+		}
+		return ""
+	}
+
+	for _, visit := range visits {
+		if store, ok := s.getStore(visit.StoreID); ok {
+			area(store.AreaCode)
+		}
+	}
+	for _, result := range results {
+		totals.addResult(result)
+		area(result.AreaCode).addResult(result)
+	}
+	for _, storeErr := range errs {
+		// An error about a whole visit, such as an unknown store, fails all
+		// of the visit's images
+		failed := 1
+		if storeErr.Image == nil && storeErr.Visit < len(visits) {
+			failed = max(1, len(visits[storeErr.Visit].ImageURLs))
+		}
+		totals.failed += failed
+		area(areaCode(storeErr.StoreID)).failed += failed
+	}
+
+	summaries := make([]AreaSummary, 0, len(areas))
+	for code, acc := range areas {
+		summaries = append(summaries, AreaSummary{AreaCode: code, ResultsStats: acc.stats()})
+	}
+	slices.SortFunc(summaries, func(a, b AreaSummary) int {
+		return cmp.Compare(a.AreaCode, b.AreaCode)
+	})
+	return totals.stats(), summaries
+}
+
+// handleJobSummary handles the job summary endpoint, which returns a job's
+// results aggregated by area code. Like the results, the summary is only
+// available once the job has finished, unless partial is set.
+func (s *Server) handleJobSummary(w http.ResponseWriter, r *http.Request) {
+	partial, err := queryBool(r.URL.Query().Get("partial"), false)
+	if err != nil {
+		responseError(w, http.StatusBadRequest, "invalid partial: must be true or false")
+		return
+	}
+
+	job, ok := s.lookupJob(w, r)
+	if !ok {
+		return
+	}
+
+	snap, results := job.SnapshotWithResults()
+	completed := resultsFinal(snap.Status)
+	if !completed && !partial {
+		responseJobError(w, http.StatusConflict, fmt.Sprintf("job is %s, its summary is only available once it has finished", snap.Status), snap.ID)
+		return
+	}
+
+	totals, areas := s.summarizeResults(job.Visits, results, snap.Errors)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(JobResultsSummary{
+		JobID:      snap.ID,
+		Status:     snap.Status,
+		Partial:    !completed,
+		Progress:   snap.Progress,
+		Totals:     totals,
+		AreaCodes:  areas,
+		Stores:     summarizeViolations(results),
+		Duplicates: s.jobDuplicates(job, results, completed),
+
+		BlankSuspects: summarizeBlankSuspects(results),
+	})
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// svgSniffLen is how much of the body is inspected for an <svg tag when the
+// server didn't say the image is an SVG
+const svgSniffLen = 512
+
+// svgUnits converts absolute CSS units to pixels, at the CSS resolution of
+// 96 pixels per inch
+var svgUnits = map[string]float64{
+	"":   1,
+	"px": 1,
+	"in": 96,
+	"cm": 96 / 2.54,
+	"mm": 96 / 25.4,
+	"pt": 96.0 / 72,
+	"pc": 16,
+}
+
+var errSVGNoDimensions = &codedError{Code: codeUnsupportedFormat, Err: errors.New("svg has no intrinsic dimensions")}
+
+// isSVG reports whether an image is an SVG, either because the server said so
+// or because its body starts with an <svg tag, optionally after an XML
+// declaration, comments or a doctype
+func isSVG(contentType string, head []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == "image/svg+xml" {
+		return true
+	}
+
+	head = bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\ufeff")))
+	if bytes.HasPrefix(head, []byte("<svg")) {
+		return true
+	}
+	for _, prolog := range []string{"<?xml", "<!--", "<!DOCTYPE"} {
+		if bytes.HasPrefix(head, []byte(prolog)) {
+			return bytes.Contains(head, []byte("<svg"))
+		}
+	}
+	return false
+}
+
+// decodeSVGDimensions reads the size of an SVG from its root element's width
+// and height attributes, falling back to its viewBox for whichever is
+// missing or relative
+func decodeSVGDimensions(r io.Reader) (width, height int, err error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+
+	var root xml.StartElement
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, 0, &codedError{Code: codeCorruptImage, Err: fmt.Errorf("corrupt svg image: %v", err)}
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			root = start
+			break
+		}
+	}
+	if root.Name.Local != "svg" {
+		return 0, 0, &codedError{Code: codeCorruptImage, Err: fmt.Errorf("corrupt svg image: root element is <%s>, not <svg>", root.Name.Local)}
+	}
+
+	var w, h float64
+	var viewBox []float64
+	for _, attr := range root.Attr {
+		if attr.Name.Space != "" {
+			continue
+		}
+		switch attr.Name.Local {
+		case "width":
+			w = svgLength(attr.Value)
+		case "height":
+			h = svgLength(attr.Value)
+		case "viewBox":
+			viewBox = svgViewBox(attr.Value)
+		}
+	}
+
+	if viewBox != nil {
+		vbWidth, vbHeight := viewBox[2], viewBox[3]
+		switch {
+		case w == 0 && h == 0:
+			w, h = vbWidth, vbHeight
+		case h == 0:
+			h = w * vbHeight / vbWidth
+		case w == 0:
+			w = h * vbWidth / vbHeight
+		}
+	}
+	if w <= 0 || h <= 0 {
+		return 0, 0, errSVGNoDimensions
+	}
+
+	return int(math.Round(w)), int(math.Round(h)), nil
+}
+
+// svgLength parses an absolute SVG length in pixels. Percentages and font
+// relative units can't be resolved without a viewport, so they return 0.
+func svgLength(value string) float64 {
+	value = strings.TrimSpace(value)
+	end := strings.LastIndexAny(value, "0123456789.") + 1
+	scale, ok := svgUnits[strings.ToLower(strings.TrimSpace(value[end:]))]
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseFloat(value[:end], 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) {
+		return 0
+	}
+	return n * scale
+}
+
+// svgViewBox parses a viewBox attribute, returning nil unless it holds four
+// numbers with a positive width and height
+func svgViewBox(value string) []float64 {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	if len(fields) != 4 {
+		return nil
+	}
+	viewBox := make([]float64, 4)
+	for i, field := range fields {
+		n, err := strconv.ParseFloat(field, 64)
+		if err != nil || math.IsInf(n, 0) || math.IsNaN(n) {
+			return nil
+		}
+		viewBox[i] = n
+	}
+	if viewBox[2] <= 0 || viewBox[3] <= 0 {
+		return nil
+	}
+	return viewBox
+}
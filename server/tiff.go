@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+)
+
+// TIFF files start with a byte order mark and the offset of the first image
+// file directory (IFD). Each IFD holds one page's tags, followed by the
+// offset of the next IFD, or 0 after the last page. IFDs can be anywhere in
+// the file, so the whole file is read before parsing.
+const (
+	tiffLittleEndianHeader = "II\x2a\x00"
+	tiffBigEndianHeader    = "MM\x00\x2a"
+)
+
+// TIFF tags and field types needed for the dimensions
+const (
+	tiffTagImageWidth  = 256
+	tiffTagImageLength = 257
+	tiffTypeShort      = 3
+	tiffTypeLong       = 4
+)
+
+// tiffMaxPages bounds the IFD chain, which a corrupt file could make cyclic
+const tiffMaxPages = 10000
+
+var errInvalidTIFF = errors.New("tiff: invalid format")
+
+func init() {
+	image.RegisterFormat("tiff", tiffLittleEndianHeader, decodeTIFF, decodeTIFFConfig)
+	image.RegisterFormat("tiff", tiffBigEndianHeader, decodeTIFF, decodeTIFFConfig)
+}
+
+// decodeTIFFConfig reads the dimensions of a TIFF image's first page
+func decodeTIFFConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	width, height, _, err := parseTIFF(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{Width: width, Height: height}, nil
+}
+
+// decodeTIFF is registered so the format is recognised, but full decodes are
+// never attempted since decodeTIFFConfig always has the dimensions
+func decodeTIFF(r io.Reader) (image.Image, error) {
+	if _, err := decodeTIFFConfig(r); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("tiff: pixel decoding not supported")
+}
+
+// parseTIFF returns the dimensions of a TIFF file's first page and the number
+// of pages it holds
+func parseTIFF(data []byte) (width, height, pages int, err error) {
+	if len(data) < 8 {
+		return 0, 0, 0, io.ErrUnexpectedEOF
+	}
+	var order binary.ByteOrder
+	switch string(data[0:4]) {
+	case tiffLittleEndianHeader:
+		order = binary.LittleEndian
+	case tiffBigEndianHeader:
+		order = binary.BigEndian
+	default:
+		return 0, 0, 0, errInvalidTIFF
+	}
+
+	seen := make(map[uint32]bool)
+	for offset := order.Uint32(data[4:8]); offset != 0; pages++ {
+		if seen[offset] || pages >= tiffMaxPages {
+			return 0, 0, 0, errInvalidTIFF
+		}
+		seen[offset] = true
+
+		if uint64(offset)+2 > uint64(len(data)) {
+			return 0, 0, 0, io.ErrUnexpectedEOF
+		}
+		count := int(order.Uint16(data[offset:]))
+		entries := int(offset) + 2
+		next := entries + count*12
+		if next+4 > len(data) {
+			return 0, 0, 0, io.ErrUnexpectedEOF
+		}
+
+		if pages == 0 {
+			for i := 0; i < count; i++ {
+				entry := data[entries+i*12 : entries+(i+1)*12]
+				var value int
+				switch order.Uint16(entry[2:4]) {
+				case tiffTypeShort:
+					value = int(order.Uint16(entry[8:10]))
+				case tiffTypeLong:
+					value = int(order.Uint32(entry[8:12]))
+				default:
+					continue
+				}
+				switch order.Uint16(entry[0:2]) {
+				case tiffTagImageWidth:
+					width = value
+				case tiffTagImageLength:
+					height = value
+				}
+			}
+			if width == 0 || height == 0 {
+				return 0, 0, 0, errInvalidTIFF
+			}
+		}
+
+		offset = order.Uint32(data[next:])
+	}
+	if pages == 0 {
+		return 0, 0, 0, errInvalidTIFF
+	}
+
+	return width, height, pages, nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+)
+
+// tiffFile returns a TIFF file in the given byte order with one IFD per
+// page, each holding the page's width as a LONG and height as a SHORT
+func tiffFile(order binary.AppendByteOrder, pages [][2]int) []byte {
+	var data []byte
+	if order == binary.AppendByteOrder(binary.LittleEndian) {
+		data = []byte(tiffLittleEndianHeader)
+	} else {
+		data = []byte(tiffBigEndianHeader)
+	}
+	data = order.AppendUint32(data, 8)
+	for i, page := range pages {
+		data = order.AppendUint16(data, 2)
+		data = order.AppendUint16(data, tiffTagImageWidth)
+		data = order.AppendUint16(data, tiffTypeLong)
+		data = order.AppendUint32(data, 1)
+		data = order.AppendUint32(data, uint32(page[0]))
+		data = order.AppendUint16(data, tiffTagImageLength)
+		data = order.AppendUint16(data, tiffTypeShort)
+		data = order.AppendUint32(data, 1)
+		data = order.AppendUint16(data, uint16(page[1]))
+		data = order.AppendUint16(data, 0)
+		next := uint32(0)
+		if i < len(pages)-1 {
+			next = uint32(len(data) + 4)
+		}
+		data = order.AppendUint32(data, next)
+	}
+	return data
+}
+
+func TestDecodeTIFF(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+		pages         int
+	}{
+		{"little endian", tiffFile(binary.LittleEndian, [][2]int{{1200, 800}}), 1200, 800, 1},
+		{"big endian", tiffFile(binary.BigEndian, [][2]int{{70000, 900}}), 70000, 900, 1},
+		// The dimensions are those of the first page
+		{"pages", tiffFile(binary.LittleEndian, [][2]int{{1200, 800}, {600, 400}, {300, 200}}), 1200, 800, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := decodeBytes(context.Background(), tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Width != tt.width || info.Height != tt.height || info.Format != "tiff" || info.Pages != tt.pages {
+				t.Errorf("decoded %dx%d %s with %d pages, want %dx%d tiff with %d", info.Width, info.Height, info.Format, info.Pages, tt.width, tt.height, tt.pages)
+			}
+		})
+	}
+}
+
+func TestParseTIFFCyclic(t *testing.T) {
+	// The second page links back to the first
+	data := tiffFile(binary.LittleEndian, [][2]int{{10, 10}, {10, 10}})
+	binary.LittleEndian.PutUint32(data[len(data)-4:], 8)
+	if _, _, _, err := parseTIFF(data); err != errInvalidTIFF {
+		t.Errorf("parseTIFF() error = %v, want %v", err, errInvalidTIFF)
+	}
+}
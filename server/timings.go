@@ -0,0 +1,79 @@
+package server
+
+import (
+	"slices"
+	"time"
+)
+
+// JobTimings summarises the per-image figures of a job's results. Durations
+// and bytes only cover the images that were actually downloaded, not those
+// served from the cache or sharing another image's download, while attempts
+// cover every result.
+type JobTimings struct {
+	DownloadMS *DistributionStats `json:"download_ms,omitempty"`
+	DecodeMS   *DistributionStats `json:"decode_ms,omitempty"`
+	Attempts   *DistributionStats `json:"attempts,omitempty"`
+	Bytes      *DistributionStats `json:"bytes,omitempty"`
+}
+
+// DistributionStats describes the spread of one figure across a job's
+// results. Median and P95 are nearest-rank percentiles.
+type DistributionStats struct {
+	Count  int     `json:"count"`
+	Min    float64 `json:"min"`
+	Median float64 `json:"median"`
+	P95    float64 `json:"p95"`
+	Max    float64 `json:"max"`
+}
+
+// durationMS returns d in milliseconds, to the microsecond
+func durationMS(d time.Duration) float64 {
+	return roundTo(float64(d)/float64(time.Millisecond), 3)
+}
+
+// timings summarises the job's results so far, or returns nil if it has none
+func (job *JobData) timings() *JobTimings {
+	job.mu.Lock()
+	var download, decode, attempts, bytes []float64
+	for _, result := range job.Results {
+		attempts = append(attempts, float64(result.Attempts))
+		if result.Bytes > 0 {
+			download = append(download, result.DownloadMS)
+			decode = append(decode, result.DecodeMS)
+			bytes = append(bytes, float64(result.Bytes))
+		}
+	}
+	job.mu.Unlock()
+
+	if len(attempts) == 0 {
+		return nil
+	}
+	return &JobTimings{
+		DownloadMS: distribution(download),
+		DecodeMS:   distribution(decode),
+		Attempts:   distribution(attempts),
+		Bytes:      distribution(bytes),
+	}
+}
+
+// distribution returns the spread of values, which it sorts, or nil if
+// there are none
+func distribution(values []float64) *DistributionStats {
+	if len(values) == 0 {
+		return nil
+	}
+	slices.Sort(values)
+	return &DistributionStats{
+		Count:  len(values),
+		Min:    values[0],
+		Median: percentile(values, 50),
+		P95:    percentile(values, 95),
+		Max:    values[len(values)-1],
+	}
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted
+func percentile(sorted []float64, p int) float64 {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
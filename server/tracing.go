@@ -0,0 +1,416 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// traceServiceName is the service.name spans are exported with
+const traceServiceName = "imgproc"
+
+// Spans are exported in batches of up to traceBatchSize, at least every
+// traceFlushInterval. Spans ended while traceQueueSize are waiting to be
+// exported are dropped rather than slowing down jobs.
+const (
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+	traceQueueSize     = 4096
+	traceExportTimeout = 10 * time.Second
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+// spanContext identifies a span within its trace
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+func (sc spanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// parseTraceparent parses a W3C traceparent header, such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(header string) (spanContext, bool) {
+	var sc spanContext
+	if len(header) < 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return sc, false
+	}
+	version := header[:2]
+	if version == "ff" || (version == "00" && len(header) != 55) || (len(header) > 55 && header[55] != '-') {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(header[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(header[36:52])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.DecodeString(header[53:55]); err != nil {
+		return sc, false
+	}
+	return sc, sc.IsValid()
+}
+
+// span is an operation in a trace. Every method may be called on a nil span,
+// which is what the tracer hands out when tracing is disabled.
+type span struct {
+	tracer *tracer
+	name   string
+	kind   int
+	sc     spanContext
+	parent [8]byte
+	start  time.Time
+
+	mu            sync.Mutex
+	end           time.Time
+	attributes    []otlpKeyValue
+	links         []spanContext
+	statusMessage string
+	failed        bool
+}
+
+// spanKey is the context key for the current span
+type spanKey struct{}
+
+// spanFromContext returns the current span of ctx, if there is one
+func spanFromContext(ctx context.Context) *span {
+	sp, _ := ctx.Value(spanKey{}).(*span)
+	return sp
+}
+
+// TraceID returns the hex ID of the span's trace
+func (sp *span) TraceID() string {
+	if sp == nil {
+		return ""
+	}
+	return hex.EncodeToString(sp.sc.TraceID[:])
+}
+
+// SetAttr sets an attribute of the span. Values other than strings, bools,
+// integers and floats are formatted as strings.
+func (sp *span) SetAttr(key string, value any) {
+	if sp == nil {
+		return
+	}
+	var v map[string]any
+	switch value := value.(type) {
+	case string:
+		v = map[string]any{"stringValue": value}
+	case bool:
+		v = map[string]any{"boolValue": value}
+	case int:
+		v = map[string]any{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]any{"doubleValue": value}
+	default:
+		v = map[string]any{"stringValue": fmt.Sprint(value)}
+	}
+	sp.mu.Lock()
+	sp.attributes = append(sp.attributes, otlpKeyValue{Key: key, Value: v})
+	sp.mu.Unlock()
+}
+
+// SetError marks the span as failed with err. It does nothing if err is nil.
+func (sp *span) SetError(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.failed = true
+	sp.statusMessage = err.Error()
+	sp.mu.Unlock()
+}
+
+// AddLink links the span to another, such as the request that caused it. It
+// does nothing if other is nil.
+func (sp *span) AddLink(other *span) {
+	if sp == nil || other == nil {
+		return
+	}
+	sp.mu.Lock()
+	sp.links = append(sp.links, other.sc)
+	sp.mu.Unlock()
+}
+
+// End ends the span and queues it for export. Only the first call has any
+// effect.
+func (sp *span) End() {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	if !sp.end.IsZero() {
+		sp.mu.Unlock()
+		return
+	}
+	sp.end = time.Now()
+	sp.mu.Unlock()
+	sp.tracer.queue(sp)
+}
+
+// tracer creates spans and exports them to an OTLP/HTTP collector. A nil
+// tracer, used when no endpoint is configured, creates no spans.
+type tracer struct {
+	endpoint string
+	client   *http.Client
+	log      *slog.Logger
+
+	spans    chan *span
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	dropped  atomic.Int64
+}
+
+// newTracer starts a tracer exporting to endpoint, or returns nil if
+// endpoint is empty
+func newTracer(endpoint string, logger *slog.Logger) *tracer {
+	if endpoint == "" {
+		return nil
+	}
+	t := &tracer{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: traceExportTimeout},
+		log:      logger,
+		spans:    make(chan *span, traceQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start starts a span that is a child of ctx's current span, or the root of
+// a new trace if ctx has none, and returns a context holding it
+func (t *tracer) Start(ctx context.Context, name string, kind int) (context.Context, *span) {
+	var parent spanContext
+	if sp := spanFromContext(ctx); sp != nil {
+		parent = sp.sc
+	}
+	return t.startWithParent(ctx, name, kind, parent)
+}
+
+// startWithParent starts a span that is a child of parent, which may belong
+// to another service, or the root of a new trace if parent isn't valid
+func (t *tracer) startWithParent(ctx context.Context, name string, kind int, parent spanContext) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	sp := &span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent.IsValid() {
+		sp.sc.TraceID = parent.TraceID
+		sp.parent = parent.SpanID
+	} else {
+		rand.Read(sp.sc.TraceID[:])
+	}
+	rand.Read(sp.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+func (t *tracer) queue(sp *span) {
+	select {
+	case t.spans <- sp:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// run exports the ended spans in batches until the tracer is shut down
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	flush := func() {
+		if len(batch) > 0 {
+			t.export(batch)
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case sp := <-t.spans:
+			batch = append(batch, sp)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for {
+				select {
+				case sp := <-t.spans:
+					batch = append(batch, sp)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown exports the spans that have ended and stops the exporter, waiting
+// until ctx is done at most
+func (t *tracer) Shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+	}
+}
+
+// export sends a batch of spans to the collector. Failed exports are logged
+// and the spans dropped, since tracing must never hold up jobs.
+func (t *tracer) export(batch []*span) {
+	spans := make([]otlpSpan, len(batch))
+	for i, sp := range batch {
+		spans[i] = sp.otlp()
+	}
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: map[string]any{"stringValue": traceServiceName}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "my-app/server"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		t.log.Error("error encoding spans", "error", err)
+		return
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.log.Warn("error exporting spans", "spans", len(batch), "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		t.log.Warn("error exporting spans", "spans", len(batch), "status", resp.StatusCode)
+	}
+	if dropped := t.dropped.Swap(0); dropped > 0 {
+		t.log.Warn("dropped spans because the export queue was full", "spans", dropped)
+	}
+}
+
+// withTracing wraps next so that every request has a span, continuing the
+// trace of an incoming traceparent header if there is one
+func (s *Server) withTracing(next http.Handler) http.Handler {
+	if s.tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, _ := parseTraceparent(r.Header.Get("traceparent"))
+		ctx, sp := s.tracer.startWithParent(r.Context(), r.Method+" "+r.URL.Path, spanKindServer, parent)
+		sp.SetAttr("http.request.method", r.Method)
+		sp.SetAttr("url.path", r.URL.Path)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		sp.SetAttr("http.response.status_code", rec.Status())
+		if rec.Status() >= http.StatusInternalServerError {
+			sp.SetError(fmt.Errorf("%d %s", rec.Status(), http.StatusText(rec.Status())))
+		}
+		sp.End()
+	})
+}
+
+// The OTLP/HTTP JSON encoding of spans, covering the fields the tracer sets
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Links             []otlpLink     `json:"links,omitempty"`
+		Status            *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+	otlpLink struct {
+		TraceID string `json:"traceId"`
+		SpanID  string `json:"spanId"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func (sp *span) otlp() otlpSpan {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(sp.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(sp.sc.SpanID[:]),
+		Name:              sp.name,
+		Kind:              sp.kind,
+		StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+		Attributes:        sp.attributes,
+	}
+	if sp.parent != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(sp.parent[:])
+	}
+	for _, link := range sp.links {
+		out.Links = append(out.Links, otlpLink{
+			TraceID: hex.EncodeToString(link.TraceID[:]),
+			SpanID:  hex.EncodeToString(link.SpanID[:]),
+		})
+	}
+	if sp.failed {
+		out.Status = &otlpStatus{Code: spanStatusError, Message: sp.statusMessage}
+	}
+	return out
+}
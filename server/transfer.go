@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// bytesCounterKey is the context key for the function that counts the body
+// bytes downloaded for a job
+type bytesCounterKey struct{}
+
+// withBytesCounter returns a context whose downloads report the body bytes
+// they read to count
+func withBytesCounter(ctx context.Context, count func(int64)) context.Context {
+	return context.WithValue(ctx, bytesCounterKey{}, count)
+}
+
+// countBytes reports n body bytes downloaded to ctx's bytes counter, if it
+// has one
+func countBytes(ctx context.Context, n int64) {
+	if count, ok := ctx.Value(bytesCounterKey{}).(func(int64)); ok && n > 0 {
+		count(n)
+	}
+}
+
+// addBytes adds n to the body bytes downloaded for the job
+func (job *JobData) addBytes(n int64) {
+	job.mu.Lock()
+	job.TotalBytes += n
+	job.mu.Unlock()
+}
+
+// truncated reports whether body ended before the contentLength bytes its
+// response declared. A body that wasn't read to its end can't be told to be
+// truncated.
+func truncated(body *sizeLimitedReader, contentLength int64) bool {
+	return body.EOF && contentLength > body.read
+}
+
+// truncatedDownloadError is returned instead of the decode error for a body
+// that ended before its declared length, since the transfer rather than the
+// image is what failed. It is retried, unlike decode errors.
+type truncatedDownloadError struct {
+	Expected int64
+	Received int64
+}
+
+func (e *truncatedDownloadError) Error() string {
+	return fmt.Sprintf("download truncated: received %d of the %d bytes declared by Content-Length", e.Received, e.Expected)
+}
+
+// verifyContentLength reads the rest of a body whose image failed to decode,
+// up to its size limit, and returns a truncatedDownloadError if it ended
+// before contentLength. Decoders give up on a half-downloaded image with an
+// unhelpful EOF error, or before reaching its end at all. Bodies without a
+// declared length can't be checked, and aren't read.
+func verifyContentLength(body *sizeLimitedReader, contentLength int64) error {
+	if contentLength <= body.read || body.Exceeded {
+		return nil
+	}
+	io.Copy(io.Discard, body)
+	if truncated(body, contentLength) {
+		return &truncatedDownloadError{Expected: contentLength, Received: body.read}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// shortBodyHost serves data for every path, declaring declared bytes with
+// Content-Length but closing the connection after sending data, and counts
+// the requests it serves
+func shortBodyHost(t *testing.T, data []byte, declared int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Length", strconv.Itoa(declared))
+		w.Write(data)
+	}))
+	t.Cleanup(host.Close)
+	return host, &requests
+}
+
+func TestTruncatedDownload(t *testing.T) {
+	shelf, err := os.ReadFile(filepath.Join("testdata", "shelf.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A JPEG whose frame header comes after 6KB of application data, so the
+	// first 4KB don't hold its dimensions
+	app := binary.BigEndian.AppendUint16([]byte{0xff, 0xe9}, 6<<10)
+	app = append(app, make([]byte, 6<<10-2)...)
+	jpeg := slices.Concat(shelf[:2], app, shelf[2:])
+
+	host, requests := shortBodyHost(t, jpeg[:4<<10], 10<<10)
+	s := newTestServer(t, func(cfg *Config) { cfg.DownloadAttempts = 2 })
+
+	_, errs := runImages(t, s, host.URL+"/a.jpg")
+	got := errs[host.URL+"/a.jpg"]
+	if got.Code != codeTruncatedDownload || !strings.Contains(got.Error, "received 4096 of the 10240 bytes") {
+		t.Errorf("error = %s %q, want %s", got.Code, got.Error, codeTruncatedDownload)
+	}
+	// Truncated transfers are retried
+	if n := requests.Load(); n != 2 {
+		t.Errorf("the image was requested %d times, want 2", n)
+	}
+}
+
+func TestTruncatedDownloadDecoded(t *testing.T) {
+	// The dimensions are in the part of the image that arrived, so it still
+	// has a result, flagged as truncated
+	data := encodeImage(t, 400, 300, func(w *bytes.Buffer, img image.Image) error { return png.Encode(w, img) })
+	host, _ := shortBodyHost(t, data[:64], len(data))
+	s := newTestServer(t, nil)
+
+	results, errs := runImages(t, s, host.URL+"/a.png")
+	result, ok := results[host.URL+"/a.png"]
+	if !ok {
+		t.Fatalf("no result, error %+v", errs[host.URL+"/a.png"])
+	}
+	if result.Width != 400 || result.Height != 300 || !result.Truncated || result.ContentLength != int64(len(data)) {
+		t.Errorf("result = %dx%d, truncated %v, content length %d, want 400x300 truncated from %d", result.Width, result.Height, result.Truncated, result.ContentLength, len(data))
+	}
+}
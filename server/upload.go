@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultMaxUploadBytes is the largest upload submission accepted when
+// neither the -max-upload-bytes flag nor IMGPROC_MAX_UPLOAD_BYTES is set
+const defaultMaxUploadBytes = 256 << 20
+
+// uploadURLPrefix starts the image URL an uploaded image is reported under,
+// followed by the name of the part it was uploaded in
+const uploadURLPrefix = "upload://"
+
+// manifestPart is the name of the part of an upload holding the submission
+const manifestPart = "manifest"
+
+// uploadedImage is an image uploaded with its job, held in memory until the
+// job has processed it
+type uploadedImage struct {
+	data        []byte
+	contentType string
+}
+
+// errNoManifest is returned for an upload without a manifest part
+var errNoManifest = errors.New("upload has no manifest part")
+
+// uploadPartError is an image part of an upload that can't be accepted,
+// reported with the given status
+type uploadPartError struct {
+	Status int
+	Err    error
+}
+
+func (e *uploadPartError) Error() string {
+	return e.Err.Error()
+}
+
+// isUploadURL reports whether imageURL names an uploaded image
+func isUploadURL(imageURL string) bool {
+	return strings.HasPrefix(imageURL, uploadURLPrefix)
+}
+
+// hasUploads reports whether any of the visits' images were uploaded
+func hasUploads(visits []JobVisit) bool {
+	return slices.ContainsFunc(visits, func(visit JobVisit) bool {
+		return slices.ContainsFunc(visit.ImageURLs, isUploadURL)
+	})
+}
+
+// readUpload reads the manifest and image parts of a multipart/form-data
+// upload. Each image part must have an image content type and be at most
+// MaxImageBytes, and the whole upload at most MaxUploadBytes.
+func (s *Server) readUpload(w http.ResponseWriter, r *http.Request) (manifest []byte, images map[string]uploadedImage, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxUploadBytes)
+	parts, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	images = make(map[string]uploadedImage)
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		name := part.FormName()
+		if name == manifestPart {
+			if manifest != nil {
+				return nil, nil, errors.New("upload has more than one manifest part")
+			}
+			manifest, err = io.ReadAll(io.LimitReader(part, s.cfg.MaxBodyBytes+1))
+			if err != nil {
+				return nil, nil, err
+			}
+			if int64(len(manifest)) > s.cfg.MaxBodyBytes {
+				return nil, nil, &uploadPartError{
+					Status: http.StatusRequestEntityTooLarge,
+					Err:    fmt.Errorf("manifest too large: must be at most %d bytes", s.cfg.MaxBodyBytes),
+				}
+			}
+			continue
+		}
+
+		if name == "" {
+			return nil, nil, errors.New("upload has a part without a name")
+		}
+		if _, exists := images[name]; exists {
+			return nil, nil, fmt.Errorf("upload has more than one part named %q", name)
+		}
+		contentType := part.Header.Get("Content-Type")
+		if mediaType, _, _ := mime.ParseMediaType(contentType); !strings.HasPrefix(mediaType, "image/") {
+			return nil, nil, &uploadPartError{
+				Status: http.StatusUnsupportedMediaType,
+				Err:    fmt.Errorf("part %q has content type %q: must be an image", name, contentType),
+			}
+		}
+		data, err := io.ReadAll(&sizeLimitedReader{R: part, Limit: s.cfg.MaxImageBytes})
+		var tooLarge *imageTooLargeError
+		if errors.As(err, &tooLarge) {
+			return nil, nil, &uploadPartError{
+				Status: http.StatusRequestEntityTooLarge,
+				Err:    fmt.Errorf("part %q: %v", name, err),
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		images[name] = uploadedImage{data: data, contentType: contentType}
+	}
+	if manifest == nil {
+		return nil, nil, errNoManifest
+	}
+	return manifest, images, nil
+}
+
+// resolveUploads replaces the part names the visits give as image URLs with
+// the URLs of the uploaded images, reporting names with no matching part
+func resolveUploads(visits []Visit, images map[string]uploadedImage) []FieldError {
+	var errs fieldErrors
+	for i := range visits {
+		for j, name := range visits[i].ImageURLs {
+			if name == "" {
+				// Reported along with the submission's other fields
+				continue
+			}
+			if _, ok := images[name]; !ok {
+				errs.add(fmt.Sprintf("visits[%d].image_url[%d]", i, j), "no image part named %q", name)
+				continue
+			}
+			visits[i].ImageURLs[j] = uploadURLPrefix + name
+		}
+	}
+	return errs
+}
+
+// uploadedImages returns a downloadFunc that decodes the job's uploaded
+// images instead of downloading them
+func (s *Server) uploadedImages(job *JobData) downloadFunc {
+	return func(ctx context.Context, imageURL string) (imageInfo, error) {
+		name := strings.TrimPrefix(imageURL, uploadURLPrefix)
+		job.mu.Lock()
+		image, ok := job.uploads[name]
+		job.mu.Unlock()
+		if !ok {
+			return imageInfo{}, &codedError{Code: codeInvalidURL, Err: fmt.Errorf("invalid image URL: no image was uploaded as %q", name)}
+		}
+
+		_, span := s.tracer.Start(ctx, "decode", spanKindInternal)
+		defer span.End()
+		start := time.Now()
+		body := &sizeLimitedReader{R: bytes.NewReader(image.data), Limit: s.cfg.MaxImageBytes}
+		info, err := s.decodeImage(ctx, body, image.contentType)
+		span.SetError(err)
+		if err != nil {
+			return imageInfo{}, err
+		}
+		info.DecodeTime = time.Since(start)
+		info.Bytes = body.read
+		span.SetAttr("imgproc.image.format", info.Format)
+		return info, nil
+	}
+}
+
+// handleSubmitUpload handles the upload submission endpoint, which takes a
+// multipart/form-data upload of a manifest part holding the submission, whose
+// image URLs name the parts the images were uploaded in instead. The job is
+// then processed like any other, with each image reported under an
+// upload://<part> URL.
+func (s *Server) handleSubmitUpload(w http.ResponseWriter, r *http.Request) {
+	if !s.allowSubmit(w, r) {
+		return
+	}
+
+	manifest, images, err := s.readUpload(w, r)
+	if err != nil {
+		var partErr *uploadPartError
+		switch {
+		case writeBodyError(w, err):
+		case errors.Is(err, http.ErrNotMultipart):
+			responseError(w, http.StatusUnsupportedMediaType, "invalid upload: must be multipart/form-data")
+		case errors.As(err, &partErr):
+			responseError(w, partErr.Status, partErr.Error())
+		default:
+			responseError(w, http.StatusBadRequest, "invalid upload: "+err.Error())
+		}
+		return
+	}
+
+	var req SubmitJobRequest
+	decoder := json.NewDecoder(bytes.NewReader(manifest))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		if fieldErr, ok := decodeFieldError(err); ok {
+			writeFieldErrors(w, []FieldError{fieldErr})
+			return
+		}
+		responseError(w, http.StatusBadRequest, "invalid manifest")
+		return
+	}
+	if errs := resolveUploads(req.Visits, images); len(errs) > 0 {
+		writeFieldErrors(w, errs)
+		return
+	}
+	if !s.checkSubmission(w, &req) {
+		return
+	}
+
+	// The images aren't part of the payload, so uploads are never
+	// deduplicated
+	job, ok := s.enqueueJob(w, r, req, jobOrigin{uploads: images})
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(JobResponse{JobID: job.ID, TraceID: job.span.TraceID()})
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+// userAgentProduct names the service in the default User-Agent
+const userAgentProduct = "image-processing-service"
+
+// jobIDHeader carries the ID of the job an image is downloaded for, so image
+// hosts can trace requests back to it
+const jobIDHeader = "X-Job-ID"
+
+// buildVersion returns the version the binary was built as: its module
+// version, or its VCS revision for development builds
+func buildVersion() string {
+	if buildInfo.Version != "" && buildInfo.Version != "(devel)" {
+		return buildInfo.Version
+	}
+	if len(buildInfo.Revision) >= 12 {
+		return buildInfo.Revision[:12]
+	}
+	return "dev"
+}
+
+// userAgent returns the User-Agent sent with image downloads: -user-agent if
+// it is set, and otherwise the service's name and version followed by the
+// -user-agent-contact URL, e.g.
+// "image-processing-service/v1.4.0 (+https://example.com/bots)"
+func (cfg Config) userAgent() string {
+	if cfg.UserAgent != "" {
+		return cfg.UserAgent
+	}
+	userAgent := userAgentProduct + "/" + buildVersion()
+	if cfg.UserAgentContact != "" {
+		userAgent += " (+" + cfg.UserAgentContact + ")"
+	}
+	return userAgent
+}
+
+// identifyRequest sets the User-Agent of an image request, unless its
+// download headers set one already, and the ID of the job it is made for
+func (s *Server) identifyRequest(ctx context.Context, req *http.Request) {
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", s.cfg.userAgent())
+	}
+	if jobID := contextJobID(ctx); jobID != "" {
+		req.Header.Set(jobIDHeader, jobID)
+	}
+}
+
+// jobIDKey is the context key for the ID of the job work is done for
+type jobIDKey struct{}
+
+// withJobID returns a context for work done for the job jobID
+func withJobID(ctx context.Context, jobID string) context.Context {
+	return context.WithValue(ctx, jobIDKey{}, jobID)
+}
+
+// contextJobID returns the ID of the job ctx is for, or "" if it isn't for one
+func contextJobID(ctx context.Context) string {
+	jobID, _ := ctx.Value(jobIDKey{}).(string)
+	return jobID
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDownloadIdentifiesRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		headers   string
+		want      string
+	}{
+		{"default", nil, "", userAgentProduct + "/" + buildVersion()},
+		{"contact", func(cfg *Config) { cfg.UserAgentContact = "https://example.com/bots" }, "", userAgentProduct + "/" + buildVersion() + " (+https://example.com/bots)"},
+		{"configured", func(cfg *Config) { cfg.UserAgent = "shelf-audit/2.0" }, "", "shelf-audit/2.0"},
+		{"download header", func(cfg *Config) { cfg.UserAgent = "shelf-audit/2.0" }, `{"User-Agent": "field-app/1.0"}`, "field-app/1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder, host := newHeaderRecorder(t)
+			s := newTestServer(t, tt.configure)
+			// Raw JSON, since DownloadHeaders are redacted when they are
+			// encoded
+			headers := ""
+			if tt.headers != "" {
+				headers = `, "download_headers": ` + tt.headers
+			}
+			body := fmt.Sprintf(`{"count": 1, "visits": [{"store_id": "S00339218", "image_url": [%q]}]%s}`, host.URL+"/a.png", headers)
+			var resp JobResponse
+			if rec := doRaw(t, s, "POST", "/api/submit", strings.NewReader(body), &resp); rec.Code != http.StatusCreated {
+				t.Fatalf("submitting the job: %d %s", rec.Code, rec.Body.String())
+			}
+			waitForJob(t, s, resp.JobID)
+
+			header := recorder.header("/a.png")
+			if got := header.Get("User-Agent"); got != tt.want {
+				t.Errorf("User-Agent = %q, want %q", got, tt.want)
+			}
+			if got := header.Get(jobIDHeader); got != resp.JobID {
+				t.Errorf("%s = %q, want %q", jobIDHeader, got, resp.JobID)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFieldErrors is the most invalid fields a rejected submission reports
+const maxFieldErrors = 100
+
+// FieldError describes an invalid field of a submission, by its path in the
+// payload, such as visits[3].image_url
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// fieldErrors collects the invalid fields of a submission
+type fieldErrors []FieldError
+
+func (errs *fieldErrors) add(field, format string, args ...any) {
+	*errs = append(*errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// writeFieldErrors writes the response rejecting a submission with invalid
+// fields, listing up to maxFieldErrors of them
+func writeFieldErrors(w http.ResponseWriter, errs []FieldError) {
+	message := fmt.Sprintf("invalid submission: %d invalid fields", len(errs))
+	if len(errs) == 1 {
+		message = fmt.Sprintf("invalid %s: %s", errs[0].Field, errs[0].Message)
+	}
+	writeErrorResponse(w, http.StatusUnprocessableEntity, ErrorResponse{
+		Error:  message,
+		Fields: errs[:min(len(errs), maxFieldErrors)],
+	})
+}
+
+// decodeFieldError translates an error decoding a submission into the field
+// it is about, when it is about one: an unknown field, or a field of the
+// wrong type. Other errors mean the body isn't valid JSON.
+func decodeFieldError(err error) (FieldError, bool) {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return FieldError{
+			Field:   fieldPath(typeErr.Field),
+			Message: fmt.Sprintf("must be %s, not %s", jsonTypeName(typeErr.Type), typeErr.Value),
+		}, true
+	}
+	// The decoder reports unknown fields with an error of no particular type
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if unquoted, err := strconv.Unquote(name); err == nil {
+			name = unquoted
+		}
+		return FieldError{Field: name, Message: "unknown field"}, true
+	}
+	return FieldError{}, false
+}
+
+// fieldPath rewrites a field path as reported by the JSON decoder, such as
+// visits.3.image_url, with array indexes in brackets: visits[3].image_url
+func fieldPath(decoderPath string) string {
+	var path strings.Builder
+	for i, part := range strings.Split(decoderPath, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			fmt.Fprintf(&path, "[%s]", part)
+			continue
+		}
+		if i > 0 {
+			path.WriteByte('.')
+		}
+		path.WriteString(part)
+	}
+	return path.String()
+}
+
+// jsonTypeName describes the JSON value a Go type is decoded from
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	}
+	return "an object"
+}
+
+// validateSubmission checks the fields of a submission without making any
+// network calls, collecting every invalid one. Every submission needs a
+// positive count matching its visits, and every visit a store ID and at least
+// one image URL. Strict submissions are also checked to have only stores
+// that exist and image URLs the URL policy allows.
+func (s *Server) validateSubmission(req SubmitJobRequest) []FieldError {
+	var errs fieldErrors
+	if len(req.Visits) == 0 {
+		errs.add("visits", "must contain at least one visit")
+	}
+	if req.Count <= 0 {
+		errs.add("count", "must be a positive integer")
+	} else if req.Count != len(req.Visits) {
+		errs.add("count", "must equal the number of visits (%d)", len(req.Visits))
+	}
+	for i, visit := range req.Visits {
+		if strings.TrimSpace(visit.StoreID) == "" {
+			errs.add(fmt.Sprintf("visits[%d].store_id", i), "must not be empty")
+		} else if _, exists := s.getStore(visit.StoreID); req.Strict && !exists {
+			errs.add(fmt.Sprintf("visits[%d].store_id", i), "store does not exist")
+		}
+		if len(visit.ImageURLs) == 0 {
+			errs.add(fmt.Sprintf("visits[%d].image_url", i), "must contain at least one URL")
+		}
+		validateDownloadHeaders(&errs, fmt.Sprintf("visits[%d].download_headers", i), visit.DownloadHeaders)
+		validateExpectedChecksums(&errs, i, visit)
+		for j, imageURL := range visit.ImageURLs {
+			if strings.TrimSpace(imageURL) == "" {
+				errs.add(fmt.Sprintf("visits[%d].image_url[%d]", i, j), "must not be empty")
+			} else if req.Strict && !isUploadURL(imageURL) {
+				// Uploaded images were matched to their parts already
+				if err := s.validateImageURL(imageURL); err != nil {
+					errs.add(fmt.Sprintf("visits[%d].image_url[%d]", i, j), "%v", err)
+				}
+			}
+		}
+	}
+
+	validateDownloadHeaders(&errs, "download_headers", req.DownloadHeaders)
+	if req.TimeoutSeconds < 0 {
+		errs.add("timeout_seconds", "must not be negative")
+	}
+	maxImageTimeoutMS := int(s.cfg.MaxImageTimeout / time.Millisecond)
+	if req.ImageTimeoutMS < 0 || req.ImageTimeoutMS > maxImageTimeoutMS {
+		errs.add("image_timeout_ms", "must be between 0 (the server default) and %d", maxImageTimeoutMS)
+	}
+	if _, ok := priorityLevels[req.Priority]; !ok {
+		errs.add("priority", "must be high, normal or low")
+	}
+	if req.OnError != onErrorContinue && req.OnError != onErrorFailFast {
+		errs.add("on_error", "must be continue or fail_fast")
+	}
+	if threshold := req.FailureThresholdPercent; threshold != nil && (*threshold < 0 || *threshold > 100) {
+		errs.add("failure_threshold_percent", "must be between 0 and 100")
+	}
+	if req.CallbackURL != "" {
+		if err := s.validateCallbackURL(req.CallbackURL); err != nil {
+			errs.add("callback_url", "%v", err)
+		}
+	}
+	return errs
+}
+
+// validateExpectedChecksums checks that a visit's expected checksums are hex
+// SHA-256 digests, each matching an image that isn't a ZIP archive, whose
+// checksum would be of the archive rather than of its images
+func validateExpectedChecksums(errs *fieldErrors, i int, visit Visit) {
+	if len(visit.ExpectedSHA256) > len(visit.ImageURLs) {
+		errs.add(fmt.Sprintf("visits[%d].expected_sha256", i), "must not have more entries than image_url (%d)", len(visit.ImageURLs))
+	}
+	for j, checksum := range visit.ExpectedSHA256 {
+		field := fmt.Sprintf("visits[%d].expected_sha256[%d]", i, j)
+		switch {
+		case checksum == "":
+		case !validChecksum(checksum):
+			errs.add(field, "must be a hex SHA-256 digest")
+		case j < len(visit.ImageURLs) && (visit.Archive || isArchiveURL(visit.ImageURLs[j])):
+			errs.add(field, "is not supported for ZIP archives")
+		}
+	}
+}
+
+// validateImageURL checks that an image URL is an absolute URL with a scheme
+// and host the URL policy allows, a data: URL holding an image, which
+// involves no host, or a file: URL inside an allowed root
+func (s *Server) validateImageURL(imageURL string) error {
+	if isDataURL(imageURL) {
+		_, _, err := parseDataURL(imageURL)
+		return err
+	}
+	if isFileURL(imageURL) {
+		_, _, err := s.filePath(imageURL)
+		return err
+	}
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return &codedError{Code: codeInvalidURL, Err: fmt.Errorf("invalid image URL: %v", err)}
+	}
+	if u.Host == "" {
+		return &codedError{Code: codeInvalidURL, Err: errors.New("invalid image URL: missing host")}
+	}
+	return s.policy.Check(u)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSubmitValidation(t *testing.T) {
+	s := newTestServer(t, nil)
+	const visit = `{"store_id":"S00339218","image_url":["http://127.0.0.1/a.jpg"]}`
+	tests := []struct {
+		name   string
+		body   string
+		fields []string
+	}{
+		{"no visits", `{"count":1,"visits":[]}`, []string{"visits", "count"}},
+		{"zero count", `{"count":0,"visits":[` + visit + `]}`, []string{"count"}},
+		{"count mismatch", `{"count":2,"visits":[` + visit + `]}`, []string{"count"}},
+		{"empty store ID", `{"count":1,"visits":[{"store_id":" ","image_url":["http://127.0.0.1/a.jpg"]}]}`, []string{"visits[0].store_id"}},
+		{"unknown store when strict", `{"count":1,"strict":true,"visits":[{"store_id":"nope","image_url":["http://127.0.0.1/a.jpg"],"visit_time":"2024-03-10T09:30:00Z"}]}`, []string{"visits[0].store_id"}},
+		{"no image URLs", `{"count":4,"visits":[` + visit + `,` + visit + `,` + visit + `,{"store_id":"S00339218","image_url":[]}]}`, []string{"visits[3].image_url"}},
+		{"empty image URL", `{"count":1,"visits":[{"store_id":"S00339218","image_url":["http://127.0.0.1/a.jpg",""]}]}`, []string{"visits[0].image_url[1]"}},
+		{"invalid image URL when strict", `{"count":1,"strict":true,"visits":[{"store_id":"S00339218","image_url":["ftp://127.0.0.1/a.jpg"],"visit_time":"2024-03-10T09:30:00Z"}]}`, []string{"visits[0].image_url[0]"}},
+		{"invalid checksum", `{"count":1,"visits":[{"store_id":"S00339218","image_url":["http://127.0.0.1/a.jpg"],"expected_sha256":["abc"]}]}`, []string{"visits[0].expected_sha256[0]"}},
+		{"denied download header", `{"count":1,"visits":[` + visit + `],"download_headers":{"Host":"example.com"}}`, []string{`download_headers["Host"]`}},
+		{"negative timeout", `{"count":1,"visits":[` + visit + `],"timeout_seconds":-1}`, []string{"timeout_seconds"}},
+		{"unknown priority", `{"count":1,"visits":[` + visit + `],"priority":"urgent"}`, []string{"priority"}},
+		{"unknown error policy", `{"count":1,"visits":[` + visit + `],"on_error":"ignore"}`, []string{"on_error"}},
+		{"threshold out of range", `{"count":1,"visits":[` + visit + `],"failure_threshold_percent":101}`, []string{"failure_threshold_percent"}},
+		{"several fields", `{"count":2,"visits":[` + visit + `,{"store_id":"","image_url":[]}],"priority":"urgent"}`, []string{"visits[1].store_id", "visits[1].image_url", "priority"}},
+
+		// Decoding errors name the field too
+		{"wrong type", `{"count":"one","visits":[]}`, []string{"count"}},
+		{"wrong nested type", `{"count":1,"visits":[{"store_id":"S00339218","image_url":"http://127.0.0.1/a.jpg"}]}`, []string{"visits[0].image_url"}},
+		{"unknown field", `{"count":1,"visits":[` + visit + `],"colour":"red"}`, []string{"colour"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ErrorResponse
+			rec := doRaw(t, s, "POST", "/api/submit", strings.NewReader(tt.body), &resp)
+			if rec.Code != http.StatusUnprocessableEntity || resp.Code != codeValidationFailed {
+				t.Fatalf("got %d %s, want 422 %s", rec.Code, rec.Body.String(), codeValidationFailed)
+			}
+			var fields []string
+			for _, fieldErr := range resp.Fields {
+				if fieldErr.Message == "" {
+					t.Errorf("field %s has no message", fieldErr.Field)
+				}
+				fields = append(fields, fieldErr.Field)
+			}
+			if !slices.Equal(fields, tt.fields) {
+				t.Errorf("invalid fields = %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestFieldPath(t *testing.T) {
+	tests := map[string]string{
+		"count":                 "count",
+		"visits.3.image_url":    "visits[3].image_url",
+		"visits.0.image_url.12": "visits[0].image_url[12]",
+	}
+	for path, want := range tests {
+		if got := fieldPath(path); got != want {
+			t.Errorf("fieldPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
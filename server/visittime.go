@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultVisitTimeLayouts are the formats visit_time may be given in when
+// neither the -visit-time-layouts flag nor IMGPROC_VISIT_TIME_LAYOUTS is set
+var defaultVisitTimeLayouts = []string{"rfc3339"}
+
+// namedVisitTimeLayouts are the names visit time layouts can be given by.
+// Any other layout is a Go time layout, such as 2006-01-02T15:04:05Z0700.
+// Times without a zone are taken to be UTC.
+var namedVisitTimeLayouts = map[string]string{
+	"rfc3339":  time.RFC3339Nano,
+	"rfc1123":  time.RFC1123,
+	"rfc1123z": time.RFC1123Z,
+	"datetime": time.DateTime,
+	"date":     time.DateOnly,
+}
+
+// Visit time layouts for Unix timestamps, which time.Parse can't handle
+const (
+	visitTimeUnix   = "unix"
+	visitTimeUnixMS = "unix_ms"
+)
+
+// parseVisitTime parses value with the first of layouts that accepts it, and
+// returns it in UTC
+func parseVisitTime(value string, layouts []string) (time.Time, error) {
+	for _, layout := range layouts {
+		switch layout {
+		case visitTimeUnix, visitTimeUnixMS:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				continue
+			}
+			if layout == visitTimeUnix {
+				return time.Unix(n, 0).UTC(), nil
+			}
+			return time.UnixMilli(n).UTC(), nil
+		}
+		if named, ok := namedVisitTimeLayouts[layout]; ok {
+			layout = named
+		}
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not in one of the formats %s", value, strings.Join(layouts, ", "))
+}
+
+// normalizeVisitTimes checks every visit's visit_time, which may be empty
+// unless strict is set, and rewrites the valid ones as RFC 3339 in UTC so
+// processJob can parse them without knowing the configured layouts
+func (s *Server) normalizeVisitTimes(visits []Visit, strict bool) []FieldError {
+	var errs fieldErrors
+	for i := range visits {
+		visit := &visits[i]
+		field := fmt.Sprintf("visits[%d].visit_time", i)
+		if visit.VisitTime == "" {
+			if strict {
+				errs.add(field, "is required")
+			}
+			continue
+		}
+		t, err := parseVisitTime(visit.VisitTime, s.cfg.VisitTimeLayouts)
+		if err != nil {
+			errs.add(field, "%v", err)
+			continue
+		}
+		visit.VisitTime = t.Format(time.RFC3339Nano)
+	}
+	return errs
+}
+
+// visitTime returns a visit's visit_time once normalizeVisitTimes has
+// normalized it, or the zero time if it has none
+func visitTime(visit Visit) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, visit.VisitTime)
+	return t
+}
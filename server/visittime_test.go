@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseVisitTime(t *testing.T) {
+	all := []string{"rfc3339", "rfc1123z", "rfc1123", "datetime", "date", "unix_ms", "2006/01/02 15:04 -0700"}
+	tests := []struct {
+		value   string
+		layouts []string
+		want    string
+	}{
+		{"2024-03-10T09:30:00Z", all, "2024-03-10T09:30:00Z"},
+		{"2024-03-10T09:30:00.25+05:30", all, "2024-03-10T04:00:00.25Z"},
+		{"2024-03-10T01:30:00-08:00", all, "2024-03-10T09:30:00Z"},
+		{"Sun, 10 Mar 2024 10:30:00 +0100", all, "2024-03-10T09:30:00Z"},
+		{"Sun, 10 Mar 2024 09:30:00 UTC", all, "2024-03-10T09:30:00Z"},
+		// Times without a zone are taken to be UTC
+		{"2024-03-10 09:30:00", all, "2024-03-10T09:30:00Z"},
+		{"2024-03-10", all, "2024-03-10T00:00:00Z"},
+		{"1710063000000", all, "2024-03-10T09:30:00Z"},
+		{"1710063000", []string{"unix"}, "2024-03-10T09:30:00Z"},
+		{"2024/03/10 18:30 +0900", all, "2024-03-10T09:30:00Z"},
+	}
+	for _, tt := range tests {
+		got, err := parseVisitTime(tt.value, tt.layouts)
+		if err != nil {
+			t.Errorf("parseVisitTime(%q) error = %v", tt.value, err)
+			continue
+		}
+		if got.Location() != time.UTC || got.Format(time.RFC3339Nano) != tt.want {
+			t.Errorf("parseVisitTime(%q) = %v, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseVisitTimeInvalid(t *testing.T) {
+	tests := []struct {
+		value   string
+		layouts []string
+	}{
+		{"yesterday", defaultVisitTimeLayouts},
+		{"2024-03-10 09:30:00", defaultVisitTimeLayouts},
+		{"2024-13-01T00:00:00Z", defaultVisitTimeLayouts},
+		{"1710063000", []string{"date"}},
+		{"1.5", []string{"unix"}},
+	}
+	for _, tt := range tests {
+		if got, err := parseVisitTime(tt.value, tt.layouts); err == nil {
+			t.Errorf("parseVisitTime(%q, %v) = %v, want an error", tt.value, tt.layouts, got)
+		}
+	}
+}
+
+func TestSubmitVisitTimes(t *testing.T) {
+	s := newTestServer(t, nil)
+	fixtures := serveFixtures(t)
+
+	jobID := submitJob(t, s, SubmitJobRequest{
+		Count: 2,
+		Visits: []Visit{
+			{StoreID: "S00339218", ImageURLs: []string{fixtures.URL + "/shelf.jpg"}, VisitTime: "2024-03-10T18:30:00+09:00"},
+			{StoreID: "S01408764", ImageURLs: []string{fixtures.URL + "/solid.png"}},
+		},
+	})
+	waitForJob(t, s, jobID)
+	results := jobResults(t, s, jobID).Results
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if got, want := results[0].VisitTime, time.Date(2024, 3, 10, 9, 30, 0, 0, time.UTC); !got.Equal(want) || got.Location() != time.UTC {
+		t.Errorf("visit_time = %v, want %v", got, want)
+	}
+	if !results[1].VisitTime.IsZero() {
+		t.Errorf("visit_time = %v for a visit without one, want none", results[1].VisitTime)
+	}
+}
+
+func TestSubmitVisitTimeErrors(t *testing.T) {
+	s := newTestServer(t, nil)
+	tests := []struct {
+		name   string
+		req    SubmitJobRequest
+		fields []string
+	}{
+		{"unparseable", SubmitJobRequest{Count: 2, Visits: []Visit{
+			{StoreID: "S00339218", ImageURLs: []string{"http://127.0.0.1/a.jpg"}, VisitTime: "2024-03-10T09:30:00Z"},
+			{StoreID: "S00339218", ImageURLs: []string{"http://127.0.0.1/b.jpg"}, VisitTime: "10/03/2024"},
+		}}, []string{"visits[1].visit_time"}},
+		{"missing when strict", SubmitJobRequest{Count: 1, Strict: true, Visits: []Visit{
+			{StoreID: "S00339218", ImageURLs: []string{"http://127.0.0.1/a.jpg"}},
+		}}, []string{"visits[0].visit_time"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ErrorResponse
+			rec := doJSON(t, s, "POST", "/api/submit", tt.req, &resp)
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got %d %s, want 422", rec.Code, rec.Body.String())
+			}
+			var fields []string
+			for _, fieldErr := range resp.Fields {
+				fields = append(fields, fieldErr.Field)
+			}
+			if !slices.Equal(fields, tt.fields) {
+				t.Errorf("invalid fields = %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+}
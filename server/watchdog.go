@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Defaults for the watchdog when neither the -stall-timeout and
+// -watchdog-interval flags nor IMGPROC_STALL_TIMEOUT and
+// IMGPROC_WATCHDOG_INTERVAL are set
+const (
+	defaultStallTimeout     = 10 * time.Minute
+	defaultWatchdogInterval = 30 * time.Second
+)
+
+// startWatchdog starts the watchdog, which stops running jobs that have made
+// no progress for the stall timeout, such as when a download is wedged on a
+// server trickling bytes forever. It is off if the stall timeout is 0.
+func (s *Server) startWatchdog() {
+	if s.cfg.StallTimeout <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.cfg.WatchdogInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			s.stopStalledJobs(now)
+		}
+	}()
+}
+
+// stopStalledJobs stops every ongoing job whose progress hasn't advanced
+// for the stall timeout
+func (s *Server) stopStalledJobs(now time.Time) {
+	s.jobsMu.Lock()
+	all := make([]*JobData, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		all = append(all, job)
+	}
+	s.jobsMu.Unlock()
+
+	for _, job := range all {
+		s.stopIfStalled(job, now)
+	}
+}
+
+// stopIfStalled stops job if it is ongoing and hasn't made progress for the
+// stall timeout. Its in-flight downloads are cancelled, and each image it
+// hadn't finished gets a job_stalled error.
+func (s *Server) stopIfStalled(job *JobData, now time.Time) {
+	job.mu.Lock()
+	if job.Status != statusOngoing || now.Sub(job.lastProgress) < s.cfg.StallTimeout {
+		job.mu.Unlock()
+		return
+	}
+	lastProgress := job.lastProgress
+	errs := job.unfinishedImagesLocked(StoreError{
+		Code:  codeJobStalled,
+		Error: fmt.Sprintf("job made no progress for %s, so the image was abandoned", s.cfg.StallTimeout),
+	})
+	for _, storeErr := range errs {
+		job.addErrorLocked(storeErr)
+		job.Progress.Failed++
+		job.publishLocked(streamEventError, storeErr)
+	}
+	job.Status = statusStalled
+	job.CompletedAt = now
+	rec := job.record()
+	job.mu.Unlock()
+
+	job.cancel()
+	for _, storeErr := range errs {
+		s.persist(s.jobStore.AppendError(job.ID, storeErr, 1))
+	}
+	s.metrics.imagesFailed(codeJobStalled, len(errs))
+	s.persist(s.jobStore.SaveJob(rec))
+	s.logger(job.ctx).Warn("job stalled",
+		"last_progress", lastProgress,
+		"stall_timeout", s.cfg.StallTimeout.String(),
+		"unfinished", len(errs),
+	)
+	s.finishJob(job)
+}
+
+// unfinishedImagesLocked returns a copy of template for each of the job's
+// images that has neither a result nor an error yet, filled in with the
+// image's store, URL, visit and index. job.mu must be held.
+func (job *JobData) unfinishedImagesLocked(template StoreError) []StoreError {
+	finished := make(map[[2]int]bool, len(job.Results)+len(job.Errors))
+	visitFailed := make(map[int]bool)
+	for _, result := range job.Results {
+		finished[[2]int{result.Visit, result.Image}] = true
+	}
+	for _, storeErr := range job.Errors {
+		if storeErr.Image == nil {
+			visitFailed[storeErr.Visit] = true
+		} else {
+			finished[[2]int{storeErr.Visit, *storeErr.Image}] = true
+		}
+	}
+
+	var errs []StoreError
+	for i, visit := range job.Visits {
+		if visitFailed[i] {
+			continue
+		}
+		for j, imageURL := range visit.ImageURLs {
+			if finished[[2]int{i, j}] {
+				continue
+			}
+			storeErr := template
+			storeErr.StoreID, storeErr.ImageURL, storeErr.Visit, storeErr.Image = visit.StoreID, imageURL, i, &j
+			errs = append(errs, storeErr)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// defaultWebhookAttempts is the number of attempts made to deliver a job's
+// callback when neither the -webhook-attempts flag nor
+// IMGPROC_WEBHOOK_ATTEMPTS is set
+const defaultWebhookAttempts = 5
+
+// defaultWebhookTimeout is the timeout for each callback delivery attempt
+// when neither the -webhook-timeout flag nor IMGPROC_WEBHOOK_TIMEOUT is set
+const defaultWebhookTimeout = 10 * time.Second
+
+// Webhook delivery states
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+)
+
+// WebhookPayload is POSTed to a job's callback URL once the job finishes
+type WebhookPayload struct {
+	JobID           string        `json:"job_id"`
+	Status          string        `json:"status"`
+	SuccessfulCount int           `json:"successful_count"`
+	ErrorCount      int           `json:"error_count"`
+	Progress        JobProgress   `json:"progress"`
+	CreatedAt       time.Time     `json:"created_at"`
+	CompletedAt     time.Time     `json:"completed_at"`
+	Errors          []StoreError  `json:"errors,omitempty"`
+	Results         []ImageResult `json:"results,omitempty"`
+}
+
+// WebhookDelivery reports how delivering a job's callback went. LastStatus
+// is the status code of the last attempt's response, and is 0 if it failed
+// without one.
+type WebhookDelivery struct {
+	URL         string     `json:"url"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	LastStatus  int        `json:"last_status_code,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// validateCallbackURL checks that a callback URL is an absolute URL with a
+// scheme and host the URL policy allows, as image URLs must be
+func (s *Server) validateCallbackURL(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	return s.policy.Check(u)
+}
+
+// finishJob is called once a job has reached a terminal status and been
+// persisted. It gives back the quota for the images the job didn't process,
+// records its metrics, ends its progress streams and delivers its callback if
+// it has one.
+func (s *Server) finishJob(job *JobData) {
+	s.releaseQuota(job)
+
+	job.mu.Lock()
+	s.metrics.jobFinished(job.Status, job.CompletedAt.Sub(job.CreatedAt))
+	job.span.SetAttr("imgproc.job.status", job.Status)
+	job.span.SetAttr("imgproc.job.results", len(job.Results))
+	job.span.SetAttr("imgproc.job.errors", len(job.Errors))
+	if job.Status == statusFailed || job.Status == statusTimedOut || job.Status == statusInterrupted || job.Status == statusStalled {
+		job.span.SetError(fmt.Errorf("job %s", job.Status))
+	}
+	job.span.End()
+	s.logger(job.ctx).Info("job finished",
+		"status", job.Status,
+		"results", len(job.Results),
+		"errors", len(job.Errors),
+		"duration_ms", job.CompletedAt.Sub(job.CreatedAt).Milliseconds(),
+	)
+	job.finishSubscribersLocked()
+	delivery := job.Webhook
+	if delivery == nil {
+		job.mu.Unlock()
+		return
+	}
+	snap, results := job.snapshotLocked(), job.Results
+	if job.includeResults {
+		results = append([]ImageResult(nil), results...)
+	} else {
+		results = nil
+	}
+	job.mu.Unlock()
+
+	payload := WebhookPayload{
+		JobID:           snap.ID,
+		Status:          snap.Status,
+		SuccessfulCount: snap.ResultCount,
+		ErrorCount:      len(snap.Errors),
+		Progress:        snap.Progress,
+		CreatedAt:       snap.CreatedAt,
+		CompletedAt:     snap.CompletedAt,
+		Errors:          snap.Errors,
+		Results:         results,
+	}
+	go s.deliverWebhook(job, delivery.URL, payload)
+}
+
+// deliverWebhook POSTs payload to the job's callback URL, retrying network
+// errors, 429 and 5xx responses with exponential backoff up to the
+// configured number of attempts. The outcome of each attempt is recorded on
+// the job.
+func (s *Server) deliverWebhook(job *JobData, callbackURL string, payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		s.logger(job.ctx).Error("error encoding callback", "error", err)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		statusCode, err := s.postWebhook(callbackURL, body)
+		delivered := err == nil && statusCode >= 200 && statusCode < 300
+		if err == nil && !delivered {
+			err = fmt.Errorf("callback responded with status code %d", statusCode)
+		}
+		retryable := !delivered && (statusCode == 0 || statusCode == http.StatusTooManyRequests || statusCode >= 500)
+		final := delivered || !retryable || attempt >= s.cfg.WebhookAttempts
+
+		job.mu.Lock()
+		update := *job.Webhook
+		update.Attempts = attempt
+		update.LastStatus = statusCode
+		update.LastError = ""
+		switch {
+		case delivered:
+			now := time.Now()
+			update.State = webhookDelivered
+			update.DeliveredAt = &now
+		case final:
+			update.State = webhookFailed
+			update.LastError = err.Error()
+		default:
+			update.LastError = err.Error()
+		}
+		job.Webhook = &update
+		rec := job.record()
+		job.mu.Unlock()
+
+		if final {
+			s.persist(s.jobStore.SaveJob(rec))
+			if !delivered {
+				s.logger(job.ctx).Warn("callback failed", "attempts", attempt, "error", err)
+			}
+			return
+		}
+		time.Sleep(retryDelay(attempt))
+	}
+}
+
+// postWebhook makes a single callback delivery attempt, returning the
+// response's status code. Callbacks are signed if a webhook secret is
+// configured, with a fresh timestamp for each attempt.
+func (s *Server) postWebhook(callbackURL string, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.WebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("error creating callback request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.cfg.WebhookSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, signPayload(s.cfg.WebhookSecret, timestamp, body))
+	}
+
+	resp, err := s.webhooks.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error delivering callback: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
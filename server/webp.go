@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+)
+
+// WebP images are RIFF containers whose first chunk is one of:
+//
+//	"VP8 "  a lossy bitstream, with a key frame header holding the size
+//	"VP8L"  a lossless bitstream, with the size packed after a signature byte
+//	"VP8X"  an extended header holding the canvas size and feature flags
+//
+// Only the headers are parsed: the dimensions are all the service needs, so
+// the pixels are never decoded.
+const webpHeader = "RIFF????WEBP"
+
+// VP8X feature flags
+const webpFlagAnimation = 0x02
+
+// errAnimatedWebP is returned for animated WebP images, whose frames may each
+// have their own size
+var errAnimatedWebP = &codedError{Code: codeUnsupportedFormat, Err: errors.New("animated webp not supported")}
+
+var errInvalidWebP = errors.New("webp: invalid format")
+
+func init() {
+	image.RegisterFormat("webp", webpHeader, decodeWebP, decodeWebPConfig)
+}
+
+// decodeWebPConfig reads the dimensions of a WebP image from its headers
+func decodeWebPConfig(r io.Reader) (image.Config, error) {
+	// RIFF header followed by the first chunk's header
+	var hdr [20]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return image.Config{}, unexpectedEOF(err)
+	}
+	if string(hdr[0:4]) != "RIFF" || string(hdr[8:12]) != "WEBP" {
+		return image.Config{}, errInvalidWebP
+	}
+
+	var width, height int
+	switch chunk := string(hdr[12:16]); chunk {
+	case "VP8 ":
+		// 3 byte frame tag, 3 byte start code, then 14 bit width and height
+		var b [10]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return image.Config{}, unexpectedEOF(err)
+		}
+		if b[0]&0x01 != 0 || b[3] != 0x9d || b[4] != 0x01 || b[5] != 0x2a {
+			return image.Config{}, errInvalidWebP
+		}
+		width = int(binary.LittleEndian.Uint16(b[6:8]) & 0x3fff)
+		height = int(binary.LittleEndian.Uint16(b[8:10]) & 0x3fff)
+
+	case "VP8L":
+		// Signature byte, then 14 bit width-1 and height-1
+		var b [5]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return image.Config{}, unexpectedEOF(err)
+		}
+		if b[0] != 0x2f {
+			return image.Config{}, errInvalidWebP
+		}
+		bits := binary.LittleEndian.Uint32(b[1:5])
+		width = int(bits&0x3fff) + 1
+		height = int((bits>>14)&0x3fff) + 1
+
+	case "VP8X":
+		// Flags, 3 reserved bytes, then 24 bit canvas width-1 and height-1
+		var b [10]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return image.Config{}, unexpectedEOF(err)
+		}
+		if b[0]&webpFlagAnimation != 0 {
+			return image.Config{}, errAnimatedWebP
+		}
+		width = int(uint32(b[4])|uint32(b[5])<<8|uint32(b[6])<<16) + 1
+		height = int(uint32(b[7])|uint32(b[8])<<8|uint32(b[9])<<16) + 1
+
+	default:
+		return image.Config{}, errInvalidWebP
+	}
+
+	return image.Config{Width: width, Height: height}, nil
+}
+
+// decodeWebP is registered so the format is recognised, but full decodes are
+// never attempted since decodeWebPConfig always has the dimensions
+func decodeWebP(r io.Reader) (image.Image, error) {
+	if _, err := decodeWebPConfig(r); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("webp: pixel decoding not supported")
+}
+
+// unexpectedEOF reports a truncated header as io.ErrUnexpectedEOF, as the
+// standard library decoders do
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// decodeBytes decodes data as a downloaded image body
+func decodeBytes(ctx context.Context, data []byte) (imageInfo, error) {
+	s := &Server{cfg: DefaultConfig()}
+	body := &sizeLimitedReader{R: bytes.NewReader(data), Limit: int64(len(data))}
+	return s.decodeImage(ctx, body, "")
+}
+
+// webpFile wraps a WebP chunk with the given fourCC and payload in a RIFF
+// container
+func webpFile(fourCC string, payload []byte) []byte {
+	chunk := binary.LittleEndian.AppendUint32([]byte(fourCC), uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	riff := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(4+len(chunk)))
+	return slices.Concat(riff, []byte("WEBP"), chunk)
+}
+
+// webpExtended returns a VP8X header with the given flags and canvas size
+func webpExtended(flags byte, width, height int) []byte {
+	payload := []byte{flags, 0, 0, 0}
+	for _, n := range []int{width - 1, height - 1} {
+		payload = append(payload, byte(n), byte(n>>8), byte(n>>16))
+	}
+	return webpFile("VP8X", payload)
+}
+
+func TestDecodeWebP(t *testing.T) {
+	// A key frame tag, the start code and 14 bit dimensions, with scaling
+	// bits set above them
+	lossy := webpFile("VP8 ", []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x20, 0x43, 0x58, 0x82})
+	// The signature byte, then 14 bit width-1 and height-1
+	lossless := webpFile("VP8L", binary.LittleEndian.AppendUint32([]byte{0x2f}, (300-1)|(200-1)<<14))
+
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height int
+	}{
+		{"lossy", lossy, 800, 600},
+		{"lossless", lossless, 300, 200},
+		{"extended", webpExtended(0x10, 5000, 70000), 5000, 70000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := decodeBytes(context.Background(), tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Width != tt.width || info.Height != tt.height || info.Format != "webp" {
+				t.Errorf("decoded %dx%d %s, want %dx%d webp", info.Width, info.Height, info.Format, tt.width, tt.height)
+			}
+			if info.PixelsUnsupported {
+				t.Error("PixelsUnsupported = true without pixel analysis")
+			}
+		})
+	}
+}
+
+func TestDecodeWebPAnimated(t *testing.T) {
+	_, err := decodeBytes(context.Background(), webpExtended(webpFlagAnimation, 100, 100))
+	var coded *codedError
+	if !errors.As(err, &coded) || coded.Code != codeUnsupportedFormat {
+		t.Errorf("error = %v, want %s", err, codeUnsupportedFormat)
+	}
+}
+
+func TestWebPPixelsUnsupported(t *testing.T) {
+	host := serveBytes(t, map[string][]byte{"/a.webp": webpExtended(0, 100, 100)})
+	s := newTestServer(t, nil)
+
+	jobID := submitJob(t, s, SubmitJobRequest{
+		Count:         1,
+		Visits:        []Visit{{StoreID: "S00339218", ImageURLs: []string{host.URL + "/a.webp"}}},
+		QualityChecks: true,
+	})
+	if status := waitForJob(t, s, jobID); status.Status != statusCompleted {
+		t.Fatalf("status = %s with errors %+v, want %s", status.Status, status.Errors, statusCompleted)
+	}
+	results := jobResults(t, s, jobID).Results
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	// The dimensions are still reported, but the image can't be checked
+	if got := results[0]; got.Width != 100 || got.Height != 100 || got.BlankSuspect || !slices.Contains(got.Warnings, warningPixelsUnsupported) {
+		t.Errorf("result = %dx%d, blank %v, warnings %v, want 100x100 with %s", got.Width, got.Height, got.BlankSuspect, got.Warnings, warningPixelsUnsupported)
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Defaults for the ZIP archive limits, used when neither their flags nor
+// environment variables are set
+const (
+	defaultMaxArchiveEntries = 1000
+	defaultMaxArchiveBytes   = 1 << 30
+)
+
+// archiveEntrySeparator separates a ZIP archive's URL from the name of one of
+// its files in the image URL the file is reported under
+const archiveEntrySeparator = "!"
+
+// zipMagic starts every ZIP archive, so nested archives are recognised
+// whatever they are named
+var zipMagic = []byte("PK\x03\x04")
+
+// archiveEntry is a file in a ZIP archive of images. Info describes it if it
+// is an image, Err says why it failed if it couldn't be decoded, and Skipped
+// says why it was skipped if it isn't an image.
+type archiveEntry struct {
+	Name    string
+	Info    imageInfo
+	Err     error
+	Skipped string
+}
+
+// archiveKey is the context key marking an image URL as a ZIP archive
+type archiveKey struct{}
+
+// withArchive returns a context whose downloads are ZIP archives of images
+func withArchive(ctx context.Context) context.Context {
+	return context.WithValue(ctx, archiveKey{}, true)
+}
+
+// isArchive reports whether downloads made with ctx are ZIP archives
+func isArchive(ctx context.Context) bool {
+	archive, _ := ctx.Value(archiveKey{}).(bool)
+	return archive
+}
+
+// isArchiveURL reports whether imageURL's path ends in .zip
+func isArchiveURL(imageURL string) bool {
+	u, err := url.Parse(imageURL)
+	return err == nil && isArchiveName(u.Path)
+}
+
+func isArchiveName(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".zip")
+}
+
+// invalidArchive returns an invalid_archive error
+func invalidArchive(format string, args ...any) error {
+	return &codedError{Code: codeInvalidArchive, Err: fmt.Errorf(format, args...)}
+}
+
+// decodeArchive reads a downloaded ZIP archive and decodes each image in it.
+// ZIP archives are read from their end, so the archive is spooled to a
+// temporary file first. Archives with more files than MaxArchiveEntries, or
+// that would expand to more than MaxArchiveBytes, are rejected before any of
+// their files is decompressed.
+func (s *Server) decodeArchive(ctx context.Context, body *sizeLimitedReader, contentType string) (imageInfo, error) {
+	f, err := os.CreateTemp("", "imgproc-*.zip")
+	if err != nil {
+		return imageInfo{}, fmt.Errorf("error storing archive: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := io.Copy(f, body)
+	if body.Exceeded {
+		return imageInfo{}, &imageTooLargeError{Limit: body.Limit}
+	}
+	if err != nil {
+		return imageInfo{}, fmt.Errorf("error downloading archive: %w", err)
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return imageInfo{}, invalidArchive("invalid ZIP archive: %v", err)
+	}
+
+	var files []*zip.File
+	var uncompressed uint64
+	for _, file := range zr.File {
+		if !file.FileInfo().IsDir() {
+			files = append(files, file)
+			uncompressed += file.UncompressedSize64
+		}
+	}
+	if len(files) > s.cfg.MaxArchiveEntries {
+		return imageInfo{}, invalidArchive("archive has %d files, more than the limit of %d", len(files), s.cfg.MaxArchiveEntries)
+	}
+	if uncompressed > uint64(s.cfg.MaxArchiveBytes) {
+		return imageInfo{}, invalidArchive("archive expands to %d bytes, more than the limit of %s", uncompressed, formatBytes(s.cfg.MaxArchiveBytes))
+	}
+
+	info := imageInfo{Format: "zip", ContentType: contentType}
+	images := 0
+	for _, file := range files {
+		entry := s.decodeArchiveEntry(ctx, file)
+		if entry.Skipped == "" {
+			images++
+		}
+		info.Entries = append(info.Entries, entry)
+	}
+	if images == 0 {
+		return imageInfo{}, invalidArchive("archive has no images")
+	}
+	return info, nil
+}
+
+// decodeArchiveEntry decodes a file of a ZIP archive, skipping it if it
+// isn't an image. Nested archives are errors rather than skipped, so they
+// aren't mistaken for having been processed.
+func (s *Server) decodeArchiveEntry(ctx context.Context, file *zip.File) archiveEntry {
+	entry := archiveEntry{Name: file.Name}
+	if isArchiveName(file.Name) {
+		entry.Err = invalidArchive("nested archive %s is not supported", file.Name)
+		return entry
+	}
+	rc, err := file.Open()
+	if err != nil {
+		entry.Err = invalidArchive("invalid archive entry %s: %v", file.Name, err)
+		return entry
+	}
+	defer rc.Close()
+
+	src := bufio.NewReader(rc)
+	if head, _ := src.Peek(len(zipMagic)); bytes.Equal(head, zipMagic) {
+		entry.Err = invalidArchive("nested archive %s is not supported", file.Name)
+		return entry
+	}
+
+	start := time.Now()
+	body := &sizeLimitedReader{R: src, Limit: s.cfg.MaxImageBytes}
+	entry.Info, entry.Err = s.decodeImage(ctx, body, mime.TypeByExtension(path.Ext(file.Name)))
+	if entry.Err != nil && errorCode(entry.Err) == codeUnsupportedFormat {
+		entry.Skipped, entry.Err = entry.Err.Error(), nil
+	}
+	entry.Info.DecodeTime = time.Since(start)
+	entry.Info.Bytes = body.read
+	return entry
+}
+
+// processArchive processes the images in the ZIP archive at imageURL,
+// recording a result or error for each, reported under the archive's URL
+// followed by "!" and the image's name in the archive. Files that aren't
+// images are recorded as warnings. The archive counts as one image towards
+// the job's progress until it has been read, and as one for each image in
+// it from then on. The error returned is the archive's own, when none of
+// its images could be processed.
+func (s *Server) processArchive(ctx context.Context, job *JobData, imageURL string, image taskImage, download downloadFunc) (err error) {
+	ctx, span := s.tracer.Start(ctx, "archive", spanKindInternal)
+	defer span.End()
+	defer func() {
+		if panicErr := s.recoverImagePanic(ctx, imageURL, recover()); panicErr != nil {
+			err = panicErr
+		}
+		if err != nil {
+			span.SetAttr("imgproc.outcome", errorCode(err))
+			span.SetError(err)
+		} else {
+			span.SetAttr("imgproc.outcome", "success")
+		}
+	}()
+	span.SetAttr("imgproc.store_id", image.store.StoreID)
+
+	info, err := download(ctx, imageURL)
+	if err != nil {
+		return err
+	}
+	if info.Entries == nil {
+		// The URL was cached when it was downloaded as an image
+		return invalidArchive("%s is a %s image, not a ZIP archive", imageURL, info.Format)
+	}
+	if err := s.simulateProcessingDelay(ctx); err != nil {
+		return err
+	}
+	span.SetAttr("imgproc.archive.entries", len(info.Entries))
+
+	images := 0
+	for _, entry := range info.Entries {
+		if entry.Skipped == "" {
+			images++
+		}
+	}
+	job.mu.Lock()
+	if job.Status != statusOngoing {
+		job.mu.Unlock()
+		return nil
+	}
+	job.Progress.Total += images - 1
+	job.mu.Unlock()
+
+	for _, entry := range info.Entries {
+		entryURL := imageURL + archiveEntrySeparator + entry.Name
+		switch {
+		case entry.Skipped != "":
+			s.recordWarning(job, JobWarning{
+				StoreID:  image.store.StoreID,
+				ImageURL: entryURL,
+				Code:     warningNonImageEntry,
+				Warning:  "skipped: " + entry.Skipped,
+				Visit:    image.visit,
+				Image:    image.image,
+			})
+		case entry.Err != nil:
+			s.recordError(job, StoreError{
+				StoreID:  image.store.StoreID,
+				ImageURL: entryURL,
+				Code:     errorCode(entry.Err),
+				Error:    entry.Err.Error(),
+				Visit:    image.visit,
+				Image:    &image.image,
+			})
+		default:
+			entry.Info.Attempts = info.Attempts
+			result := imageResult(image.store, entryURL, entry.Info)
+			result.Visit, result.Image, result.VisitTime = image.visit, image.image, image.visitTime
+			s.recordResult(job, result)
+		}
+	}
+	s.logger(ctx).Debug("archive processed", "store_id", image.store.StoreID, "image_url", imageURL, "entries", len(info.Entries), "images", images)
+	return nil
+}